@@ -0,0 +1,618 @@
+package router
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	log "github.com/hashicorp/go-hclog"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	// ChallengeHTTP01 is answered on the router's plain HTTP listener
+	ChallengeHTTP01 = "http-01"
+	// ChallengeTLSALPN01 is answered on the router's HTTPS listener
+	ChallengeTLSALPN01 = "tls-alpn-01"
+)
+
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// ACMEConfig defines how certificates are obtained from an ACME CA
+type ACMEConfig struct {
+	// DirectoryURL is the directory endpoint of the CA
+	DirectoryURL string
+	// Email is the contact address for the account
+	Email string
+	// Hosts are the names certificates are obtained for
+	Hosts []string
+	// ConsulPrefix is the KV prefix where the account, certificates and
+	// pending challenges are stored, it is shared by all router instances
+	ConsulPrefix string
+	// RenewBefore is how long before expiry a certificate is renewed
+	RenewBefore time.Duration
+	// CheckInterval is how often the certificates are checked for renewal
+	CheckInterval time.Duration
+	// Challenges are the challenge types in order of preference
+	Challenges []string
+}
+
+// acmeManager obtains and renews certificates, the account and certificates
+// are stored in Consul KV so every instance serves the same certificates and
+// a Consul lock ensures only one instance talks to the CA at a time
+type acmeManager struct {
+	config   ACMEConfig
+	consul   *api.Client
+	logger   log.Logger
+	client   *acme.Client
+	lockWait time.Duration
+
+	// pending challenge responses are watched so they can be answered
+	// without reading Consul on every request, local holds the challenges
+	// started by this instance which the watch may not have seen yet
+	mu               sync.RWMutex
+	challenges       map[string][]byte
+	local            map[string][]byte
+	challengesIndex  uint64
+	challengesLoaded bool
+}
+
+// EnableACME obtains certificates for the hosts from an ACME CA, the HTTPS
+// listener must have been configured with SetTLS
+func (r *Router) EnableACME(c ACMEConfig) error {
+	if r.tls == nil {
+		return fmt.Errorf("ACME requires the HTTPS listener")
+	}
+
+	if len(c.Hosts) == 0 {
+		return fmt.Errorf("ACME requires at least one host")
+	}
+
+	if c.ConsulPrefix == "" {
+		c.ConsulPrefix = "connect-router/acme"
+	}
+	c.ConsulPrefix = strings.TrimSuffix(c.ConsulPrefix, "/")
+
+	if c.RenewBefore == 0 {
+		c.RenewBefore = 30 * 24 * time.Hour
+	}
+
+	if c.CheckInterval == 0 {
+		c.CheckInterval = time.Hour
+	}
+
+	if len(c.Challenges) == 0 {
+		c.Challenges = []string{ChallengeTLSALPN01, ChallengeHTTP01}
+	}
+
+	for _, ch := range c.Challenges {
+		if ch != ChallengeHTTP01 && ch != ChallengeTLSALPN01 {
+			return fmt.Errorf("Invalid ACME challenge %s", ch)
+		}
+	}
+
+	r.acme = &acmeManager{
+		config:   c,
+		consul:   r.consulClient,
+		logger:   r.logger.Named("acme"),
+		lockWait: 15 * time.Second,
+	}
+
+	r.tlsServerConfig.NextProtos = append(r.tlsServerConfig.NextProtos, acme.ALPNProto)
+	r.tlsServerConfig.GetCertificate = r.acme.getCertificate(r.certificates.GetCertificate)
+
+	cs := &consulCertificateSource{client: r.consulClient, prefix: c.ConsulPrefix + "/certs"}
+	go r.watchCertificateSource("acme", cs.load, 0)
+	go r.acme.watchChallenges(r.tlsStop)
+	go r.acme.run(r.tlsStop)
+
+	return nil
+}
+
+// run checks the certificates for renewal until stopped
+func (m *acmeManager) run(stop chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	for {
+		err := m.renew(ctx)
+		if err != nil && ctx.Err() == nil {
+			m.logger.Error("Unable to renew certificates", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(m.config.CheckInterval):
+		}
+	}
+}
+
+// renew obtains certificates for any hosts which are missing a certificate
+// or are due for renewal, nothing is done when another instance holds the
+// lock as it will renew the certificates
+func (m *acmeManager) renew(ctx context.Context) error {
+	due, err := m.due()
+	if err != nil || len(due) == 0 {
+		return err
+	}
+
+	lock, err := m.consul.LockOpts(&api.LockOptions{
+		Key:          m.key("lock"),
+		SessionName:  "connect-router-acme",
+		LockTryOnce:  true,
+		LockWaitTime: m.lockWait,
+	})
+	if err != nil {
+		return err
+	}
+
+	lost, err := lock.Lock(ctx.Done())
+	if err != nil {
+		return err
+	}
+
+	if lost == nil {
+		m.logger.Debug("Certificates are being renewed by another instance")
+		return nil
+	}
+	defer lock.Unlock()
+
+	// check again as another instance may have renewed before releasing the
+	// lock
+	due, err = m.due()
+	if err != nil || len(due) == 0 {
+		return err
+	}
+
+	client, err := m.acmeClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, host := range due {
+		select {
+		case <-lost:
+			return fmt.Errorf("Lost the ACME lock")
+		default:
+		}
+
+		m.logger.Info("Obtaining certificate", "host", host)
+
+		err := m.obtain(ctx, client, host)
+		if err != nil {
+			return fmt.Errorf("Unable to obtain certificate for %s: %s", host, err)
+		}
+	}
+
+	return nil
+}
+
+// due returns the hosts without a certificate or with a certificate which
+// expires within the renewal window
+func (m *acmeManager) due() ([]string, error) {
+	hosts := []string{}
+
+	for _, host := range m.config.Hosts {
+		p, _, err := m.consul.KV().Get(m.key("certs", host, "cert"), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if p != nil {
+			if b, _ := pem.Decode(p.Value); b != nil {
+				c, err := x509.ParseCertificate(b.Bytes)
+				if err == nil && time.Now().Add(m.config.RenewBefore).Before(c.NotAfter) {
+					continue
+				}
+			}
+		}
+
+		hosts = append(hosts, host)
+	}
+
+	return hosts, nil
+}
+
+// acmeClient returns a client for the account stored in Consul, a new
+// account is registered when none exists
+func (m *acmeManager) acmeClient(ctx context.Context) (*acme.Client, error) {
+	if m.client != nil {
+		return m.client, nil
+	}
+
+	kv := m.consul.KV()
+
+	p, _, err := kv.Get(m.key("account", "key"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var key *ecdsa.PrivateKey
+	if p != nil {
+		b, _ := pem.Decode(p.Value)
+		if b == nil {
+			return nil, fmt.Errorf("Invalid ACME account key")
+		}
+
+		key, err = x509.ParseECPrivateKey(b.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		der, _ := x509.MarshalECPrivateKey(key)
+		_, err = kv.Put(&api.KVPair{
+			Key:   m.key("account", "key"),
+			Value: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}),
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	client := &acme.Client{Key: key, DirectoryURL: m.config.DirectoryURL}
+
+	p, _, err = kv.Get(m.key("account", "registration"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if p == nil {
+		a := &acme.Account{}
+		if m.config.Email != "" {
+			a.Contact = []string{"mailto:" + m.config.Email}
+		}
+
+		a, err = client.Register(ctx, a, acme.AcceptTOS)
+		if err == acme.ErrAccountAlreadyExists {
+			// the account already exists for the key
+			a, err = client.GetReg(ctx, "")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		d, _ := json.Marshal(a)
+		_, err = kv.Put(&api.KVPair{Key: m.key("account", "registration"), Value: d}, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m.client = client
+
+	return client, nil
+}
+
+// obtain places an order for the host, completes its authorizations and
+// stores the issued certificate in Consul
+func (m *acmeManager) obtain(ctx context.Context, client *acme.Client, host string) error {
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(host))
+	if err != nil {
+		return err
+	}
+
+	for _, u := range order.AuthzURLs {
+		err := m.authorize(ctx, client, u)
+		if err != nil {
+			return err
+		}
+	}
+
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: host},
+		DNSNames: []string{host},
+	}, key)
+	if err != nil {
+		return err
+	}
+
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return err
+	}
+
+	certPEM := []byte{}
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	// the pair is written in a transaction so instances never load a
+	// certificate with the wrong key
+	ok, _, _, err := m.consul.KV().Txn(api.KVTxnOps{
+		&api.KVTxnOp{Verb: api.KVSet, Key: m.key("certs", host, "cert"), Value: certPEM},
+		&api.KVTxnOp{Verb: api.KVSet, Key: m.key("certs", host, "key"), Value: keyPEM},
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return fmt.Errorf("Unable to store certificate")
+	}
+
+	return nil
+}
+
+// authorize completes a challenge for a pending authorization of an order,
+// authorizations which are already valid are skipped
+func (m *acmeManager) authorize(ctx context.Context, client *acme.Client, url string) error {
+	authz, err := client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	if authz.Status != acme.StatusPending {
+		return nil
+	}
+
+	chal := m.pickChallenge(authz.Challenges)
+	if chal == nil {
+		return fmt.Errorf("No supported challenge offered")
+	}
+
+	cleanup, err := m.fulfill(client, chal, authz.Identifier.Value)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	_, err = client.Accept(ctx, chal)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+// pickChallenge returns the first offered challenge in order of preference
+func (m *acmeManager) pickChallenge(offered []*acme.Challenge) *acme.Challenge {
+	for _, t := range m.config.Challenges {
+		for _, c := range offered {
+			if c.Type == t {
+				return c
+			}
+		}
+	}
+
+	return nil
+}
+
+// fulfill stores the challenge response in Consul so it can be answered by
+// any router instance, the returned func removes the response
+func (m *acmeManager) fulfill(client *acme.Client, chal *acme.Challenge, host string) (func(), error) {
+	var key string
+	var value []byte
+
+	switch chal.Type {
+	case ChallengeHTTP01:
+		resp, err := client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return nil, err
+		}
+
+		key = m.key("challenges", ChallengeHTTP01, chal.Token)
+		value = []byte(resp)
+
+	case ChallengeTLSALPN01:
+		cert, err := client.TLSALPN01ChallengeCert(chal.Token, host)
+		if err != nil {
+			return nil, err
+		}
+
+		keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+		if err != nil {
+			return nil, err
+		}
+
+		key = m.key("challenges", ChallengeTLSALPN01, host)
+		value = append(
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}),
+			pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})...,
+		)
+	}
+
+	_, err := m.consul.KV().Put(&api.KVPair{Key: key, Value: value}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	m.setLocalChallenge(key, value)
+
+	return func() {
+		m.consul.KV().Delete(key, nil)
+		m.setLocalChallenge(key, nil)
+	}, nil
+}
+
+// setLocalChallenge adds a challenge started by this instance, a nil value
+// removes it
+func (m *acmeManager) setLocalChallenge(key string, value []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.local == nil {
+		m.local = map[string][]byte{}
+	}
+
+	if value == nil {
+		delete(m.local, key)
+		return
+	}
+
+	m.local[key] = value
+}
+
+// challenge returns the response for a pending challenge. Consul is only
+// read when the watch has not loaded yet or a challenge is pending which
+// has not been seen by the watch, nil is returned when there is no challenge.
+func (m *acmeManager) challenge(kind, name string) ([]byte, error) {
+	key := m.key("challenges", kind, name)
+
+	m.mu.RLock()
+	v, ok := m.local[key]
+	if !ok {
+		v, ok = m.challenges[key]
+	}
+	pending := !m.challengesLoaded || len(m.challenges) > 0 || len(m.local) > 0
+	m.mu.RUnlock()
+
+	if ok || !pending {
+		return v, nil
+	}
+
+	p, _, err := m.consul.KV().Get(key, nil)
+	if err != nil || p == nil {
+		return nil, err
+	}
+
+	return p.Value, nil
+}
+
+// loadChallenges fetches the pending challenges, blocking until the index
+// changes when they have previously been loaded
+func (m *acmeManager) loadChallenges(ctx context.Context) error {
+	m.mu.RLock()
+	q := &api.QueryOptions{WaitIndex: m.challengesIndex, WaitTime: 5 * time.Minute}
+	m.mu.RUnlock()
+
+	pairs, meta, err := m.consul.KV().List(m.key("challenges")+"/", q.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	challenges := map[string][]byte{}
+	for _, p := range pairs {
+		challenges[p.Key] = p.Value
+	}
+
+	m.mu.Lock()
+	m.challenges = challenges
+	m.challengesIndex = meta.LastIndex
+	m.challengesLoaded = true
+	m.mu.Unlock()
+
+	return nil
+}
+
+// watchChallenges keeps the pending challenges up to date until stopped
+func (m *acmeManager) watchChallenges(stop chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	for {
+		err := m.loadChallenges(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		if err != nil {
+			m.logger.Error("Unable to watch ACME challenges", "error", err)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// getCertificate answers TLS-ALPN-01 challenges, all other handshakes use
+// the next func
+func (m *acmeManager) getCertificate(next func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if len(hello.SupportedProtos) != 1 || hello.SupportedProtos[0] != acme.ALPNProto {
+			return next(hello)
+		}
+
+		name := strings.ToLower(hello.ServerName)
+		v, err := m.challenge(ChallengeTLSALPN01, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if v == nil {
+			return nil, fmt.Errorf("No ACME challenge pending for %s", hello.ServerName)
+		}
+
+		c, err := tls.X509KeyPair(v, v)
+		if err != nil {
+			return nil, err
+		}
+
+		return &c, nil
+	}
+}
+
+// httpHandler answers HTTP-01 challenges, all other requests are passed to
+// the next handler
+func (m *acmeManager) httpHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, acmeChallengePath) {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		token := strings.TrimPrefix(req.URL.Path, acmeChallengePath)
+		if token == "" || strings.Contains(token, "/") {
+			http.NotFound(rw, req)
+			return
+		}
+
+		v, err := m.challenge(ChallengeHTTP01, token)
+		if err != nil {
+			m.logger.Error("Unable to read ACME challenge", "error", err)
+			http.Error(rw, "Unable to read challenge", http.StatusInternalServerError)
+			return
+		}
+
+		if v == nil {
+			http.NotFound(rw, req)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Write(v)
+	})
+}
+
+func (m *acmeManager) key(parts ...string) string {
+	return path.Join(append([]string{m.config.ConsulPrefix}, parts...)...)
+}
@@ -0,0 +1,547 @@
+package router
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+// acmeStub is a minimal RFC 8555 CA which validates challenges by
+// connecting to the router's listeners
+type acmeStub struct {
+	server   *httptest.Server
+	httpAddr string
+	tlsAddr  string
+	caKey    *ecdsa.PrivateKey
+	caDER    []byte
+	caCert   *x509.Certificate
+
+	mu         sync.Mutex
+	nonce      int
+	thumbprint string
+	orders     map[string]*acmeStubOrder
+	authz      map[string]*acmeStubAuthz
+	certs      map[string][]byte
+	issued     int
+	validity   time.Duration
+}
+
+type acmeStubOrder struct {
+	host   string
+	authz  string
+	status string
+	cert   string
+}
+
+type acmeStubAuthz struct {
+	host   string
+	status string
+	token  string
+}
+
+func newACMEStub(t *testing.T) *acmeStub {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+
+	s := &acmeStub{
+		caKey:    key,
+		caDER:    der,
+		caCert:   ca,
+		orders:   map[string]*acmeStubOrder{},
+		authz:    map[string]*acmeStubAuthz{},
+		certs:    map[string][]byte{},
+		validity: 90 * 24 * time.Hour,
+	}
+	s.server = httptest.NewServer(s)
+
+	return s
+}
+
+func (s *acmeStub) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.nonce++
+	rw.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", s.nonce))
+	s.mu.Unlock()
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	// every request other than the directory is a JWS, requests with an
+	// empty payload are POST-as-GET
+	protected := struct {
+		JWK map[string]string `json:"jwk"`
+	}{}
+	payload := map[string]interface{}{}
+	if r.Method == http.MethodPost {
+		jws := struct{ Protected, Payload string }{}
+		json.NewDecoder(r.Body).Decode(&jws)
+		b, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+		json.Unmarshal(b, &protected)
+		b, _ = base64.RawURLEncoding.DecodeString(jws.Payload)
+		json.Unmarshal(b, &payload)
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch parts[0] {
+	case "directory":
+		json.NewEncoder(rw).Encode(map[string]string{
+			"newNonce":   s.server.URL + "/new-nonce",
+			"newAccount": s.server.URL + "/new-account",
+			"newOrder":   s.server.URL + "/new-order",
+		})
+
+	case "new-nonce":
+		rw.WriteHeader(http.StatusNoContent)
+
+	case "new-account":
+		s.mu.Lock()
+		existing := s.thumbprint != ""
+		s.thumbprint = jwkThumbprint(protected.JWK)
+		s.mu.Unlock()
+
+		rw.Header().Set("Location", s.server.URL+"/account/1")
+		if existing || payload["onlyReturnExisting"] == true {
+			rw.WriteHeader(http.StatusOK)
+		} else {
+			rw.WriteHeader(http.StatusCreated)
+		}
+		rw.Write([]byte(`{"status":"valid"}`))
+
+	case "new-order":
+		ids := payload["identifiers"].([]interface{})
+		host := ids[0].(map[string]interface{})["value"].(string)
+
+		s.mu.Lock()
+		id := fmt.Sprintf("%d", len(s.orders)+1)
+		s.authz[id] = &acmeStubAuthz{host: host, status: "pending", token: "token" + id}
+		s.orders[id] = &acmeStubOrder{host: host, authz: id, status: "pending"}
+		s.mu.Unlock()
+
+		rw.Header().Set("Location", s.server.URL+"/order/"+id)
+		rw.WriteHeader(http.StatusCreated)
+		s.writeOrder(rw, id)
+
+	case "order":
+		s.writeOrder(rw, parts[1])
+
+	case "authz":
+		s.writeAuthz(rw, parts[1])
+
+	case "chal":
+		s.mu.Lock()
+		a := s.authz[parts[1]]
+		keyAuth := a.token + "." + s.thumbprint
+		s.mu.Unlock()
+
+		status := "invalid"
+		if s.validate(parts[2], a, keyAuth) {
+			status = "valid"
+		}
+
+		s.mu.Lock()
+		a.status = status
+		s.mu.Unlock()
+
+		json.NewEncoder(rw).Encode(map[string]string{"url": s.server.URL + r.URL.Path, "type": parts[2], "token": a.token, "status": status})
+
+	case "finalize":
+		b, _ := base64.RawURLEncoding.DecodeString(payload["csr"].(string))
+		csr, err := x509.ParseCertificateRequest(b)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		s.mu.Lock()
+		o := s.orders[parts[1]]
+		if o.status != "ready" {
+			s.mu.Unlock()
+			rw.WriteHeader(http.StatusForbidden)
+			rw.Write([]byte(`{"type":"urn:ietf:params:acme:error:orderNotReady"}`))
+			return
+		}
+		s.issued++
+		serial := s.issued + 1
+		validity := s.validity
+		s.mu.Unlock()
+
+		der, _ := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(int64(serial)),
+			Subject:      csr.Subject,
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(validity),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}, s.caCert, csr.PublicKey, s.caKey)
+
+		s.mu.Lock()
+		s.certs[parts[1]] = append(
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.caDER})...,
+		)
+		o.status = "valid"
+		o.cert = s.server.URL + "/cert/" + parts[1]
+		s.mu.Unlock()
+
+		rw.Header().Set("Location", s.server.URL+"/order/"+parts[1])
+		s.writeOrder(rw, parts[1])
+
+	case "cert":
+		s.mu.Lock()
+		chain := s.certs[parts[1]]
+		s.mu.Unlock()
+
+		rw.Header().Set("Content-Type", "application/pem-certificate-chain")
+		rw.Write(chain)
+
+	default:
+		rw.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// writeOrder writes the order, a pending order becomes ready once its
+// authorization is valid
+func (s *acmeStub) writeOrder(rw http.ResponseWriter, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o := s.orders[id]
+	if o.status == "pending" && s.authz[o.authz].status == "valid" {
+		o.status = "ready"
+	}
+
+	json.NewEncoder(rw).Encode(map[string]interface{}{
+		"status":         o.status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": o.host}},
+		"authorizations": []string{s.server.URL + "/authz/" + o.authz},
+		"finalize":       s.server.URL + "/finalize/" + id,
+		"certificate":    o.cert,
+	})
+}
+
+func (s *acmeStub) writeAuthz(rw http.ResponseWriter, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := s.authz[id]
+	json.NewEncoder(rw).Encode(map[string]interface{}{
+		"status":     a.status,
+		"identifier": map[string]string{"type": "dns", "value": a.host},
+		"challenges": []map[string]string{
+			{"url": s.server.URL + "/chal/" + id + "/http-01", "type": "http-01", "token": a.token, "status": "pending"},
+			{"url": s.server.URL + "/chal/" + id + "/tls-alpn-01", "type": "tls-alpn-01", "token": a.token, "status": "pending"},
+		},
+	})
+}
+
+// jwkThumbprint returns the RFC 7638 thumbprint of an EC account key
+func jwkThumbprint(jwk map[string]string) string {
+	b := fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, jwk["crv"], jwk["kty"], jwk["x"], jwk["y"])
+	sum := sha256.Sum256([]byte(b))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// validate checks the challenge response served by the router
+func (s *acmeStub) validate(typ string, a *acmeStubAuthz, keyAuth string) bool {
+	if typ == "http-01" {
+		req, _ := http.NewRequest("GET", "http://"+s.httpAddr+"/.well-known/acme-challenge/"+a.token, nil)
+		req.Host = a.host
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode == http.StatusOK && string(b) == keyAuth
+	}
+
+	conn, err := tls.Dial("tcp", s.tlsAddr, &tls.Config{
+		ServerName:         a.host,
+		NextProtos:         []string{"acme-tls/1"},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != "acme-tls/1" {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(keyAuth))
+	expected, _ := asn1.Marshal(sum[:])
+
+	for _, ext := range state.PeerCertificates[0].Extensions {
+		if ext.Id.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}) {
+			return string(ext.Value) == string(expected)
+		}
+	}
+
+	return false
+}
+
+func (s *acmeStub) Issued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.issued
+}
+
+// setupACMERouter starts the router listeners and a CA which validates
+// challenges against them
+func setupACMERouter(t *testing.T, challenges ...string) (*Router, *consulStub, *acmeStub) {
+	cs, c := newConsulStub(t)
+	t.Cleanup(cs.Close)
+
+	ca := newACMEStub(t)
+	t.Cleanup(ca.server.Close)
+
+	rec := setupRouterTests(t)
+	rec.consulClient = c
+	err := rec.SetTLS(TLSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the handler is built on each request as ACME is enabled after the
+	// listener has started
+	hs := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rec.httpHandler().ServeHTTP(rw, r)
+	}))
+	t.Cleanup(hs.Close)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	ca.httpAddr = hs.Listener.Addr().String()
+	ca.tlsAddr = l.Addr().String()
+
+	err = rec.EnableACME(ACMEConfig{
+		DirectoryURL: ca.server.URL + "/directory",
+		Hosts:        []string{"api.example.com"},
+		ConsulPrefix: "acme",
+		Challenges:   challenges,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { close(rec.tlsStop) })
+
+	srv, err := rec.newTLSServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go rec.serveTLS(srv, l)
+
+	return rec, cs, ca
+}
+
+func TestACMEObtainsCertificateWithHTTP01(t *testing.T) {
+	rec, cs, ca := setupACMERouter(t, ChallengeHTTP01)
+
+	waitFor(t, func() bool {
+		return currentName(rec.certificates, "api.example.com") == "api.example.com"
+	}, "Should have obtained a certificate")
+
+	assert.Equal(t, 1, ca.Issued())
+
+	// the challenge is removed after the certificate has been stored
+	waitFor(t, func() bool {
+		cs.mu.Lock()
+		defer cs.mu.Unlock()
+
+		_, ok := cs.kv["acme/challenges/http-01/token1"]
+		return !ok
+	}, "Should have removed the challenge")
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	assert.Contains(t, cs.kv, "acme/account/key")
+	assert.Contains(t, cs.kv, "acme/account/registration")
+}
+
+func TestACMEObtainsCertificateWithTLSALPN01(t *testing.T) {
+	rec, _, ca := setupACMERouter(t, ChallengeTLSALPN01)
+
+	waitFor(t, func() bool {
+		return currentName(rec.certificates, "api.example.com") == "api.example.com"
+	}, "Should have obtained a certificate")
+
+	assert.Equal(t, 1, ca.Issued())
+	assert.Contains(t, rec.tlsServerConfig.NextProtos, "acme-tls/1")
+}
+
+func TestACMEReusesAccountForExistingKey(t *testing.T) {
+	cs, c := newConsulStub(t)
+	defer cs.Close()
+
+	ca := newACMEStub(t)
+	defer ca.server.Close()
+
+	m := &acmeManager{config: ACMEConfig{DirectoryURL: ca.server.URL + "/directory", ConsulPrefix: "acme"}, consul: c, logger: hclog.Default()}
+
+	_, err := m.acmeClient(context.Background())
+	assert.NoError(t, err)
+
+	// the registration was lost but the key is still registered with the CA
+	cs.Delete("acme/account/registration")
+	m.client = nil
+
+	_, err = m.acmeClient(context.Background())
+	assert.NoError(t, err)
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	assert.Contains(t, string(cs.kv["acme/account/registration"].Value), ca.server.URL+"/account/1")
+}
+
+func TestACMEAnswersChallengesFromWatch(t *testing.T) {
+	cs, c := newConsulStub(t)
+	defer cs.Close()
+
+	m := &acmeManager{config: ACMEConfig{ConsulPrefix: "acme"}, consul: c, logger: hclog.Default()}
+	stop := make(chan struct{})
+	defer close(stop)
+	go m.watchChallenges(stop)
+
+	h := m.httpHandler(http.NotFoundHandler())
+
+	// another instance starts a challenge
+	cs.Put("acme/challenges/http-01/token1", []byte("response"))
+
+	waitFor(t, func() bool {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		return m.challenges["acme/challenges/http-01/token1"] != nil
+	}, "Should have loaded the challenge")
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("GET", "/.well-known/acme-challenge/token1", nil))
+	assert.Equal(t, "response", rw.Body.String())
+
+	cs.Delete("acme/challenges/http-01/token1")
+
+	waitFor(t, func() bool {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		return len(m.challenges) == 0
+	}, "Should have removed the challenge")
+
+}
+
+func TestACMEDoesNotReadConsulWithoutPendingChallenges(t *testing.T) {
+	// requests to Consul fail
+	c, _ := api.NewClient(&api.Config{Address: "127.0.0.1:1"})
+	m := &acmeManager{config: ACMEConfig{ConsulPrefix: "acme"}, consul: c, logger: hclog.Default(), challengesLoaded: true}
+
+	rw := httptest.NewRecorder()
+	m.httpHandler(http.NotFoundHandler()).ServeHTTP(rw, httptest.NewRequest("GET", "/.well-known/acme-challenge/token1", nil))
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+
+	m.challengesLoaded = false
+
+	rw = httptest.NewRecorder()
+	m.httpHandler(http.NotFoundHandler()).ServeHTTP(rw, httptest.NewRequest("GET", "/.well-known/acme-challenge/token1", nil))
+	assert.Equal(t, http.StatusInternalServerError, rw.Code, "Should read Consul before the watch has loaded")
+}
+
+func TestACMERenewsOnlyWhenHoldingLock(t *testing.T) {
+	cs, c := newConsulStub(t)
+	defer cs.Close()
+
+	ca := newACMEStub(t)
+	defer ca.server.Close()
+
+	m := &acmeManager{
+		config: ACMEConfig{
+			DirectoryURL: ca.server.URL + "/directory",
+			Hosts:        []string{"api.example.com"},
+			ConsulPrefix: "acme",
+			RenewBefore:  30 * 24 * time.Hour,
+			Challenges:   []string{ChallengeHTTP01},
+		},
+		consul:   c,
+		logger:   hclog.Default(),
+		lockWait: 50 * time.Millisecond,
+	}
+
+	hs := httptest.NewServer(m.httpHandler(http.NotFoundHandler()))
+	defer hs.Close()
+	ca.httpAddr = hs.Listener.Addr().String()
+
+	// another instance holds the lock
+	cs.mu.Lock()
+	cs.sessions["other"] = &api.SessionEntry{ID: "other"}
+	cs.kv["acme/lock"] = &api.KVPair{Key: "acme/lock", Session: "other", Flags: api.LockFlagValue}
+	cs.mu.Unlock()
+
+	err := m.renew(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, ca.Issued(), "Should not have renewed without the lock")
+
+	cs.mu.Lock()
+	cs.destroySession("other")
+	cs.mu.Unlock()
+
+	// the certificate expires within the renewal window
+	ca.validity = 24 * time.Hour
+	err = m.renew(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, ca.Issued())
+
+	err = m.renew(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, ca.Issued(), "Should have renewed the expiring certificate")
+
+	ca.validity = 90 * 24 * time.Hour
+	m.renew(context.Background())
+	m.renew(context.Background())
+	assert.Equal(t, 3, ca.Issued(), "Should not renew a valid certificate")
+}
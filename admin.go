@@ -0,0 +1,139 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamStatus is the state of the instances of a load balanced service
+// returned by the admin API
+type upstreamStatus struct {
+	Service    string           `json:"service"`
+	Datacenter string           `json:"datacenter,omitempty"`
+	Instances  []instanceStatus `json:"instances"`
+}
+
+type instanceStatus struct {
+	ID                string     `json:"id"`
+	Address           string     `json:"address"`
+	Node              string     `json:"node"`
+	ActiveRequests    int64      `json:"active_requests"`
+	Healthy           bool       `json:"healthy"`
+	HealthCheckError  string     `json:"health_check_error,omitempty"`
+	Ejected           bool       `json:"ejected"`
+	EjectedUntil      *time.Time `json:"ejected_until,omitempty"`
+	EjectionReason    string     `json:"ejection_reason,omitempty"`
+	Ejections         int        `json:"ejections"`
+	Consecutive5xx    int        `json:"consecutive_5xx"`
+	ConsecutiveErrors int        `json:"consecutive_errors"`
+	LatencyMS         float64    `json:"latency_ms"`
+}
+
+// SetAdminListener enables the admin API on the address, the API is not
+// authenticated and should only be reachable by operators
+func (r *Router) SetAdminListener(bindAddress string) error {
+	_, port, err := net.SplitHostPort(bindAddress)
+	if err != nil {
+		return fmt.Errorf("Invalid admin listen address: %s", err)
+	}
+
+	if _, err := strconv.Atoi(port); err != nil {
+		return fmt.Errorf("Invalid admin listen port: %s", port)
+	}
+
+	r.adminBindAddress = bindAddress
+
+	return nil
+}
+
+// adminHandler returns the handler for the admin API
+func (r *Router) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/upstreams", r.upstreamsHandler)
+
+	return mux
+}
+
+// upstreamsHandler returns the state of the instances of load balanced
+// services
+func (r *Router) upstreamsHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := []upstreamStatus{}
+	if r.balancer != nil {
+		status = r.balancer.status()
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(status)
+}
+
+// status returns the state of the watched services
+func (b *loadBalancer) status() []upstreamStatus {
+	b.mu.Lock()
+	pools := make([]*instancePool, 0, len(b.pools))
+	for _, p := range b.pools {
+		pools = append(pools, p)
+	}
+	b.mu.Unlock()
+
+	sort.Slice(pools, func(i, j int) bool {
+		if pools[i].service == pools[j].service {
+			return pools[i].datacenter < pools[j].datacenter
+		}
+		return pools[i].service < pools[j].service
+	})
+
+	now := b.now()
+	status := []upstreamStatus{}
+
+	for _, p := range pools {
+		p.mu.RLock()
+		instances := p.instances
+		p.mu.RUnlock()
+
+		us := upstreamStatus{Service: p.service, Datacenter: p.datacenter, Instances: []instanceStatus{}}
+
+		for _, i := range instances {
+			h := &i.health
+			h.mu.Lock()
+
+			is := instanceStatus{
+				ID:                i.id,
+				Address:           i.addr,
+				Node:              i.node,
+				ActiveRequests:    atomic.LoadInt64(&i.active),
+				Healthy:           !h.unhealthy,
+				HealthCheckError:  h.lastCheckError,
+				Ejected:           now.Before(h.ejectedUntil),
+				Ejections:         h.ejections,
+				Consecutive5xx:    h.consecutive5xx,
+				ConsecutiveErrors: h.consecutiveErrors,
+				LatencyMS:         h.latency * 1000,
+			}
+
+			if is.Ejected {
+				until := h.ejectedUntil
+				is.EjectedUntil = &until
+				is.EjectionReason = h.reason
+			}
+
+			h.mu.Unlock()
+
+			us.Instances = append(us.Instances, is)
+		}
+
+		status = append(status, us)
+	}
+
+	return status
+}
@@ -0,0 +1,54 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetAdminListenerValidatesAddress(t *testing.T) {
+	r := &Router{}
+
+	assert.Error(t, r.SetAdminListener("localhost"))
+	assert.Error(t, r.SetAdminListener("localhost:admin"))
+	assert.NoError(t, r.SetAdminListener("127.0.0.1:9102"))
+	assert.Equal(t, "127.0.0.1:9102", r.adminBindAddress)
+}
+
+func TestAdminReturnsUpstreamInstances(t *testing.T) {
+	rec, _ := setupOutliers(t, "service=api#path=/api#lb=round_robin#outlier_5xx=1", map[string]int{
+		"10.0.0.1:8080": http.StatusServiceUnavailable,
+		"10.0.0.2:8080": http.StatusOK,
+	})
+	sendRequests(rec, 2)
+
+	rw := httptest.NewRecorder()
+	rec.adminHandler().ServeHTTP(rw, httptest.NewRequest("GET", "/v1/upstreams", nil))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+
+	status := []upstreamStatus{}
+	err := json.Unmarshal(rw.Body.Bytes(), &status)
+	assert.NoError(t, err)
+
+	assert.Len(t, status, 1)
+	assert.Equal(t, "api", status[0].Service)
+	assert.Len(t, status[0].Instances, 2)
+	assert.Equal(t, "10.0.0.1:8080", status[0].Instances[0].Address)
+	assert.True(t, status[0].Instances[0].Ejected)
+	assert.Equal(t, "5xx", status[0].Instances[0].EjectionReason)
+	assert.False(t, status[0].Instances[1].Ejected)
+}
+
+func TestAdminRejectsOtherMethods(t *testing.T) {
+	r := &Router{}
+	rw := httptest.NewRecorder()
+
+	r.adminHandler().ServeHTTP(rw, httptest.NewRequest("POST", "/v1/upstreams", nil))
+
+	assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+}
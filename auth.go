@@ -0,0 +1,259 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// AuthType defines the authentication required by a route
+type AuthType string
+
+// AuthJWT requires a valid bearer JWT
+const AuthJWT AuthType = "jwt"
+
+// AuthAPIKey requires an API key stored in the credential store
+const AuthAPIKey AuthType = "api_key"
+
+// AuthBasic requires HTTP Basic credentials stored in the credential store
+const AuthBasic AuthType = "basic"
+
+// DefaultPrincipalHeader is the header used to forward the authenticated
+// principal to the upstream
+const DefaultPrincipalHeader = "X-Auth-Principal"
+
+// DefaultAPIKeyHeader is the request header containing the API key
+const DefaultAPIKeyHeader = "X-API-Key"
+
+type contextKey string
+
+// claimsContextKey is the request context key for validated JWT claims
+const claimsContextKey contextKey = "jwt_claims"
+
+// principalContextKey is the request context key for the authenticated
+// principal
+const principalContextKey contextKey = "principal"
+
+// authenticate validates the credentials required by the upstream, the
+// returned request carries the authenticated principal in its context and
+// in the principal header. When authentication fails the error is written to
+// the response and false is returned.
+func (r *Router) authenticate(rw http.ResponseWriter, req *http.Request, us *Upstream) (*http.Request, bool) {
+	// remove any client supplied value before setting the principal, callers
+	// on the Connect listener have already been identified
+	header := us.PrincipalHeader
+	if header == "" {
+		header = DefaultPrincipalHeader
+	}
+
+	req.Header.Del(header)
+	if p := requestPrincipal(req); p != "" {
+		req.Header.Set(header, p)
+	}
+
+	var principal string
+	var ok bool
+
+	switch us.Auth {
+	case "":
+		return req, true
+	case AuthJWT:
+		req, principal, ok = r.authenticateJWT(rw, req, us)
+	case AuthAPIKey, AuthBasic:
+		principal, ok = r.authenticateCredentials(rw, req, us)
+	default:
+		r.logger.Error("Unknown authentication type", "upstream", us.Service, "auth", us.Auth)
+		http.Error(rw, "Authentication not configured", http.StatusInternalServerError)
+	}
+
+	if !ok {
+		return nil, false
+	}
+
+	req.Header.Del(header)
+	if principal != "" {
+		req.Header.Set(header, principal)
+	}
+
+	return req.WithContext(contextWithPrincipal(req, principal)), true
+}
+
+// authenticateJWT validates the bearer token and required claims then maps
+// the claims to the configured upstream headers, the token subject is used as
+// the principal
+func (r *Router) authenticateJWT(rw http.ResponseWriter, req *http.Request, us *Upstream) (*http.Request, string, bool) {
+	if r.jwtValidator == nil {
+		r.logger.Error("JWT authentication has not been configured", "upstream", us.Service)
+		http.Error(rw, "Authentication not configured", http.StatusInternalServerError)
+		return nil, "", false
+	}
+
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="connect-router"`)
+		http.Error(rw, "Bearer token required", http.StatusUnauthorized)
+		return nil, "", false
+	}
+
+	claims, err := r.jwtValidator.Validate(strings.TrimPrefix(auth, "Bearer "))
+	if err != nil {
+		r.logger.Info("Invalid bearer token", "upstream", us.Service, "error", err)
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="connect-router", error="invalid_token"`)
+		http.Error(rw, "Invalid bearer token", http.StatusUnauthorized)
+		return nil, "", false
+	}
+
+	for claim, value := range us.JWTClaims {
+		if !claimHasValue(claims[claim], value) {
+			r.logger.Info("Bearer token missing required claim", "upstream", us.Service, "claim", claim)
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="connect-router", error="insufficient_scope"`)
+			http.Error(rw, "Forbidden", http.StatusForbidden)
+			return nil, "", false
+		}
+	}
+
+	// remove any client supplied values before setting the claim headers
+	for claim, header := range us.JWTHeaders {
+		req.Header.Del(header)
+		if v := claimString(claims[claim]); v != "" {
+			req.Header.Set(header, v)
+		}
+	}
+
+	return req.WithContext(context.WithValue(req.Context(), claimsContextKey, claims)), claimString(claims["sub"]), true
+}
+
+// authenticateCredentials checks an API key or Basic credentials against the
+// credential store, the credentials are removed from the upstream request
+func (r *Router) authenticateCredentials(rw http.ResponseWriter, req *http.Request, us *Upstream) (string, bool) {
+	if r.credentials == nil {
+		r.logger.Error("Credential store has not been configured", "upstream", us.Service)
+		http.Error(rw, "Authentication not configured", http.StatusInternalServerError)
+		return "", false
+	}
+
+	var principal string
+	var err error
+
+	if us.Auth == AuthBasic {
+		user, pass, ok := req.BasicAuth()
+		if !ok {
+			rw.Header().Set("WWW-Authenticate", `Basic realm="connect-router"`)
+			http.Error(rw, "Credentials required", http.StatusUnauthorized)
+			return "", false
+		}
+
+		principal, err = r.credentials.VerifyBasic(credentialClient(req), user, pass)
+		req.Header.Del("Authorization")
+	} else {
+		header := us.APIKeyHeader
+		if header == "" {
+			header = DefaultAPIKeyHeader
+		}
+
+		principal, err = r.credentials.VerifyAPIKey(credentialClient(req), req.Header.Get(header))
+		req.Header.Del(header)
+	}
+
+	if err == errTooManyAttempts {
+		r.logger.Info("Too many failed authentication attempts", "upstream", us.Service, "auth", us.Auth, "remote_addr", req.RemoteAddr)
+		rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(1/credentialFailureRate))))
+		http.Error(rw, "Too many failed attempts", http.StatusTooManyRequests)
+		return "", false
+	}
+
+	if err != nil {
+		r.logger.Info("Invalid credentials", "upstream", us.Service, "auth", us.Auth)
+		if us.Auth == AuthBasic {
+			rw.Header().Set("WWW-Authenticate", `Basic realm="connect-router"`)
+		}
+		http.Error(rw, "Invalid credentials", http.StatusUnauthorized)
+		return "", false
+	}
+
+	return principal, true
+}
+
+// credentialClient returns the address of the client used to limit failed
+// credential checks
+func credentialClient(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+// contextWithPrincipal returns the request context with the principal set
+func contextWithPrincipal(req *http.Request, principal string) context.Context {
+	return context.WithValue(req.Context(), principalContextKey, principal)
+}
+
+// requestPrincipal returns the authenticated principal for the request
+func requestPrincipal(req *http.Request) string {
+	p, _ := req.Context().Value(principalContextKey).(string)
+	return p
+}
+
+// requestClaims returns the validated JWT claims for the request
+func requestClaims(req *http.Request) (map[string]interface{}, bool) {
+	claims, ok := req.Context().Value(claimsContextKey).(map[string]interface{})
+	return claims, ok
+}
+
+// claimHasValue checks that a claim exists and, when value is not empty,
+// contains the value. Space separated strings such as scope and arrays are
+// checked for the value as a member.
+func claimHasValue(claim interface{}, value string) bool {
+	if claim == nil {
+		return false
+	}
+
+	if value == "" {
+		return true
+	}
+
+	switch c := claim.(type) {
+	case string:
+		for _, s := range strings.Fields(c) {
+			if s == value {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, s := range c {
+			if claimString(s) == value {
+				return true
+			}
+		}
+	default:
+		return claimString(c) == value
+	}
+
+	return false
+}
+
+// claimString converts a claim value to a string, arrays are comma separated
+func claimString(claim interface{}) string {
+	switch c := claim.(type) {
+	case nil:
+		return ""
+	case string:
+		return c
+	case float64:
+		return strconv.FormatFloat(c, 'f', -1, 64)
+	case []interface{}:
+		s := []string{}
+		for _, v := range c {
+			s = append(s, claimString(v))
+		}
+		return strings.Join(s, ",")
+	}
+
+	return fmt.Sprintf("%v", claim)
+}
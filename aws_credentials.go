@@ -0,0 +1,270 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// awsContainerCredentialsHost is the ECS task metadata endpoint used with
+// AWS_CONTAINER_CREDENTIALS_RELATIVE_URI
+const awsContainerCredentialsHost = "http://169.254.170.2"
+
+// awsInstanceMetadataEndpoint is the EC2 instance metadata service, it can be
+// overridden with AWS_EC2_METADATA_SERVICE_ENDPOINT
+const awsInstanceMetadataEndpoint = "http://169.254.169.254"
+
+// awsInstanceMetadataTokenTTL is the lifetime in seconds of the IMDSv2
+// session token requested for each refresh
+const awsInstanceMetadataTokenTTL = "300"
+
+// awsCredentialsExpiryWindow is how long before expiry temporary credentials
+// are refreshed
+const awsCredentialsExpiryWindow = 5 * time.Minute
+
+// awsCredentialProvider returns the credentials used to sign a request,
+// providers of temporary credentials refresh them before they expire
+type awsCredentialProvider interface {
+	Credentials(ctx context.Context) (awsCredentials, error)
+}
+
+// newAWSCredentialProvider returns a provider for the configured credentials,
+// when none are configured the credentials are read from the environment, the
+// ECS container credentials endpoint or the EC2 instance profile
+func newAWSCredentialProvider(c LambdaConfig) (awsCredentialProvider, error) {
+	if c.AccessKeyID != "" || c.SecretAccessKey != "" {
+		if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+			return nil, fmt.Errorf("Lambda credentials require an access key id and secret access key")
+		}
+
+		return staticAWSCredentials{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey, SessionToken: c.SessionToken}, nil
+	}
+
+	if os.Getenv("AWS_ACCESS_KEY_ID") != "" {
+		return envAWSCredentials{}, nil
+	}
+
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		return newContainerAWSCredentials(awsContainerCredentialsHost+uri, ""), nil
+	}
+
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); uri != "" {
+		return newContainerAWSCredentials(uri, os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")), nil
+	}
+
+	if strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		return nil, fmt.Errorf("Lambda credentials are not configured")
+	}
+
+	endpoint := os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT")
+	if endpoint == "" {
+		endpoint = awsInstanceMetadataEndpoint
+	}
+
+	return newInstanceAWSCredentials(strings.TrimSuffix(endpoint, "/")), nil
+}
+
+// staticAWSCredentials are credentials set in the configuration
+type staticAWSCredentials awsCredentials
+
+func (s staticAWSCredentials) Credentials(ctx context.Context) (awsCredentials, error) {
+	return awsCredentials(s), nil
+}
+
+// envAWSCredentials reads the credentials from the environment for every
+// request so rotated session tokens are used
+type envAWSCredentials struct{}
+
+func (envAWSCredentials) Credentials(ctx context.Context) (awsCredentials, error) {
+	c := awsCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return awsCredentials{}, fmt.Errorf("AWS credentials are not set in the environment")
+	}
+
+	return c, nil
+}
+
+// containerAWSCredentials fetches temporary credentials from the ECS
+// container credentials endpoint, credentials are cached until shortly
+// before they expire
+type containerAWSCredentials struct {
+	uri        string
+	token      string
+	httpClient *http.Client
+	now        func() time.Time
+
+	mu      sync.Mutex
+	creds   awsCredentials
+	expires time.Time
+}
+
+func newContainerAWSCredentials(uri, token string) *containerAWSCredentials {
+	return &containerAWSCredentials{
+		uri:        uri,
+		token:      token,
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+		now:        time.Now,
+	}
+}
+
+func (c *containerAWSCredentials) Credentials(ctx context.Context) (awsCredentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.now().Before(c.expires.Add(-awsCredentialsExpiryWindow)) {
+		return c.creds, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.uri, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+
+	if c.token != "" {
+		req.Header.Set("Authorization", c.token)
+	}
+
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("Unable to fetch AWS credentials: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, fmt.Errorf("Unexpected status code %d fetching AWS credentials", resp.StatusCode)
+	}
+
+	creds, expires, err := decodeAWSCredentials(resp)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+
+	c.creds = creds
+	c.expires = expires
+
+	return c.creds, nil
+}
+
+// instanceAWSCredentials fetches the temporary credentials of the EC2
+// instance profile using IMDSv2, credentials are cached until shortly before
+// they expire
+type instanceAWSCredentials struct {
+	endpoint   string
+	httpClient *http.Client
+	now        func() time.Time
+
+	mu      sync.Mutex
+	creds   awsCredentials
+	expires time.Time
+}
+
+func newInstanceAWSCredentials(endpoint string) *instanceAWSCredentials {
+	return &instanceAWSCredentials{
+		endpoint:   endpoint,
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+		now:        time.Now,
+	}
+}
+
+func (c *instanceAWSCredentials) Credentials(ctx context.Context) (awsCredentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.now().Before(c.expires.Add(-awsCredentialsExpiryWindow)) {
+		return c.creds, nil
+	}
+
+	// IMDSv2 requires a session token for every metadata request
+	req, err := http.NewRequest(http.MethodPut, c.endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", awsInstanceMetadataTokenTTL)
+
+	token, err := c.get(ctx, req)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+
+	path := c.endpoint + "/latest/meta-data/iam/security-credentials/"
+	req, _ = http.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+
+	roles, err := c.get(ctx, req)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if role == "" {
+		return awsCredentials{}, fmt.Errorf("No instance profile is attached to the instance")
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, path+role, nil)
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("Unable to fetch AWS credentials: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, fmt.Errorf("Unexpected status code %d fetching AWS credentials", resp.StatusCode)
+	}
+
+	creds, expires, err := decodeAWSCredentials(resp)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+
+	c.creds = creds
+	c.expires = expires
+
+	return c.creds, nil
+}
+
+// get returns the body of a metadata request
+func (c *instanceAWSCredentials) get(ctx context.Context, req *http.Request) ([]byte, error) {
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch AWS credentials: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status code %d fetching AWS credentials", resp.StatusCode)
+	}
+
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+}
+
+// decodeAWSCredentials parses the temporary credentials returned by the
+// container and instance metadata endpoints
+func decodeAWSCredentials(resp *http.Response) (awsCredentials, time.Time, error) {
+	out := struct {
+		AccessKeyID     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		Token           string    `json:"Token"`
+		Expiration      time.Time `json:"Expiration"`
+	}{}
+
+	err := json.NewDecoder(resp.Body).Decode(&out)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, fmt.Errorf("Unable to parse AWS credentials: %s", err)
+	}
+
+	return awsCredentials{AccessKeyID: out.AccessKeyID, SecretAccessKey: out.SecretAccessKey, SessionToken: out.Token}, out.Expiration, nil
+}
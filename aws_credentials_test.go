@@ -0,0 +1,126 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContainerAWSCredentialsRefreshBeforeExpiry(t *testing.T) {
+	now := time.Now()
+	fetches := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		fetches++
+		assert.Equal(t, "secret-token", r.Header.Get("Authorization"))
+
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"AccessKeyId":     "AKIDTASK",
+			"SecretAccessKey": "secret",
+			"Token":           "token",
+			"Expiration":      now.Add(time.Hour),
+		})
+	}))
+	defer ts.Close()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", ts.URL+"/creds")
+	t.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN", "secret-token")
+
+	p, err := newAWSCredentialProvider(LambdaConfig{})
+	assert.NoError(t, err)
+
+	c := p.(*containerAWSCredentials)
+	c.now = func() time.Time { return now }
+
+	creds, err := c.Credentials(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "AKIDTASK", creds.AccessKeyID)
+	assert.Equal(t, "token", creds.SessionToken)
+
+	c.Credentials(context.Background())
+	assert.Equal(t, 1, fetches, "Should have cached the credentials")
+
+	now = now.Add(56 * time.Minute)
+	c.Credentials(context.Background())
+	assert.Equal(t, 2, fetches, "Should have refreshed the credentials before they expire")
+}
+
+func TestAWSCredentialProviderRequiresCredentials(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", "")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	_, err := newAWSCredentialProvider(LambdaConfig{})
+	assert.Error(t, err)
+
+	_, err = newAWSCredentialProvider(LambdaConfig{AccessKeyID: "AKID"})
+	assert.Error(t, err, "Should require the secret access key")
+}
+
+func TestInstanceAWSCredentialsUseIMDSv2(t *testing.T) {
+	now := time.Now()
+	fetches := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" {
+			assert.Equal(t, http.MethodPut, r.Method)
+			assert.NotEmpty(t, r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds"))
+			rw.Write([]byte("session-token"))
+			return
+		}
+
+		if r.Header.Get("X-aws-ec2-metadata-token") != "session-token" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/latest/meta-data/iam/security-credentials/":
+			rw.Write([]byte("router-role"))
+		case "/latest/meta-data/iam/security-credentials/router-role":
+			fetches++
+			json.NewEncoder(rw).Encode(map[string]interface{}{
+				"Code":            "Success",
+				"AccessKeyId":     "AKIDINSTANCE",
+				"SecretAccessKey": "secret",
+				"Token":           "token",
+				"Expiration":      now.Add(time.Hour),
+			})
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", "")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "")
+	t.Setenv("AWS_EC2_METADATA_SERVICE_ENDPOINT", ts.URL+"/")
+
+	p, err := newAWSCredentialProvider(LambdaConfig{})
+	assert.NoError(t, err)
+
+	c := p.(*instanceAWSCredentials)
+	c.now = func() time.Time { return now }
+
+	creds, err := c.Credentials(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "AKIDINSTANCE", creds.AccessKeyID)
+	assert.Equal(t, "token", creds.SessionToken)
+
+	c.Credentials(context.Background())
+	assert.Equal(t, 1, fetches, "Should have cached the credentials")
+
+	now = now.Add(56 * time.Minute)
+	c.Credentials(context.Background())
+	assert.Equal(t, 2, fetches, "Should have refreshed the credentials before they expire")
+}
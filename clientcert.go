@@ -0,0 +1,229 @@
+package router
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// DefaultClientCertHeader is the header used to forward the verified client
+// certificate to the upstream
+const DefaultClientCertHeader = "X-Client-Cert"
+
+// Revocation checks for client certificates
+const (
+	RevocationCRL  = "crl"
+	RevocationOCSP = "ocsp"
+)
+
+var clientCertFields = map[string]bool{
+	"pem": true, "subject": true, "cn": true, "dns": true, "uri": true, "email": true, "serial": true, "hash": true,
+}
+
+// ClientCertPolicy defines the client certificate requirements for a route,
+// certificates are verified against the client CA bundle of the listener
+type ClientCertPolicy struct {
+	// Required rejects requests without a verified client certificate
+	Required bool
+	// Subjects are patterns matched against the subject common name or
+	// distinguished name i.e. *.partner.com or CN=client,O=Partner
+	Subjects []string
+	// SANs are patterns matched against the DNS, email, URI and IP subject
+	// alternative names i.e. spiffe://partner/*
+	SANs []string
+	// Revocation is an optional revocation check, crl or ocsp
+	Revocation string
+	// Header is the header used to forward the certificate to the upstream
+	Header string
+	// Forward is either pem to forward the URL encoded PEM certificate or a
+	// list of fields, subject, cn, dns, uri, email, serial and hash
+	Forward []string
+
+	subjects []*regexp.Regexp
+	sans     []*regexp.Regexp
+}
+
+// NewClientCertPolicy creates a policy, a certificate is required when
+// patterns or a revocation check are specified
+func NewClientCertPolicy(required bool, subjects, sans []string, revocation, header string, forward []string) (*ClientCertPolicy, error) {
+	if revocation != "" && revocation != RevocationCRL && revocation != RevocationOCSP {
+		return nil, fmt.Errorf("Invalid revocation check %s", revocation)
+	}
+
+	if header == "" {
+		header = DefaultClientCertHeader
+	}
+
+	if len(forward) == 0 {
+		forward = []string{"pem"}
+	}
+
+	for _, f := range forward {
+		if !clientCertFields[f] {
+			return nil, fmt.Errorf("Invalid client certificate field %s", f)
+		}
+	}
+
+	p := &ClientCertPolicy{
+		Required:   required || len(subjects) > 0 || len(sans) > 0 || revocation != "",
+		Subjects:   subjects,
+		SANs:       sans,
+		Revocation: revocation,
+		Header:     header,
+		Forward:    forward,
+	}
+
+	for _, s := range subjects {
+		p.subjects = append(p.subjects, globPattern(s))
+	}
+
+	for _, s := range sans {
+		p.sans = append(p.sans, globPattern(s))
+	}
+
+	return p, nil
+}
+
+// globPattern converts a pattern where * matches any characters to a regular
+// expression
+func globPattern(s string) *regexp.Regexp {
+	return regexp.MustCompile("^" + strings.Replace(regexp.QuoteMeta(s), `\*`, ".*", -1) + "$")
+}
+
+// Allowed returns true when the certificate matches any of the subject or
+// SAN patterns, any certificate is allowed when there are no patterns
+func (p *ClientCertPolicy) Allowed(cert *x509.Certificate) bool {
+	if len(p.subjects) == 0 && len(p.sans) == 0 {
+		return true
+	}
+
+	if matchAny(p.subjects, cert.Subject.CommonName, cert.Subject.String()) {
+		return true
+	}
+
+	names := append([]string{}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+
+	return matchAny(p.sans, names...)
+}
+
+func matchAny(patterns []*regexp.Regexp, values ...string) bool {
+	for _, p := range patterns {
+		for _, v := range values {
+			if v != "" && p.MatchString(v) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// headerValue returns the forwarded value for the certificate, fields are
+// formatted as key=value pairs separated by ; i.e.
+// Hash=...;Subject="CN=client";URI=spiffe://partner/client
+func (p *ClientCertPolicy) headerValue(cert *x509.Certificate) string {
+	if len(p.Forward) == 1 && p.Forward[0] == "pem" {
+		return url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+	}
+
+	values := []string{}
+	for _, f := range p.Forward {
+		switch f {
+		case "pem":
+			values = append(values, "Cert="+url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))))
+		case "hash":
+			sum := sha256.Sum256(cert.Raw)
+			values = append(values, "Hash="+hex.EncodeToString(sum[:]))
+		case "subject":
+			values = append(values, fmt.Sprintf("Subject=%q", cert.Subject.String()))
+		case "cn":
+			values = append(values, fmt.Sprintf("CN=%q", cert.Subject.CommonName))
+		case "serial":
+			values = append(values, "Serial="+cert.SerialNumber.Text(16))
+		case "dns":
+			for _, n := range cert.DNSNames {
+				values = append(values, "DNS="+n)
+			}
+		case "email":
+			for _, e := range cert.EmailAddresses {
+				values = append(values, "Email="+e)
+			}
+		case "uri":
+			for _, u := range cert.URIs {
+				values = append(values, "URI="+u.String())
+			}
+		}
+	}
+
+	return strings.Join(values, ";")
+}
+
+// clientCertificate returns the verified client certificate and its issuer
+// for the request
+func clientCertificate(req *http.Request) (*x509.Certificate, *x509.Certificate) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+
+	chain := req.TLS.VerifiedChains[0]
+	if len(chain) == 1 {
+		return chain[0], nil
+	}
+
+	return chain[0], chain[1]
+}
+
+// authorizeClientCert checks the client certificate against the route policy
+// and forwards the verified certificate to the upstream, client supplied
+// values for the header are always removed
+func (r *Router) authorizeClientCert(rw http.ResponseWriter, req *http.Request, us *Upstream) bool {
+	req.Header.Del(DefaultClientCertHeader)
+
+	p := us.ClientCert
+	if p == nil {
+		return true
+	}
+	req.Header.Del(p.Header)
+
+	cert, issuer := clientCertificate(req)
+	if cert == nil {
+		if p.Required {
+			http.Error(rw, "Client certificate required", http.StatusForbidden)
+			return false
+		}
+
+		return true
+	}
+
+	if !p.Allowed(cert) {
+		r.logger.Info("Client certificate not allowed", "upstream", us.Service, "subject", cert.Subject.String())
+		http.Error(rw, "Client certificate not allowed", http.StatusForbidden)
+		return false
+	}
+
+	if p.Revocation != "" {
+		err := r.checkRevocation(p.Revocation, cert, issuer)
+		if err != nil {
+			r.logger.Info("Client certificate revocation check failed", "upstream", us.Service, "subject", cert.Subject.String(), "error", err)
+			http.Error(rw, "Client certificate not allowed", http.StatusForbidden)
+			return false
+		}
+	}
+
+	req.Header.Set(p.Header, p.headerValue(cert))
+
+	return true
+}
@@ -0,0 +1,392 @@
+package router
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"golang.org/x/crypto/ocsp"
+)
+
+// testCA issues client certificates for tests
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Partner CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	return &testCA{cert: cert, key: key, serial: 1}
+}
+
+// issue creates a client certificate, the template is completed with a
+// serial, validity and key usage, the extended key usage defaults to client
+// authentication
+func (ca *testCA) issue(t *testing.T, tmpl *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	ca.serial++
+	tmpl.SerialNumber = big.NewInt(ca.serial)
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	if tmpl.ExtKeyUsage == nil {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	return cert, key
+}
+
+func (ca *testCA) pem() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+// clientCertRequest returns a request with a verified client certificate
+func clientCertRequest(cert, issuer *x509.Certificate) *http.Request {
+	r := httptest.NewRequest("GET", "/partner", nil)
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert, issuer}}}
+
+	return r
+}
+
+func setupClientCertRouter(t *testing.T, p *ClientCertPolicy) *Router {
+	rec := setupRouterTests(t)
+	rec.revocation, _ = newRevocationChecker(nil)
+	rec.upstreams = append(rec.upstreams, Upstream{Service: "partner", Path: "/partner", ClientCert: p})
+
+	return rec
+}
+
+func TestHandlerRequiresClientCertificate(t *testing.T) {
+	p, _ := NewClientCertPolicy(true, nil, nil, "", "", nil)
+	rec := setupClientCertRouter(t, p)
+	rw := httptest.NewRecorder()
+
+	rec.Handler(rw, httptest.NewRequest("GET", "/partner", nil))
+
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	mockHTTPClient.AssertNotCalled(t, "Do", mock.Anything)
+}
+
+func TestHandlerRejectsClientCertificateNotMatchingPatterns(t *testing.T) {
+	ca := newTestCA(t)
+	p, _ := NewClientCertPolicy(false, []string{"*.partner.com"}, []string{"spiffe://partner/*"}, "", "", nil)
+	rec := setupClientCertRouter(t, p)
+
+	tests := []struct {
+		name string
+		tmpl *x509.Certificate
+		code int
+	}{
+		{"subject", &x509.Certificate{Subject: pkix.Name{CommonName: "api.partner.com"}}, http.StatusOK},
+		{"san", &x509.Certificate{Subject: pkix.Name{CommonName: "client"}, URIs: []*url.URL{{Scheme: "spiffe", Host: "partner", Path: "/billing"}}}, http.StatusOK},
+		{"no match", &x509.Certificate{Subject: pkix.Name{CommonName: "api.other.com"}, DNSNames: []string{"partner.com"}}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		cert, _ := ca.issue(t, tt.tmpl)
+		rw := httptest.NewRecorder()
+
+		rec.Handler(rw, clientCertRequest(cert, ca.cert))
+
+		assert.Equal(t, tt.code, rw.Code, tt.name)
+	}
+}
+
+func TestHandlerForwardsClientCertificateAsPEM(t *testing.T) {
+	ca := newTestCA(t)
+	cert, _ := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "client"}})
+	p, _ := NewClientCertPolicy(true, nil, nil, "", "", nil)
+	rec := setupClientCertRouter(t, p)
+	rw := httptest.NewRecorder()
+	r := clientCertRequest(cert, ca.cert)
+	r.Header.Set("X-Client-Cert", "spoofed")
+
+	rec.Handler(rw, r)
+
+	mockHTTPClient.AssertCalled(t, "Do", mock.Anything)
+	req := mockHTTPClient.Calls[0].Arguments.Get(0).(*http.Request)
+
+	v, err := url.QueryUnescape(req.Header.Get("X-Client-Cert"))
+	assert.NoError(t, err)
+
+	b, _ := pem.Decode([]byte(v))
+	assert.Equal(t, cert.Raw, b.Bytes)
+}
+
+func TestHandlerRemovesClientCertHeaderWithoutPolicy(t *testing.T) {
+	rec := setupRouterTests(t)
+	rec.upstreams = append(rec.upstreams, Upstream{Service: "test", Path: "/test"})
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/test", nil)
+	r.Header.Set("X-Client-Cert", "spoofed")
+
+	rec.Handler(rw, r)
+
+	req := mockHTTPClient.Calls[0].Arguments.Get(0).(*http.Request)
+	assert.Empty(t, req.Header.Get("X-Client-Cert"))
+}
+
+func TestClientCertPolicyForwardsSelectedFields(t *testing.T) {
+	ca := newTestCA(t)
+	cert, _ := ca.issue(t, &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "client", Organization: []string{"Partner"}},
+		DNSNames: []string{"client.partner.com"},
+		URIs:     []*url.URL{{Scheme: "spiffe", Host: "partner", Path: "/client"}},
+	})
+
+	p, err := NewClientCertPolicy(true, nil, nil, "", "X-Partner", []string{"subject", "dns", "uri", "serial"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, `Subject="CN=client,O=Partner";DNS=client.partner.com;URI=spiffe://partner/client;Serial=2`, p.headerValue(cert))
+
+	_, err = NewClientCertPolicy(true, nil, nil, "", "", []string{"password"})
+	assert.Error(t, err)
+
+	_, err = NewClientCertPolicy(true, nil, nil, "magic", "", nil)
+	assert.Error(t, err)
+}
+
+func TestRevocationCheckerRejectsCertificatesInCRL(t *testing.T) {
+	ca := newTestCA(t)
+	revoked, _ := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "revoked"}})
+	valid, _ := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "valid"}})
+
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: revoked.SerialNumber, RevocationTime: time.Now()},
+		},
+	}, ca.cert, ca.key)
+	assert.NoError(t, err)
+
+	dir, _ := ioutil.TempDir("", "crl")
+	defer os.RemoveAll(dir)
+	crlFile := filepath.Join(dir, "partner.crl")
+	ioutil.WriteFile(crlFile, crl, 0600)
+
+	rc, err := newRevocationChecker([]string{crlFile})
+	assert.NoError(t, err)
+
+	assert.Equal(t, errCertificateRevoked, rc.CheckCRL(revoked, ca.cert))
+	assert.NoError(t, rc.CheckCRL(valid, ca.cert))
+
+	other := newTestCA(t)
+	unknown, _ := other.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "unknown"}})
+	assert.Error(t, rc.CheckCRL(unknown, other.cert), "Should fail when there is no CRL for the issuer")
+}
+
+func TestRevocationCheckerReloadsChangedCRLs(t *testing.T) {
+	ca := newTestCA(t)
+	cert, _ := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "partner"}})
+
+	writeCRL := func(f string, revoked ...*x509.Certificate) {
+		entries := []x509.RevocationListEntry{}
+		for _, c := range revoked {
+			entries = append(entries, x509.RevocationListEntry{SerialNumber: c.SerialNumber, RevocationTime: time.Now()})
+		}
+
+		crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+			Number:                    big.NewInt(int64(len(entries) + 1)),
+			ThisUpdate:                time.Now().Add(-time.Minute),
+			NextUpdate:                time.Now().Add(time.Hour),
+			RevokedCertificateEntries: entries,
+		}, ca.cert, ca.key)
+		assert.NoError(t, err)
+
+		ioutil.WriteFile(f, crl, 0600)
+	}
+
+	dir, _ := ioutil.TempDir("", "crl")
+	defer os.RemoveAll(dir)
+	crlFile := filepath.Join(dir, "partner.crl")
+	writeCRL(crlFile)
+
+	rec := setupRouterTests(t)
+	err := rec.SetTLS(TLSConfig{ClientCRLFiles: []string{crlFile}, ReloadInterval: 10 * time.Millisecond})
+	assert.NoError(t, err)
+	defer close(rec.tlsStop)
+
+	assert.NoError(t, rec.revocation.CheckCRL(cert, ca.cert))
+
+	writeCRL(crlFile, cert)
+	os.Chtimes(crlFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+
+	waitFor(t, func() bool {
+		return rec.revocation.CheckCRL(cert, ca.cert) == errCertificateRevoked
+	}, "Should have reloaded the CRL")
+}
+
+func TestRevocationCheckerQueriesAndCachesOCSP(t *testing.T) {
+	ca := newTestCA(t)
+	requests := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requests++
+		b, _ := ioutil.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(b)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		status := ocsp.Good
+		if req.SerialNumber.Int64() == 2 {
+			status = ocsp.Revoked
+		}
+
+		resp, _ := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+			Status:       status,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+			RevokedAt:    time.Now().Add(-time.Minute),
+		}, ca.key)
+		rw.Write(resp)
+	}))
+	defer ts.Close()
+
+	revoked, _ := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "revoked"}, OCSPServer: []string{ts.URL}})
+	valid, _ := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "valid"}, OCSPServer: []string{ts.URL}})
+
+	rc, _ := newRevocationChecker(nil)
+
+	assert.Equal(t, errCertificateRevoked, rc.CheckOCSP(revoked, ca.cert))
+	assert.NoError(t, rc.CheckOCSP(valid, ca.cert))
+	assert.NoError(t, rc.CheckOCSP(valid, ca.cert))
+	assert.Equal(t, 2, requests, "Should have cached the response")
+
+	// the cached response is removed once the next update has passed
+	rc.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	rc.CheckOCSP(valid, ca.cert)
+	assert.Equal(t, 3, requests, "Should have queried the responder again")
+}
+
+func TestRevocationCheckerRejectsLargeOCSPResponses(t *testing.T) {
+	ca := newTestCA(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write(make([]byte, ocspMaxResponseSize+1))
+	}))
+	defer ts.Close()
+
+	cert, _ := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "client"}, OCSPServer: []string{ts.URL}})
+	rc, _ := newRevocationChecker(nil)
+
+	err := rc.CheckOCSP(cert, ca.cert)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "larger than")
+}
+
+func TestRevocationCheckerBoundsOCSPCache(t *testing.T) {
+	ca := newTestCA(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		req, _ := ocsp.ParseRequest(b)
+
+		resp, _ := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}, ca.key)
+		rw.Write(resp)
+	}))
+	defer ts.Close()
+
+	rc, _ := newRevocationChecker(nil)
+	rc.cache, _ = lru.New(2)
+
+	for i := 0; i < 5; i++ {
+		cert, _ := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: fmt.Sprintf("client-%d", i)}, OCSPServer: []string{ts.URL}})
+		assert.NoError(t, rc.CheckOCSP(cert, ca.cert))
+	}
+
+	assert.Equal(t, 2, rc.cache.Len())
+}
+
+func TestHTTPSListenerVerifiesClientCertificates(t *testing.T) {
+	ca := newTestCA(t)
+	other := newTestCA(t)
+
+	dir, _ := ioutil.TempDir("", "mtls")
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, ca.pem(), 0600)
+	certFile, keyFile := writeTestCert(t, dir, "server", "api.example.com")
+
+	rec := setupRouterTests(t)
+	p, _ := NewClientCertPolicy(false, nil, nil, "", "", []string{"cn"})
+	rec.upstreams = append(rec.upstreams, Upstream{Service: "partner", Path: "/partner", ClientCert: p})
+	err := rec.SetTLS(TLSConfig{CertFiles: []string{certFile}, KeyFiles: []string{keyFile}, ClientCAFiles: []string{caFile}})
+	assert.NoError(t, err)
+	defer close(rec.tlsStop)
+
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	srv, err := rec.newTLSServer()
+	assert.NoError(t, err)
+	go rec.serveTLS(srv, l)
+	defer l.Close()
+
+	client := func(ca *testCA) *http.Client {
+		cert, key := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "client"}})
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}},
+		}}}
+	}
+
+	resp, err := client(ca).Get("https://" + l.Addr().String() + "/partner")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	req := mockHTTPClient.Calls[0].Arguments.Get(0).(*http.Request)
+	assert.Equal(t, `CN="client"`, req.Header.Get("X-Client-Cert"))
+
+	_, err = client(other).Get("https://" + l.Addr().String() + "/partner")
+	assert.Error(t, err, "Should have rejected a certificate from an unknown CA")
+}
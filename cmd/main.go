@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	metrics "github.com/armon/go-metrics"
 	"github.com/hashicorp/consul/api"
 	log "github.com/hashicorp/go-hclog"
 	router "github.com/nicholasjackson/consul-connect-router"
@@ -18,6 +21,75 @@ var upstream = flag.StringSlice("upstream", nil, "define upstreams with service=
 var listen = flag.String("listen", ":8181", "listen address i.e localhost:8181")
 var logLevel = flag.String("log_level", "info", "log level, info, debug, trace")
 
+var rateLimit = flag.String("rate_limit", "", "global rate limit applied to all requests i.e 100/s, 6000/m")
+var rateLimitBurst = flag.Int("rate_limit_burst", 0, "maximum burst for the global rate limit, defaults to the per second rate")
+var rateLimitKey = flag.String("rate_limit_key", "", "group the global rate limit by ip or header:[name]")
+var rateLimitConsulPrefix = flag.String("rate_limit_consul_prefix", "", "share rate limits between routers using Consul KV at the given prefix i.e connect-router/ratelimit")
+
+var jwtKeyFiles = flag.StringSlice("jwt_key_file", nil, "PEM encoded public key or certificate used to validate RS256 and ES256 tokens")
+var jwtHMACSecretFile = flag.String("jwt_hmac_secret_file", "", "file containing the shared secret used to validate HS256 tokens")
+var jwtJWKSURL = flag.String("jwt_jwks_url", "", "URL of the JSON Web Key Set used to validate tokens")
+var jwtJWKSRefresh = flag.Duration("jwt_jwks_refresh", 10*time.Minute, "interval to refresh the JSON Web Key Set")
+var jwtIssuer = flag.String("jwt_issuer", "", "required issuer for tokens")
+var jwtAudience = flag.String("jwt_audience", "", "required audience for tokens")
+var jwtClockSkew = flag.Duration("jwt_clock_skew", 30*time.Second, "clock skew allowed when checking token expiry")
+var jwtRequireExp = flag.Bool("jwt_require_exp", true, "reject tokens without an exp claim")
+
+var credentialsConsulPrefix = flag.String("credentials_consul_prefix", "", "Consul KV prefix containing API key and Basic credentials i.e connect-router/credentials")
+
+var intentionsSourcePrefix = flag.String("intentions_source_prefix", "external-", "prefix added to principals to build the intention source name")
+var intentionsCacheTTL = flag.Duration("intentions_cache_ttl", 30*time.Second, "time intention decisions are cached")
+var intentionsCacheSize = flag.Int("intentions_cache_size", 10000, "maximum number of intention decisions cached")
+var intentionsFailOpen = flag.Bool("intentions_fail_open", false, "allow requests when intentions can not be checked")
+
+var tlsListen = flag.String("tls_listen", "", "HTTPS listen address i.e :8443")
+var tlsCertFiles = flag.StringSlice("tls_cert_file", nil, "PEM encoded certificate for the HTTPS listener, can be specified multiple times")
+var tlsKeyFiles = flag.StringSlice("tls_key_file", nil, "PEM encoded key for each certificate")
+var tlsReloadInterval = flag.Duration("tls_reload_interval", 10*time.Second, "interval to check certificate files for changes")
+var tlsMinVersion = flag.String("tls_min_version", "1.2", "minimum TLS version, 1.0, 1.1, 1.2 or 1.3")
+var tlsCipherSuites = flag.StringSlice("tls_cipher_suites", nil, "cipher suites allowed for TLS 1.2 and below")
+var tlsRedirectHTTP = flag.Bool("tls_redirect_http", false, "redirect requests on the HTTP listener to HTTPS")
+var tlsConsulPrefix = flag.String("tls_consul_prefix", "", "Consul KV prefix to load certificates from i.e. router/certs")
+var tlsVaultAddr = flag.String("tls_vault_addr", "", "address of the Vault server to load certificates from")
+var tlsVaultToken = flag.String("tls_vault_token", os.Getenv("VAULT_TOKEN"), "token for the Vault server, defaults to VAULT_TOKEN")
+var tlsVaultMount = flag.String("tls_vault_mount", "secret", "mount of the Vault KV v2 secrets engine")
+var tlsVaultPath = flag.String("tls_vault_path", "", "path in the Vault KV v2 secrets engine to load certificates from")
+var tlsClientCAFiles = flag.StringSlice("tls_client_ca_file", nil, "PEM encoded CA bundle used to verify client certificates, can be specified multiple times")
+var tlsClientCRLFiles = flag.StringSlice("tls_client_crl_file", nil, "CRL used to check client certificates, can be specified multiple times")
+
+var connectListen = flag.String("connect_listen", "", "listen address for requests from Connect services i.e. :9443, registers the router as Connect native")
+
+var lambdaRegion = flag.String("lambda_region", "", "default region for upstreams with type=lambda, defaults to AWS_REGION")
+var lambdaEndpoint = flag.String("lambda_endpoint", "", "Lambda API endpoint i.e. a local Lambda emulator, credentials are read from the AWS environment variables, ECS container credentials or EC2 instance profile")
+var lambdaTimeout = flag.Duration("lambda_timeout", 30*time.Second, "maximum duration of a Lambda invocation")
+
+var disableRegistration = flag.Bool("disable_registration", false, "do not register the router as a Consul service")
+var connectCAFile = flag.String("connect_ca_file", "", "PEM encoded Connect CA certificate for a pre-provisioned identity")
+var connectCertFile = flag.String("connect_cert_file", "", "PEM encoded Connect certificate for a pre-provisioned identity, used instead of requesting a certificate from the agent")
+var connectKeyFile = flag.String("connect_key_file", "", "PEM encoded key for the Connect certificate")
+
+var tcpRoutes = flag.StringSlice("tcp_route", nil, "TCP route to a Connect service i.e. service=postgres#listen=:5432 or service=db#listen=:443#sni=db.example.com")
+
+var h2cEnabled = flag.Bool("h2c", false, "accept cleartext HTTP/2 on the HTTP listener with prior knowledge or upgrade")
+var http2MaxStreams = flag.Uint32("http2_max_concurrent_streams", 0, "maximum concurrent HTTP/2 streams per connection, defaults to 250")
+var http2MaxFrameSize = flag.Uint32("http2_max_frame_size", 0, "largest HTTP/2 frame read in bytes, defaults to 1MB")
+var http2ConnWindow = flag.Int32("http2_connection_window", 0, "HTTP/2 flow control window for each connection in bytes, defaults to 1MB")
+var http2StreamWindow = flag.Int32("http2_stream_window", 0, "HTTP/2 flow control window for each stream in bytes, defaults to 1MB")
+var http2IdleTimeout = flag.Duration("http2_idle_timeout", 0, "close HTTP/2 connections with no active streams after this duration")
+
+var proxyProtocolCIDRs = flag.StringSlice("proxy_protocol_trusted_cidr", nil, "source CIDR of load balancers which send PROXY protocol headers, enables PROXY protocol on the HTTP, HTTPS and TCP listeners")
+
+var acmeDirectoryURL = flag.String("acme_directory_url", "", "directory URL of the ACME CA, enables automatic certificates")
+var acmeEmail = flag.String("acme_email", "", "contact email for the ACME account")
+var acmeHosts = flag.StringSlice("acme_host", nil, "hostname to obtain a certificate for, can be specified multiple times")
+var acmeConsulPrefix = flag.String("acme_consul_prefix", "connect-router/acme", "Consul KV prefix for the ACME account and certificates")
+var acmeRenewBefore = flag.Duration("acme_renew_before", 30*24*time.Hour, "renew certificates this long before they expire")
+var acmeChallenges = flag.StringSlice("acme_challenge", []string{"tls-alpn-01", "http-01"}, "ACME challenge types in order of preference")
+
+var adminListen = flag.String("admin_listen", "", "listen address for the admin API i.e. 127.0.0.1:9102, the API is not authenticated")
+
+var statsdAddr = flag.String("statsd_addr", "", "address of a statsd server to send metrics to i.e localhost:8125")
+
 var logger log.Logger
 
 func main() {
@@ -32,6 +104,16 @@ func main() {
 		logger.SetLevel(log.Trace)
 	}
 
+	if *statsdAddr != "" {
+		sink, err := metrics.NewStatsdSink(*statsdAddr)
+		if err != nil {
+			logger.Error("Unable to create statsd sink", "error", err)
+			return
+		}
+
+		metrics.NewGlobal(metrics.DefaultConfig("connect-router"), sink)
+	}
+
 	config := api.DefaultConfig()
 	config.Address = *consulAddr
 
@@ -49,22 +131,227 @@ func main() {
 		return
 	}
 
+	if *rateLimit != "" {
+		rl, err := router.NewRateLimit(*rateLimit, *rateLimitBurst, *rateLimitKey)
+		if err != nil {
+			logger.Error("Unable to create rate limit", "error", err)
+			return
+		}
+
+		err = r.SetRateLimit(rl)
+		if err != nil {
+			logger.Error("Unable to set rate limit", "error", err)
+			return
+		}
+	}
+
+	if *rateLimitConsulPrefix != "" {
+		err = r.EnableDistributedRateLimit(*rateLimitConsulPrefix)
+		if err != nil {
+			logger.Error("Unable to enable distributed rate limit", "error", err)
+			return
+		}
+	}
+
+	if len(*jwtKeyFiles) > 0 || *jwtHMACSecretFile != "" || *jwtJWKSURL != "" {
+		v, err := router.NewJWTValidator(router.JWTConfig{
+			KeyFiles:        *jwtKeyFiles,
+			HMACSecretFile:  *jwtHMACSecretFile,
+			JWKSURL:         *jwtJWKSURL,
+			JWKSRefresh:     *jwtJWKSRefresh,
+			Issuer:          *jwtIssuer,
+			Audience:        *jwtAudience,
+			ClockSkew:       *jwtClockSkew,
+			AllowMissingExp: !*jwtRequireExp,
+		})
+		if err != nil {
+			logger.Error("Unable to create JWT validator", "error", err)
+			return
+		}
+
+		r.SetJWTValidator(v)
+	}
+
+	if *credentialsConsulPrefix != "" {
+		cs, err := router.NewCredentialStore(consulClient, *credentialsConsulPrefix, logger)
+		if err != nil {
+			logger.Error("Unable to create credential store", "error", err)
+			return
+		}
+
+		r.SetCredentialStore(cs)
+	}
+
+	r.SetIntentionChecker(router.NewIntentionChecker(consulClient, router.IntentionConfig{
+		SourcePrefix: *intentionsSourcePrefix,
+		CacheTTL:     *intentionsCacheTTL,
+		CacheSize:    *intentionsCacheSize,
+		FailOpen:     *intentionsFailOpen,
+	}))
+
+	if *tlsListen != "" {
+		err = r.SetTLS(router.TLSConfig{
+			BindAddress:    *tlsListen,
+			CertFiles:      *tlsCertFiles,
+			KeyFiles:       *tlsKeyFiles,
+			ReloadInterval: *tlsReloadInterval,
+			MinVersion:     *tlsMinVersion,
+			CipherSuites:   *tlsCipherSuites,
+			RedirectHTTP:   *tlsRedirectHTTP,
+			ConsulPrefix:   *tlsConsulPrefix,
+			VaultAddr:      *tlsVaultAddr,
+			VaultToken:     *tlsVaultToken,
+			VaultMount:     *tlsVaultMount,
+			VaultPath:      *tlsVaultPath,
+			ClientCAFiles:  *tlsClientCAFiles,
+			ClientCRLFiles: *tlsClientCRLFiles,
+		})
+		if err != nil {
+			logger.Error("Unable to configure TLS", "error", err)
+			return
+		}
+	}
+
+	if *acmeDirectoryURL != "" {
+		err = r.EnableACME(router.ACMEConfig{
+			DirectoryURL: *acmeDirectoryURL,
+			Email:        *acmeEmail,
+			Hosts:        *acmeHosts,
+			ConsulPrefix: *acmeConsulPrefix,
+			RenewBefore:  *acmeRenewBefore,
+			Challenges:   *acmeChallenges,
+		})
+		if err != nil {
+			logger.Error("Unable to configure ACME", "error", err)
+			return
+		}
+	}
+
+	if len(*tcpRoutes) > 0 {
+		err = r.SetTCPRoutes(*tcpRoutes)
+		if err != nil {
+			logger.Error("Unable to configure TCP routes", "error", err)
+			return
+		}
+	}
+
+	if *h2cEnabled || *http2MaxStreams > 0 || *http2MaxFrameSize > 0 || *http2ConnWindow > 0 || *http2StreamWindow > 0 || *http2IdleTimeout > 0 {
+		err = r.SetHTTP2(router.HTTP2Config{
+			H2C:                  *h2cEnabled,
+			MaxConcurrentStreams: *http2MaxStreams,
+			MaxReadFrameSize:     *http2MaxFrameSize,
+			ConnectionWindowSize: *http2ConnWindow,
+			StreamWindowSize:     *http2StreamWindow,
+			IdleTimeout:          *http2IdleTimeout,
+		})
+		if err != nil {
+			logger.Error("Unable to configure HTTP/2", "error", err)
+			return
+		}
+	}
+
+	if len(*proxyProtocolCIDRs) > 0 {
+		err = r.EnableProxyProtocol(*proxyProtocolCIDRs)
+		if err != nil {
+			logger.Error("Unable to configure PROXY protocol", "error", err)
+			return
+		}
+	}
+
+	if *connectListen != "" {
+		err = r.SetConnectListener(*connectListen)
+		if err != nil {
+			logger.Error("Unable to configure Connect listener", "error", err)
+			return
+		}
+	}
+
+	if *adminListen != "" {
+		err = r.SetAdminListener(*adminListen)
+		if err != nil {
+			logger.Error("Unable to configure admin API", "error", err)
+			return
+		}
+	}
+
+	if *lambdaRegion != "" || *lambdaEndpoint != "" {
+		err = r.SetLambda(router.LambdaConfig{Region: *lambdaRegion, Endpoint: *lambdaEndpoint, Timeout: *lambdaTimeout})
+		if err != nil {
+			logger.Error("Unable to configure Lambda", "error", err)
+			return
+		}
+	}
+
+	if *disableRegistration {
+		r.DisableRegistration()
+	}
+
+	if *connectCertFile != "" {
+		err = setIdentity(r)
+		if err != nil {
+			logger.Error("Unable to configure Connect identity", "error", err)
+			return
+		}
+	}
+
 	// ensure the router stops cleanly when sigterm is detected
-	handleSigTerm(r)
+	stopped := handleSigTerm(r)
+
+	err = r.Run()
+	if err != nil {
+		logger.Error("Unable to start router", "error", err)
+		os.Exit(1)
+	}
 
-	r.Run()
-	r.ListenAndServe()
+	err = r.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		logger.Error("Unable to start listeners", "error", err)
+		os.Exit(1)
+	}
+
+	// wait for requests in progress to complete
+	<-stopped
 }
 
-func handleSigTerm(r *router.Router) {
+// setIdentity loads the pre-provisioned Connect certificates
+func setIdentity(r *router.Router) error {
+	ca, err := ioutil.ReadFile(*connectCAFile)
+	if err != nil {
+		return err
+	}
+
+	cert, err := ioutil.ReadFile(*connectCertFile)
+	if err != nil {
+		return err
+	}
+
+	key, err := ioutil.ReadFile(*connectKeyFile)
+	if err != nil {
+		return err
+	}
+
+	return r.SetIdentity(ca, cert, key)
+}
+
+// handleSigTerm stops the router when SIGINT or SIGTERM is received, the
+// returned channel is closed once the router has stopped
+func handleSigTerm(r *router.Router) <-chan struct{} {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
+	stopped := make(chan struct{})
+
 	go func() {
+		defer close(stopped)
+
 		sig := <-sigs
 		logger.Info("Received termination signal, shutting down", "signal", sig)
 
-		ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
 		r.Stop(ctx)
 	}()
+
+	return stopped
 }
@@ -0,0 +1,275 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errConcurrencyLimit is returned when a request can not be admitted because
+// both the in flight requests and the wait queue are full
+var errConcurrencyLimit = errors.New("Concurrency limit exceeded")
+
+// ConcurrencyLimit defines the maximum number of requests which can be in
+// flight to an upstream service at any one time
+type ConcurrencyLimit struct {
+	// MaxInFlight is the maximum number of concurrent requests, in adaptive
+	// mode this is the upper bound for the limit
+	MaxInFlight int
+	// MaxQueue is the number of requests which can wait for a slot
+	MaxQueue int
+	// QueueTimeout is the maximum time a request waits in the queue
+	QueueTimeout time.Duration
+	// Adaptive adjusts the limit based on the observed latency
+	Adaptive bool
+	// LatencyTarget is the latency above which the adaptive limit is
+	// reduced, when 0 the target is derived from the average latency
+	LatencyTarget time.Duration
+
+	limiter concurrencyLimiter
+}
+
+type concurrencyLimiter interface {
+	// Acquire blocks until a slot is available or returns an error when the
+	// queue is full, the queue timeout has elapsed or the context is done
+	Acquire(ctx context.Context) error
+	// Release returns the slot along with the outcome of the request
+	Release(latency time.Duration, failed bool)
+}
+
+// NewConcurrencyLimit creates a concurrency limit for an upstream, when the
+// queue timeout is 0 queued requests wait for up to a second
+func NewConcurrencyLimit(maxInFlight, maxQueue int, queueTimeout time.Duration, adaptive bool, latencyTarget time.Duration) *ConcurrencyLimit {
+	if queueTimeout == 0 {
+		queueTimeout = time.Second
+	}
+
+	cl := &ConcurrencyLimit{
+		MaxInFlight:   maxInFlight,
+		MaxQueue:      maxQueue,
+		QueueTimeout:  queueTimeout,
+		Adaptive:      adaptive,
+		LatencyTarget: latencyTarget,
+	}
+
+	if adaptive {
+		cl.limiter = newAIMDLimiter(maxInFlight, maxQueue, queueTimeout, latencyTarget)
+	} else {
+		cl.limiter = newStaticLimiter(maxInFlight, maxQueue, queueTimeout)
+	}
+
+	return cl
+}
+
+// sameSettings returns true when the limits have the same settings
+func (c *ConcurrencyLimit) sameSettings(o *ConcurrencyLimit) bool {
+	return c.MaxInFlight == o.MaxInFlight &&
+		c.MaxQueue == o.MaxQueue &&
+		c.QueueTimeout == o.QueueTimeout &&
+		c.Adaptive == o.Adaptive &&
+		c.LatencyTarget == o.LatencyTarget
+}
+
+// Acquire a slot for a request, requests which are cancelled while waiting
+// leave the queue
+func (c *ConcurrencyLimit) Acquire(ctx context.Context) error {
+	return c.limiter.Acquire(ctx)
+}
+
+// Release a slot acquired with Acquire
+func (c *ConcurrencyLimit) Release(latency time.Duration, failed bool) {
+	c.limiter.Release(latency, failed)
+}
+
+// acquireConcurrency acquires a slot for the upstream, when the limit has
+// been reached a 503 is written to the response and false is returned
+func (r *Router) acquireConcurrency(us *Upstream, rw http.ResponseWriter, req *http.Request) bool {
+	if us.ConcurrencyLimit == nil {
+		return true
+	}
+
+	if err := us.ConcurrencyLimit.Acquire(req.Context()); err != nil {
+		r.logger.Info("Concurrency limit exceeded", "upstream", us.Service)
+		http.Error(rw, "Upstream concurrency limit exceeded", http.StatusServiceUnavailable)
+		return false
+	}
+
+	return true
+}
+
+// staticLimiter uses a buffered channel as a semaphore to enforce a fixed
+// number of concurrent requests, admitted counts the requests which are
+// waiting or in flight so that the queue is bounded
+type staticLimiter struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+	admitted     int32
+	capacity     int32
+}
+
+func newStaticLimiter(maxInFlight, maxQueue int, queueTimeout time.Duration) *staticLimiter {
+	return &staticLimiter{
+		slots:        make(chan struct{}, maxInFlight),
+		queueTimeout: queueTimeout,
+		capacity:     int32(maxInFlight + maxQueue),
+	}
+}
+
+func (s *staticLimiter) Acquire(ctx context.Context) error {
+	if atomic.AddInt32(&s.admitted, 1) > s.capacity {
+		atomic.AddInt32(&s.admitted, -1)
+		return errConcurrencyLimit
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	t := time.NewTimer(s.queueTimeout)
+	defer t.Stop()
+
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-t.C:
+	case <-ctx.Done():
+	}
+
+	atomic.AddInt32(&s.admitted, -1)
+	return errConcurrencyLimit
+}
+
+func (s *staticLimiter) Release(latency time.Duration, failed bool) {
+	<-s.slots
+	atomic.AddInt32(&s.admitted, -1)
+}
+
+// aimdLimiter adjusts the concurrency limit using additive increase,
+// multiplicative decrease. Every successful request under the latency target
+// grows the limit by 1/limit, so the limit grows by roughly one per round
+// trip, a slow or failed request reduces the limit by the backoff ratio.
+type aimdLimiter struct {
+	mu           sync.Mutex
+	limit        float64
+	minLimit     float64
+	maxLimit     float64
+	backoff      float64
+	inFlight     int
+	maxQueue     int
+	queueTimeout time.Duration
+	waiters      []chan struct{}
+	target       time.Duration
+	average      float64
+}
+
+func newAIMDLimiter(maxInFlight, maxQueue int, queueTimeout, target time.Duration) *aimdLimiter {
+	return &aimdLimiter{
+		limit:        float64(maxInFlight),
+		minLimit:     1,
+		maxLimit:     float64(maxInFlight),
+		backoff:      0.9,
+		maxQueue:     maxQueue,
+		queueTimeout: queueTimeout,
+		target:       target,
+	}
+}
+
+func (a *aimdLimiter) Acquire(ctx context.Context) error {
+	a.mu.Lock()
+
+	if a.inFlight < int(a.limit) && len(a.waiters) == 0 {
+		a.inFlight++
+		a.mu.Unlock()
+		return nil
+	}
+
+	if len(a.waiters) >= a.maxQueue {
+		a.mu.Unlock()
+		return errConcurrencyLimit
+	}
+
+	ch := make(chan struct{})
+	a.waiters = append(a.waiters, ch)
+	a.mu.Unlock()
+
+	t := time.NewTimer(a.queueTimeout)
+	defer t.Stop()
+
+	select {
+	case <-ch:
+		return nil
+	case <-t.C:
+	case <-ctx.Done():
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for i, w := range a.waiters {
+		if w == ch {
+			a.waiters = append(a.waiters[:i], a.waiters[i+1:]...)
+			return errConcurrencyLimit
+		}
+	}
+
+	// the slot was handed over while the timeout fired or the request was
+	// cancelled, it is returned when the request is cancelled
+	if ctx.Err() != nil {
+		a.inFlight--
+		a.handOver()
+		return errConcurrencyLimit
+	}
+
+	return nil
+}
+
+func (a *aimdLimiter) Release(latency time.Duration, failed bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.inFlight--
+
+	target := a.target
+	if target == 0 && a.average > 0 {
+		target = time.Duration(2 * a.average)
+	}
+
+	if failed || (target > 0 && latency > target) {
+		a.limit = math.Max(a.minLimit, a.limit*a.backoff)
+	} else {
+		a.limit = math.Min(a.maxLimit, a.limit+1/a.limit)
+	}
+
+	// exponentially weighted moving average of the latency
+	if a.average == 0 {
+		a.average = float64(latency)
+	} else {
+		a.average = 0.9*a.average + 0.1*float64(latency)
+	}
+
+	a.handOver()
+}
+
+// handOver hands free slots to the waiting requests in order, the lock must
+// be held
+func (a *aimdLimiter) handOver() {
+	for len(a.waiters) > 0 && a.inFlight < int(a.limit) {
+		a.inFlight++
+		close(a.waiters[0])
+		a.waiters = a.waiters[1:]
+	}
+}
+
+// Limit returns the current concurrency limit
+func (a *aimdLimiter) Limit() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return int(a.limit)
+}
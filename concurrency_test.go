@@ -0,0 +1,130 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticLimiterRejectsWhenInFlightAndQueueFull(t *testing.T) {
+	cl := NewConcurrencyLimit(1, 1, 50*time.Millisecond, false, 0)
+
+	assert.NoError(t, cl.Acquire(context.Background()))
+
+	// the second request waits in the queue and times out
+	done := make(chan error)
+	go func() { done <- cl.Acquire(context.Background()) }()
+	time.Sleep(10 * time.Millisecond)
+
+	// the third request is rejected immediately as the queue is full
+	start := time.Now()
+	assert.Equal(t, errConcurrencyLimit, cl.Acquire(context.Background()))
+	assert.True(t, time.Since(start) < 20*time.Millisecond, "Should have rejected without waiting")
+
+	assert.Equal(t, errConcurrencyLimit, <-done)
+}
+
+func TestStaticLimiterAdmitsQueuedRequestOnRelease(t *testing.T) {
+	cl := NewConcurrencyLimit(1, 1, time.Second, false, 0)
+	cl.Acquire(context.Background())
+
+	done := make(chan error)
+	go func() { done <- cl.Acquire(context.Background()) }()
+	time.Sleep(10 * time.Millisecond)
+
+	cl.Release(time.Millisecond, false)
+
+	assert.NoError(t, <-done)
+}
+
+func TestAIMDLimiterReducesLimitOnSlowRequests(t *testing.T) {
+	cl := NewConcurrencyLimit(10, 0, 0, true, 100*time.Millisecond)
+	l := cl.limiter.(*aimdLimiter)
+
+	cl.Acquire(context.Background())
+	cl.Release(time.Second, false)
+
+	assert.Equal(t, 9, l.Limit())
+
+	cl.Acquire(context.Background())
+	cl.Release(time.Millisecond, true)
+
+	assert.Equal(t, 8, l.Limit())
+}
+
+func TestAIMDLimiterIncreasesLimitOnFastRequests(t *testing.T) {
+	cl := NewConcurrencyLimit(10, 0, 0, true, 100*time.Millisecond)
+	l := cl.limiter.(*aimdLimiter)
+	l.limit = 2
+
+	for i := 0; i < 4; i++ {
+		cl.Acquire(context.Background())
+		cl.Release(time.Millisecond, false)
+	}
+
+	assert.Equal(t, 3, l.Limit())
+}
+
+func TestAIMDLimiterRejectsAboveLimit(t *testing.T) {
+	cl := NewConcurrencyLimit(2, 0, 0, true, 0)
+
+	assert.NoError(t, cl.Acquire(context.Background()))
+	assert.NoError(t, cl.Acquire(context.Background()))
+	assert.Equal(t, errConcurrencyLimit, cl.Acquire(context.Background()))
+}
+
+func TestHandlerReturnsServiceUnavailableWhenConcurrencyLimitReached(t *testing.T) {
+	rec := setupRouterTests(t)
+	cl := NewConcurrencyLimit(1, 0, 0, false, 0)
+	cl.Acquire(context.Background())
+	rec.upstreams = append(rec.upstreams, Upstream{Service: "test", Path: "/test", ConcurrencyLimit: cl})
+	rw := httptest.NewRecorder()
+
+	rec.Handler(rw, httptest.NewRequest("GET", "/test", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	mockHTTPClient.AssertNotCalled(t, "Do")
+}
+
+func TestHandlerReleasesConcurrencyLimit(t *testing.T) {
+	rec := setupRouterTests(t)
+	cl := NewConcurrencyLimit(1, 0, 0, false, 0)
+	rec.upstreams = append(rec.upstreams, Upstream{Service: "test", Path: "/test", ConcurrencyLimit: cl})
+
+	rec.Handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+
+	assert.NoError(t, cl.Acquire(context.Background()), "Should have released the slot")
+}
+
+func TestLimitersRemoveCancelledRequestsFromQueue(t *testing.T) {
+	for _, adaptive := range []bool{false, true} {
+		cl := NewConcurrencyLimit(1, 1, time.Minute, adaptive, 0)
+		assert.NoError(t, cl.Acquire(context.Background()))
+
+		// the client disconnects while the request is queued
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- cl.Acquire(ctx) }()
+		time.Sleep(10 * time.Millisecond)
+
+		cancel()
+
+		select {
+		case err := <-done:
+			assert.Equal(t, errConcurrencyLimit, err)
+		case <-time.After(time.Second):
+			t.Fatal("Should stop waiting when the request is cancelled")
+		}
+
+		// the queue slot is free for the next request
+		go func() { done <- cl.Acquire(context.Background()) }()
+		time.Sleep(10 * time.Millisecond)
+		cl.Release(time.Millisecond, false)
+
+		assert.NoError(t, <-done)
+	}
+}
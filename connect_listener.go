@@ -0,0 +1,143 @@
+package router
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	connectid "github.com/hashicorp/consul/agent/connect"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/connect"
+)
+
+// connContextKey is the key for the connection a request was received on
+const connContextKey contextKey = "conn"
+
+// connectSourceContextKey is the key for the calling Connect service
+const connectSourceContextKey contextKey = "connect_source"
+
+// SetConnectListener enables a listener which accepts mTLS connections from
+// services in the mesh, the router is registered as a Connect native service
+// on the listener port. Callers are routed using the same upstreams as the
+// HTTP listener.
+func (r *Router) SetConnectListener(bindAddress string) error {
+	_, port, err := net.SplitHostPort(bindAddress)
+	if err != nil {
+		return fmt.Errorf("Invalid Connect listen address: %s", err)
+	}
+
+	if _, err := strconv.Atoi(port); err != nil {
+		return fmt.Errorf("Invalid Connect listen port: %s", port)
+	}
+
+	r.connectBindAddress = bindAddress
+
+	return nil
+}
+
+// registration returns the Consul service registration for the router
+func (r *Router) registration() *api.AgentServiceRegistration {
+	asr := &api.AgentServiceRegistration{Name: "connect-router"}
+
+	if r.connectBindAddress != "" {
+		host, port, _ := net.SplitHostPort(r.connectBindAddress)
+		asr.Port, _ = strconv.Atoi(port)
+		asr.Connect = &api.AgentServiceConnect{Native: true}
+
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			asr.Address = host
+		}
+	}
+
+	return asr
+}
+
+// newConnectServer creates the server for the Connect listener, it is
+// created before the listener is started so Stop can always shut it down
+func (r *Router) newConnectServer(tc *tls.Config) *http.Server {
+	return &http.Server{
+		Handler:   http.HandlerFunc(r.Handler),
+		TLSConfig: tc,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey, c)
+		},
+	}
+}
+
+// listenAndServeConnect starts the Connect listener, the handshake verifies
+// the caller is allowed to connect to the router
+func (r *Router) listenAndServeConnect(s *http.Server) error {
+	l, err := net.Listen("tcp", r.connectBindAddress)
+	if err != nil {
+		return err
+	}
+
+	return r.serveConnect(s, l)
+}
+
+// serveConnect serves requests from mesh services on the listener
+func (r *Router) serveConnect(s *http.Server, l net.Listener) error {
+	return s.Serve(tls.NewListener(l, s.TLSConfig))
+}
+
+// authorizeConnect identifies callers on the Connect listener using the
+// SPIFFE ID in their certificate and checks the intention from the caller to
+// the upstream service. The caller becomes the principal for the request.
+// Requests from other listeners are not modified.
+func (r *Router) authorizeConnect(rw http.ResponseWriter, req *http.Request, us *Upstream) (*http.Request, bool) {
+	conn, ok := req.Context().Value(connContextKey).(net.Conn)
+	if !ok {
+		return req, true
+	}
+
+	uri, err := connect.CertURIFromConn(conn)
+	if err != nil {
+		r.logger.Info("Unable to identify Connect caller", "error", err)
+		http.Error(rw, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+
+	id, ok := uri.(*connectid.SpiffeIDService)
+	if !ok {
+		r.logger.Info("Connect caller is not a service", "uri", uri.URI().String())
+		http.Error(rw, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+
+	if r.intentions == nil {
+		r.logger.Error("Intention checks have not been configured", "upstream", us.Service)
+		http.Error(rw, "Authorization not configured", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	allowed, err := r.intentions.AllowedService(id.Service, us.Service)
+	if err != nil {
+		r.logger.Error("Unable to check intentions", "source", id.Service, "destination", us.Service, "error", err)
+	}
+
+	if !allowed {
+		r.logger.Info("Request denied by intentions", "source", id.Service, "destination", us.Service)
+		http.Error(rw, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+
+	header := us.PrincipalHeader
+	if header == "" {
+		header = DefaultPrincipalHeader
+	}
+	req.Header.Set(header, id.Service)
+
+	ctx := context.WithValue(contextWithPrincipal(req, id.Service), connectSourceContextKey, id.Service)
+
+	return req.WithContext(ctx), true
+}
+
+// connectSource returns the calling service for requests received on the
+// Connect listener
+func connectSource(req *http.Request) string {
+	s, _ := req.Context().Value(connectSourceContextKey).(string)
+	return s
+}
@@ -0,0 +1,113 @@
+package router
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRunRegistersConnectNativeService(t *testing.T) {
+	var registerParams *api.AgentServiceRegistration
+
+	r := setupRouterTests(t)
+	r.registerService = func(asr *api.AgentServiceRegistration) {
+		registerParams = asr
+	}
+	r.connectServiceFactory = func(name string) (ConnectService, error) {
+		return mockConnectService, nil
+	}
+
+	assert.Error(t, r.SetConnectListener("9443"))
+	assert.NoError(t, r.SetConnectListener("10.0.0.1:9443"))
+
+	err := r.Run()
+
+	assert.NoError(t, err)
+	assert.Equal(t, 9443, registerParams.Port)
+	assert.Equal(t, "10.0.0.1", registerParams.Address)
+	assert.True(t, registerParams.Connect.Native)
+}
+
+// setupConnectListener serves the router on a listener which verifies
+// clients in the same way as a Connect service, the returned func creates a
+// client for the given SPIFFE ID
+func setupConnectListener(t *testing.T) (*Router, string, func(spiffe string) *http.Client) {
+	ca := newTestCA(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	rec := setupRouterTests(t)
+	rec.intentions, _, _ = setupIntentions(t, IntentionConfig{SourcePrefix: "external-"}, map[string]bool{"web/api": true})
+	rec.upstreams = Upstreams{
+		{Service: "api", Path: "/api", Intentions: true},
+		{Service: "billing", Path: "/billing"},
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	srv := rec.newConnectServer(&tls.Config{
+		Certificates: []tls.Certificate{testKeyPair(t, "connect-router")},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	go rec.serveConnect(srv, l)
+
+	client := func(spiffe string) *http.Client {
+		tmpl := &x509.Certificate{Subject: pkix.Name{CommonName: "client"}}
+		if spiffe != "" {
+			u, _ := url.Parse(spiffe)
+			tmpl.URIs = []*url.URL{u}
+		}
+
+		cert, key := ca.issue(t, tmpl)
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}},
+		}}}
+	}
+
+	return rec, "https://" + l.Addr().String(), client
+}
+
+func TestConnectListenerRoutesAuthorizedServices(t *testing.T) {
+	_, addr, client := setupConnectListener(t)
+	web := client("spiffe://11111111-2222-3333-4444-555555555555.consul/ns/default/dc/dc1/svc/web")
+
+	resp, err := web.Get(addr + "/api")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	mockHTTPClient.AssertCalled(t, "Do", mock.Anything)
+	req := mockHTTPClient.Calls[0].Arguments.Get(0).(*http.Request)
+	assert.Equal(t, "web", req.Header.Get(DefaultPrincipalHeader))
+
+	resp, err = web.Get(addr + "/billing")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "Should have been denied by intentions")
+}
+
+func TestConnectListenerRejectsCallersWithoutServiceIdentity(t *testing.T) {
+	_, addr, client := setupConnectListener(t)
+
+	resp, err := client("").Get(addr + "/api")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, err = client("spiffe://11111111-2222-3333-4444-555555555555.consul").Get(addr + "/api")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	mockHTTPClient.AssertNotCalled(t, "Do", mock.Anything)
+}
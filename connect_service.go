@@ -1,8 +1,11 @@
 package router
 
 import (
+	"context"
+	"crypto/tls"
 	"net"
 
+	"github.com/hashicorp/consul/connect"
 	"github.com/stretchr/testify/mock"
 )
 
@@ -11,6 +14,8 @@ type ConnectService interface {
 	Close() error
 	ReadyWait() <-chan struct{}
 	HTTPDialTLS(network, addr string) (net.Conn, error)
+	ServerTLSConfig() *tls.Config
+	Dial(ctx context.Context, resolver connect.Resolver) (net.Conn, error)
 }
 
 type MockConnectService struct {
@@ -34,3 +39,19 @@ func (m *MockConnectService) HTTPDialTLS(network, addr string) (net.Conn, error)
 
 	return args.Get(0).(net.Conn), args.Error(1)
 }
+
+func (m *MockConnectService) ServerTLSConfig() *tls.Config {
+	args := m.Called()
+
+	return args.Get(0).(*tls.Config)
+}
+
+func (m *MockConnectService) Dial(ctx context.Context, resolver connect.Resolver) (net.Conn, error) {
+	args := m.Called(ctx, resolver)
+
+	if c, ok := args.Get(0).(net.Conn); ok {
+		return c, args.Error(1)
+	}
+
+	return nil, args.Error(1)
+}
@@ -0,0 +1,348 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// consulStub is a minimal in memory implementation of the Consul HTTP API
+// used to test features which interact with Consul, additional endpoints can
+// be added to the mux by individual tests
+type consulStub struct {
+	mux      *http.ServeMux
+	server   *httptest.Server
+	mu       sync.Mutex
+	index    uint64
+	changed  chan struct{}
+	kv       map[string]*api.KVPair
+	sessions map[string]*api.SessionEntry
+}
+
+func newConsulStub(t *testing.T) (*consulStub, *api.Client) {
+	s := &consulStub{
+		mux:      http.NewServeMux(),
+		index:    1,
+		changed:  make(chan struct{}),
+		kv:       map[string]*api.KVPair{},
+		sessions: map[string]*api.SessionEntry{},
+	}
+
+	s.mux.HandleFunc("/v1/kv/", s.handleKV)
+	s.mux.HandleFunc("/v1/txn", s.handleTxn)
+	s.mux.HandleFunc("/v1/session/create", s.handleSessionCreate)
+	s.mux.HandleFunc("/v1/session/renew/", s.handleSessionRenew)
+	s.mux.HandleFunc("/v1/session/destroy/", s.handleSessionDestroy)
+
+	s.server = httptest.NewServer(s.mux)
+
+	conf := api.DefaultConfig()
+	conf.Address = s.server.URL
+
+	c, err := api.NewClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, c
+}
+
+// waitFor polls the condition until it is true or fails the test after two
+// seconds, used when waiting for watches to observe changes to the stub
+func waitFor(t *testing.T, cond func() bool, msg string) {
+	timeout := time.After(2 * time.Second)
+
+	for !cond() {
+		select {
+		case <-timeout:
+			t.Fatal(msg)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (s *consulStub) Close() {
+	s.server.Close()
+}
+
+// bump increments the raft index and wakes any blocking queries, the lock
+// must be held
+func (s *consulStub) bump() uint64 {
+	s.index++
+	close(s.changed)
+	s.changed = make(chan struct{})
+
+	return s.index
+}
+
+// Put sets a key directly in the stub
+func (s *consulStub) Put(key string, value []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx := s.bump()
+	p, ok := s.kv[key]
+	if !ok {
+		p = &api.KVPair{Key: key, CreateIndex: idx}
+		s.kv[key] = p
+	}
+	p.Value = value
+	p.ModifyIndex = idx
+}
+
+// Delete removes a key directly from the stub
+func (s *consulStub) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.kv, key)
+	s.bump()
+}
+
+// wait blocks until the index has moved past the index in the query or the
+// wait time has elapsed, the lock is held when wait returns
+func (s *consulStub) wait(r *http.Request) {
+	s.mu.Lock()
+
+	idx, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	if idx == 0 || idx < s.index {
+		return
+	}
+
+	wait, err := time.ParseDuration(r.URL.Query().Get("wait"))
+	if err != nil || wait == 0 {
+		wait = 5 * time.Second
+	}
+
+	timeout := time.After(wait)
+	for idx >= s.index {
+		ch := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-ch:
+		case <-timeout:
+			s.mu.Lock()
+			return
+		case <-r.Context().Done():
+			s.mu.Lock()
+			return
+		}
+
+		s.mu.Lock()
+	}
+}
+
+// WriteJSON writes a JSON response with the current index
+func (s *consulStub) writeJSON(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("X-Consul-Index", strconv.FormatUint(s.index, 10))
+	rw.Header().Set("X-Consul-KnownLeader", "true")
+	json.NewEncoder(rw).Encode(v)
+}
+
+func (s *consulStub) handleKV(rw http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	q := r.URL.Query()
+
+	if r.Method == http.MethodGet {
+		s.wait(r)
+		defer s.mu.Unlock()
+
+		_, recurse := q["recurse"]
+		_, keys := q["keys"]
+
+		pairs := api.KVPairs{}
+		for k, p := range s.kv {
+			if k == key || (recurse || keys) && strings.HasPrefix(k, key) {
+				pairs = append(pairs, p)
+			}
+		}
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+
+		if keys {
+			names := []string{}
+			for _, p := range pairs {
+				names = append(names, p.Key)
+			}
+			s.writeJSON(rw, names)
+			return
+		}
+
+		if len(pairs) == 0 {
+			rw.Header().Set("X-Consul-Index", strconv.FormatUint(s.index, 10))
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		s.writeJSON(rw, pairs)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing := s.kv[key]
+
+	if _, ok := q["cas"]; ok {
+		cas, _ := strconv.ParseUint(q.Get("cas"), 10, 64)
+		if (cas == 0 && existing != nil) || (cas != 0 && (existing == nil || existing.ModifyIndex != cas)) {
+			s.writeJSON(rw, false)
+			return
+		}
+	}
+
+	if r.Method == http.MethodDelete {
+		_, recurse := q["recurse"]
+		for k := range s.kv {
+			if k == key || recurse && strings.HasPrefix(k, key) {
+				delete(s.kv, k)
+			}
+		}
+		s.bump()
+		s.writeJSON(rw, true)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+
+	session := ""
+	if existing != nil {
+		session = existing.Session
+	}
+
+	if id := q.Get("acquire"); id != "" {
+		if _, ok := s.sessions[id]; !ok || (session != "" && session != id) {
+			s.writeJSON(rw, false)
+			return
+		}
+		session = id
+	}
+
+	if id := q.Get("release"); id != "" {
+		if session != id {
+			s.writeJSON(rw, false)
+			return
+		}
+		session = ""
+	}
+
+	idx := s.bump()
+	p := &api.KVPair{Key: key, CreateIndex: idx}
+	if existing != nil {
+		p.CreateIndex = existing.CreateIndex
+		p.LockIndex = existing.LockIndex
+	}
+	if q.Get("acquire") != "" {
+		p.LockIndex++
+	}
+	p.ModifyIndex = idx
+	p.Session = session
+	p.Value = body
+	p.Flags, _ = strconv.ParseUint(q.Get("flags"), 10, 64)
+	s.kv[key] = p
+
+	s.writeJSON(rw, true)
+}
+
+// handleTxn applies set operations atomically, other verbs are not supported
+func (s *consulStub) handleTxn(rw http.ResponseWriter, r *http.Request) {
+	ops := api.TxnOps{}
+	json.NewDecoder(r.Body).Decode(&ops)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx := s.bump()
+	results := []*api.TxnResult{}
+	for _, op := range ops {
+		if op.KV == nil || op.KV.Verb != api.KVSet {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		p := &api.KVPair{Key: op.KV.Key, CreateIndex: idx}
+		if existing, ok := s.kv[op.KV.Key]; ok {
+			p.CreateIndex = existing.CreateIndex
+		}
+		p.ModifyIndex = idx
+		p.Value = op.KV.Value
+		p.Flags = op.KV.Flags
+		s.kv[op.KV.Key] = p
+
+		results = append(results, &api.TxnResult{KV: p})
+	}
+
+	s.writeJSON(rw, api.TxnResponse{Results: results})
+}
+
+func (s *consulStub) handleSessionCreate(rw http.ResponseWriter, r *http.Request) {
+	se := &api.SessionEntry{}
+	json.NewDecoder(r.Body).Decode(se)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	se.ID = fmt.Sprintf("session-%d", s.bump())
+	s.sessions[se.ID] = se
+
+	s.writeJSON(rw, map[string]string{"ID": se.ID})
+}
+
+func (s *consulStub) handleSessionRenew(rw http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/session/renew/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	se, ok := s.sessions[id]
+	if !ok {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	s.writeJSON(rw, []*api.SessionEntry{se})
+}
+
+func (s *consulStub) handleSessionDestroy(rw http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/session/destroy/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.destroySession(id)
+	s.writeJSON(rw, true)
+}
+
+// destroySession invalidates the session, deleting or releasing any held
+// locks, the lock must be held
+func (s *consulStub) destroySession(id string) {
+	se, ok := s.sessions[id]
+	if !ok {
+		return
+	}
+
+	delete(s.sessions, id)
+	for k, p := range s.kv {
+		if p.Session != id {
+			continue
+		}
+
+		if se.Behavior == api.SessionBehaviorDelete {
+			delete(s.kv, k)
+		} else {
+			p.Session = ""
+		}
+	}
+
+	s.bump()
+}
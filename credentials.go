@@ -0,0 +1,357 @@
+package router
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	log "github.com/hashicorp/go-hclog"
+	lru "github.com/hashicorp/golang-lru"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var errInvalidCredentials = errors.New("Invalid credentials")
+
+var errTooManyAttempts = errors.New("Too many failed attempts")
+
+const (
+	// credentialFailureRate is the number of failed attempts allowed for a
+	// client every second once its burst has been used
+	credentialFailureRate = 0.2
+	// credentialFailureBurst is the number of failed attempts a client can
+	// make in a burst
+	credentialFailureBurst = 10
+	// credentialFailureTTL is how long a failed secret is remembered so
+	// repeating it is rejected without hashing
+	credentialFailureTTL = 30 * time.Second
+	// credentialFailureCacheSize is the number of failed secrets remembered
+	credentialFailureCacheSize = 10000
+)
+
+// Credential is a hashed API key or password stored in Consul KV as JSON,
+// API keys are stored at [prefix]/api_keys/[key id] and Basic credentials at
+// [prefix]/basic/[username]
+type Credential struct {
+	// Principal is the identity forwarded to the upstream, when empty the
+	// key id or username is used
+	Principal string `json:"principal"`
+	// Hash is a bcrypt or argon2id (PHC string format) hash of the secret
+	Hash string `json:"hash"`
+}
+
+// CredentialStore holds API keys and Basic credentials loaded from Consul KV,
+// the prefix is watched with blocking queries so credentials can be added or
+// revoked without restarting the router
+type CredentialStore struct {
+	client *api.Client
+	prefix string
+	logger log.Logger
+	cancel context.CancelFunc
+
+	mu          sync.RWMutex
+	apiKeys     map[string]Credential
+	basic       map[string]Credential
+	index       uint64
+	verified    map[[32]byte]string
+	waitTimeout time.Duration
+
+	// failed holds the expiry of recently failed secrets and limiter the
+	// failed attempts of each client, both are checked before hashing so
+	// bad credentials can not be used to exhaust the CPU
+	failed  *lru.Cache
+	limiter *failureLimiter
+}
+
+// NewCredentialStore loads the credentials at the prefix and starts watching
+// for changes
+func NewCredentialStore(c *api.Client, prefix string, l log.Logger) (*CredentialStore, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// the size is always positive so New can not fail
+	failed, _ := lru.New(credentialFailureCacheSize)
+
+	s := &CredentialStore{
+		client:      c,
+		prefix:      strings.TrimSuffix(prefix, "/"),
+		logger:      l,
+		cancel:      cancel,
+		apiKeys:     map[string]Credential{},
+		basic:       map[string]Credential{},
+		verified:    map[[32]byte]string{},
+		waitTimeout: 5 * time.Minute,
+		failed:      failed,
+		limiter:     newFailureLimiter(credentialFailureRate, credentialFailureBurst),
+	}
+
+	err := s.load(ctx)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("Unable to load credentials: %s", err)
+	}
+
+	go s.watch(ctx)
+
+	return s, nil
+}
+
+// Close stops watching for changes
+func (s *CredentialStore) Close() {
+	s.cancel()
+}
+
+// VerifyAPIKey checks an API key in the form [key id].[secret] returning the
+// principal for the key, client identifies the caller for limiting failed
+// attempts
+func (s *CredentialStore) VerifyAPIKey(client, key string) (string, error) {
+	parts := strings.SplitN(key, ".", 2)
+	if len(parts) != 2 {
+		return "", errInvalidCredentials
+	}
+
+	return s.verify(client, "api_keys", parts[0], parts[1])
+}
+
+// VerifyBasic checks a username and password returning the principal,
+// client identifies the caller for limiting failed attempts
+func (s *CredentialStore) VerifyBasic(client, username, password string) (string, error) {
+	return s.verify(client, "basic", username, password)
+}
+
+// verify checks the secret against the stored hash, successful checks are
+// cached until the credentials change as hashing is deliberately slow.
+// Failed secrets are remembered briefly and every hash takes one of the
+// client's failed attempts, which is returned when the check succeeds.
+func (s *CredentialStore) verify(client, kind, id, secret string) (string, error) {
+	cacheKey := sha256.Sum256([]byte(kind + "\x00" + id + "\x00" + secret))
+
+	s.mu.RLock()
+	principal, cached := s.verified[cacheKey]
+	creds := s.apiKeys
+	if kind == "basic" {
+		creds = s.basic
+	}
+	c, ok := creds[id]
+	index := s.index
+	s.mu.RUnlock()
+
+	if cached {
+		return principal, nil
+	}
+
+	if !ok {
+		return "", errInvalidCredentials
+	}
+
+	if v, failed := s.failed.Get(cacheKey); failed && time.Now().Before(v.(time.Time)) {
+		return "", errInvalidCredentials
+	}
+
+	if !s.limiter.take(client) {
+		return "", errTooManyAttempts
+	}
+
+	if !checkHash(c.Hash, secret) {
+		s.mu.RLock()
+		if index == s.index {
+			s.failed.Add(cacheKey, time.Now().Add(credentialFailureTTL))
+		}
+		s.mu.RUnlock()
+
+		return "", errInvalidCredentials
+	}
+
+	s.limiter.refund(client)
+
+	principal = c.Principal
+	if principal == "" {
+		principal = id
+	}
+
+	s.mu.Lock()
+	// only cache if the credentials have not changed during the check
+	if index == s.index {
+		s.verified[cacheKey] = principal
+	}
+	s.mu.Unlock()
+
+	return principal, nil
+}
+
+// load fetches all credentials under the prefix, blocking until the index
+// changes when an index has previously been loaded
+func (s *CredentialStore) load(ctx context.Context) error {
+	s.mu.RLock()
+	q := &api.QueryOptions{WaitIndex: s.index, WaitTime: s.waitTimeout}
+	s.mu.RUnlock()
+
+	pairs, meta, err := s.client.KV().List(s.prefix+"/", q.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	unchanged := meta.LastIndex == s.index
+	s.mu.RUnlock()
+
+	if unchanged {
+		return nil
+	}
+
+	apiKeys := map[string]Credential{}
+	basic := map[string]Credential{}
+
+	for _, p := range pairs {
+		c := Credential{}
+		if err := json.Unmarshal(p.Value, &c); err != nil {
+			s.logger.Error("Unable to parse credential", "key", p.Key, "error", err)
+			continue
+		}
+
+		dir, id := path.Split(strings.TrimPrefix(p.Key, s.prefix+"/"))
+		switch dir {
+		case "api_keys/":
+			apiKeys[id] = c
+		case "basic/":
+			basic[id] = c
+		}
+	}
+
+	s.mu.Lock()
+	s.apiKeys = apiKeys
+	s.basic = basic
+	s.index = meta.LastIndex
+	s.verified = map[[32]byte]string{}
+	s.failed.Purge()
+	s.mu.Unlock()
+
+	s.logger.Debug("Loaded credentials", "api_keys", len(apiKeys), "basic", len(basic))
+
+	return nil
+}
+
+// watch reloads the credentials whenever the prefix changes
+func (s *CredentialStore) watch(ctx context.Context) {
+	for {
+		err := s.load(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		if err != nil {
+			s.logger.Error("Unable to watch credentials", "error", err)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// failureLimiter is a token bucket per client limiting the number of
+// credential checks which can fail
+type failureLimiter struct {
+	rate  float64
+	burst int
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	takes   int
+}
+
+func newFailureLimiter(rate float64, burst int) *failureLimiter {
+	return &failureLimiter{
+		rate:    rate,
+		burst:   burst,
+		now:     time.Now,
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// take removes a token from the client's bucket, false is returned when the
+// client has no failed attempts left
+func (l *failureLimiter) take(client string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	// periodically remove buckets which have refilled, they are identical
+	// to a new bucket
+	l.takes++
+	if l.takes%1000 == 0 {
+		refill := time.Duration(float64(l.burst) / l.rate * float64(time.Second))
+		for k, b := range l.buckets {
+			if now.Sub(b.Last) > refill {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{}
+		l.buckets[client] = b
+	}
+
+	return b.take(now, l.rate, l.burst).Allowed
+}
+
+// refund returns the token taken for a check which succeeded
+func (l *failureLimiter) refund(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if b, ok := l.buckets[client]; ok && b.Tokens < float64(l.burst) {
+		b.Tokens++
+	}
+}
+
+// checkHash compares a secret with a bcrypt or argon2id hash
+func checkHash(hash, secret string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return checkArgon2(hash, secret)
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret)) == nil
+}
+
+// checkArgon2 compares a secret with an argon2id hash in the PHC string
+// format $argon2id$v=19$m=65536,t=3,p=2$[salt]$[hash]
+func checkArgon2(hash, secret string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false
+	}
+
+	var memory, iterations uint32
+	var threads uint8
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads)
+	if err != nil {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+
+	expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+
+	actual := argon2.IDKey([]byte(secret), salt, iterations, memory, threads, uint32(len(expected)))
+
+	return subtle.ConstantTimeCompare(expected, actual) == 1
+}
@@ -0,0 +1,267 @@
+package router
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	log "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func putCredential(t *testing.T, stub *consulStub, key string, c Credential) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stub.Put(key, data)
+}
+
+func bcryptHash(secret string) string {
+	h, _ := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.MinCost)
+	return string(h)
+}
+
+func argon2Hash(secret string) string {
+	salt := []byte("somesalt")
+	h := argon2.IDKey([]byte(secret), salt, 1, 64, 1, 32)
+
+	return fmt.Sprintf(
+		"$argon2id$v=19$m=64,t=1,p=1$%s$%s",
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(h),
+	)
+}
+
+func setupCredentialStore(t *testing.T) (*consulStub, *CredentialStore) {
+	stub, client := newConsulStub(t)
+	t.Cleanup(stub.Close)
+
+	putCredential(t, stub, "creds/api_keys/partner", Credential{Principal: "partner-a", Hash: bcryptHash("abc123")})
+	putCredential(t, stub, "creds/api_keys/argon", Credential{Hash: argon2Hash("def456")})
+	putCredential(t, stub, "creds/basic/nic", Credential{Hash: bcryptHash("password")})
+
+	cs, err := NewCredentialStore(client, "creds", log.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cs.Close)
+
+	return stub, cs
+}
+
+func TestCredentialStoreVerifiesAPIKeys(t *testing.T) {
+	_, cs := setupCredentialStore(t)
+
+	p, err := cs.VerifyAPIKey("client", "partner.abc123")
+	assert.NoError(t, err)
+	assert.Equal(t, "partner-a", p)
+
+	p, err = cs.VerifyAPIKey("client", "argon.def456")
+	assert.NoError(t, err)
+	assert.Equal(t, "argon", p, "Should have used the key id as the principal")
+
+	_, err = cs.VerifyAPIKey("client", "partner.wrong")
+	assert.Equal(t, errInvalidCredentials, err)
+
+	_, err = cs.VerifyAPIKey("client", "unknown.abc123")
+	assert.Equal(t, errInvalidCredentials, err)
+
+	_, err = cs.VerifyAPIKey("client", "abc123")
+	assert.Equal(t, errInvalidCredentials, err)
+}
+
+func TestCredentialStoreVerifiesBasic(t *testing.T) {
+	_, cs := setupCredentialStore(t)
+
+	p, err := cs.VerifyBasic("client", "nic", "password")
+	assert.NoError(t, err)
+	assert.Equal(t, "nic", p)
+
+	_, err = cs.VerifyBasic("client", "nic", "wrong")
+	assert.Equal(t, errInvalidCredentials, err)
+}
+
+func TestCredentialStoreLimitsFailedAttemptsPerClient(t *testing.T) {
+	_, cs := setupCredentialStore(t)
+	cs.limiter = newFailureLimiter(1, 3)
+	now := time.Now()
+	cs.limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		_, err := cs.VerifyBasic("attacker", "nic", fmt.Sprintf("wrong%d", i))
+		assert.Equal(t, errInvalidCredentials, err)
+	}
+
+	_, err := cs.VerifyBasic("attacker", "nic", "password")
+	assert.Equal(t, errTooManyAttempts, err, "Should not check the password once the attempts are used")
+
+	p, err := cs.VerifyBasic("client", "nic", "password")
+	assert.NoError(t, err, "Should not limit other clients")
+	assert.Equal(t, "nic", p)
+
+	now = now.Add(time.Second)
+	_, err = cs.VerifyBasic("attacker", "nic", "wrong3")
+	assert.Equal(t, errInvalidCredentials, err, "Should allow another attempt once refilled")
+
+	_, err = cs.VerifyBasic("attacker", "nic", "wrong4")
+	assert.Equal(t, errTooManyAttempts, err)
+}
+
+func TestCredentialStoreRemembersFailedSecrets(t *testing.T) {
+	_, cs := setupCredentialStore(t)
+	cs.limiter = newFailureLimiter(1, 1)
+
+	_, err := cs.VerifyAPIKey("client", "partner.wrong")
+	assert.Equal(t, errInvalidCredentials, err)
+
+	// the repeated secret is rejected without taking an attempt
+	_, err = cs.VerifyAPIKey("client", "partner.wrong")
+	assert.Equal(t, errInvalidCredentials, err)
+
+	_, err = cs.VerifyAPIKey("client", "partner.other")
+	assert.Equal(t, errTooManyAttempts, err)
+}
+
+func TestCredentialStoreRefundsSuccessfulAttempts(t *testing.T) {
+	_, cs := setupCredentialStore(t)
+	cs.limiter = newFailureLimiter(0.001, 1)
+
+	_, err := cs.VerifyAPIKey("client", "partner.abc123")
+	assert.NoError(t, err)
+
+	_, err = cs.VerifyAPIKey("client", "argon.def456")
+	assert.NoError(t, err, "Should not count successful checks as failures")
+}
+
+func TestCredentialStoreRevokesDeletedKeys(t *testing.T) {
+	stub, cs := setupCredentialStore(t)
+
+	_, err := cs.VerifyAPIKey("client", "partner.abc123")
+	assert.NoError(t, err)
+
+	stub.Delete("creds/api_keys/partner")
+
+	waitFor(t, func() bool {
+		_, err := cs.VerifyAPIKey("client", "partner.abc123")
+		return err == errInvalidCredentials
+	}, "Key should have been revoked")
+}
+
+func TestCredentialStoreLoadsAddedKeys(t *testing.T) {
+	stub, cs := setupCredentialStore(t)
+
+	putCredential(t, stub, "creds/api_keys/new", Credential{Hash: bcryptHash("xyz")})
+
+	waitFor(t, func() bool {
+		_, err := cs.VerifyAPIKey("client", "new.xyz")
+		return err == nil
+	}, "Key should have been added")
+}
+
+func TestHandlerForwardsAPIKeyPrincipal(t *testing.T) {
+	rec := setupRouterTests(t)
+	_, rec.credentials = setupCredentialStore(t)
+	rec.upstreams = append(rec.upstreams, Upstream{Service: "test", Path: "/test", Auth: AuthAPIKey})
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/test", nil)
+	r.Header.Set("X-API-Key", "partner.abc123")
+	r.Header.Set("X-Auth-Principal", "spoofed")
+
+	rec.Handler(rw, r)
+
+	mockHTTPClient.AssertCalled(t, "Do", mock.Anything)
+	req := mockHTTPClient.Calls[0].Arguments.Get(0).(*http.Request)
+
+	assert.Equal(t, []string{"partner-a"}, req.Header["X-Auth-Principal"])
+	assert.Empty(t, req.Header.Get("X-API-Key"), "Should not forward the API key")
+}
+
+func TestHandlerRecordsPrincipalMetrics(t *testing.T) {
+	sink := metrics.NewInmemSink(time.Minute, time.Minute)
+	conf := metrics.DefaultConfig("router-test")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	metrics.NewGlobal(conf, sink)
+	defer metrics.NewGlobal(metrics.DefaultConfig(""), &metrics.BlackholeSink{})
+
+	rec := setupRouterTests(t)
+	_, rec.credentials = setupCredentialStore(t)
+	rec.upstreams = append(rec.upstreams,
+		Upstream{Service: "test", Path: "/test", Auth: AuthAPIKey, PrincipalMetrics: true},
+		Upstream{Service: "other", Path: "/other", Auth: AuthAPIKey},
+	)
+
+	for _, p := range []string{"/test", "/other"} {
+		r := httptest.NewRequest("GET", p, nil)
+		r.Header.Set("X-API-Key", "partner.abc123")
+		rec.Handler(httptest.NewRecorder(), r)
+	}
+
+	counters := sink.Data()[0].Counters
+	c, ok := counters["router-test.router.request.principal;upstream=test;principal=partner-a;code=200"]
+	assert.True(t, ok, "Should have counted the request for the principal")
+	assert.Equal(t, 1, c.Count)
+
+	assert.NotContains(t, counters, "router-test.router.request.principal;upstream=other;principal=partner-a;code=200", "Should only count principals for routes with principal metrics")
+	assert.Contains(t, counters, "router-test.router.request;upstream=test;code=200")
+}
+
+func TestHandlerReturnsTooManyRequestsAfterFailedAttempts(t *testing.T) {
+	rec := setupRouterTests(t)
+	_, rec.credentials = setupCredentialStore(t)
+	rec.credentials.limiter = newFailureLimiter(0.001, 1)
+	rec.upstreams = append(rec.upstreams, Upstream{Service: "test", Path: "/test", Auth: AuthBasic})
+
+	codes := []int{}
+	for _, pass := range []string{"wrong", "password"} {
+		rw := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/test", nil)
+		r.SetBasicAuth("nic", pass)
+
+		rec.Handler(rw, r)
+		codes = append(codes, rw.Code)
+	}
+
+	assert.Equal(t, []int{http.StatusUnauthorized, http.StatusTooManyRequests}, codes)
+	mockHTTPClient.AssertNotCalled(t, "Do")
+}
+
+func TestHandlerRemovesPrincipalHeaderWithoutAuth(t *testing.T) {
+	rec := setupRouterTests(t)
+	rec.upstreams = append(rec.upstreams, Upstream{Service: "test", Path: "/test"})
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/test", nil)
+	r.Header.Set("X-Auth-Principal", "spoofed")
+
+	rec.Handler(rw, r)
+
+	mockHTTPClient.AssertCalled(t, "Do", mock.Anything)
+	req := mockHTTPClient.Calls[0].Arguments.Get(0).(*http.Request)
+
+	assert.Empty(t, req.Header.Get("X-Auth-Principal"))
+}
+
+func TestHandlerReturnsUnauthorizedForInvalidBasicCredentials(t *testing.T) {
+	rec := setupRouterTests(t)
+	_, rec.credentials = setupCredentialStore(t)
+	rec.upstreams = append(rec.upstreams, Upstream{Service: "test", Path: "/test", Auth: AuthBasic})
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/test", nil)
+	r.SetBasicAuth("nic", "wrong")
+
+	rec.Handler(rw, r)
+
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	assert.Contains(t, rw.Header().Get("WWW-Authenticate"), "Basic")
+	mockHTTPClient.AssertNotCalled(t, "Do")
+}
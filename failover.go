@@ -0,0 +1,282 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/eapache/go-resiliency/breaker"
+	"github.com/eapache/go-resiliency/retrier"
+	"github.com/hashicorp/consul/api"
+)
+
+// circuit breaker settings for routes with failover datacenters, the circuit
+// for a datacenter opens after consecutive failures and is tested again
+// after the timeout
+const (
+	circuitErrorThreshold   = 5
+	circuitSuccessThreshold = 1
+	circuitTimeout          = 30 * time.Second
+)
+
+// retryBodyLimit is the largest request body buffered in memory so the
+// request can be retried, requests with larger bodies are sent once
+const retryBodyLimit = 64 * 1024
+
+// errNoHealthyTargets is returned when no datacenter can serve the request
+var errNoHealthyTargets = errors.New("No healthy instances in any datacenter")
+
+// connectTarget is a Connect service or prepared query in a datacenter, the
+// local datacenter is used when the datacenter is empty
+type connectTarget struct {
+	name       string
+	query      bool
+	datacenter string
+}
+
+// host returns the Consul DNS name resolved by the Connect client
+func (t connectTarget) host() string {
+	parts := []string{t.name, "service"}
+	if t.query {
+		parts[1] = "query"
+	}
+
+	if t.datacenter != "" {
+		parts = append(parts, t.datacenter)
+	}
+
+	return strings.Join(append(parts, "consul"), ".")
+}
+
+// targets returns the route's target followed by the failover datacenters
+func (u *Upstream) targets() []connectTarget {
+	t := connectTarget{name: u.Service, datacenter: u.Datacenter}
+	if u.Query != "" {
+		t = connectTarget{name: u.Query, query: true, datacenter: u.Datacenter}
+	}
+
+	ts := []connectTarget{t}
+	for _, dc := range u.Failover {
+		t.datacenter = dc
+		ts = append(ts, t)
+	}
+
+	return ts
+}
+
+// doUpstream sends the request to the upstream retrying errors, Connect
+// routes with failover datacenters use the first datacenter which has
+// healthy instances and a closed circuit
+func (r *Router) doUpstream(us *Upstream, req *http.Request) (*http.Response, error) {
+	if len(us.Failover) == 0 || (us.Type != HTTP && us.Type != GRPC) {
+		return r.doWithRetry(us, us.targets()[0], req)
+	}
+
+	for _, t := range us.targets() {
+		n, err := r.health.connectInstances(t)
+		if err != nil {
+			// try the datacenter when its health is unknown
+			r.logger.Error("Unable to check health of upstream", "upstream", t.host(), "error", err)
+		} else if n == 0 {
+			r.logger.Debug("No healthy instances, trying next datacenter", "upstream", t.host())
+			continue
+		}
+
+		req.URL.Host = t.host()
+		req.Host = t.host()
+
+		var resp *http.Response
+		err = r.circuit(t.host()).Run(func() error {
+			var err error
+			resp, err = r.doWithRetry(us, t, req)
+			return err
+		})
+
+		if err == breaker.ErrBreakerOpen {
+			r.logger.Debug("Circuit open, trying next datacenter", "upstream", t.host())
+			continue
+		}
+
+		return resp, err
+	}
+
+	return nil, errNoHealthyTargets
+}
+
+// doWithRetry retries the request 3 times with a backoff, routes with a load
+// balancer select an instance of the target other than the failed instance
+// for each attempt and idempotent requests to routes with a hedge policy may
+// be hedged
+func (r *Router) doWithRetry(us *Upstream, t connectTarget, req *http.Request) (*http.Response, error) {
+	var backoff []time.Duration
+	if retryable(req) {
+		err := bufferBody(req)
+		if err != nil {
+			return nil, err
+		}
+
+		backoff = retrier.ConstantBackoff(3, 200*time.Millisecond)
+	}
+
+	var resp *http.Response
+	var failed *connectInstance
+	attempt := 0
+
+	retry := retrier.New(backoff, retrier.BlacklistClassifier{errNoHealthyInstances})
+	err := retry.Run(func() error {
+		attempt++
+		if attempt > 1 {
+			localError := rewindBody(req)
+			if localError != nil {
+				return localError
+			}
+		}
+
+		if hedgeable(us, t, req) {
+			var localError error
+			resp, localError = r.doHedged(us, t, req)
+			return localError
+		}
+
+		br, localError := r.balanceExcluding(us, t, req, failed)
+		if localError == errNoHealthyInstances && failed != nil {
+			// the failed instance is the only instance
+			br, localError = r.balance(us, t, req)
+		}
+
+		if localError != nil {
+			r.logger.Error("Unable to select upstream instance", "upstream", t.host(), "error", localError)
+			return localError
+		}
+
+		resp, localError = r.upstreamClient(us).Do(req)
+		br.result(resp, localError)
+
+		if localError != nil {
+			if br != nil {
+				failed = br.instance
+			}
+
+			br.release()
+			r.logger.Error("Unable to contact upstream", "error", localError)
+			return localError
+		}
+
+		resp.Body = &releaseBody{ReadCloser: resp.Body, release: br.release}
+
+		return nil
+	})
+
+	return resp, err
+}
+
+// retryable returns true when a failed request can be sent again, bodies
+// larger than the limit or streamed without a known length are never
+// buffered so the request is only sent once
+func retryable(req *http.Request) bool {
+	if req.GetBody != nil || req.Body == nil || req.Body == http.NoBody {
+		return true
+	}
+
+	return req.ContentLength >= 0 && req.ContentLength <= retryBodyLimit
+}
+
+// bufferBody reads the request body into memory and sets GetBody so the
+// body can be sent again
+func bufferBody(req *http.Request) error {
+	if req.ContentLength <= 0 || req.GetBody != nil {
+		return nil
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(req.Body, retryBodyLimit+1))
+	req.Body.Close()
+	if err != nil {
+		return fmt.Errorf("Unable to read request body: %s", err)
+	}
+
+	if len(b) > retryBodyLimit {
+		return fmt.Errorf("Request body is larger than its Content-Length")
+	}
+
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+	req.Body, _ = req.GetBody()
+
+	return nil
+}
+
+// rewindBody resets the body of a request before it is sent again
+func rewindBody(req *http.Request) error {
+	if req.GetBody == nil {
+		return nil
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return err
+	}
+
+	req.Body = body
+
+	return nil
+}
+
+// circuit returns the circuit breaker for the target
+func (r *Router) circuit(host string) *breaker.Breaker {
+	r.circuitsMu.Lock()
+	defer r.circuitsMu.Unlock()
+
+	if r.circuits == nil {
+		r.circuits = map[string]*breaker.Breaker{}
+	}
+
+	b, ok := r.circuits[host]
+	if !ok {
+		b = breaker.New(circuitErrorThreshold, circuitSuccessThreshold, circuitTimeout)
+		r.circuits[host] = b
+	}
+
+	return b
+}
+
+// connectInstances returns the number of healthy Connect instances for the
+// target, the result is cached
+func (h *healthResolver) connectInstances(t connectTarget) (int, error) {
+	_, addrs, err := h.lookup("connect/"+t.host(), func(ctx context.Context) ([]string, error) {
+		q := (&api.QueryOptions{Datacenter: t.datacenter, Connect: true}).WithContext(ctx)
+		ids := []string{}
+
+		if t.query {
+			resp, _, err := h.client.PreparedQuery().Execute(t.name, q)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to execute query %s: %s", t.name, err)
+			}
+
+			for _, se := range resp.Nodes {
+				ids = append(ids, se.Service.ID)
+			}
+
+			return ids, nil
+		}
+
+		entries, _, err := h.client.Health().Connect(t.name, "", true, q)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to find instances of %s: %s", t.name, err)
+		}
+
+		for _, se := range entries {
+			ids = append(ids, se.Service.ID)
+		}
+
+		return ids, nil
+	})
+
+	return len(addrs), err
+}
@@ -0,0 +1,267 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eapache/go-resiliency/breaker"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// setupConsulConnect stubs the Consul Connect health and prepared query APIs,
+// instances are keyed by service or query and datacenter i.e. api/dc2
+func setupConsulConnect(t *testing.T, instances map[string]int) (*healthResolver, *int32) {
+	calls := new(int32)
+
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(calls, 1)
+
+		dc := req.URL.Query().Get("dc")
+		if dc == "" {
+			dc = "dc1"
+		}
+
+		entries := []api.ServiceEntry{}
+
+		switch {
+		case strings.HasPrefix(req.URL.Path, "/v1/health/connect/"):
+			name := strings.TrimPrefix(req.URL.Path, "/v1/health/connect/")
+			for i := 0; i < instances[name+"/"+dc]; i++ {
+				entries = append(entries, api.ServiceEntry{Service: &api.AgentService{ID: name}})
+			}
+
+			json.NewEncoder(rw).Encode(entries)
+		case strings.HasPrefix(req.URL.Path, "/v1/query/"):
+			name := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/v1/query/"), "/execute")
+			for i := 0; i < instances[name+"/"+dc]; i++ {
+				entries = append(entries, api.ServiceEntry{Service: &api.AgentService{ID: name}})
+			}
+
+			json.NewEncoder(rw).Encode(api.PreparedQueryExecuteResponse{Service: name, Datacenter: dc, Nodes: entries})
+		default:
+			http.NotFound(rw, req)
+		}
+	}))
+	t.Cleanup(s.Close)
+
+	c, _ := api.NewClient(&api.Config{Address: s.Listener.Addr().String()})
+
+	return newHealthResolver(c), calls
+}
+
+// recordHosts records the host of each request sent to the upstream
+func recordHosts() *[]string {
+	hosts := &[]string{}
+
+	mockHTTPClient.ExpectedCalls = nil
+	mockHTTPClient.On("Do", mock.Anything).Run(func(args mock.Arguments) {
+		*hosts = append(*hosts, args.Get(0).(*http.Request).URL.Host)
+	}).Return(httpResponse, nil)
+
+	return hosts
+}
+
+func TestHandlerUsesQueryAndDatacenter(t *testing.T) {
+	tests := []struct {
+		route string
+		host  string
+	}{
+		{"service=api#path=/api", "api.service.consul"},
+		{"service=api#path=/api#datacenter=dc2", "api.service.dc2.consul"},
+		{"query=api-nearest#path=/api", "api-nearest.query.consul"},
+		{"query=api-nearest#path=/api#datacenter=dc2", "api-nearest.query.dc2.consul"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.route, func(t *testing.T) {
+			rec := setupDirectRouter(t, tt.route)
+			rw := httptest.NewRecorder()
+
+			rec.Handler(rw, httptest.NewRequest("GET", "/api/users", nil))
+
+			req := mockHTTPClient.Calls[0].Arguments.Get(0).(*http.Request)
+			assert.Equal(t, "https://"+tt.host+"/users", req.URL.String())
+		})
+	}
+}
+
+func TestHandlerUsesLocalDatacenterWhenHealthy(t *testing.T) {
+	health, _ := setupConsulConnect(t, map[string]int{"api/dc1": 1, "api/dc2": 1})
+
+	rec := setupDirectRouter(t, "service=api#path=/api#failover=dc2;dc3")
+	rec.health = health
+	hosts := recordHosts()
+	rw := httptest.NewRecorder()
+
+	rec.Handler(rw, httptest.NewRequest("GET", "/api", nil))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, []string{"api.service.consul"}, *hosts)
+}
+
+func TestHandlerFailsOverWhenNoHealthyInstances(t *testing.T) {
+	health, calls := setupConsulConnect(t, map[string]int{"api/dc3": 2})
+
+	rec := setupDirectRouter(t, "service=api#path=/api#failover=dc2;dc3")
+	rec.health = health
+	hosts := recordHosts()
+
+	for i := 0; i < 2; i++ {
+		rw := httptest.NewRecorder()
+		rec.Handler(rw, httptest.NewRequest("GET", "/api", nil))
+		assert.Equal(t, http.StatusOK, rw.Code)
+	}
+
+	assert.Equal(t, []string{"api.service.dc3.consul", "api.service.dc3.consul"}, *hosts)
+	assert.Equal(t, int32(3), atomic.LoadInt32(calls), "Should cache the health of each datacenter")
+}
+
+func TestHandlerFailsOverPreparedQueries(t *testing.T) {
+	health, _ := setupConsulConnect(t, map[string]int{"api-nearest/dc2": 1})
+
+	rec := setupDirectRouter(t, "query=api-nearest#path=/api#failover=dc2")
+	rec.health = health
+	hosts := recordHosts()
+	rw := httptest.NewRecorder()
+
+	rec.Handler(rw, httptest.NewRequest("GET", "/api", nil))
+
+	assert.Equal(t, []string{"api-nearest.query.dc2.consul"}, *hosts)
+}
+
+func TestHandlerFailsOverWhenCircuitOpen(t *testing.T) {
+	health, _ := setupConsulConnect(t, map[string]int{"api/dc1": 1, "api/dc2": 1})
+
+	rec := setupDirectRouter(t, "service=api#path=/api#failover=dc2")
+	rec.health = health
+	hosts := recordHosts()
+
+	// open the circuit for the local datacenter
+	b := breaker.New(1, 1, time.Minute)
+	b.Run(func() error { return errors.New("boom") })
+	rec.circuits = map[string]*breaker.Breaker{"api.service.consul": b}
+
+	rw := httptest.NewRecorder()
+	rec.Handler(rw, httptest.NewRequest("GET", "/api", nil))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, []string{"api.service.dc2.consul"}, *hosts)
+}
+
+func TestHandlerReturnsUnavailableWhenNoDatacenterHealthy(t *testing.T) {
+	health, _ := setupConsulConnect(t, nil)
+
+	rec := setupDirectRouter(t, "service=api#path=/api#failover=dc2")
+	rec.health = health
+	rw := httptest.NewRecorder()
+
+	rec.Handler(rw, httptest.NewRequest("GET", "/api", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	mockHTTPClient.AssertNotCalled(t, "Do", mock.Anything)
+}
+
+func TestHandlerTriesDatacenterWhenHealthUnknown(t *testing.T) {
+	c, _ := api.NewClient(&api.Config{Address: "127.0.0.1:1"})
+
+	rec := setupDirectRouter(t, "service=api#path=/api#failover=dc2")
+	rec.health = newHealthResolver(c)
+	hosts := recordHosts()
+	rw := httptest.NewRecorder()
+
+	rec.Handler(rw, httptest.NewRequest("GET", "/api", nil))
+
+	assert.Equal(t, []string{"api.service.consul"}, *hosts)
+}
+
+// failingClient fails the first requests it receives and records the
+// instance and body of each request
+type failingClient struct {
+	mu       sync.Mutex
+	failures int
+	requests []string
+}
+
+func (f *failingClient) Do(req *http.Request) (*http.Response, error) {
+	body, _ := ioutil.ReadAll(req.Body)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, req.URL.Host+" "+string(body))
+
+	if len(f.requests) <= f.failures {
+		return nil, errors.New("connection reset")
+	}
+
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+}
+
+func TestHandlerRetriesRequestBodyOnAnotherInstance(t *testing.T) {
+	rec, catalog := setupLoadBalancer(t, "service=api#path=/api#lb=hash#hash_on=header:x-user")
+	catalog.set("api", "a=10.0.0.1:8080", "b=10.0.0.2:8080")
+
+	fc := &failingClient{failures: 1}
+	rec.httpClient = fc
+
+	req := httptest.NewRequest("PUT", "/api", strings.NewReader("hello"))
+	req.Header.Set("x-user", "nic")
+	rw := httptest.NewRecorder()
+
+	rec.Handler(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Len(t, fc.requests, 2)
+	assert.True(t, strings.HasSuffix(fc.requests[0], " hello"))
+	assert.True(t, strings.HasSuffix(fc.requests[1], " hello"), "Should send the body again")
+	assert.NotEqual(t, fc.requests[0], fc.requests[1], "Should retry on another instance")
+}
+
+func TestHandlerRetriesPostRequests(t *testing.T) {
+	rec := setupDirectRouter(t, "service=api#path=/api")
+	fc := &failingClient{failures: 1}
+	rec.httpClient = fc
+	rw := httptest.NewRecorder()
+
+	rec.Handler(rw, httptest.NewRequest("POST", "/api", strings.NewReader("hello")))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, []string{"api.service.consul hello", "api.service.consul hello"}, fc.requests)
+}
+
+func TestHandlerDoesNotRetryLargeRequestBodies(t *testing.T) {
+	rec := setupDirectRouter(t, "service=api#path=/api")
+	fc := &failingClient{failures: 1}
+	rec.httpClient = fc
+	rw := httptest.NewRecorder()
+
+	body := strings.Repeat("a", retryBodyLimit+1)
+	rec.Handler(rw, httptest.NewRequest("PUT", "/api", strings.NewReader(body)))
+
+	assert.Equal(t, http.StatusInternalServerError, rw.Code)
+	assert.Equal(t, []string{"api.service.consul " + body}, fc.requests, "Should send the body once without buffering")
+}
+
+func TestHandlerDoesNotRetryStreamedRequestBodies(t *testing.T) {
+	rec := setupDirectRouter(t, "service=api#path=/api")
+	fc := &failingClient{failures: 1}
+	rec.httpClient = fc
+	rw := httptest.NewRecorder()
+
+	req := httptest.NewRequest("PUT", "/api", strings.NewReader("hello"))
+	req.ContentLength = -1
+	rec.Handler(rw, req)
+
+	assert.Equal(t, http.StatusInternalServerError, rw.Code)
+	assert.Len(t, fc.requests, 1)
+}
@@ -0,0 +1,342 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+const (
+	defaultHedgeMaxPercent = 10
+	// hedgeSamples is the number of recent response times used to calculate
+	// the percentile delay
+	hedgeSamples = 1000
+	// hedgeMinSamples is the number of response times needed before requests
+	// are hedged using a percentile delay
+	hedgeMinSamples = 20
+	// hedgeRecalculateSamples is the number of response times recorded
+	// before the percentile delay is calculated again
+	hedgeRecalculateSamples = 50
+	// hedgeMaxBudget is the largest number of hedges which can be saved up
+	// and sent in a burst
+	hedgeMaxBudget = 10
+)
+
+// HedgePolicy sends a duplicate of idempotent requests to a different
+// instance when the first instance has not responded after the delay, the
+// first successful response is used and the other request is cancelled
+type HedgePolicy struct {
+	// Delay is the time to wait before hedging, when zero the delay is the
+	// percentile of the recent response times
+	Delay      time.Duration
+	Percentile float64
+	// MaxPercent is the largest percentage of requests which are hedged
+	MaxPercent int
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	next      int
+	// observed is the number of response times recorded, percentile was
+	// calculated when calculated response times had been recorded
+	observed      int
+	calculated    int
+	percentile    time.Duration
+	recalculating bool
+	// budget is the percentage of a hedge saved up by previous requests
+	budget int
+}
+
+// parseHedgeDelay parses a duration i.e. 50ms or a percentile of the recent
+// response times i.e. p95
+func parseHedgeDelay(h *HedgePolicy, s string) error {
+	if strings.HasPrefix(s, "p") {
+		p, err := strconv.ParseFloat(s[1:], 64)
+		if err != nil || p <= 0 || p >= 100 {
+			return fmt.Errorf("Invalid hedge percentile: %s", s)
+		}
+
+		h.Percentile = p
+		return nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	if d <= 0 {
+		return fmt.Errorf("Invalid hedge delay: %s", s)
+	}
+
+	h.Delay = d
+	return nil
+}
+
+// setDefaults sets the defaults for values which are not set
+func (h *HedgePolicy) setDefaults() {
+	if h.MaxPercent == 0 {
+		h.MaxPercent = defaultHedgeMaxPercent
+	}
+}
+
+// observe records the response time of a request
+func (h *HedgePolicy) observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.observed++
+
+	if len(h.latencies) < hedgeSamples {
+		h.latencies = append(h.latencies, d)
+		return
+	}
+
+	h.latencies[h.next] = d
+	h.next = (h.next + 1) % hedgeSamples
+}
+
+// delay returns the time to wait before hedging the request, false is
+// returned when there are not enough response times for the percentile. The
+// percentile is cached until more response times have been recorded, only
+// one caller recalculates it while the others use the cached value.
+func (h *HedgePolicy) delay() (time.Duration, bool) {
+	if h.Delay > 0 {
+		return h.Delay, true
+	}
+
+	h.mu.Lock()
+	if len(h.latencies) < hedgeMinSamples {
+		h.mu.Unlock()
+		return 0, false
+	}
+
+	stale := h.calculated == 0 || h.observed-h.calculated >= hedgeRecalculateSamples
+	if !stale || h.recalculating {
+		// no percentile has been published while the first calculation is
+		// in progress, the request is not hedged rather than hedged at once
+		d, ok := h.percentile, h.calculated > 0
+		h.mu.Unlock()
+		return d, ok
+	}
+
+	h.recalculating = true
+	observed := h.observed
+	latencies := make([]time.Duration, len(h.latencies))
+	copy(latencies, h.latencies)
+	h.mu.Unlock()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	i := int(float64(len(latencies))*h.Percentile/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+
+	h.mu.Lock()
+	h.percentile = latencies[i]
+	h.calculated = observed
+	h.recalculating = false
+	h.mu.Unlock()
+
+	return latencies[i], true
+}
+
+// request adds the route's share of hedges to the budget for each request
+func (h *HedgePolicy) request() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.budget += h.MaxPercent
+	if h.budget > hedgeMaxBudget*100 {
+		h.budget = hedgeMaxBudget * 100
+	}
+}
+
+// allow returns true when the budget allows another hedge
+func (h *HedgePolicy) allow() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.budget < 100 {
+		return false
+	}
+
+	h.budget -= 100
+	return true
+}
+
+// hedgeable returns true for idempotent requests to load balanced targets
+// which can be sent more than once
+func hedgeable(us *Upstream, t connectTarget, req *http.Request) bool {
+	if us.Hedge == nil || us.LoadBalancer == "" || t.query || (us.Type != HTTP && us.Type != GRPC) {
+		return false
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return false
+	}
+
+	return req.Body == nil || req.Body == http.NoBody
+}
+
+// hedgeResult is the outcome of a request sent by doHedged
+type hedgeResult struct {
+	resp   *http.Response
+	err    error
+	hedge  bool
+	br     *balancedRequest
+	cancel context.CancelFunc
+}
+
+// discard closes the response and releases the instance
+func (h hedgeResult) discard() {
+	if h.resp != nil {
+		h.resp.Body.Close()
+	}
+
+	h.br.release()
+	h.cancel()
+}
+
+// doHedged sends the request to an instance of the target, a hedged request
+// is sent to a different instance when there is no response after the
+// delay. The first successful response is returned and the other request is
+// cancelled, when both fail the response of the last request is returned.
+func (r *Router) doHedged(us *Upstream, t connectTarget, req *http.Request) (*http.Response, error) {
+	h := us.Hedge
+	h.request()
+
+	results := make(chan hedgeResult, 2)
+	cancels := map[bool]context.CancelFunc{}
+
+	send := func(hedge bool, exclude *connectInstance) (*connectInstance, error) {
+		ctx, cancel := context.WithCancel(req.Context())
+		hreq := req.Clone(ctx)
+
+		br, err := r.balanceExcluding(us, t, hreq, exclude)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+
+		cancels[hedge] = cancel
+
+		go func() {
+			start := time.Now()
+			resp, err := r.upstreamClient(us).Do(hreq)
+
+			// requests cancelled because the other request won do not
+			// count against the instance
+			if err == nil || ctx.Err() == nil {
+				br.result(resp, err)
+			}
+
+			if err == nil {
+				h.observe(time.Since(start))
+			}
+
+			results <- hedgeResult{resp: resp, err: err, hedge: hedge, br: br, cancel: cancel}
+		}()
+
+		return br.instance, nil
+	}
+
+	primary, err := send(false, nil)
+	if err != nil {
+		r.logger.Error("Unable to select upstream instance", "upstream", t.host(), "error", err)
+		return nil, err
+	}
+
+	var timer <-chan time.Time
+	if d, ok := h.delay(); ok {
+		tt := time.NewTimer(d)
+		defer tt.Stop()
+		timer = tt.C
+	}
+
+	pending := 1
+	var last *hedgeResult
+
+	for pending > 0 {
+		select {
+		case <-timer:
+			timer = nil
+
+			if !h.allow() {
+				r.logger.Debug("Hedge budget exhausted", "upstream", t.host())
+				continue
+			}
+
+			_, err := send(true, primary)
+			if err != nil {
+				r.logger.Debug("Unable to hedge request", "upstream", t.host(), "error", err)
+				continue
+			}
+
+			pending++
+			metrics.IncrCounterWithLabels([]string{"router", "upstream", "hedge"}, 1, []metrics.Label{{Name: "upstream", Value: us.Service}})
+
+		case res := <-results:
+			pending--
+
+			if res.err != nil || res.resp.StatusCode >= http.StatusInternalServerError {
+				if last != nil {
+					last.discard()
+				}
+				last = &res
+				continue
+			}
+
+			if last != nil {
+				last.discard()
+			}
+
+			// cancel the request which is still in progress
+			if pending > 0 {
+				cancels[!res.hedge]()
+
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						res := <-results
+						res.discard()
+					}
+				}(pending)
+			}
+
+			if res.hedge {
+				r.logger.Debug("Hedged request won", "upstream", t.host())
+				metrics.IncrCounterWithLabels([]string{"router", "upstream", "hedge", "won"}, 1, []metrics.Label{{Name: "upstream", Value: us.Service}})
+			}
+
+			return r.hedgeResponse(res), nil
+		}
+	}
+
+	if last.err != nil {
+		last.discard()
+		r.logger.Error("Unable to contact upstream", "error", last.err)
+		return nil, last.err
+	}
+
+	return r.hedgeResponse(*last), nil
+}
+
+// hedgeResponse releases the instance and cancels the request when the body
+// of the response is closed
+func (r *Router) hedgeResponse(res hedgeResult) *http.Response {
+	res.resp.Body = &releaseBody{ReadCloser: res.resp.Body, release: func() {
+		res.br.release()
+		res.cancel()
+	}}
+
+	return res.resp
+}
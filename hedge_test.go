@@ -0,0 +1,215 @@
+package router
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// slowInstances responds with the address of the instance after the delay
+// of the instance, cancelled requests are recorded
+type slowInstances struct {
+	mu        sync.Mutex
+	delays    map[string]time.Duration
+	requests  []string
+	cancelled []string
+}
+
+func (s *slowInstances) Do(req *http.Request) (*http.Response, error) {
+	s.mu.Lock()
+	s.requests = append(s.requests, req.URL.Host)
+	d := s.delays[req.URL.Host]
+	s.mu.Unlock()
+
+	select {
+	case <-time.After(d):
+	case <-req.Context().Done():
+		s.mu.Lock()
+		s.cancelled = append(s.cancelled, req.URL.Host)
+		s.mu.Unlock()
+
+		return nil, req.Context().Err()
+	}
+
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(req.URL.Host))}, nil
+}
+
+func (s *slowInstances) count() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.requests), len(s.cancelled)
+}
+
+func setupHedge(t *testing.T, route string, delays map[string]time.Duration) (*Router, *slowInstances) {
+	rec, catalog := setupLoadBalancer(t, route)
+	catalog.set("api", "a=10.0.0.1:8080", "b=10.0.0.2:8080")
+
+	si := &slowInstances{delays: delays}
+	rec.httpClient = si
+
+	return rec, si
+}
+
+func TestHedgeUsesFirstResponseAndCancelsSlowRequest(t *testing.T) {
+	rec, si := setupHedge(t, "service=api#path=/api#lb=round_robin#hedge_delay=10ms#hedge_max_percent=100", map[string]time.Duration{
+		"10.0.0.1:8080": 5 * time.Second,
+	})
+
+	rw := httptest.NewRecorder()
+	rec.Handler(rw, httptest.NewRequest("GET", "/api", nil))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "10.0.0.2:8080", rw.Body.String(), "Should use the response of the hedged request")
+
+	waitFor(t, func() bool {
+		_, cancelled := si.count()
+		return cancelled == 1
+	}, "Expected slow request to be cancelled")
+
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8080"}, si.requests)
+	assert.Equal(t, []string{"10.0.0.1:8080"}, si.cancelled)
+
+	// the cancelled request does not count against the instance
+	waitFor(t, func() bool {
+		return rec.balancer.status()[0].Instances[0].ActiveRequests == 0
+	}, "Expected slow request to be released")
+	assert.Equal(t, 0, rec.balancer.status()[0].Instances[0].ConsecutiveErrors)
+}
+
+func TestHedgeIsNotSentBeforeDelay(t *testing.T) {
+	rec, si := setupHedge(t, "service=api#path=/api#lb=round_robin#hedge_delay=1s#hedge_max_percent=100", map[string]time.Duration{})
+
+	sendRequests(rec, 4)
+
+	requests, _ := si.count()
+	assert.Equal(t, 4, requests)
+}
+
+func TestHedgeIsLimitedByMaxPercent(t *testing.T) {
+	rec, si := setupHedge(t, "service=api#path=/api#lb=round_robin#hedge_delay=1ms#hedge_max_percent=10", map[string]time.Duration{
+		"10.0.0.1:8080": 20 * time.Millisecond,
+		"10.0.0.2:8080": 20 * time.Millisecond,
+	})
+
+	sendRequests(rec, 30)
+
+	requests, _ := si.count()
+	assert.Equal(t, 33, requests, "Should hedge 10% of requests")
+}
+
+func TestHedgeIsNotSentForNonIdempotentRequests(t *testing.T) {
+	rec, si := setupHedge(t, "service=api#path=/api#lb=round_robin#hedge_delay=1ms#hedge_max_percent=100", map[string]time.Duration{
+		"10.0.0.1:8080": 20 * time.Millisecond,
+	})
+
+	rec.Handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/api", strings.NewReader("{}")))
+	rec.Handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/api", strings.NewReader("{}")))
+
+	requests, _ := si.count()
+	assert.Equal(t, 2, requests)
+}
+
+func TestHedgeDelayUsesPercentileOfResponseTimes(t *testing.T) {
+	h := &HedgePolicy{Percentile: 95}
+
+	for i := 1; i < hedgeMinSamples; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+
+	_, ok := h.delay()
+	assert.False(t, ok, "Should not hedge without enough response times")
+
+	for i := hedgeMinSamples; i <= 100; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+
+	d, ok := h.delay()
+	assert.True(t, ok)
+	assert.Equal(t, 95*time.Millisecond, d)
+}
+
+func TestHedgeDelayCachesPercentile(t *testing.T) {
+	h := &HedgePolicy{Percentile: 50}
+
+	for i := 0; i < hedgeMinSamples; i++ {
+		h.observe(10 * time.Millisecond)
+	}
+
+	d, _ := h.delay()
+	assert.Equal(t, 10*time.Millisecond, d)
+
+	for i := 0; i < hedgeRecalculateSamples-1; i++ {
+		h.observe(100 * time.Millisecond)
+	}
+
+	d, _ = h.delay()
+	assert.Equal(t, 10*time.Millisecond, d, "Should use the cached percentile")
+
+	h.observe(100 * time.Millisecond)
+
+	d, _ = h.delay()
+	assert.Equal(t, 100*time.Millisecond, d, "Should recalculate the percentile")
+}
+
+func TestHedgeDelayIsNotZeroForConcurrentCallers(t *testing.T) {
+	// each policy is used for the first time by concurrent callers while the
+	// percentile is being calculated
+	for n := 0; n < 50; n++ {
+		h := &HedgePolicy{Percentile: 50}
+
+		for i := 0; i < hedgeSamples; i++ {
+			h.observe(10 * time.Millisecond)
+		}
+
+		start := make(chan struct{})
+		wg := sync.WaitGroup{}
+		delays := make(chan time.Duration, 16)
+
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+
+				if d, ok := h.delay(); ok {
+					delays <- d
+				}
+			}()
+		}
+
+		close(start)
+		wg.Wait()
+		close(delays)
+
+		for d := range delays {
+			assert.Equal(t, 10*time.Millisecond, d, "Should only return a calculated percentile")
+		}
+	}
+}
+
+func TestHedgeDelayIsNotUsedWhileFirstCalculated(t *testing.T) {
+	h := &HedgePolicy{Percentile: 50}
+
+	for i := 0; i < hedgeMinSamples; i++ {
+		h.observe(10 * time.Millisecond)
+	}
+
+	// another caller is calculating the first percentile
+	h.recalculating = true
+
+	_, ok := h.delay()
+	assert.False(t, ok, "Should not hedge before a percentile has been calculated")
+
+	h.recalculating = false
+
+	d, ok := h.delay()
+	assert.True(t, ok)
+	assert.Equal(t, 10*time.Millisecond, d)
+}
@@ -0,0 +1,84 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// HTTP2Config defines the HTTP/2 settings for the HTTP and HTTPS listeners,
+// zero values use the http2 package defaults
+type HTTP2Config struct {
+	// H2C enables cleartext HTTP/2 on the plain HTTP listener, clients can
+	// connect with prior knowledge or upgrade from HTTP/1.1
+	H2C bool
+	// MaxConcurrentStreams limits the streams open on each connection
+	MaxConcurrentStreams uint32
+	// MaxReadFrameSize is the largest frame the router will read
+	MaxReadFrameSize uint32
+	// ConnectionWindowSize and StreamWindowSize are the flow control windows
+	// advertised for each connection and stream in bytes
+	ConnectionWindowSize int32
+	StreamWindowSize     int32
+	// IdleTimeout closes connections with no active streams
+	IdleTimeout time.Duration
+}
+
+// minimum and maximum values allowed by RFC 7540
+const (
+	http2MinWindowSize    = 65535
+	http2MinReadFrameSize = 16384
+	http2MaxReadFrameSize = 1<<24 - 1
+)
+
+// SetHTTP2 configures HTTP/2 for the listeners
+func (r *Router) SetHTTP2(c HTTP2Config) error {
+	if c.ConnectionWindowSize != 0 && c.ConnectionWindowSize < http2MinWindowSize {
+		return fmt.Errorf("HTTP/2 connection window size must be at least %d bytes", http2MinWindowSize)
+	}
+
+	if c.StreamWindowSize != 0 && c.StreamWindowSize < http2MinWindowSize {
+		return fmt.Errorf("HTTP/2 stream window size must be at least %d bytes", http2MinWindowSize)
+	}
+
+	if c.MaxReadFrameSize != 0 && (c.MaxReadFrameSize < http2MinReadFrameSize || c.MaxReadFrameSize > http2MaxReadFrameSize) {
+		return fmt.Errorf("HTTP/2 max frame size must be between %d and %d bytes", http2MinReadFrameSize, http2MaxReadFrameSize)
+	}
+
+	r.http2 = &c
+
+	return nil
+}
+
+// server returns the http2 server for the settings
+func (c *HTTP2Config) server() *http2.Server {
+	return &http2.Server{
+		MaxConcurrentStreams:         c.MaxConcurrentStreams,
+		MaxReadFrameSize:             c.MaxReadFrameSize,
+		MaxUploadBufferPerConnection: c.ConnectionWindowSize,
+		MaxUploadBufferPerStream:     c.StreamWindowSize,
+		IdleTimeout:                  c.IdleTimeout,
+	}
+}
+
+// h2cHandler serves cleartext HTTP/2 connections with the handler when
+// enabled
+func (r *Router) h2cHandler(h http.Handler) http.Handler {
+	if r.http2 == nil || !r.http2.H2C {
+		return h
+	}
+
+	return h2c.NewHandler(h, r.http2.server())
+}
+
+// configureHTTP2 applies the settings to the HTTPS server
+func (r *Router) configureHTTP2(s *http.Server) error {
+	if r.http2 == nil {
+		return nil
+	}
+
+	return http2.ConfigureServer(s, r.http2.server())
+}
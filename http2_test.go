@@ -0,0 +1,158 @@
+package router
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"golang.org/x/net/http2"
+)
+
+// serverSettings sends the client preface and returns the settings from the
+// first frame sent by the server
+func serverSettings(t *testing.T, c net.Conn) map[http2.SettingID]uint32 {
+	c.Write([]byte(http2.ClientPreface))
+
+	fr := http2.NewFramer(c, c)
+	fr.WriteSettings()
+
+	f, err := fr.ReadFrame()
+	assert.NoError(t, err)
+
+	sf, ok := f.(*http2.SettingsFrame)
+	if !assert.True(t, ok, "Should have received a settings frame") {
+		return nil
+	}
+
+	settings := map[http2.SettingID]uint32{}
+	sf.ForeachSetting(func(s http2.Setting) error {
+		settings[s.ID] = s.Val
+		return nil
+	})
+
+	return settings
+}
+
+func setupH2CRouter(t *testing.T, c HTTP2Config) (*Router, net.Listener) {
+	rec := setupRouterTests(t)
+	rec.upstreams = append(rec.upstreams, Upstream{Service: "test", Path: "/test"})
+	assert.NoError(t, rec.SetHTTP2(c))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	go http.Serve(l, rec.httpHandler())
+
+	return rec, l
+}
+
+func TestSetHTTP2ValidatesSettings(t *testing.T) {
+	rec := setupRouterTests(t)
+
+	assert.Error(t, rec.SetHTTP2(HTTP2Config{ConnectionWindowSize: 1024}))
+	assert.Error(t, rec.SetHTTP2(HTTP2Config{StreamWindowSize: 1024}))
+	assert.Error(t, rec.SetHTTP2(HTTP2Config{MaxReadFrameSize: 1 << 24}))
+	assert.NoError(t, rec.SetHTTP2(HTTP2Config{H2C: true, StreamWindowSize: 1 << 20}))
+}
+
+func TestH2CServesPriorKnowledgeRequests(t *testing.T) {
+	_, l := setupH2CRouter(t, HTTP2Config{H2C: true})
+	defer l.Close()
+
+	client := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+	}
+
+	resp, err := client.Get("http://" + l.Addr().String() + "/test")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, resp.ProtoMajor)
+	mockHTTPClient.AssertCalled(t, "Do", mock.Anything)
+}
+
+func TestH2CUpgradesHTTP1Requests(t *testing.T) {
+	_, l := setupH2CRouter(t, HTTP2Config{H2C: true})
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	defer c.Close()
+
+	c.Write([]byte("GET /test HTTP/1.1\r\nHost: test\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n\r\n"))
+
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "h2c", resp.Header.Get("Upgrade"))
+
+	// the response to the upgraded request is sent on stream 1
+	c.Write([]byte(http2.ClientPreface))
+	fr := http2.NewFramer(c, br)
+	fr.WriteSettings()
+
+	for {
+		f, err := fr.ReadFrame()
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		if h, ok := f.(*http2.HeadersFrame); ok {
+			assert.Equal(t, uint32(1), h.StreamID)
+			break
+		}
+	}
+
+	mockHTTPClient.AssertCalled(t, "Do", mock.Anything)
+}
+
+func TestH2CAdvertisesConfiguredSettings(t *testing.T) {
+	_, l := setupH2CRouter(t, HTTP2Config{H2C: true, MaxConcurrentStreams: 42, StreamWindowSize: 1 << 20, MaxReadFrameSize: 1 << 20})
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	defer c.Close()
+
+	s := serverSettings(t, c)
+	assert.Equal(t, uint32(42), s[http2.SettingMaxConcurrentStreams])
+	assert.Equal(t, uint32(1<<20), s[http2.SettingInitialWindowSize])
+	assert.Equal(t, uint32(1<<20), s[http2.SettingMaxFrameSize])
+}
+
+func TestHTTPSListenerAdvertisesConfiguredSettings(t *testing.T) {
+	rec := setupRouterTests(t)
+	rec.SetTLS(TLSConfig{})
+	defer close(rec.tlsStop)
+	rec.certificates.Set("test", []tls.Certificate{testKeyPair(t, "example.com")})
+	rec.SetHTTP2(HTTP2Config{MaxConcurrentStreams: 42})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	srv, err := rec.newTLSServer()
+	assert.NoError(t, err)
+	go rec.serveTLS(srv, l)
+	defer l.Close()
+
+	c, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		ServerName:         "example.com",
+		NextProtos:         []string{"h2"},
+		InsecureSkipVerify: true,
+	})
+	assert.NoError(t, err)
+	defer c.Close()
+
+	s := serverSettings(t, c)
+	assert.Equal(t, uint32(42), s[http2.SettingMaxConcurrentStreams])
+}
@@ -0,0 +1,140 @@
+package router
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+
+	connectid "github.com/hashicorp/consul/agent/connect"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/connect"
+	log "github.com/hashicorp/go-hclog"
+)
+
+// DisableRegistration stops the router registering itself as a Consul
+// service on start, used when the router runs without a local agent such as
+// in AWS Lambda
+func (r *Router) DisableRegistration() {
+	r.registerService = func(*api.AgentServiceRegistration) {}
+}
+
+// SetIdentity uses a pre-provisioned Connect identity instead of requesting
+// a leaf certificate from the Consul agent. The certificates are PEM encoded,
+// the service name is read from the SPIFFE ID of the certificate. Static
+// certificates are not renewed, the router must be restarted with new
+// certificates before they expire. Callers of the Connect listener are not
+// authorized by the agent, use SetIntentionChecker to enforce intentions.
+func (r *Router) SetIdentity(caPEM, certPEM, keyPEM []byte) error {
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("Unable to parse Connect CA certificate")
+	}
+
+	leaf, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("Unable to parse Connect certificate: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(leaf.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("Unable to parse Connect certificate: %s", err)
+	}
+
+	if time.Now().After(cert.NotAfter) {
+		return fmt.Errorf("Connect certificate expired at %s", cert.NotAfter.Format(time.RFC3339))
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, der := range leaf.Certificate[1:] {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("Unable to parse Connect certificate chain: %s", err)
+		}
+		intermediates.AddCert(c)
+	}
+
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("Connect certificate is not signed by the CA: %s", err)
+	}
+
+	if len(cert.URIs) == 0 {
+		return fmt.Errorf("Connect certificate does not contain a SPIFFE ID")
+	}
+
+	uri, err := connectid.ParseCertURI(cert.URIs[0])
+	if err != nil {
+		return fmt.Errorf("Invalid SPIFFE ID in Connect certificate: %s", err)
+	}
+
+	id, ok := uri.(*connectid.SpiffeIDService)
+	if !ok {
+		return fmt.Errorf("Connect certificate is not a service certificate: %s", cert.URIs[0])
+	}
+
+	// the base config matches the defaults of the Connect service, peer
+	// certificates are verified by the Connect hooks rather than by name
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ClientAuth:         tls.RequireAndVerifyClientCert,
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h2"},
+		Certificates:       []tls.Certificate{leaf},
+		RootCAs:            roots,
+		ClientCAs:          roots,
+	}
+
+	r.connectServiceFactory = func(string) (ConnectService, error) {
+		s, err := connect.NewDevServiceWithTLSConfig(
+			id.Service,
+			r.logger.StandardLogger(&log.StandardLoggerOptions{InferLevels: true}),
+			cfg,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		return &staticConnectService{
+			Service:          s,
+			resolverFromAddr: connect.ConsulResolverFromAddrFunc(r.consulClient),
+		}, nil
+	}
+
+	r.logger.Info("Using pre-provisioned Connect identity", "service", id.Service, "expires", cert.NotAfter)
+
+	return nil
+}
+
+// staticConnectService is a Connect service with static certificates, the
+// service does not have a Consul client so upstreams are resolved using the
+// router's client
+type staticConnectService struct {
+	*connect.Service
+	resolverFromAddr func(addr string) (connect.Resolver, error)
+}
+
+// ReadyWait returns a closed channel, static certificates are always ready
+// but the Connect service returns a nil channel which blocks forever
+func (s *staticConnectService) ReadyWait() <-chan struct{} {
+	ready := make(chan struct{})
+	close(ready)
+
+	return ready
+}
+
+// HTTPDialTLS resolves the upstream from the request address and dials it
+func (s *staticConnectService) HTTPDialTLS(network, addr string) (net.Conn, error) {
+	r, err := s.resolverFromAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Service.Dial(context.Background(), r)
+}
@@ -0,0 +1,225 @@
+package router
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	connectid "github.com/hashicorp/consul/agent/connect"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/connect"
+	log "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSpiffeID = "spiffe://11111111-2222-3333-4444-555555555555.consul/ns/default/dc/dc1/svc/"
+
+// issueIdentity returns PEM encoded Connect certificates for the service
+func issueIdentity(t *testing.T, ca *testCA, spiffe string) ([]byte, []byte) {
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "identity"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	if spiffe != "" {
+		u, _ := url.Parse(spiffe)
+		tmpl.URIs = []*url.URL{u}
+	}
+
+	cert, key := ca.issue(t, tmpl)
+
+	return pemCert(cert), pemKey(t, key)
+}
+
+func pemCert(c *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+}
+
+func pemKey(t *testing.T, k *ecdsa.PrivateKey) []byte {
+	der, err := x509.MarshalECPrivateKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func setupIdentityRouter(t *testing.T) *Router {
+	c, _ := api.NewClient(api.DefaultConfig())
+	r, _ := NewRouter(c, log.Default(), "", nil)
+
+	return r
+}
+
+func TestRunContextReturnsErrorWhenCertificatesNotReady(t *testing.T) {
+	r := setupRouterTests(t)
+	r.registerService = func(*api.AgentServiceRegistration) {}
+
+	ready := make(chan struct{})
+	s := &MockConnectService{}
+	s.On("ReadyWait").Return(ready)
+
+	created := 0
+	r.connectServiceFactory = func(name string) (ConnectService, error) {
+		created++
+		return s, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := r.RunContext(ctx)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Timed out waiting for Connect certificates")
+
+	close(ready)
+	err = r.RunContext(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, created, "Should reuse the Connect service")
+	assert.NotNil(t, r.httpClient)
+}
+
+func TestRunContextOnlyStartsOnce(t *testing.T) {
+	r := setupRouterTests(t)
+	registered := 0
+	r.registerService = func(*api.AgentServiceRegistration) { registered++ }
+	r.connectServiceFactory = func(name string) (ConnectService, error) {
+		return mockConnectService, nil
+	}
+
+	r.Run()
+	pool := r.http2Pool
+	r.Run()
+
+	assert.Equal(t, 1, registered)
+	assert.Equal(t, pool, r.http2Pool)
+}
+
+func TestDisableRegistrationDoesNotRegisterService(t *testing.T) {
+	registered := 0
+	agent := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/v1/agent/service/register" {
+			registered++
+		}
+	}))
+	defer agent.Close()
+
+	c, _ := api.NewClient(&api.Config{Address: agent.Listener.Addr().String()})
+	r, _ := NewRouter(c, log.Default(), "", nil)
+	setupRouterTests(t)
+	r.connectServiceFactory = func(name string) (ConnectService, error) {
+		return mockConnectService, nil
+	}
+
+	r.DisableRegistration()
+
+	assert.NoError(t, r.Run())
+	assert.Equal(t, 0, registered)
+}
+
+func TestSetIdentityUsesCertificateServiceName(t *testing.T) {
+	ca := newTestCA(t)
+	cert, key := issueIdentity(t, ca, testSpiffeID+"edge")
+
+	r := setupIdentityRouter(t)
+	err := r.SetIdentity(ca.pem(), cert, key)
+	assert.NoError(t, err)
+
+	s, err := r.connectServiceFactory("connect-router")
+	assert.NoError(t, err)
+
+	select {
+	case <-s.ReadyWait():
+	default:
+		t.Fatal("Static identity should be ready")
+	}
+
+	assert.Equal(t, "edge", s.(*staticConnectService).Name())
+}
+
+func TestSetIdentityReturnsErrorForInvalidCertificates(t *testing.T) {
+	ca := newTestCA(t)
+	other := newTestCA(t)
+	cert, key := issueIdentity(t, ca, testSpiffeID+"edge")
+	noID, noIDKey := issueIdentity(t, ca, "")
+	agent, agentKey := issueIdentity(t, ca, "spiffe://11111111-2222-3333-4444-555555555555.consul/agent/client/dc/dc1/id/node")
+
+	tests := []struct {
+		name           string
+		ca, cert, key  []byte
+		expectedErrMsg string
+	}{
+		{"invalid ca", []byte("nope"), cert, key, "Unable to parse Connect CA certificate"},
+		{"mismatched key", ca.pem(), cert, noIDKey, "Unable to parse Connect certificate"},
+		{"different ca", other.pem(), cert, key, "not signed by the CA"},
+		{"no spiffe id", ca.pem(), noID, noIDKey, "does not contain a SPIFFE ID"},
+		{"not a service", ca.pem(), agent, agentKey, "SPIFFE ID"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := setupIdentityRouter(t)
+			err := r.SetIdentity(tt.ca, tt.cert, tt.key)
+
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tt.expectedErrMsg)
+			}
+		})
+	}
+}
+
+func TestStaticIdentityDialsConnectServices(t *testing.T) {
+	ca := newTestCA(t)
+
+	// upstream service using the same CA
+	upstream := setupIdentityRouter(t)
+	cert, key := issueIdentity(t, ca, testSpiffeID+"api")
+	assert.NoError(t, upstream.SetIdentity(ca.pem(), cert, key))
+	us, _ := upstream.connectServiceFactory("api")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		tc := tls.Server(c, us.ServerTLSConfig())
+		tc.Write([]byte("hello"))
+		tc.Close()
+	}()
+
+	r := setupIdentityRouter(t)
+	cert, key = issueIdentity(t, ca, testSpiffeID+"edge")
+	assert.NoError(t, r.SetIdentity(ca.pem(), cert, key))
+	s, _ := r.connectServiceFactory("connect-router")
+
+	uri, _ := url.Parse(testSpiffeID + "api")
+	id, _ := connectid.ParseCertURI(uri)
+	s.(*staticConnectService).resolverFromAddr = func(addr string) (connect.Resolver, error) {
+		assert.Equal(t, "api.service.consul:443", addr)
+		return &connect.StaticResolver{Addr: l.Addr().String(), CertURI: id}, nil
+	}
+
+	conn, err := s.HTTPDialTLS("tcp", "api.service.consul:443")
+	if assert.NoError(t, err) {
+		defer conn.Close()
+
+		b := make([]byte, 5)
+		conn.Read(b)
+		assert.Equal(t, "hello", string(b))
+	}
+}
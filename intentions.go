@@ -0,0 +1,182 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// defaultIntentionCacheSize is the number of decisions cached when the
+// cache size is not set
+const defaultIntentionCacheSize = 10000
+
+var errInvalidSourceName = errors.New("Principal is not a valid intention source name")
+
+// IntentionConfig defines how external principals are checked against
+// Consul Connect intentions
+type IntentionConfig struct {
+	// SourcePrefix is prepended to the principal to build the intention
+	// source name, i.e. external- results in external-partner-a
+	SourcePrefix string
+	// CacheTTL is the time a decision is cached
+	CacheTTL time.Duration
+	// CacheSize is the maximum number of decisions cached, the least
+	// recently used decisions are evicted
+	CacheSize int
+	// FailOpen allows requests when Consul can not be contacted and there
+	// is no cached decision, by default requests are denied
+	FailOpen bool
+}
+
+// IntentionChecker authorizes external principals using Consul intentions,
+// the authenticated principal is mapped to a logical source service name and
+// checked against the destination upstream service
+type IntentionChecker struct {
+	client *api.Client
+	config IntentionConfig
+	now    func() time.Time
+	cache  *lru.Cache
+}
+
+type intentionDecision struct {
+	allowed bool
+	expires time.Time
+}
+
+// validSourceName matches principals which can be used as a service name
+// without being changed
+var validSourceName = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// NewIntentionChecker creates a checker, when the cache TTL is 0 decisions
+// are cached for 30 seconds
+func NewIntentionChecker(c *api.Client, config IntentionConfig) *IntentionChecker {
+	if config.CacheTTL == 0 {
+		config.CacheTTL = 30 * time.Second
+	}
+
+	if config.CacheSize <= 0 {
+		config.CacheSize = defaultIntentionCacheSize
+	}
+
+	// the size is always positive so New can not fail
+	cache, _ := lru.New(config.CacheSize)
+
+	return &IntentionChecker{
+		client: c,
+		config: config,
+		now:    time.Now,
+		cache:  cache,
+	}
+}
+
+// SourceName returns the intention source name for the request, the source
+// is derived from the authenticated principal or the verified client
+// certificate common name, unauthenticated requests use the name anonymous.
+// Principals which are not valid service names return an error rather than
+// being rewritten, which could map two principals to the same source.
+func (i *IntentionChecker) SourceName(req *http.Request) (string, error) {
+	principal := requestPrincipal(req)
+
+	if principal == "" && req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		principal = req.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+
+	if principal == "" {
+		principal = "anonymous"
+	}
+
+	if !validSourceName.MatchString(principal) {
+		return "", errInvalidSourceName
+	}
+
+	return i.config.SourcePrefix + principal, nil
+}
+
+// Allowed checks if the external source can connect to the destination
+// service, when Consul returns an error a stale cached decision is used
+// before falling back to the fail open setting
+func (i *IntentionChecker) Allowed(source, destination string) (bool, error) {
+	return i.check("external", source, destination, i.config.FailOpen)
+}
+
+// AllowedService checks if a service in the mesh can connect to the
+// destination service. Decisions are cached separately from external
+// sources and mesh callers are never allowed when there is no decision.
+func (i *IntentionChecker) AllowedService(source, destination string) (bool, error) {
+	return i.check("service", source, destination, false)
+}
+
+// check returns the cached decision for the source kind or queries Consul
+func (i *IntentionChecker) check(kind, source, destination string, failOpen bool) (bool, error) {
+	key := kind + "/" + source + "/" + destination
+	now := i.now()
+
+	var d intentionDecision
+	v, cached := i.cache.Get(key)
+	if cached {
+		d = v.(intentionDecision)
+	}
+
+	if cached && now.Before(d.expires) {
+		return d.allowed, nil
+	}
+
+	allowed, _, err := i.client.Connect().IntentionCheck(&api.IntentionCheck{
+		Source:      source,
+		Destination: destination,
+		SourceType:  api.IntentionSourceConsul,
+	}, nil)
+
+	if err != nil {
+		if cached {
+			return d.allowed, err
+		}
+
+		return failOpen, err
+	}
+
+	i.cache.Add(key, intentionDecision{allowed: allowed, expires: now.Add(i.config.CacheTTL)})
+
+	return allowed, nil
+}
+
+// authorizeIntentions checks the intentions for routes which require it,
+// when the request is denied a 403 is written to the response and false is
+// returned
+func (r *Router) authorizeIntentions(rw http.ResponseWriter, req *http.Request, us *Upstream) bool {
+	// callers on the Connect listener have already been authorized using
+	// their service identity
+	if !us.Intentions || connectSource(req) != "" {
+		return true
+	}
+
+	if r.intentions == nil {
+		r.logger.Error("Intention checks have not been configured", "upstream", us.Service)
+		http.Error(rw, "Authorization not configured", http.StatusInternalServerError)
+		return false
+	}
+
+	source, err := r.intentions.SourceName(req)
+	if err != nil {
+		r.logger.Info("Request denied by intentions", "principal", requestPrincipal(req), "error", err)
+		http.Error(rw, "Forbidden", http.StatusForbidden)
+		return false
+	}
+
+	allowed, err := r.intentions.Allowed(source, us.Service)
+	if err != nil {
+		r.logger.Error("Unable to check intentions", "source", source, "destination", us.Service, "error", err)
+	}
+
+	if !allowed {
+		r.logger.Info("Request denied by intentions", "source", source, "destination", us.Service)
+		http.Error(rw, "Forbidden", http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,176 @@
+package router
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setupIntentions adds an intention check endpoint to the stub which allows
+// the given source and destination pairs
+func setupIntentions(t *testing.T, config IntentionConfig, allowed map[string]bool) (*IntentionChecker, *int, *bool) {
+	stub, client := newConsulStub(t)
+	t.Cleanup(stub.Close)
+
+	calls := 0
+	fail := false
+	stub.mux.HandleFunc("/v1/connect/intentions/check", func(rw http.ResponseWriter, r *http.Request) {
+		calls++
+		if fail {
+			http.Error(rw, "no leader", http.StatusInternalServerError)
+			return
+		}
+
+		key := r.URL.Query().Get("source") + "/" + r.URL.Query().Get("destination")
+		stub.writeJSON(rw, map[string]bool{"Allowed": allowed[key]})
+	})
+
+	return NewIntentionChecker(client, config), &calls, &fail
+}
+
+func TestIntentionSourceNameUsesPrincipal(t *testing.T) {
+	ic, _, _ := setupIntentions(t, IntentionConfig{SourcePrefix: "external-"}, nil)
+	r := httptest.NewRequest("GET", "/", nil)
+
+	name, err := ic.SourceName(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "external-anonymous", name)
+
+	r = r.WithContext(contextWithPrincipal(r, "partner-a"))
+	name, err = ic.SourceName(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "external-partner-a", name)
+}
+
+func TestIntentionSourceNameRejectsInvalidServiceNames(t *testing.T) {
+	ic, _, _ := setupIntentions(t, IntentionConfig{SourcePrefix: "external-"}, nil)
+	r := httptest.NewRequest("GET", "/", nil)
+
+	for _, p := range []string{"Partner A@example.com", "partner_a", "Partner-A", "-partner"} {
+		_, err := ic.SourceName(r.WithContext(contextWithPrincipal(r, p)))
+		assert.Equal(t, errInvalidSourceName, err, p)
+	}
+}
+
+func TestIntentionSourceNameUsesClientCertificate(t *testing.T) {
+	ic, _, _ := setupIntentions(t, IntentionConfig{}, nil)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "billing"}}}},
+	}
+
+	name, err := ic.SourceName(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "billing", name)
+}
+
+func TestIntentionCheckerCachesDecisions(t *testing.T) {
+	ic, calls, _ := setupIntentions(t, IntentionConfig{CacheTTL: time.Minute}, map[string]bool{"partner/api": true})
+	now := time.Now()
+	ic.now = func() time.Time { return now }
+
+	allowed, err := ic.Allowed("partner", "api")
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+
+	allowed, _ = ic.Allowed("partner", "api")
+	assert.True(t, allowed)
+	assert.Equal(t, 1, *calls)
+
+	now = now.Add(2 * time.Minute)
+	ic.Allowed("partner", "api")
+	assert.Equal(t, 2, *calls, "Should have checked again after the TTL")
+
+	allowed, _ = ic.Allowed("other", "api")
+	assert.False(t, allowed)
+}
+
+func TestIntentionCheckerBoundsCache(t *testing.T) {
+	ic, calls, _ := setupIntentions(t, IntentionConfig{CacheSize: 2}, nil)
+
+	ic.Allowed("a", "api")
+	ic.Allowed("b", "api")
+	ic.Allowed("c", "api")
+	assert.Equal(t, 2, ic.cache.Len())
+
+	ic.Allowed("a", "api")
+	assert.Equal(t, 4, *calls, "Should have evicted the least recently used decision")
+}
+
+func TestIntentionCheckerCachesServicesSeparately(t *testing.T) {
+	ic, calls, fail := setupIntentions(t, IntentionConfig{FailOpen: true}, map[string]bool{"web/api": true})
+
+	allowed, _ := ic.Allowed("web", "api")
+	assert.True(t, allowed)
+
+	*fail = true
+
+	allowed, err := ic.AllowedService("web", "api")
+	assert.Error(t, err)
+	assert.False(t, allowed, "Should not use the decision for the external source or fail open")
+	assert.Equal(t, 2, *calls)
+}
+
+func TestIntentionCheckerFailsClosedByDefault(t *testing.T) {
+	ic, _, fail := setupIntentions(t, IntentionConfig{}, nil)
+	*fail = true
+
+	allowed, err := ic.Allowed("partner", "api")
+
+	assert.Error(t, err)
+	assert.False(t, allowed)
+}
+
+func TestIntentionCheckerFailsOpen(t *testing.T) {
+	ic, _, fail := setupIntentions(t, IntentionConfig{FailOpen: true}, nil)
+	*fail = true
+
+	allowed, err := ic.Allowed("partner", "api")
+
+	assert.Error(t, err)
+	assert.True(t, allowed)
+}
+
+func TestIntentionCheckerUsesStaleDecisionOnError(t *testing.T) {
+	ic, _, fail := setupIntentions(t, IntentionConfig{CacheTTL: time.Minute}, map[string]bool{"partner/api": true})
+	now := time.Now()
+	ic.now = func() time.Time { return now }
+
+	ic.Allowed("partner", "api")
+	*fail = true
+	now = now.Add(2 * time.Minute)
+
+	allowed, err := ic.Allowed("partner", "api")
+
+	assert.Error(t, err)
+	assert.True(t, allowed)
+}
+
+func TestHandlerReturnsForbiddenWhenDeniedByIntentions(t *testing.T) {
+	rec := setupRouterTests(t)
+	rec.intentions, _, _ = setupIntentions(t, IntentionConfig{}, map[string]bool{"anonymous/other": true})
+	rec.upstreams = append(rec.upstreams, Upstream{Service: "test", Path: "/test", Intentions: true})
+	rw := httptest.NewRecorder()
+
+	rec.Handler(rw, httptest.NewRequest("GET", "/test", nil))
+
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	mockHTTPClient.AssertNotCalled(t, "Do")
+}
+
+func TestHandlerAllowsRequestPermittedByIntentions(t *testing.T) {
+	rec := setupRouterTests(t)
+	rec.intentions, _, _ = setupIntentions(t, IntentionConfig{}, map[string]bool{"anonymous/test": true})
+	rec.upstreams = append(rec.upstreams, Upstream{Service: "test", Path: "/test", Intentions: true})
+	rw := httptest.NewRecorder()
+
+	rec.Handler(rw, httptest.NewRequest("GET", "/test", nil))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+}
@@ -0,0 +1,453 @@
+package router
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwksMinRefresh is the shortest interval between key set refreshes caused
+// by unknown key ids
+const jwksMinRefresh = 10 * time.Second
+
+var (
+	errJWTMalformed = errors.New("Malformed token")
+	errJWTSignature = errors.New("Invalid token signature")
+	errJWTNoKey     = errors.New("No key found to verify token")
+	errJWTExpired   = errors.New("Token has expired")
+	errJWTNoExpiry  = errors.New("Token has no expiry")
+	errJWTNotBefore = errors.New("Token is not valid yet")
+	errJWTIssuer    = errors.New("Invalid token issuer")
+	errJWTAudience  = errors.New("Invalid token audience")
+)
+
+// JWTConfig defines the keys and standard claims used to validate tokens
+type JWTConfig struct {
+	// KeyFiles are PEM encoded public keys or certificates used to verify
+	// RS256 and ES256 tokens
+	KeyFiles []string
+	// HMACSecretFile contains the shared secret used to verify HS256 tokens
+	HMACSecretFile string
+	// JWKSURL is the location of a JSON Web Key Set
+	JWKSURL string
+	// JWKSRefresh is the interval the key set is refreshed, unknown key ids
+	// also trigger a refresh
+	JWKSRefresh time.Duration
+	// Issuer is the required iss claim, ignored when empty
+	Issuer string
+	// Audience is the required aud claim, ignored when empty
+	Audience string
+	// ClockSkew is the leeway allowed when checking exp and nbf
+	ClockSkew time.Duration
+	// AllowMissingExp accepts tokens without an exp claim
+	AllowMissingExp bool
+}
+
+// jwtKey is a key used to verify a token signature
+type jwtKey struct {
+	kid string
+	alg string
+	key interface{}
+}
+
+// JWTValidator validates bearer tokens
+type JWTValidator struct {
+	config     JWTConfig
+	httpClient *http.Client
+	now        func() time.Time
+
+	mu          sync.Mutex
+	staticKeys  []jwtKey
+	jwksKeys    []jwtKey
+	jwksFetched time.Time
+	refreshing  chan struct{}
+}
+
+// NewJWTValidator creates a validator loading any static keys from disk
+func NewJWTValidator(c JWTConfig) (*JWTValidator, error) {
+	v := &JWTValidator{
+		config:     c,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		now:        time.Now,
+	}
+
+	if v.config.JWKSRefresh == 0 {
+		v.config.JWKSRefresh = 10 * time.Minute
+	}
+
+	for _, f := range c.KeyFiles {
+		k, err := loadPEMKey(f)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load key %s: %s", f, err)
+		}
+		v.staticKeys = append(v.staticKeys, k)
+	}
+
+	if c.HMACSecretFile != "" {
+		secret, err := ioutil.ReadFile(c.HMACSecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load secret %s: %s", c.HMACSecretFile, err)
+		}
+		v.staticKeys = append(v.staticKeys, jwtKey{alg: "HS256", key: []byte(strings.TrimSpace(string(secret)))})
+	}
+
+	return v, nil
+}
+
+// Validate checks the token signature and standard claims returning the
+// token claims
+func (v *JWTValidator) Validate(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errJWTMalformed
+	}
+
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errJWTMalformed
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errJWTMalformed
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errJWTMalformed
+	}
+
+	keys := v.keys(header.Kid)
+	if len(keys) == 0 {
+		return nil, errJWTNoKey
+	}
+
+	verified := false
+	for _, k := range keys {
+		if k.alg != header.Alg {
+			continue
+		}
+
+		if verifySignature(header.Alg, k.key, parts[0]+"."+parts[1], sig) {
+			verified = true
+			break
+		}
+	}
+
+	if !verified {
+		return nil, errJWTSignature
+	}
+
+	return claims, v.validateClaims(claims)
+}
+
+// validateClaims checks the expiry, not before, issuer and audience
+func (v *JWTValidator) validateClaims(claims map[string]interface{}) error {
+	now := v.now()
+
+	exp, ok := claims["exp"].(float64)
+	if !ok && !v.config.AllowMissingExp {
+		return errJWTNoExpiry
+	}
+
+	if ok && now.Add(-v.config.ClockSkew).After(time.Unix(int64(exp), 0)) {
+		return errJWTExpired
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Add(v.config.ClockSkew).Before(time.Unix(int64(nbf), 0)) {
+			return errJWTNotBefore
+		}
+	}
+
+	if v.config.Issuer != "" && claims["iss"] != v.config.Issuer {
+		return errJWTIssuer
+	}
+
+	if v.config.Audience != "" {
+		switch aud := claims["aud"].(type) {
+		case string:
+			if aud != v.config.Audience {
+				return errJWTAudience
+			}
+		case []interface{}:
+			found := false
+			for _, a := range aud {
+				if a == v.config.Audience {
+					found = true
+				}
+			}
+			if !found {
+				return errJWTAudience
+			}
+		default:
+			return errJWTAudience
+		}
+	}
+
+	return nil
+}
+
+// keys returns the keys which can be used to verify a token with the given
+// key id. A stale key set is refreshed in the background, when the id is not
+// known the caller waits for a refresh.
+func (v *JWTValidator) keys(kid string) []jwtKey {
+	v.mu.Lock()
+	if v.config.JWKSURL != "" && !v.jwksFetched.IsZero() && v.now().Sub(v.jwksFetched) > v.config.JWKSRefresh {
+		v.startRefresh()
+	}
+
+	keys := matchKeys(kid, v.staticKeys, v.jwksKeys)
+	if len(keys) > 0 || v.config.JWKSURL == "" {
+		v.mu.Unlock()
+		return keys
+	}
+
+	// the key may have been rotated, refresh at most every 10 seconds to
+	// avoid unknown key ids overloading the key server
+	done := v.refreshing
+	if done == nil && v.now().Sub(v.jwksFetched) > jwksMinRefresh {
+		done = v.startRefresh()
+	}
+	v.mu.Unlock()
+
+	if done == nil {
+		return keys
+	}
+	<-done
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return matchKeys(kid, v.staticKeys, v.jwksKeys)
+}
+
+func matchKeys(kid string, sets ...[]jwtKey) []jwtKey {
+	keys := []jwtKey{}
+	for _, set := range sets {
+		for _, k := range set {
+			if kid == "" || k.kid == "" || k.kid == kid {
+				keys = append(keys, k)
+			}
+		}
+	}
+
+	return keys
+}
+
+// startRefresh fetches the key set in the background unless a refresh is
+// already running, the returned channel is closed when the fetch completes.
+// The lock must be held.
+func (v *JWTValidator) startRefresh() chan struct{} {
+	if v.refreshing != nil {
+		return v.refreshing
+	}
+
+	done := make(chan struct{})
+	v.refreshing = done
+	v.jwksFetched = v.now()
+
+	go func() {
+		keys, err := v.fetchJWKS()
+
+		v.mu.Lock()
+		// on error the existing keys are retained
+		if err == nil {
+			v.jwksKeys = keys
+		}
+		v.refreshing = nil
+		v.mu.Unlock()
+
+		close(done)
+	}()
+
+	return done
+}
+
+// fetchJWKS downloads and parses the key set
+func (v *JWTValidator) fetchJWKS() ([]jwtKey, error) {
+	resp, err := v.httpClient.Get(v.config.JWKSURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+
+	set := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := []jwtKey{}
+	for _, jwk := range set.Keys {
+		if k, err := jwk.key(); err == nil {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys, nil
+}
+
+// jsonWebKey is a single key from a JWKS document
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+func (j jsonWebKey) key() (jwtKey, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeBigInt(j.N)
+		if err != nil {
+			return jwtKey{}, err
+		}
+		e, err := decodeBigInt(j.E)
+		if err != nil {
+			return jwtKey{}, err
+		}
+		return jwtKey{kid: j.Kid, alg: "RS256", key: &rsa.PublicKey{N: n, E: int(e.Int64())}}, nil
+	case "EC":
+		if j.Crv != "P-256" {
+			return jwtKey{}, fmt.Errorf("Unsupported curve %s", j.Crv)
+		}
+		x, err := decodeBigInt(j.X)
+		if err != nil {
+			return jwtKey{}, err
+		}
+		y, err := decodeBigInt(j.Y)
+		if err != nil {
+			return jwtKey{}, err
+		}
+		return jwtKey{kid: j.Kid, alg: "ES256", key: &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}}, nil
+	case "oct":
+		k, err := base64.RawURLEncoding.DecodeString(j.K)
+		if err != nil {
+			return jwtKey{}, err
+		}
+		return jwtKey{kid: j.Kid, alg: "HS256", key: k}, nil
+	}
+
+	return jwtKey{}, fmt.Errorf("Unsupported key type %s", j.Kty)
+}
+
+// loadPEMKey loads an RSA or ECDSA public key from a PEM encoded public key
+// or certificate
+func loadPEMKey(file string) (jwtKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return jwtKey{}, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return jwtKey{}, fmt.Errorf("No PEM data found")
+	}
+
+	var pub interface{}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return jwtKey{}, err
+		}
+		pub = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+
+	if err != nil {
+		return jwtKey{}, err
+	}
+
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return jwtKey{alg: "RS256", key: pub}, nil
+	case *ecdsa.PublicKey:
+		return jwtKey{alg: "ES256", key: pub}, nil
+	}
+
+	return jwtKey{}, fmt.Errorf("Unsupported key type %T", pub)
+}
+
+// verifySignature verifies the signature over the signing input
+func verifySignature(alg string, key interface{}, input string, sig []byte) bool {
+	h := sha256.Sum256([]byte(input))
+
+	switch alg {
+	case "HS256":
+		secret, ok := key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(input))
+		return hmac.Equal(sig, mac.Sum(nil))
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig) == nil
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(pub, h[:], r, s)
+	}
+
+	return false
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,324 @@
+package router
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var testRSAKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+var testECKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+// signTestJWT creates a token signed with the given algorithm and key, an
+// exp claim is added when not set and removed when set to nil
+func signTestJWT(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	c := map[string]interface{}{"exp": time.Now().Add(time.Hour).Unix()}
+	for k, v := range claims {
+		c[k] = v
+		if v == nil {
+			delete(c, k)
+		}
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(c)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	h := sha256.Sum256([]byte(input))
+
+	var sig []byte
+	switch alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(input))
+		sig = mac.Sum(nil)
+	case "RS256":
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, h[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), h[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func writeTestPublicKey(t *testing.T, dir, name string, pub interface{}) string {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := filepath.Join(dir, name)
+	ioutil.WriteFile(f, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+
+	return f
+}
+
+func setupJWTValidator(t *testing.T, c JWTConfig) *JWTValidator {
+	dir, err := ioutil.TempDir("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	secret := filepath.Join(dir, "secret")
+	ioutil.WriteFile(secret, []byte("s3cr3t\n"), 0600)
+
+	c.HMACSecretFile = secret
+	c.KeyFiles = []string{
+		writeTestPublicKey(t, dir, "rsa.pem", &testRSAKey.PublicKey),
+		writeTestPublicKey(t, dir, "ec.pem", &testECKey.PublicKey),
+	}
+
+	v, err := NewJWTValidator(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return v
+}
+
+func TestJWTValidatesSupportedAlgorithms(t *testing.T) {
+	v := setupJWTValidator(t, JWTConfig{})
+	claims := map[string]interface{}{"sub": "nic"}
+
+	tests := []struct {
+		alg string
+		key interface{}
+	}{
+		{"HS256", []byte("s3cr3t")},
+		{"RS256", testRSAKey},
+		{"ES256", testECKey},
+	}
+
+	for _, tt := range tests {
+		c, err := v.Validate(signTestJWT(t, tt.alg, "", tt.key, claims))
+
+		assert.NoError(t, err, tt.alg)
+		assert.Equal(t, "nic", c["sub"], tt.alg)
+	}
+}
+
+func TestJWTRejectsInvalidSignature(t *testing.T) {
+	v := setupJWTValidator(t, JWTConfig{})
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	_, err := v.Validate(signTestJWT(t, "RS256", "", other, map[string]interface{}{}))
+	assert.Equal(t, errJWTSignature, err)
+
+	_, err = v.Validate(signTestJWT(t, "HS256", "", []byte("wrong"), map[string]interface{}{}))
+	assert.Equal(t, errJWTSignature, err)
+
+	_, err = v.Validate("abc.def")
+	assert.Equal(t, errJWTMalformed, err)
+}
+
+func TestJWTRejectsAlgorithmNone(t *testing.T) {
+	v := setupJWTValidator(t, JWTConfig{})
+
+	_, err := v.Validate("eyJhbGciOiJub25lIn0.eyJzdWIiOiJuaWMifQ.")
+	assert.Equal(t, errJWTSignature, err)
+}
+
+func TestJWTValidatesStandardClaims(t *testing.T) {
+	v := setupJWTValidator(t, JWTConfig{Issuer: "auth", Audience: "api", ClockSkew: 30 * time.Second})
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		err    error
+	}{
+		{"valid", map[string]interface{}{"iss": "auth", "aud": "api", "exp": now.Add(time.Minute).Unix()}, nil},
+		{"audience array", map[string]interface{}{"iss": "auth", "aud": []string{"web", "api"}}, nil},
+		{"expired within skew", map[string]interface{}{"iss": "auth", "aud": "api", "exp": now.Add(-10 * time.Second).Unix()}, nil},
+		{"expired", map[string]interface{}{"iss": "auth", "aud": "api", "exp": now.Add(-time.Minute).Unix()}, errJWTExpired},
+		{"not before", map[string]interface{}{"iss": "auth", "aud": "api", "nbf": now.Add(time.Minute).Unix()}, errJWTNotBefore},
+		{"issuer", map[string]interface{}{"iss": "other", "aud": "api"}, errJWTIssuer},
+		{"audience", map[string]interface{}{"iss": "auth", "aud": "web"}, errJWTAudience},
+		{"no expiry", map[string]interface{}{"iss": "auth", "aud": "api", "exp": nil}, errJWTNoExpiry},
+	}
+
+	for _, tt := range tests {
+		_, err := v.Validate(signTestJWT(t, "ES256", "", testECKey, tt.claims))
+
+		assert.Equal(t, tt.err, err, tt.name)
+	}
+}
+
+func TestJWTAllowsMissingExpiryWhenConfigured(t *testing.T) {
+	v := setupJWTValidator(t, JWTConfig{AllowMissingExp: true})
+
+	_, err := v.Validate(signTestJWT(t, "ES256", "", testECKey, map[string]interface{}{"exp": nil}))
+	assert.NoError(t, err)
+}
+
+func TestJWTLoadsKeysFromJWKSAndRefreshesOnRotation(t *testing.T) {
+	key1, _ := rsa.GenerateKey(rand.Reader, 2048)
+	key2, _ := rsa.GenerateKey(rand.Reader, 2048)
+	current := map[string]*rsa.PrivateKey{"1": key1}
+	fetches := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		fetches++
+		keys := []map[string]string{}
+		for kid, k := range current {
+			keys = append(keys, map[string]string{
+				"kty": "RSA",
+				"kid": kid,
+				"n":   base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(rw).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer ts.Close()
+
+	v, err := NewJWTValidator(JWTConfig{JWKSURL: ts.URL, JWKSRefresh: time.Hour})
+	assert.NoError(t, err)
+	now := time.Now()
+	v.now = func() time.Time { return now }
+
+	_, err = v.Validate(signTestJWT(t, "RS256", "1", key1, map[string]interface{}{}))
+	assert.NoError(t, err)
+
+	_, err = v.Validate(signTestJWT(t, "RS256", "1", key1, map[string]interface{}{}))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fetches, "Should have cached the key set")
+
+	// rotate the key
+	current = map[string]*rsa.PrivateKey{"2": key2}
+	now = now.Add(time.Minute)
+
+	_, err = v.Validate(signTestJWT(t, "RS256", "2", key2, map[string]interface{}{}))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, fetches, "Should have refreshed the key set for an unknown key id")
+
+	_, err = v.Validate(signTestJWT(t, "RS256", "3", key2, map[string]interface{}{}))
+	assert.Equal(t, errJWTNoKey, err)
+	assert.Equal(t, 2, fetches, "Should not refresh again within the minimum interval")
+}
+
+func TestJWTDoesNotWaitForStaleKeySetRefresh(t *testing.T) {
+	block := make(chan struct{})
+	key := testRSAKey
+	var fetches int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&fetches, 1) > 1 {
+			<-block
+		}
+
+		json.NewEncoder(rw).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "1",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	defer ts.Close()
+	defer close(block)
+
+	v, err := NewJWTValidator(JWTConfig{JWKSURL: ts.URL, JWKSRefresh: time.Minute})
+	assert.NoError(t, err)
+
+	_, err = v.Validate(signTestJWT(t, "RS256", "1", key, map[string]interface{}{}))
+	assert.NoError(t, err)
+
+	// the key set is stale, the refresh blocks on the server
+	v.mu.Lock()
+	v.jwksFetched = time.Now().Add(-time.Hour)
+	v.mu.Unlock()
+
+	done := make(chan error)
+	go func() {
+		_, err := v.Validate(signTestJWT(t, "RS256", "1", key, map[string]interface{}{}))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Validation waited for the key set refresh")
+	}
+}
+
+func setupJWTRouter(t *testing.T) *Router {
+	rec := setupRouterTests(t)
+	rec.jwtValidator = setupJWTValidator(t, JWTConfig{})
+	rec.upstreams = append(rec.upstreams, Upstream{
+		Service:    "test",
+		Path:       "/test",
+		Auth:       AuthJWT,
+		JWTClaims:  map[string]string{"scope": "read"},
+		JWTHeaders: map[string]string{"sub": "X-User-ID"},
+	})
+
+	return rec
+}
+
+func TestHandlerReturnsUnauthorizedWithoutToken(t *testing.T) {
+	rec := setupJWTRouter(t)
+	rw := httptest.NewRecorder()
+
+	rec.Handler(rw, httptest.NewRequest("GET", "/test", nil))
+
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	assert.Contains(t, rw.Header().Get("WWW-Authenticate"), "Bearer")
+	mockHTTPClient.AssertNotCalled(t, "Do")
+}
+
+func TestHandlerReturnsForbiddenWhenClaimMissing(t *testing.T) {
+	rec := setupJWTRouter(t)
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/test", nil)
+	r.Header.Set("Authorization", "Bearer "+signTestJWT(t, "RS256", "", testRSAKey, map[string]interface{}{"scope": "write"}))
+
+	rec.Handler(rw, r)
+
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+}
+
+func TestHandlerForwardsClaimsAsHeaders(t *testing.T) {
+	rec := setupJWTRouter(t)
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/test", nil)
+	r.Header.Set("Authorization", "Bearer "+signTestJWT(t, "RS256", "", testRSAKey, map[string]interface{}{"sub": "nic", "scope": "read write"}))
+	r.Header.Set("X-User-ID", "spoofed")
+
+	rec.Handler(rw, r)
+
+	mockHTTPClient.AssertCalled(t, "Do", mock.Anything)
+	req := mockHTTPClient.Calls[0].Arguments.Get(0).(*http.Request)
+
+	assert.Equal(t, []string{"nic"}, req.Header["X-User-Id"])
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ALBTargetGroupRequest is the event sent by an ALB target group, the
+// vendored events package predates ALB support
+type ALBTargetGroupRequest struct {
+	HTTPMethod                      string                       `json:"httpMethod"`
+	Path                            string                       `json:"path"`
+	QueryStringParameters           map[string]string            `json:"queryStringParameters,omitempty"`
+	MultiValueQueryStringParameters map[string][]string          `json:"multiValueQueryStringParameters,omitempty"`
+	Headers                         map[string]string            `json:"headers,omitempty"`
+	MultiValueHeaders               map[string][]string          `json:"multiValueHeaders,omitempty"`
+	RequestContext                  ALBTargetGroupRequestContext `json:"requestContext"`
+	IsBase64Encoded                 bool                         `json:"isBase64Encoded"`
+	Body                            string                       `json:"body"`
+}
+
+// ALBTargetGroupRequestContext identifies the target group
+type ALBTargetGroupRequestContext struct {
+	ELB ELBContext `json:"elb"`
+}
+
+// ELBContext contains the target group ARN
+type ELBContext struct {
+	TargetGroupArn string `json:"targetGroupArn"`
+}
+
+// ALBTargetGroupResponse is the response for an ALB target group, multi
+// value headers must only be set when the target group has multi value
+// headers enabled
+type ALBTargetGroupResponse struct {
+	StatusCode        int                 `json:"statusCode"`
+	StatusDescription string              `json:"statusDescription"`
+	Headers           map[string]string   `json:"headers,omitempty"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders,omitempty"`
+	Body              string              `json:"body"`
+	IsBase64Encoded   bool                `json:"isBase64Encoded"`
+}
+
+// multiValue returns true when the target group has multi value headers
+// enabled, the event then only contains the multi value fields
+func (e ALBTargetGroupRequest) multiValue() bool {
+	return e.MultiValueHeaders != nil || e.MultiValueQueryStringParameters != nil
+}
+
+// newALBRequest converts the event to a request for the router, the ALB
+// does not decode query strings so the values are unescaped
+func newALBRequest(e ALBTargetGroupRequest) (*http.Request, error) {
+	body := []byte(e.Body)
+	if e.IsBase64Encoded {
+		b, err := base64.StdEncoding.DecodeString(e.Body)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decode request body: %s", err)
+		}
+		body = b
+	}
+
+	req, err := http.NewRequest(e.HTTPMethod, "http://localhost", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	for k, vs := range queryValues(e.QueryStringParameters, e.MultiValueQueryStringParameters) {
+		k = unescapeQuery(k)
+		for _, v := range vs {
+			query.Add(k, unescapeQuery(v))
+		}
+	}
+
+	req.URL.Path = e.Path
+	req.URL.RawQuery = query.Encode()
+	req.RequestURI = req.URL.RequestURI()
+	req.Header = headerValues(e.Headers, e.MultiValueHeaders)
+
+	if h := req.Header.Get("Host"); h != "" {
+		req.Host = h
+	}
+
+	// the ALB appends the client address to X-Forwarded-For
+	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+		parts := strings.Split(xff, ",")
+		req.RemoteAddr = strings.TrimSpace(parts[len(parts)-1])
+	}
+
+	return req, nil
+}
+
+func unescapeQuery(s string) string {
+	u, err := url.QueryUnescape(s)
+	if err != nil {
+		return s
+	}
+
+	return u
+}
+
+// ALBResponse returns the response for an ALB target group
+func (l *LambdaResponseWriter) ALBResponse(multiValue bool) ALBTargetGroupResponse {
+	body, encoded := l.Body()
+	status := l.StatusCode()
+
+	resp := ALBTargetGroupResponse{
+		StatusCode:        status,
+		StatusDescription: fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Body:              body,
+		IsBase64Encoded:   encoded,
+	}
+
+	if multiValue {
+		resp.MultiValueHeaders = map[string][]string{}
+	} else {
+		resp.Headers = map[string]string{}
+	}
+
+	for k, v := range l.Header() {
+		if len(v) == 0 {
+			continue
+		}
+
+		if multiValue {
+			resp.MultiValueHeaders[k] = v
+		} else {
+			// without multi value headers only the last value is returned
+			resp.Headers[k] = v[len(v)-1]
+		}
+	}
+
+	return resp
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/nicholasjackson/consul-connect-router/serverless/serverlesstest"
+	"github.com/stretchr/testify/assert"
+)
+
+func albEvent(method, path string) ALBTargetGroupRequest {
+	return ALBTargetGroupRequest{
+		HTTPMethod: method,
+		Path:       path,
+		RequestContext: ALBTargetGroupRequestContext{
+			ELB: ELBContext{TargetGroupArn: "arn:aws:elasticloadbalancing:eu-west-1:123456789012:targetgroup/router/abc"},
+		},
+	}
+}
+
+func TestALBHandlerConvertsEvents(t *testing.T) {
+	tests := []struct {
+		name  string
+		event func() ALBTargetGroupRequest
+		check func(t *testing.T, req *http.Request)
+	}{
+		{
+			name: "headers and client address",
+			event: func() ALBTargetGroupRequest {
+				e := albEvent("GET", "/api")
+				e.Headers = map[string]string{"host": "api.example.com", "x-forwarded-for": "198.51.100.1, 203.0.113.7"}
+				return e
+			},
+			check: func(t *testing.T, req *http.Request) {
+				assert.Equal(t, "GET", req.Method)
+				assert.Equal(t, "/api", req.URL.Path)
+				assert.Equal(t, "api.example.com", req.Host)
+				assert.Equal(t, "203.0.113.7", req.RemoteAddr)
+			},
+		},
+		{
+			name: "encoded query strings",
+			event: func() ALBTargetGroupRequest {
+				e := albEvent("GET", "/api")
+				e.QueryStringParameters = map[string]string{"q": "a%20b", "name": "nic%26co"}
+				return e
+			},
+			check: func(t *testing.T, req *http.Request) {
+				assert.Equal(t, "a b", req.URL.Query().Get("q"))
+				assert.Equal(t, "nic&co", req.URL.Query().Get("name"))
+			},
+		},
+		{
+			name: "multi value headers and query strings",
+			event: func() ALBTargetGroupRequest {
+				e := albEvent("GET", "/api")
+				e.MultiValueHeaders = map[string][]string{"x-tag": {"a", "b"}}
+				e.MultiValueQueryStringParameters = map[string][]string{"id": {"1", "2"}}
+				return e
+			},
+			check: func(t *testing.T, req *http.Request) {
+				assert.Equal(t, []string{"a", "b"}, req.Header["X-Tag"])
+				assert.Equal(t, []string{"1", "2"}, req.URL.Query()["id"])
+			},
+		},
+		{
+			name: "base64 encoded body",
+			event: func() ALBTargetGroupRequest {
+				e := albEvent("POST", "/api")
+				e.Body = base64.StdEncoding.EncodeToString([]byte("hello"))
+				e.IsBase64Encoded = true
+				return e
+			},
+			check: func(t *testing.T, req *http.Request) {
+				assert.Equal(t, int64(5), req.ContentLength)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req *http.Request
+			handler = func(rw http.ResponseWriter, r *http.Request) { req = r }
+
+			_, err := ALBHandler(tt.event())
+			assert.NoError(t, err)
+
+			if assert.NotNil(t, req) {
+				tt.check(t, req)
+			}
+		})
+	}
+}
+
+func TestALBHandlerReturnsHeadersForTargetGroupMode(t *testing.T) {
+	single := albEvent("GET", "/api")
+	single.Headers = map[string]string{}
+
+	multi := albEvent("GET", "/api")
+	multi.MultiValueHeaders = map[string][]string{}
+
+	tests := []struct {
+		name     string
+		event    ALBTargetGroupRequest
+		expected ALBTargetGroupResponse
+	}{
+		{
+			name:  "single value",
+			event: single,
+			expected: ALBTargetGroupResponse{
+				StatusCode:        http.StatusNotFound,
+				StatusDescription: "404 Not Found",
+				Headers:           map[string]string{"Content-Type": "text/plain", "Set-Cookie": "b=2"},
+				Body:              "missing",
+			},
+		},
+		{
+			name:  "multi value",
+			event: multi,
+			expected: ALBTargetGroupResponse{
+				StatusCode:        http.StatusNotFound,
+				StatusDescription: "404 Not Found",
+				MultiValueHeaders: map[string][]string{"Content-Type": {"text/plain"}, "Set-Cookie": {"a=1", "b=2"}},
+				Body:              "missing",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler = func(rw http.ResponseWriter, r *http.Request) {
+				rw.Header().Set("Content-Type", "text/plain")
+				rw.Header().Add("Set-Cookie", "a=1")
+				rw.Header().Add("Set-Cookie", "b=2")
+				rw.WriteHeader(http.StatusNotFound)
+				rw.Write([]byte("missing"))
+			}
+
+			resp, err := ALBHandler(tt.event)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, resp)
+		})
+	}
+}
+
+func invokeALB(t *testing.T, h http.Handler, req serverlesstest.Request) serverlesstest.Response {
+	e := albEvent(req.Method, req.Path)
+	e.MultiValueHeaders = map[string][]string{}
+	for k, v := range req.Header {
+		e.MultiValueHeaders[k] = v
+	}
+
+	// the ALB does not decode query strings
+	e.MultiValueQueryStringParameters = map[string][]string{}
+	for k, vs := range req.Query {
+		for _, v := range vs {
+			e.MultiValueQueryStringParameters[k] = append(e.MultiValueQueryStringParameters[k], url.QueryEscape(v))
+		}
+	}
+
+	e.Body = base64.StdEncoding.EncodeToString(req.Body)
+	e.IsBase64Encoded = true
+
+	handler = h.ServeHTTP
+	resp, err := ALBHandler(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte(resp.Body)
+	if resp.IsBase64Encoded {
+		body, _ = base64.StdEncoding.DecodeString(resp.Body)
+	}
+
+	return serverlesstest.Response{StatusCode: resp.StatusCode, Header: resp.MultiValueHeaders, Body: body}
+}
+
+func TestALBMultiValueConformance(t *testing.T) {
+	serverlesstest.Run(t, invokeALB)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/nicholasjackson/consul-connect-router/serverless"
+)
+
+// APIGatewayProxyRequest is the API Gateway proxy event including the multi
+// value headers and query strings which are missing from the vendored events
+// package
+type APIGatewayProxyRequest struct {
+	events.APIGatewayProxyRequest
+	MultiValueHeaders               map[string][]string `json:"multiValueHeaders"`
+	MultiValueQueryStringParameters map[string][]string `json:"multiValueQueryStringParameters"`
+}
+
+// APIGatewayProxyResponse is the API Gateway proxy response including multi
+// value headers
+type APIGatewayProxyResponse struct {
+	events.APIGatewayProxyResponse
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders,omitempty"`
+}
+
+// stripStage removes the stage from the start of the request path, API
+// Gateway includes it when the API is called with the execute-api hostname
+var stripStage = true
+
+// newAPIGatewayRequest converts the event to a request for the router
+func newAPIGatewayRequest(e APIGatewayProxyRequest) (*http.Request, error) {
+	body := []byte(e.Body)
+	if e.IsBase64Encoded {
+		b, err := base64.StdEncoding.DecodeString(e.Body)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decode request body: %s", err)
+		}
+		body = b
+	}
+
+	req, err := http.NewRequest(e.HTTPMethod, "http://localhost", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.URL.Path = eventPath(e)
+	req.URL.RawQuery = queryValues(e.QueryStringParameters, e.MultiValueQueryStringParameters).Encode()
+	req.RequestURI = req.URL.RequestURI()
+	req.Header = headerValues(e.Headers, e.MultiValueHeaders)
+
+	if h := req.Header.Get("Host"); h != "" {
+		req.Host = h
+	}
+
+	if ip := e.RequestContext.Identity.SourceIP; ip != "" {
+		req.RemoteAddr = ip
+	}
+
+	return req, nil
+}
+
+// eventPath returns the request path, the path is built from the resource
+// and path parameters when API Gateway does not send it i.e. test
+// invocations
+func eventPath(e APIGatewayProxyRequest) string {
+	p := e.Path
+	if p == "" {
+		p = e.Resource
+		for k, v := range e.PathParameters {
+			p = strings.Replace(p, "{"+k+"+}", v, -1)
+			p = strings.Replace(p, "{"+k+"}", url.PathEscape(v), -1)
+		}
+	}
+
+	stage := e.RequestContext.Stage
+	if stripStage && stage != "" && (p == "/"+stage || strings.HasPrefix(p, "/"+stage+"/")) {
+		p = strings.TrimPrefix(p, "/"+stage)
+	}
+
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+
+	return p
+}
+
+// queryValues merges the single and multi value query strings, multi value
+// parameters contain every value
+func queryValues(single map[string]string, multi map[string][]string) url.Values {
+	v := url.Values{}
+
+	for k, s := range single {
+		v.Set(k, s)
+	}
+
+	for k, m := range multi {
+		v[k] = append([]string{}, m...)
+	}
+
+	return v
+}
+
+// headerValues merges the single and multi value headers
+func headerValues(single map[string]string, multi map[string][]string) http.Header {
+	h := http.Header{}
+
+	for k, s := range single {
+		h.Set(k, s)
+	}
+
+	for k, m := range multi {
+		h.Del(k)
+		for _, s := range m {
+			h.Add(k, s)
+		}
+	}
+
+	return h
+}
+
+// LambdaResponseWriter buffers the router response so it can be returned
+// from the Lambda handler
+type LambdaResponseWriter struct {
+	*serverless.ResponseWriter
+}
+
+// NewLambdaResponseWriter creates a response writer
+func NewLambdaResponseWriter() *LambdaResponseWriter {
+	return &LambdaResponseWriter{serverless.NewResponseWriter()}
+}
+
+// Body returns the response body and whether it must be base64 encoded
+func (l *LambdaResponseWriter) Body() (string, bool) {
+	b := l.Bytes()
+	if serverless.IsBinary(l.Header(), b) {
+		return base64.StdEncoding.EncodeToString(b), true
+	}
+
+	return string(b), false
+}
+
+// APIGatewayResponse returns the response for API Gateway
+func (l *LambdaResponseWriter) APIGatewayResponse() APIGatewayProxyResponse {
+	body, encoded := l.Body()
+
+	resp := APIGatewayProxyResponse{
+		APIGatewayProxyResponse: events.APIGatewayProxyResponse{
+			StatusCode:      l.StatusCode(),
+			Headers:         map[string]string{},
+			Body:            body,
+			IsBase64Encoded: encoded,
+		},
+		MultiValueHeaders: map[string][]string{},
+	}
+
+	for k, v := range l.Header() {
+		if len(v) == 0 {
+			continue
+		}
+
+		resp.Headers[k] = v[0]
+		resp.MultiValueHeaders[k] = v
+	}
+
+	return resp
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// APIGatewayV2HTTPRequest is the payload format version 2.0 event sent by
+// API Gateway HTTP APIs
+type APIGatewayV2HTTPRequest struct {
+	Version               string                         `json:"version"`
+	RouteKey              string                         `json:"routeKey"`
+	RawPath               string                         `json:"rawPath"`
+	RawQueryString        string                         `json:"rawQueryString"`
+	Cookies               []string                       `json:"cookies,omitempty"`
+	Headers               map[string]string              `json:"headers"`
+	QueryStringParameters map[string]string              `json:"queryStringParameters,omitempty"`
+	PathParameters        map[string]string              `json:"pathParameters,omitempty"`
+	StageVariables        map[string]string              `json:"stageVariables,omitempty"`
+	RequestContext        APIGatewayV2HTTPRequestContext `json:"requestContext"`
+	Body                  string                         `json:"body,omitempty"`
+	IsBase64Encoded       bool                           `json:"isBase64Encoded"`
+}
+
+// APIGatewayV2HTTPRequestContext contains the details of the HTTP request
+type APIGatewayV2HTTPRequestContext struct {
+	AccountID  string                                        `json:"accountId"`
+	APIID      string                                        `json:"apiId"`
+	DomainName string                                        `json:"domainName"`
+	RequestID  string                                        `json:"requestId"`
+	Stage      string                                        `json:"stage"`
+	HTTP       APIGatewayV2HTTPRequestContextHTTPDescription `json:"http"`
+}
+
+// APIGatewayV2HTTPRequestContextHTTPDescription is the method, path and
+// caller of the request
+type APIGatewayV2HTTPRequestContextHTTPDescription struct {
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Protocol  string `json:"protocol"`
+	SourceIP  string `json:"sourceIp"`
+	UserAgent string `json:"userAgent"`
+}
+
+// APIGatewayV2HTTPResponse is the payload format version 2.0 response,
+// multiple header values are comma separated and cookies are returned
+// separately
+type APIGatewayV2HTTPResponse struct {
+	StatusCode      int               `json:"statusCode"`
+	Headers         map[string]string `json:"headers,omitempty"`
+	Body            string            `json:"body"`
+	IsBase64Encoded bool              `json:"isBase64Encoded"`
+	Cookies         []string          `json:"cookies,omitempty"`
+}
+
+// newAPIGatewayV2Request converts the event to a request for the router
+func newAPIGatewayV2Request(e APIGatewayV2HTTPRequest) (*http.Request, error) {
+	body := []byte(e.Body)
+	if e.IsBase64Encoded {
+		b, err := base64.StdEncoding.DecodeString(e.Body)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decode request body: %s", err)
+		}
+		body = b
+	}
+
+	req, err := http.NewRequest(e.RequestContext.HTTP.Method, "http://localhost", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	p := e.RawPath
+	if p == "" {
+		p = e.RequestContext.HTTP.Path
+	}
+
+	// the stage is part of the raw path for stages other than $default
+	stage := e.RequestContext.Stage
+	if stripStage && stage != "" && stage != "$default" && (p == "/"+stage || strings.HasPrefix(p, "/"+stage+"/")) {
+		p = strings.TrimPrefix(p, "/"+stage)
+	}
+
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+
+	req.URL.Path = p
+	req.URL.RawQuery = e.RawQueryString
+	req.RequestURI = req.URL.RequestURI()
+	req.Header = headerValues(e.Headers, nil)
+
+	if len(e.Cookies) > 0 {
+		req.Header.Set("Cookie", strings.Join(e.Cookies, "; "))
+	}
+
+	req.Host = e.RequestContext.DomainName
+	if h := req.Header.Get("Host"); h != "" {
+		req.Host = h
+	}
+
+	if ip := e.RequestContext.HTTP.SourceIP; ip != "" {
+		req.RemoteAddr = ip
+	}
+
+	return req, nil
+}
+
+// APIGatewayV2Response returns the response for an HTTP API
+func (l *LambdaResponseWriter) APIGatewayV2Response() APIGatewayV2HTTPResponse {
+	body, encoded := l.Body()
+
+	resp := APIGatewayV2HTTPResponse{
+		StatusCode:      l.StatusCode(),
+		Headers:         map[string]string{},
+		Body:            body,
+		IsBase64Encoded: encoded,
+	}
+
+	for k, v := range l.Header() {
+		if len(v) == 0 {
+			continue
+		}
+
+		if k == "Set-Cookie" {
+			resp.Cookies = append(resp.Cookies, v...)
+			continue
+		}
+
+		resp.Headers[k] = strings.Join(v, ",")
+	}
+
+	return resp
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func apiGatewayV2Event(method, path string) APIGatewayV2HTTPRequest {
+	e := APIGatewayV2HTTPRequest{
+		Version:  "2.0",
+		RouteKey: "$default",
+		RawPath:  path,
+		Headers:  map[string]string{},
+	}
+	e.RequestContext.Stage = "$default"
+	e.RequestContext.DomainName = "abc.execute-api.eu-west-1.amazonaws.com"
+	e.RequestContext.HTTP.Method = method
+	e.RequestContext.HTTP.Path = path
+	e.RequestContext.HTTP.SourceIP = "203.0.113.7"
+
+	return e
+}
+
+func TestAPIGatewayV2HandlerConvertsEvents(t *testing.T) {
+	tests := []struct {
+		name  string
+		event func() APIGatewayV2HTTPRequest
+		check func(t *testing.T, req *http.Request)
+	}{
+		{
+			name:  "method path host and source ip",
+			event: func() APIGatewayV2HTTPRequest { return apiGatewayV2Event("PUT", "/api/users/1") },
+			check: func(t *testing.T, req *http.Request) {
+				assert.Equal(t, "PUT", req.Method)
+				assert.Equal(t, "/api/users/1", req.URL.Path)
+				assert.Equal(t, "abc.execute-api.eu-west-1.amazonaws.com", req.Host)
+				assert.Equal(t, "203.0.113.7", req.RemoteAddr)
+			},
+		},
+		{
+			name: "raw query string",
+			event: func() APIGatewayV2HTTPRequest {
+				e := apiGatewayV2Event("GET", "/api")
+				e.RawQueryString = "id=1&id=2&q=a%20b"
+				return e
+			},
+			check: func(t *testing.T, req *http.Request) {
+				assert.Equal(t, []string{"1", "2"}, req.URL.Query()["id"])
+				assert.Equal(t, "a b", req.URL.Query().Get("q"))
+			},
+		},
+		{
+			name: "headers and cookies",
+			event: func() APIGatewayV2HTTPRequest {
+				e := apiGatewayV2Event("GET", "/api")
+				e.Headers = map[string]string{"host": "api.example.com", "accept": "text/plain,application/json"}
+				e.Cookies = []string{"a=1", "b=2"}
+				return e
+			},
+			check: func(t *testing.T, req *http.Request) {
+				assert.Equal(t, "api.example.com", req.Host)
+				assert.Equal(t, "text/plain,application/json", req.Header.Get("Accept"))
+
+				c, err := req.Cookie("b")
+				assert.NoError(t, err)
+				assert.Equal(t, "2", c.Value)
+			},
+		},
+		{
+			name: "named stage",
+			event: func() APIGatewayV2HTTPRequest {
+				e := apiGatewayV2Event("GET", "/prod/api")
+				e.RequestContext.Stage = "prod"
+				return e
+			},
+			check: func(t *testing.T, req *http.Request) {
+				assert.Equal(t, "/api", req.URL.Path)
+			},
+		},
+		{
+			name: "base64 encoded body",
+			event: func() APIGatewayV2HTTPRequest {
+				e := apiGatewayV2Event("POST", "/api")
+				e.Body = base64.StdEncoding.EncodeToString([]byte("hello"))
+				e.IsBase64Encoded = true
+				return e
+			},
+			check: func(t *testing.T, req *http.Request) {
+				assert.Equal(t, int64(5), req.ContentLength)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req *http.Request
+			handler = func(rw http.ResponseWriter, r *http.Request) { req = r }
+
+			_, err := APIGatewayV2Handler(tt.event())
+			assert.NoError(t, err)
+
+			if assert.NotNil(t, req) {
+				tt.check(t, req)
+			}
+		})
+	}
+}
+
+func TestAPIGatewayV2HandlerReturnsCookiesAndJoinedHeaders(t *testing.T) {
+	handler = func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Add("Vary", "Accept")
+		rw.Header().Add("Vary", "Origin")
+		rw.Header().Add("Set-Cookie", "a=1")
+		rw.Header().Add("Set-Cookie", "b=2")
+		rw.Write([]byte(`{}`))
+	}
+
+	resp, err := APIGatewayV2Handler(apiGatewayV2Event("GET", "/api"))
+
+	assert.NoError(t, err)
+	assert.Equal(t, APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Headers:    map[string]string{"Content-Type": "application/json", "Vary": "Accept,Origin"},
+		Body:       "{}",
+		Cookies:    []string{"a=1", "b=2"},
+	}, resp)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	router "github.com/nicholasjackson/consul-connect-router"
+)
+
+// initTimeout is the maximum time an invocation waits for the router to
+// start, the invocation deadline also applies
+var initTimeout = 10 * time.Second
+
+// newRouter creates the router on the first invocation
+var newRouter = routerFromEnv
+
+var (
+	initMu  sync.Mutex
+	initErr error
+)
+
+// initRouter starts the router when it is not already running, the router
+// and its Connect certificates are reused by warm invocations. When the
+// router does not start in time the next invocation continues waiting for
+// the same Connect service.
+func initRouter(ctx context.Context) error {
+	initMu.Lock()
+	defer initMu.Unlock()
+
+	if handler != nil {
+		return nil
+	}
+
+	if cr == nil {
+		r, err := newRouter()
+		if err != nil {
+			initErr = err
+			return err
+		}
+
+		cr = r
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, initTimeout)
+	defer cancel()
+
+	err := cr.RunContext(ctx)
+	if err != nil {
+		initErr = err
+		return err
+	}
+
+	initErr = nil
+	handler = cr.Handler
+
+	return nil
+}
+
+// route serves the request with the router, requests fail with service
+// unavailable when the router has not started
+func route(rw http.ResponseWriter, req *http.Request) {
+	if handler == nil {
+		http.Error(rw, fmt.Sprintf("Connect Router is not ready: %s", initErr), http.StatusServiceUnavailable)
+		return
+	}
+
+	handler(rw, req)
+}
+
+// routerFromEnv creates the router from the function environment
+func routerFromEnv() (*router.Router, error) {
+	config := api.DefaultConfig()
+	config.Address = os.Getenv("CONSUL_ADDR")
+
+	// Create a Consul API client
+	consulClient, err := api.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create consul client: %s", err)
+	}
+
+	upstreams := strings.Split(os.Getenv("UPSTREAMS"), ",")
+
+	r, err := router.NewRouter(consulClient, logger, "", upstreams)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create router: %s", err)
+	}
+
+	if os.Getenv("SKIP_REGISTRATION") == "true" {
+		r.DisableRegistration()
+	}
+
+	ca, cert, key, err := identityFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	if cert != nil {
+		err := r.SetIdentity(ca, cert, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// identityFromEnv loads the pre-provisioned Connect certificates, nil is
+// returned when no certificates are configured and the router requests them
+// from the Consul agent
+func identityFromEnv() ([]byte, []byte, []byte, error) {
+	params := []string{"CONNECT_CA_CERT", "CONNECT_CERT", "CONNECT_KEY"}
+	values := make([][]byte, len(params))
+	missing := []string{}
+
+	for i, p := range params {
+		v, err := loadParameter(p)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		if v == nil {
+			missing = append(missing, p)
+		}
+
+		values[i] = v
+	}
+
+	if len(missing) == len(params) {
+		return nil, nil, nil, nil
+	}
+
+	if len(missing) > 0 {
+		return nil, nil, nil, fmt.Errorf("Connect identity is missing %s", strings.Join(missing, ", "))
+	}
+
+	return values[0], values[1], values[2], nil
+}
+
+// loadParameter returns the value of the environment variable or the
+// contents of the file named by the variable with a _FILE suffix, such as a
+// parameter written by an SSM layer or extension. Escaped newlines in
+// environment values are expanded so PEM values can be set on one line.
+func loadParameter(name string) ([]byte, error) {
+	if v := os.Getenv(name); v != "" {
+		return []byte(strings.Replace(v, `\n`, "\n", -1)), nil
+	}
+
+	f := os.Getenv(name + "_FILE")
+	if f == "" {
+		return nil, nil
+	}
+
+	d, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read %s: %s", name, err)
+	}
+
+	return d, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	router "github.com/nicholasjackson/consul-connect-router"
+	"github.com/stretchr/testify/assert"
+)
+
+const v2Event = `{"version":"2.0","routeKey":"$default","rawPath":"/api","rawQueryString":"","requestContext":{"stage":"$default","http":{"method":"GET","path":"/api"}}}`
+
+// setupInit resets the router state and counts the routers created
+func setupInit(t *testing.T) *int {
+	cr, handler, initErr = nil, nil, nil
+
+	created := 0
+	newRouter = func() (*router.Router, error) {
+		created++
+		return routerFromEnv()
+	}
+
+	initTimeout = 50 * time.Millisecond
+
+	t.Setenv("CONSUL_ADDR", "127.0.0.1:1")
+	t.Setenv("SKIP_REGISTRATION", "true")
+	t.Setenv("UPSTREAMS", "service=billing#path=/billing")
+	t.Cleanup(func() {
+		cr, handler, initErr = nil, nil, nil
+		newRouter = routerFromEnv
+	})
+
+	return &created
+}
+
+// testIdentity returns PEM encoded CA, certificate and key for the service
+func testIdentity(t *testing.T, service string) (string, string, string) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Connect CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	u, _ := url.Parse("spiffe://11111111-2222-3333-4444-555555555555.consul/ns/default/dc/dc1/svc/" + service)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: service},
+		URIs:         []*url.URL{u},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+func TestHandlerReturnsServiceUnavailableWhenRouterDoesNotStart(t *testing.T) {
+	created := setupInit(t)
+
+	for i := 0; i < 2; i++ {
+		resp, err := Handler(context.Background(), json.RawMessage(v2Event))
+		assert.NoError(t, err)
+
+		r := resp.(APIGatewayV2HTTPResponse)
+		assert.Equal(t, http.StatusServiceUnavailable, r.StatusCode)
+		assert.Contains(t, r.Body, "Timed out waiting for Connect certificates")
+	}
+
+	assert.Equal(t, 1, *created, "Should reuse the router between invocations")
+}
+
+func TestHandlerStartsRouterWithPreProvisionedIdentity(t *testing.T) {
+	created := setupInit(t)
+
+	ca, cert, key := testIdentity(t, "edge")
+	t.Setenv("CONNECT_CA_CERT", strings.Replace(ca, "\n", `\n`, -1))
+	t.Setenv("CONNECT_CERT", cert)
+
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	ioutil.WriteFile(keyFile, []byte(key), 0600)
+	t.Setenv("CONNECT_KEY_FILE", keyFile)
+
+	for i := 0; i < 2; i++ {
+		resp, err := Handler(context.Background(), json.RawMessage(v2Event))
+		assert.NoError(t, err)
+
+		// the request does not match the upstream
+		assert.Equal(t, http.StatusNotFound, resp.(APIGatewayV2HTTPResponse).StatusCode)
+	}
+
+	assert.Equal(t, 1, *created, "Should reuse the router between invocations")
+}
+
+func TestHandlerReturnsServiceUnavailableForIncompleteIdentity(t *testing.T) {
+	created := setupInit(t)
+	t.Setenv("CONNECT_CERT", "cert")
+
+	resp, err := Handler(context.Background(), json.RawMessage(v2Event))
+	assert.NoError(t, err)
+
+	r := resp.(APIGatewayV2HTTPResponse)
+	assert.Equal(t, http.StatusServiceUnavailable, r.StatusCode)
+	assert.Contains(t, r.Body, "Connect identity is missing CONNECT_CA_CERT, CONNECT_KEY")
+
+	Handler(context.Background(), json.RawMessage(v2Event))
+	assert.Equal(t, 2, *created, "Should retry creating the router")
+}
+
+func TestLoadParameter(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "param")
+	ioutil.WriteFile(file, []byte("from file"), 0600)
+
+	t.Setenv("TEST_VALUE", `line1\nline2`)
+	t.Setenv("TEST_FILE_VALUE_FILE", file)
+	t.Setenv("TEST_MISSING_FILE_VALUE_FILE", filepath.Join(t.TempDir(), "missing"))
+
+	v, err := loadParameter("TEST_VALUE")
+	assert.NoError(t, err)
+	assert.Equal(t, "line1\nline2", string(v))
+
+	v, err = loadParameter("TEST_FILE_VALUE")
+	assert.NoError(t, err)
+	assert.Equal(t, "from file", string(v))
+
+	v, err = loadParameter("TEST_UNSET_VALUE")
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+
+	_, err = loadParameter("TEST_MISSING_FILE_VALUE")
+	assert.Error(t, err)
+}
@@ -1,24 +1,27 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"os"
-	"strings"
+	"time"
 
-	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/hashicorp/consul/api"
 	log "github.com/hashicorp/go-hclog"
 	router "github.com/nicholasjackson/consul-connect-router"
 )
 
 var cr *router.Router
 
+// handler serves the requests converted from Lambda events
+var handler http.HandlerFunc
+
+var logger = log.Default()
+
 // Enables capability to run the router in AWS lambda
 func main() {
-
-	logger := log.Default()
 	logger.Info("Starting Connect Router for AWS Lambda v0.1.2")
 
 	switch os.Getenv("LOG_LEVEL") {
@@ -28,76 +31,129 @@ func main() {
 		logger.SetLevel(log.Trace)
 	}
 
-	config := api.DefaultConfig()
-	config.Address = os.Getenv("CONSUL_ADDR")
+	stripStage = os.Getenv("STRIP_STAGE") != "false"
 
-	// Create a Consul API client
-	consulClient, err := api.NewClient(config)
-	if err != nil {
-		logger.Error("Unable to create consul client", "error", err)
-		return
+	if t := os.Getenv("INIT_TIMEOUT"); t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			logger.Error("Invalid INIT_TIMEOUT", "error", err)
+		} else {
+			initTimeout = d
+		}
 	}
 
-	upstreams := strings.Split(os.Getenv("UPSTREAMS"), ",")
+	// the router is started by the first invocation so the init phase is not
+	// blocked waiting for the Connect certificates
+	lambda.Start(Handler)
+}
 
-	// Create and start the router
-	cr, err = router.NewRouter(consulClient, logger, "", upstreams)
+// Handler detects the type of the event and returns the matching response,
+// API Gateway REST and HTTP APIs and ALB target groups are supported. The
+// router is started by the first invocation, when it fails to start the
+// response has the status service unavailable.
+func Handler(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	err := initRouter(ctx)
 	if err != nil {
-		logger.Error("Unable to create router", "error", err)
-		return
+		logger.Error("Unable to start router", "error", err)
 	}
 
-	err = cr.Run()
+	switch eventType(payload) {
+	case eventALB:
+		e := ALBTargetGroupRequest{}
+		err := json.Unmarshal(payload, &e)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse ALB event: %s", err)
+		}
+
+		return ALBHandler(e)
+	case eventAPIGatewayV2:
+		e := APIGatewayV2HTTPRequest{}
+		err := json.Unmarshal(payload, &e)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse API Gateway event: %s", err)
+		}
+
+		return APIGatewayV2Handler(e)
+	}
+
+	e := APIGatewayProxyRequest{}
+	err = json.Unmarshal(payload, &e)
 	if err != nil {
-		logger.Error("Unable to start router", err)
+		return nil, fmt.Errorf("Unable to parse API Gateway event: %s", err)
 	}
 
-	lambda.Start(Handler)
+	return APIGatewayHandler(e)
 }
 
-type Request struct {
-	ID    float64 `json:"id"`
-	Value string  `json:"value"`
-}
+// event types handled by the router
+const (
+	eventAPIGateway   = "apigateway"
+	eventAPIGatewayV2 = "apigatewayv2"
+	eventALB          = "alb"
+)
 
-type Response struct {
-	Message string `json:"message"`
-	Ok      bool   `json:"ok"`
+// eventType returns the type of the event, ALB events contain the target
+// group and HTTP API events use payload format version 2.0
+func eventType(payload json.RawMessage) string {
+	e := struct {
+		Version        string `json:"version"`
+		RequestContext struct {
+			ELB  *json.RawMessage `json:"elb"`
+			HTTP *json.RawMessage `json:"http"`
+		} `json:"requestContext"`
+	}{}
+
+	json.Unmarshal(payload, &e)
+
+	switch {
+	case e.RequestContext.ELB != nil:
+		return eventALB
+	case e.Version == "2.0" || e.RequestContext.HTTP != nil:
+		return eventAPIGatewayV2
+	}
+
+	return eventAPIGateway
 }
 
-// Handler is your Lambda function handler
-// It uses Amazon API Gateway request/responses provided by the aws-lambda-go/events package,
-// However you could use other event sources (S3, Kinesis etc), or JSON-decoded primitive types such as 'string'.
-func Handler(r events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	// build the request for the router
-	req, err := http.NewRequest(r.HTTPMethod, "http://localhost"+r.Path, bytes.NewReader([]byte(r.Body)))
+// APIGatewayHandler converts the API Gateway proxy event to a request for
+// the router and returns the router response
+func APIGatewayHandler(e APIGatewayProxyRequest) (APIGatewayProxyResponse, error) {
+	req, err := newAPIGatewayRequest(e)
 	if err != nil {
-		return events.APIGatewayProxyResponse{
-			StatusCode: http.StatusInternalServerError,
-		}, err
+		resp := APIGatewayProxyResponse{}
+		resp.StatusCode = http.StatusBadRequest
+		return resp, err
 	}
 
-	pr := events.APIGatewayProxyResponse{}
-	rw := &LambdaResponseWriter{&pr}
-
-	cr.Handler(rw, req)
+	rw := NewLambdaResponseWriter()
+	route(rw, req)
 
-	return pr, nil
+	return rw.APIGatewayResponse(), nil
 }
 
-type LambdaResponseWriter struct {
-	pr *events.APIGatewayProxyResponse
-}
+// APIGatewayV2Handler handles HTTP API events
+func APIGatewayV2Handler(e APIGatewayV2HTTPRequest) (APIGatewayV2HTTPResponse, error) {
+	req, err := newAPIGatewayV2Request(e)
+	if err != nil {
+		return APIGatewayV2HTTPResponse{StatusCode: http.StatusBadRequest}, err
+	}
 
-func (l *LambdaResponseWriter) Header() http.Header {
-	return http.Header{}
-}
+	rw := NewLambdaResponseWriter()
+	route(rw, req)
 
-func (l *LambdaResponseWriter) Write(data []byte) (int, error) {
-	l.pr.Body = string(data)
-	return len(data), nil
+	return rw.APIGatewayV2Response(), nil
 }
 
-func (l *LambdaResponseWriter) WriteHeader(statusCode int) {
-	l.pr.StatusCode = statusCode
+// ALBHandler handles ALB target group events, the response uses multi
+// value headers when they are enabled for the target group
+func ALBHandler(e ALBTargetGroupRequest) (ALBTargetGroupResponse, error) {
+	req, err := newALBRequest(e)
+	if err != nil {
+		return ALBTargetGroupResponse{StatusCode: http.StatusBadRequest, StatusDescription: "400 Bad Request"}, err
+	}
+
+	rw := NewLambdaResponseWriter()
+	route(rw, req)
+
+	return rw.ALBResponse(e.multiValue()), nil
 }
@@ -1 +1,346 @@
 package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/nicholasjackson/consul-connect-router/serverless/serverlesstest"
+	"github.com/stretchr/testify/assert"
+)
+
+func apiGatewayEvent(method, path string) APIGatewayProxyRequest {
+	e := APIGatewayProxyRequest{}
+	e.HTTPMethod = method
+	e.Path = path
+	e.RequestContext.Stage = "prod"
+	e.RequestContext.Identity.SourceIP = "203.0.113.7"
+
+	return e
+}
+
+func TestHandlerConvertsAPIGatewayEvents(t *testing.T) {
+	tests := []struct {
+		name  string
+		event func() APIGatewayProxyRequest
+		check func(t *testing.T, req *http.Request, body string)
+	}{
+		{
+			name:  "method path and source ip",
+			event: func() APIGatewayProxyRequest { return apiGatewayEvent("DELETE", "/api/users/1") },
+			check: func(t *testing.T, req *http.Request, body string) {
+				assert.Equal(t, "DELETE", req.Method)
+				assert.Equal(t, "/api/users/1", req.URL.Path)
+				assert.Equal(t, "203.0.113.7", req.RemoteAddr)
+			},
+		},
+		{
+			name: "single value query strings",
+			event: func() APIGatewayProxyRequest {
+				e := apiGatewayEvent("GET", "/api")
+				e.QueryStringParameters = map[string]string{"q": "a b", "page": "2"}
+				return e
+			},
+			check: func(t *testing.T, req *http.Request, body string) {
+				assert.Equal(t, "a b", req.URL.Query().Get("q"))
+				assert.Equal(t, "2", req.URL.Query().Get("page"))
+			},
+		},
+		{
+			name: "multi value query strings",
+			event: func() APIGatewayProxyRequest {
+				e := apiGatewayEvent("GET", "/api")
+				e.QueryStringParameters = map[string]string{"id": "2"}
+				e.MultiValueQueryStringParameters = map[string][]string{"id": {"1", "2"}}
+				return e
+			},
+			check: func(t *testing.T, req *http.Request, body string) {
+				assert.Equal(t, []string{"1", "2"}, req.URL.Query()["id"])
+			},
+		},
+		{
+			name: "single and multi value headers",
+			event: func() APIGatewayProxyRequest {
+				e := apiGatewayEvent("GET", "/api")
+				e.Headers = map[string]string{"Host": "api.example.com", "accept": "text/plain", "X-Tag": "b"}
+				e.MultiValueHeaders = map[string][]string{"x-tag": {"a", "b"}}
+				return e
+			},
+			check: func(t *testing.T, req *http.Request, body string) {
+				assert.Equal(t, "api.example.com", req.Host)
+				assert.Equal(t, "text/plain", req.Header.Get("Accept"))
+				assert.Equal(t, []string{"a", "b"}, req.Header["X-Tag"])
+			},
+		},
+		{
+			name: "text body",
+			event: func() APIGatewayProxyRequest {
+				e := apiGatewayEvent("POST", "/api")
+				e.Body = `{"name":"nic"}`
+				return e
+			},
+			check: func(t *testing.T, req *http.Request, body string) {
+				assert.Equal(t, `{"name":"nic"}`, body)
+				assert.Equal(t, int64(14), req.ContentLength)
+			},
+		},
+		{
+			name: "base64 encoded body",
+			event: func() APIGatewayProxyRequest {
+				e := apiGatewayEvent("POST", "/api")
+				e.Body = base64.StdEncoding.EncodeToString([]byte{0xff, 0x00, 0x01})
+				e.IsBase64Encoded = true
+				return e
+			},
+			check: func(t *testing.T, req *http.Request, body string) {
+				assert.Equal(t, string([]byte{0xff, 0x00, 0x01}), body)
+			},
+		},
+		{
+			name:  "stage prefix",
+			event: func() APIGatewayProxyRequest { return apiGatewayEvent("GET", "/prod/api/users") },
+			check: func(t *testing.T, req *http.Request, body string) {
+				assert.Equal(t, "/api/users", req.URL.Path)
+			},
+		},
+		{
+			name:  "stage only",
+			event: func() APIGatewayProxyRequest { return apiGatewayEvent("GET", "/prod") },
+			check: func(t *testing.T, req *http.Request, body string) {
+				assert.Equal(t, "/", req.URL.Path)
+			},
+		},
+		{
+			name:  "path starting with the stage name",
+			event: func() APIGatewayProxyRequest { return apiGatewayEvent("GET", "/production/api") },
+			check: func(t *testing.T, req *http.Request, body string) {
+				assert.Equal(t, "/production/api", req.URL.Path)
+			},
+		},
+		{
+			name: "path parameters without a path",
+			event: func() APIGatewayProxyRequest {
+				e := apiGatewayEvent("GET", "")
+				e.Resource = "/api/{group}/{proxy+}"
+				e.PathParameters = map[string]string{"group": "admins", "proxy": "users/1"}
+				return e
+			},
+			check: func(t *testing.T, req *http.Request, body string) {
+				assert.Equal(t, "/api/admins/users/1", req.URL.Path)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req *http.Request
+			var body []byte
+			handler = func(rw http.ResponseWriter, r *http.Request) {
+				req = r
+				body, _ = ioutil.ReadAll(r.Body)
+			}
+
+			_, err := APIGatewayHandler(tt.event())
+			assert.NoError(t, err)
+
+			if assert.NotNil(t, req) {
+				tt.check(t, req, string(body))
+			}
+		})
+	}
+}
+
+func TestHandlerRejectsInvalidBase64Body(t *testing.T) {
+	e := apiGatewayEvent("POST", "/api")
+	e.Body = "not base64!"
+	e.IsBase64Encoded = true
+
+	resp, err := APIGatewayHandler(e)
+
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestHandlerReturnsAPIGatewayResponses(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		expected APIGatewayProxyResponse
+	}{
+		{
+			name:    "default status",
+			handler: func(rw http.ResponseWriter, r *http.Request) {},
+			expected: APIGatewayProxyResponse{
+				APIGatewayProxyResponse: events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Headers: map[string]string{}},
+				MultiValueHeaders:       map[string][]string{},
+			},
+		},
+		{
+			name: "headers and status",
+			handler: func(rw http.ResponseWriter, r *http.Request) {
+				rw.Header().Set("Content-Type", "application/json")
+				rw.Header().Add("Set-Cookie", "a=1")
+				rw.Header().Add("Set-Cookie", "b=2")
+				rw.WriteHeader(http.StatusCreated)
+				rw.WriteHeader(http.StatusInternalServerError)
+				rw.Write([]byte(`{"ok":true}`))
+			},
+			expected: APIGatewayProxyResponse{
+				APIGatewayProxyResponse: events.APIGatewayProxyResponse{
+					StatusCode: http.StatusCreated,
+					Headers:    map[string]string{"Content-Type": "application/json", "Set-Cookie": "a=1"},
+					Body:       `{"ok":true}`,
+				},
+				MultiValueHeaders: map[string][]string{"Content-Type": {"application/json"}, "Set-Cookie": {"a=1", "b=2"}},
+			},
+		},
+		{
+			name: "multiple writes",
+			handler: func(rw http.ResponseWriter, r *http.Request) {
+				rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				rw.Write([]byte("hello "))
+				rw.Write([]byte("world"))
+			},
+			expected: APIGatewayProxyResponse{
+				APIGatewayProxyResponse: events.APIGatewayProxyResponse{
+					StatusCode: http.StatusOK,
+					Headers:    map[string]string{"Content-Type": "text/plain; charset=utf-8"},
+					Body:       "hello world",
+				},
+				MultiValueHeaders: map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}},
+			},
+		},
+		{
+			name: "binary content type",
+			handler: func(rw http.ResponseWriter, r *http.Request) {
+				rw.Header().Set("Content-Type", "image/png")
+				rw.Write([]byte("png"))
+			},
+			expected: APIGatewayProxyResponse{
+				APIGatewayProxyResponse: events.APIGatewayProxyResponse{
+					StatusCode:      http.StatusOK,
+					Headers:         map[string]string{"Content-Type": "image/png"},
+					Body:            base64.StdEncoding.EncodeToString([]byte("png")),
+					IsBase64Encoded: true,
+				},
+				MultiValueHeaders: map[string][]string{"Content-Type": {"image/png"}},
+			},
+		},
+		{
+			name: "compressed text",
+			handler: func(rw http.ResponseWriter, r *http.Request) {
+				rw.Header().Set("Content-Type", "text/html")
+				rw.Header().Set("Content-Encoding", "gzip")
+				rw.Write([]byte("gz"))
+			},
+			expected: APIGatewayProxyResponse{
+				APIGatewayProxyResponse: events.APIGatewayProxyResponse{
+					StatusCode:      http.StatusOK,
+					Headers:         map[string]string{"Content-Type": "text/html", "Content-Encoding": "gzip"},
+					Body:            base64.StdEncoding.EncodeToString([]byte("gz")),
+					IsBase64Encoded: true,
+				},
+				MultiValueHeaders: map[string][]string{"Content-Type": {"text/html"}, "Content-Encoding": {"gzip"}},
+			},
+		},
+		{
+			name: "binary body without content type",
+			handler: func(rw http.ResponseWriter, r *http.Request) {
+				rw.Write([]byte{0xff, 0xfe})
+			},
+			expected: APIGatewayProxyResponse{
+				APIGatewayProxyResponse: events.APIGatewayProxyResponse{
+					StatusCode:      http.StatusOK,
+					Headers:         map[string]string{},
+					Body:            base64.StdEncoding.EncodeToString([]byte{0xff, 0xfe}),
+					IsBase64Encoded: true,
+				},
+				MultiValueHeaders: map[string][]string{},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler = tt.handler
+
+			resp, err := APIGatewayHandler(apiGatewayEvent("GET", "/api"))
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, resp)
+		})
+	}
+}
+
+func TestHandlerDetectsEventType(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  string
+		expected interface{}
+	}{
+		{
+			name:     "api gateway rest",
+			payload:  `{"resource":"/{proxy+}","path":"/api","httpMethod":"GET","requestContext":{"stage":"prod","httpMethod":"GET"}}`,
+			expected: APIGatewayProxyResponse{},
+		},
+		{
+			name:     "api gateway http payload version 1.0",
+			payload:  `{"version":"1.0","path":"/api","httpMethod":"GET","requestContext":{"stage":"$default"}}`,
+			expected: APIGatewayProxyResponse{},
+		},
+		{
+			name:     "api gateway http payload version 2.0",
+			payload:  `{"version":"2.0","routeKey":"$default","rawPath":"/api","rawQueryString":"","requestContext":{"stage":"$default","http":{"method":"GET","path":"/api"}}}`,
+			expected: APIGatewayV2HTTPResponse{},
+		},
+		{
+			name:     "alb",
+			payload:  `{"requestContext":{"elb":{"targetGroupArn":"arn:aws:elasticloadbalancing:eu-west-1:123456789012:targetgroup/router/abc"}},"httpMethod":"GET","path":"/api","headers":{}}`,
+			expected: ALBTargetGroupResponse{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var path string
+			handler = func(rw http.ResponseWriter, r *http.Request) {
+				path = r.URL.Path
+			}
+
+			resp, err := Handler(context.Background(), json.RawMessage(tt.payload))
+
+			assert.NoError(t, err)
+			assert.IsType(t, tt.expected, resp)
+			assert.Equal(t, "/api", path)
+		})
+	}
+}
+
+func invokeAPIGateway(t *testing.T, h http.Handler, req serverlesstest.Request) serverlesstest.Response {
+	e := apiGatewayEvent(req.Method, req.Path)
+	e.MultiValueQueryStringParameters = req.Query
+	e.MultiValueHeaders = req.Header
+	e.Body = base64.StdEncoding.EncodeToString(req.Body)
+	e.IsBase64Encoded = true
+
+	handler = h.ServeHTTP
+	resp, err := APIGatewayHandler(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte(resp.Body)
+	if resp.IsBase64Encoded {
+		body, _ = base64.StdEncoding.DecodeString(resp.Body)
+	}
+
+	return serverlesstest.Response{StatusCode: resp.StatusCode, Header: resp.MultiValueHeaders, Body: body}
+}
+
+func TestAPIGatewayConformance(t *testing.T) {
+	serverlesstest.Run(t, invokeAPIGateway)
+}
@@ -0,0 +1,724 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	connectid "github.com/hashicorp/consul/agent/connect"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/connect"
+	log "github.com/hashicorp/go-hclog"
+)
+
+// LoadBalancerPolicy selects the instance of a Connect service used for each
+// request
+type LoadBalancerPolicy string
+
+// Load balancer policies, hash sends requests with the same key to the same
+// instance while instances do not change and nearest prefers the instances
+// with the lowest RTT from the router
+const (
+	LoadBalancerRoundRobin   LoadBalancerPolicy = "round_robin"
+	LoadBalancerLeastRequest LoadBalancerPolicy = "least_request"
+	LoadBalancerP2C          LoadBalancerPolicy = "p2c"
+	LoadBalancerHash         LoadBalancerPolicy = "hash"
+	LoadBalancerNearest      LoadBalancerPolicy = "nearest"
+)
+
+// hashRingReplicas is the number of points for each instance on the hash ring
+const hashRingReplicas = 100
+
+// poolIdleTimeout is how long a service is watched after its last request
+const poolIdleTimeout = 10 * time.Minute
+
+// errNoHealthyInstances is returned when a service has no healthy instances
+var errNoHealthyInstances = errors.New("No healthy instances of upstream")
+
+// parseHashOn validates the key used by hash routes, the key is the client
+// IP, header:[name] or cookie:[name]
+func parseHashOn(s string) error {
+	if s == "ip" {
+		return nil
+	}
+
+	kv := strings.SplitN(s, ":", 2)
+	if len(kv) != 2 || kv[1] == "" || (kv[0] != "header" && kv[0] != "cookie") {
+		return fmt.Errorf("Invalid hash key: %s", s)
+	}
+
+	return nil
+}
+
+// hashKey returns the key of the request, requests without the header or
+// cookie return an empty key
+func hashKey(hashOn string, req *http.Request) string {
+	kv := strings.SplitN(hashOn, ":", 2)
+
+	switch kv[0] {
+	case "header":
+		return req.Header.Get(kv[1])
+	case "cookie":
+		c, err := req.Cookie(kv[1])
+		if err != nil {
+			return ""
+		}
+		return c.Value
+	}
+
+	// the router sets X-Forwarded-For to the client address
+	xff := req.Header["X-Forwarded-For"]
+	if len(xff) == 0 {
+		return ""
+	}
+
+	if host, _, err := net.SplitHostPort(xff[0]); err == nil {
+		return host
+	}
+
+	return xff[0]
+}
+
+// connectInstance is a healthy instance of a Connect service
+type connectInstance struct {
+	id      string
+	addr    string
+	node    string
+	certURI connectid.CertURI
+	// active is the number of requests in progress
+	active int64
+	// removed is set when the instance has left the catalog
+	removed int32
+	health  instanceHealth
+}
+
+type hashPoint struct {
+	hash     uint64
+	instance *connectInstance
+}
+
+// loadBalancer selects instances of Connect services, the instances of each
+// service are watched with blocking queries
+type loadBalancer struct {
+	client      *api.Client
+	logger      log.Logger
+	waitTimeout time.Duration
+	idleTimeout time.Duration
+	coordinates *coordinateCache
+	conns       *connTracker
+	now         func() time.Time
+	ctx         context.Context
+	cancel      context.CancelFunc
+	reaper      sync.Once
+
+	mu    sync.Mutex
+	pools map[string]*instancePool
+	// drain is called with the address of instances which have left the
+	// catalog once they have no requests in progress
+	drain func(addr string)
+}
+
+func newLoadBalancer(c *api.Client, l log.Logger) *loadBalancer {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &loadBalancer{
+		client:      c,
+		logger:      l,
+		waitTimeout: 5 * time.Minute,
+		idleTimeout: poolIdleTimeout,
+		coordinates: newCoordinateCache(c, l),
+		conns:       &connTracker{conns: map[string]map[*trackedConn]struct{}{}},
+		now:         time.Now,
+		ctx:         ctx,
+		cancel:      cancel,
+		pools:       map[string]*instancePool{},
+	}
+}
+
+// pool returns the instances of the service in the datacenter, the service
+// is watched from the first request until it has been idle for the idle
+// timeout
+func (b *loadBalancer) pool(service, datacenter string) *instancePool {
+	key := service + "/" + datacenter
+
+	b.reaper.Do(func() { go b.removeIdlePools() })
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	p, ok := b.pools[key]
+	if !ok {
+		ctx, cancel := context.WithCancel(b.ctx)
+
+		p = &instancePool{
+			balancer:   b,
+			service:    service,
+			datacenter: datacenter,
+			ctx:        ctx,
+			cancel:     cancel,
+			ready:      make(chan struct{}),
+		}
+		b.pools[key] = p
+
+		go p.watch(ctx)
+	}
+
+	p.lastUsed = b.now()
+
+	return p
+}
+
+// removeIdlePools stops watching services which have not been used for the
+// idle timeout until the balancer is closed
+func (b *loadBalancer) removeIdlePools() {
+	t := time.NewTicker(b.idleTimeout / 2)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-t.C:
+			b.removeIdle()
+		}
+	}
+}
+
+// removeIdle removes the pools which have not been used for the idle timeout,
+// connections to their instances are drained
+func (b *loadBalancer) removeIdle() {
+	b.mu.Lock()
+	idle := []*instancePool{}
+	for key, p := range b.pools {
+		if b.now().Sub(p.lastUsed) >= b.idleTimeout {
+			delete(b.pools, key)
+			idle = append(idle, p)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, p := range idle {
+		b.logger.Debug("Removing idle upstream", "upstream", p.service, "datacenter", p.datacenter)
+
+		p.cancel()
+
+		p.mu.RLock()
+		instances := p.instances
+		p.mu.RUnlock()
+
+		for _, i := range instances {
+			b.remove(i)
+		}
+	}
+}
+
+// remove marks an instance which has left the catalog, the connections to
+// the instance are drained when it has no requests in progress
+func (b *loadBalancer) remove(i *connectInstance) {
+	atomic.StoreInt32(&i.removed, 1)
+	b.drainIdle(i)
+}
+
+// drainIdle drains the connections to a removed instance which has no
+// requests in progress
+func (b *loadBalancer) drainIdle(i *connectInstance) {
+	if atomic.LoadInt32(&i.removed) == 0 || atomic.LoadInt64(&i.active) > 0 {
+		return
+	}
+
+	b.mu.Lock()
+	drain := b.drain
+	b.mu.Unlock()
+
+	if drain != nil {
+		drain(i.addr)
+	}
+}
+
+// certURI returns the identity of the instance at the address
+func (b *loadBalancer) certURI(addr string) connectid.CertURI {
+	b.mu.Lock()
+	pools := make([]*instancePool, 0, len(b.pools))
+	for _, p := range b.pools {
+		pools = append(pools, p)
+	}
+	b.mu.Unlock()
+
+	for _, p := range pools {
+		p.mu.RLock()
+		for _, i := range p.instances {
+			if i.addr == addr {
+				p.mu.RUnlock()
+				return i.certURI
+			}
+		}
+		p.mu.RUnlock()
+	}
+
+	return nil
+}
+
+// Close stops watching services and coordinates
+func (b *loadBalancer) Close() {
+	b.cancel()
+}
+
+// instancePool holds the healthy Connect instances of a service
+type instancePool struct {
+	balancer   *loadBalancer
+	service    string
+	datacenter string
+	ctx        context.Context
+	cancel     context.CancelFunc
+	// ready is closed when the instances have been loaded
+	ready       chan struct{}
+	next        uint32
+	healthCheck sync.Once
+	// lastUsed is the time of the last request, guarded by the balancer's
+	// lock
+	lastUsed time.Time
+
+	mu          sync.RWMutex
+	instances   []*connectInstance
+	ring        []hashPoint
+	index       uint64
+	trustDomain string
+	err         error
+}
+
+// pick returns an instance using the route's policy, ejected and unhealthy
+// instances are only used when no other instances are available. The
+// instances are loaded before the first request is balanced. The excluded
+// instance is never returned.
+func (p *instancePool) pick(ctx context.Context, us *Upstream, key string, exclude *connectInstance) (*connectInstance, error) {
+	select {
+	case <-p.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	all := []*connectInstance{}
+	for _, i := range p.instances {
+		if i != exclude {
+			all = append(all, i)
+		}
+	}
+
+	if len(all) == 0 {
+		if p.err != nil {
+			return nil, fmt.Errorf("Unable to find instances of %s: %s", p.service, p.err)
+		}
+
+		return nil, errNoHealthyInstances
+	}
+
+	now := p.balancer.now()
+	instances := []*connectInstance{}
+	for _, i := range all {
+		if i.health.available(now) {
+			instances = append(instances, i)
+		}
+	}
+
+	if len(instances) == 0 {
+		instances = all
+	}
+
+	n := int(atomic.AddUint32(&p.next, 1) - 1)
+
+	switch us.LoadBalancer {
+	case LoadBalancerLeastRequest:
+		return leastRequest(instances, n), nil
+	case LoadBalancerNearest:
+		return p.nearest(us, instances, n), nil
+	case LoadBalancerP2C:
+		if len(instances) == 1 {
+			return instances[0], nil
+		}
+
+		a := rand.Intn(len(instances))
+		b := rand.Intn(len(instances) - 1)
+		if b >= a {
+			b++
+		}
+
+		if atomic.LoadInt64(&instances[b].active) < atomic.LoadInt64(&instances[a].active) {
+			return instances[b], nil
+		}
+		return instances[a], nil
+	case LoadBalancerHash:
+		// requests without a key are sent to the instances in turn
+		if key != "" {
+			h := hash64(key)
+			i := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+
+			// keys of unavailable instances move to the next instance
+			for j := 0; j < len(p.ring); j++ {
+				inst := p.ring[(i+j)%len(p.ring)].instance
+				if inst != exclude && inst.health.available(now) {
+					return inst, nil
+				}
+			}
+
+			for j := 0; j < len(p.ring); j++ {
+				inst := p.ring[(i+j)%len(p.ring)].instance
+				if inst != exclude {
+					return inst, nil
+				}
+			}
+		}
+	}
+
+	return instances[n%len(instances)], nil
+}
+
+// load fetches the healthy instances, blocking until they change when they
+// have previously been loaded
+func (p *instancePool) load(ctx context.Context) error {
+	b := p.balancer
+
+	p.mu.RLock()
+	trustDomain := p.trustDomain
+	q := &api.QueryOptions{
+		Datacenter: p.datacenter,
+		AllowStale: true,
+		WaitIndex:  p.index,
+		WaitTime:   b.waitTimeout,
+	}
+	p.mu.RUnlock()
+
+	// instances are verified using the cluster's trust domain
+	if trustDomain == "" {
+		roots, _, err := b.client.Agent().ConnectCARoots((&api.QueryOptions{}).WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("Unable to fetch trust domain: %s", err)
+		}
+
+		if roots.TrustDomain == "" {
+			return fmt.Errorf("Trust domain is empty, Connect is not bootstrapped")
+		}
+
+		trustDomain = roots.TrustDomain
+	}
+
+	entries, meta, err := b.client.Health().Connect(p.service, "", true, q.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	p.mu.RLock()
+	unchanged := meta.LastIndex == p.index
+	current := map[string]*connectInstance{}
+	for _, i := range p.instances {
+		current[i.id+"/"+i.addr] = i
+	}
+	p.mu.RUnlock()
+
+	if unchanged {
+		return nil
+	}
+
+	instances := []*connectInstance{}
+	for _, se := range entries {
+		addr := se.Service.Address
+		if addr == "" {
+			addr = se.Node.Address
+		}
+		addr = net.JoinHostPort(addr, strconv.Itoa(se.Service.Port))
+
+		// keep the requests in progress of existing instances
+		if i, ok := current[se.Service.ID+"/"+addr]; ok {
+			instances = append(instances, i)
+			delete(current, se.Service.ID+"/"+addr)
+			continue
+		}
+
+		service := se.Service.ProxyDestination
+		if se.Service.Connect != nil && se.Service.Connect.Native {
+			service = se.Service.Service
+		}
+
+		instances = append(instances, &connectInstance{
+			id:   se.Service.ID,
+			addr: addr,
+			node: se.Node.Node,
+			certURI: &connectid.SpiffeIDService{
+				Host:       trustDomain,
+				Namespace:  "default",
+				Datacenter: se.Node.Datacenter,
+				Service:    service,
+			},
+		})
+	}
+
+	sort.Slice(instances, func(i, j int) bool { return instances[i].id < instances[j].id })
+
+	ring := make([]hashPoint, 0, len(instances)*hashRingReplicas)
+	for _, i := range instances {
+		for r := 0; r < hashRingReplicas; r++ {
+			ring = append(ring, hashPoint{hash: hash64(i.id + "-" + strconv.Itoa(r)), instance: i})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	p.mu.Lock()
+	p.instances = instances
+	p.ring = ring
+	p.index = meta.LastIndex
+	p.trustDomain = trustDomain
+	p.err = nil
+	p.mu.Unlock()
+
+	b.logger.Debug("Loaded upstream instances", "upstream", p.service, "datacenter", p.datacenter, "instances", len(instances))
+
+	// connections to instances which have left the catalog are drained
+	for _, i := range current {
+		b.remove(i)
+	}
+
+	return nil
+}
+
+// watch reloads the instances whenever they change, requests wait for the
+// first load
+func (p *instancePool) watch(ctx context.Context) {
+	first := true
+
+	for {
+		err := p.load(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		if err != nil {
+			p.balancer.logger.Error("Unable to watch upstream instances", "upstream", p.service, "error", err)
+
+			p.mu.Lock()
+			p.err = err
+			p.mu.Unlock()
+		}
+
+		if first {
+			close(p.ready)
+			first = false
+		}
+
+		if err != nil {
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// balancedRequest is a request to an instance selected by the load balancer,
+// the methods can be called on a nil request for routes without a load
+// balancer
+type balancedRequest struct {
+	pool     *instancePool
+	instance *connectInstance
+	outlier  *OutlierDetection
+	start    time.Time
+	once     sync.Once
+}
+
+// release is called when the request is complete
+func (b *balancedRequest) release() {
+	if b == nil {
+		return
+	}
+
+	b.once.Do(func() {
+		if atomic.AddInt64(&b.instance.active, -1) == 0 {
+			b.pool.balancer.drainIdle(b.instance)
+		}
+	})
+}
+
+// balance selects the instance of the target for a route with a load
+// balancer, release must be called when the request is complete
+func (r *Router) balance(us *Upstream, t connectTarget, req *http.Request) (*balancedRequest, error) {
+	return r.balanceExcluding(us, t, req, nil)
+}
+
+// balanceExcluding selects an instance other than the excluded instance
+func (r *Router) balanceExcluding(us *Upstream, t connectTarget, req *http.Request, exclude *connectInstance) (*balancedRequest, error) {
+	if us.LoadBalancer == "" || t.query || (us.Type != HTTP && us.Type != GRPC) {
+		return nil, nil
+	}
+
+	if us.LoadBalancer == LoadBalancerNearest {
+		r.balancer.coordinates.start(r.balancer.ctx)
+	}
+
+	p := r.balancer.pool(t.name, t.datacenter)
+
+	if us.HealthCheck != nil {
+		p.startHealthCheck(us.HealthCheck, r.httpClient, t.host())
+	}
+
+	inst, err := p.pick(req.Context(), us, hashKey(us.HashOn, req), exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	// the host is the instance so connections are pooled for each instance
+	req.URL.Host = inst.addr
+	req.Host = t.host()
+
+	atomic.AddInt64(&inst.active, 1)
+
+	return &balancedRequest{
+		pool:     p,
+		instance: inst,
+		outlier:  us.OutlierDetection,
+		start:    r.balancer.now(),
+	}, nil
+}
+
+// drainInstance closes the connections to an instance which has left the
+// catalog, it is called when the instance has no requests in progress
+func (r *Router) drainInstance(addr string) {
+	r.logger.Debug("Draining upstream instance", "addr", addr)
+
+	if r.http2Pool != nil {
+		r.http2Pool.drain(addr)
+	}
+
+	r.balancer.conns.close(addr)
+}
+
+// connTracker records the connections dialed to instances selected by the
+// load balancer so the connections to one instance can be closed
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[string]map[*trackedConn]struct{}
+}
+
+// track records the connection until it is closed
+func (t *connTracker) track(addr string, c net.Conn) net.Conn {
+	tc := &trackedConn{Conn: c, tracker: t, addr: addr}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conns[addr] == nil {
+		t.conns[addr] = map[*trackedConn]struct{}{}
+	}
+	t.conns[addr][tc] = struct{}{}
+
+	return tc
+}
+
+// close closes the connections to the address
+func (t *connTracker) close(addr string) {
+	t.mu.Lock()
+	conns := t.conns[addr]
+	delete(t.conns, addr)
+	t.mu.Unlock()
+
+	for c := range conns {
+		c.Close()
+	}
+}
+
+func (t *connTracker) remove(c *trackedConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.conns[c.addr], c)
+	if len(t.conns[c.addr]) == 0 {
+		delete(t.conns, c.addr)
+	}
+}
+
+// trackedConn removes itself from the tracker when it is closed
+type trackedConn struct {
+	net.Conn
+	tracker *connTracker
+	addr    string
+	once    sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { c.tracker.remove(c) })
+
+	return c.Conn.Close()
+}
+
+// balancedConnectService dials instances selected by the load balancer
+// directly, other addresses are resolved by the Connect service
+type balancedConnectService struct {
+	ConnectService
+	balancer *loadBalancer
+}
+
+// HTTPDialTLS dials the instance at the address when it is known, the
+// connections to instances are tracked so they can be drained
+func (s *balancedConnectService) HTTPDialTLS(network, addr string) (net.Conn, error) {
+	uri := s.balancer.certURI(addr)
+	if uri == nil {
+		return s.ConnectService.HTTPDialTLS(network, addr)
+	}
+
+	c, err := s.ConnectService.Dial(context.Background(), &connect.StaticResolver{Addr: addr, CertURI: uri})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.balancer.conns.track(addr, c), nil
+}
+
+// dialTLS dials the instance at the address when it is known without
+// tracking the connection, used by pools which drain their own connections
+func (s *balancedConnectService) dialTLS(network, addr string) (net.Conn, error) {
+	uri := s.balancer.certURI(addr)
+	if uri == nil {
+		return s.ConnectService.HTTPDialTLS(network, addr)
+	}
+
+	return s.ConnectService.Dial(context.Background(), &connect.StaticResolver{Addr: addr, CertURI: uri})
+}
+
+// releaseBody calls release when the response body is closed
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	b.release()
+
+	return b.ReadCloser.Close()
+}
+
+// hash64 returns the FNV-1a hash of the string mixed with the murmur3
+// finalizer so similar strings are spread around the ring
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+
+	k := h.Sum64()
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+
+	return k
+}
@@ -0,0 +1,380 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	connectid "github.com/hashicorp/consul/agent/connect"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/connect"
+	log "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// testCatalog stubs the Consul Connect health and coordinate APIs, health
+// queries block until the instances change. Instances are [id]=[address] and
+// run on a node named after the instance, the agent's node is router.
+type testCatalog struct {
+	mu        sync.Mutex
+	index     uint64
+	instances map[string][]string
+	coords    []*api.CoordinateEntry
+	changed   chan struct{}
+}
+
+func (c *testCatalog) set(service string, instances ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.index++
+	c.instances[service] = instances
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *testCatalog) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/v1/agent/connect/ca/roots":
+		json.NewEncoder(rw).Encode(api.CARootList{TrustDomain: "11111111.consul"})
+		return
+	case "/v1/agent/self":
+		json.NewEncoder(rw).Encode(map[string]map[string]interface{}{"Config": {"NodeName": "router"}})
+		return
+	case "/v1/coordinate/nodes":
+		c.mu.Lock()
+		json.NewEncoder(rw).Encode(c.coords)
+		c.mu.Unlock()
+		return
+	}
+
+	service := strings.TrimPrefix(req.URL.Path, "/v1/health/connect/")
+	wait, _ := strconv.ParseUint(req.URL.Query().Get("index"), 10, 64)
+
+	c.mu.Lock()
+	changed := c.changed
+	index := c.index
+	c.mu.Unlock()
+
+	// block until the instances change
+	if wait == index {
+		select {
+		case <-changed:
+		case <-req.Context().Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+
+	c.mu.Lock()
+	entries := []api.ServiceEntry{}
+	for _, i := range c.instances[service] {
+		kv := strings.SplitN(i, "=", 2)
+		host, port, _ := net.SplitHostPort(kv[1])
+		p, _ := strconv.Atoi(port)
+
+		entries = append(entries, api.ServiceEntry{
+			Node:    &api.Node{Node: kv[0], Datacenter: "dc1"},
+			Service: &api.AgentService{ID: kv[0], Service: service + "-proxy", ProxyDestination: service, Address: host, Port: p},
+		})
+	}
+	rw.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+	c.mu.Unlock()
+
+	json.NewEncoder(rw).Encode(entries)
+}
+
+func setupLoadBalancer(t *testing.T, route string) (*Router, *testCatalog) {
+	catalog := &testCatalog{index: 1, instances: map[string][]string{}, changed: make(chan struct{})}
+
+	s := httptest.NewServer(catalog)
+	t.Cleanup(s.Close)
+
+	c, _ := api.NewClient(&api.Config{Address: s.Listener.Addr().String()})
+
+	rec := setupDirectRouter(t, route)
+	rec.balancer = newLoadBalancer(c, log.Default())
+	t.Cleanup(rec.balancer.Close)
+
+	return rec, catalog
+}
+
+// requestHosts sends requests to the router and returns the upstream hosts
+func requestHosts(rec *Router, n int, setup func(*http.Request)) []string {
+	hosts := []string{}
+
+	mockHTTPClient.ExpectedCalls = nil
+	mockHTTPClient.On("Do", mock.Anything).Run(func(args mock.Arguments) {
+		hosts = append(hosts, args.Get(0).(*http.Request).URL.Host)
+	}).Return(httpResponse, nil)
+
+	for i := 0; i < n; i++ {
+		req := httptest.NewRequest("GET", "/api", nil)
+		if setup != nil {
+			setup(req)
+		}
+
+		rec.Handler(httptest.NewRecorder(), req)
+	}
+
+	return hosts
+}
+
+func TestRoundRobinUsesInstancesInTurn(t *testing.T) {
+	rec, catalog := setupLoadBalancer(t, "service=api#path=/api#lb=round_robin")
+	catalog.set("api", "a=10.0.0.1:8080", "b=10.0.0.2:8080")
+
+	hosts := requestHosts(rec, 4, nil)
+
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.1:8080", "10.0.0.2:8080"}, hosts)
+
+	req := mockHTTPClient.Calls[0].Arguments.Get(0).(*http.Request)
+	assert.Equal(t, "api.service.consul", req.Host, "Should send the service as the host")
+}
+
+func TestLeastRequestUsesInstanceWithFewestRequests(t *testing.T) {
+	rec, catalog := setupLoadBalancer(t, "service=api#path=/api#lb=least_request")
+	catalog.set("api", "a=10.0.0.1:8080", "b=10.0.0.2:8080")
+
+	us := rec.upstreams.FindUpstream("/api")
+	target := us.targets()[0]
+
+	hosts := []string{}
+	requests := []*balancedRequest{}
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "https://api.service.consul/", nil)
+		br, err := rec.balance(us, target, req)
+		assert.NoError(t, err)
+
+		hosts = append(hosts, req.URL.Host)
+		requests = append(requests, br)
+	}
+
+	// complete the request to the first instance
+	requests[0].release()
+
+	// the request to the second instance is still in progress
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "https://api.service.consul/", nil)
+		br, err := rec.balance(us, target, req)
+		assert.NoError(t, err)
+		br.release()
+
+		hosts = append(hosts, req.URL.Host)
+	}
+
+	assert.NotEqual(t, hosts[0], hosts[1])
+	assert.Equal(t, []string{hosts[0], hosts[0]}, hosts[2:], "Should use the instance with the fewest requests")
+}
+
+func TestP2CUsesLessLoadedInstance(t *testing.T) {
+	rec, catalog := setupLoadBalancer(t, "service=api#path=/api#lb=p2c")
+	catalog.set("api", "a=10.0.0.1:8080", "b=10.0.0.2:8080")
+
+	us := rec.upstreams.FindUpstream("/api")
+	req := httptest.NewRequest("GET", "https://api.service.consul/", nil)
+	_, err := rec.balance(us, us.targets()[0], req)
+	assert.NoError(t, err)
+
+	busy := req.URL.Host
+
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest("GET", "https://api.service.consul/", nil)
+		br, err := rec.balance(us, us.targets()[0], req)
+		assert.NoError(t, err)
+		br.release()
+
+		assert.NotEqual(t, busy, req.URL.Host)
+	}
+}
+
+func TestHashUsesSameInstanceForKey(t *testing.T) {
+	tests := []struct {
+		route string
+		key   func(req *http.Request, key string)
+	}{
+		{"#hash_on=header:X-User", func(req *http.Request, key string) { req.Header.Set("X-User", key) }},
+		{"#hash_on=cookie:session", func(req *http.Request, key string) { req.AddCookie(&http.Cookie{Name: "session", Value: key}) }},
+		{"", func(req *http.Request, key string) { req.RemoteAddr = key + ":1234" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.route, func(t *testing.T) {
+			rec, catalog := setupLoadBalancer(t, "service=api#path=/api#lb=hash"+tt.route)
+			catalog.set("api", "a=10.0.0.1:8080", "b=10.0.0.2:8080", "c=10.0.0.3:8080")
+
+			hosts := requestHosts(rec, 3, func(req *http.Request) { tt.key(req, "10.1.1.1") })
+			assert.Equal(t, hosts[0], hosts[1])
+			assert.Equal(t, hosts[0], hosts[2])
+
+			used := map[string]bool{}
+			for i := 0; i < 20; i++ {
+				key := "10.1.1." + strconv.Itoa(i)
+				h := requestHosts(rec, 1, func(req *http.Request) { tt.key(req, key) })
+				used[h[0]] = true
+			}
+			assert.Len(t, used, 3, "Should spread keys between instances")
+		})
+	}
+}
+
+func TestHashWithoutKeyUsesInstancesInTurn(t *testing.T) {
+	rec, catalog := setupLoadBalancer(t, "service=api#path=/api#lb=hash#hash_on=header:X-User")
+	catalog.set("api", "a=10.0.0.1:8080", "b=10.0.0.2:8080")
+
+	hosts := requestHosts(rec, 2, nil)
+
+	assert.NotEqual(t, hosts[0], hosts[1])
+}
+
+func TestLoadBalancerDrainsInstancesWhichLeaveCatalog(t *testing.T) {
+	rec, catalog := setupLoadBalancer(t, "service=api#path=/api#lb=round_robin")
+	catalog.set("api", "a=10.0.0.1:8080", "b=10.0.0.2:8080")
+
+	drained := make(chan string, 1)
+	rec.balancer.drain = func(addr string) { drained <- addr }
+
+	assert.Len(t, requestHosts(rec, 2, nil), 2)
+
+	catalog.set("api", "a=10.0.0.1:8080")
+
+	select {
+	case addr := <-drained:
+		assert.Equal(t, "10.0.0.2:8080", addr)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected instance to be drained")
+	}
+
+	hosts := requestHosts(rec, 2, nil)
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.1:8080"}, hosts)
+}
+
+func TestLoadBalancerDrainsInstancesAfterRequestsComplete(t *testing.T) {
+	rec, catalog := setupLoadBalancer(t, "service=api#path=/api#lb=round_robin")
+	catalog.set("api", "a=10.0.0.1:8080")
+
+	drained := make(chan string, 1)
+	rec.balancer.drain = func(addr string) { drained <- addr }
+
+	us := rec.upstreams[0]
+	br, err := rec.balance(&us, us.targets()[0], httptest.NewRequest("GET", "/api", nil))
+	assert.NoError(t, err)
+
+	catalog.set("api")
+
+	waitFor(t, func() bool { return atomic.LoadInt32(&br.instance.removed) == 1 }, "Expected instance to be removed")
+
+	select {
+	case <-drained:
+		t.Fatal("Should not drain an instance with requests in progress")
+	default:
+	}
+
+	br.release()
+
+	assert.Equal(t, "10.0.0.1:8080", <-drained)
+}
+
+func TestLoadBalancerRemovesIdlePools(t *testing.T) {
+	rec, catalog := setupLoadBalancer(t, "service=api#path=/api#lb=round_robin")
+	catalog.set("api", "a=10.0.0.1:8080")
+
+	drained := make(chan string, 1)
+	rec.balancer.drain = func(addr string) { drained <- addr }
+
+	requestHosts(rec, 1, nil)
+
+	p := rec.balancer.pool("api", "")
+	rec.balancer.removeIdle()
+	assert.Len(t, rec.balancer.pools, 1, "Should keep pools which have been used")
+
+	now := time.Now().Add(poolIdleTimeout)
+	rec.balancer.now = func() time.Time { return now }
+	rec.balancer.removeIdle()
+
+	assert.Len(t, rec.balancer.pools, 0)
+	assert.Error(t, p.ctx.Err(), "Should stop watching the service")
+	assert.Equal(t, "10.0.0.1:8080", <-drained)
+}
+
+func TestConnTrackerClosesConnectionsToAddress(t *testing.T) {
+	ct := &connTracker{conns: map[string]map[*trackedConn]struct{}{}}
+
+	a, _ := net.Pipe()
+	b, _ := net.Pipe()
+	ca := ct.track("10.0.0.1:8080", a)
+	ct.track("10.0.0.2:8080", b)
+
+	ct.close("10.0.0.1:8080")
+
+	_, err := ca.Write([]byte("x"))
+	assert.Error(t, err, "Should close connections to the address")
+	assert.Len(t, ct.conns, 1)
+	assert.Len(t, ct.conns["10.0.0.2:8080"], 1, "Should not close connections to other addresses")
+
+	b.Close()
+}
+
+func TestLoadBalancerReturnsUnavailableWithoutInstances(t *testing.T) {
+	rec, _ := setupLoadBalancer(t, "service=api#path=/api#lb=round_robin")
+	rw := httptest.NewRecorder()
+
+	rec.Handler(rw, httptest.NewRequest("GET", "/api", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	mockHTTPClient.AssertNotCalled(t, "Do", mock.Anything)
+}
+
+func TestBalancedConnectServiceDialsSelectedInstance(t *testing.T) {
+	rec, catalog := setupLoadBalancer(t, "service=api#path=/api#lb=round_robin")
+	catalog.set("api", "a=10.0.0.1:8080")
+	requestHosts(rec, 1, nil)
+
+	cs := &MockConnectService{}
+	cs.On("Dial", mock.Anything, mock.Anything).Return(nil, errors.New("dial"))
+	cs.On("HTTPDialTLS", "tcp", "web.service.consul:443").Return(&net.TCPConn{}, nil)
+
+	s := &balancedConnectService{ConnectService: cs, balancer: rec.balancer}
+
+	s.HTTPDialTLS("tcp", "10.0.0.1:8080")
+	s.HTTPDialTLS("tcp", "web.service.consul:443")
+
+	r := cs.Calls[0].Arguments.Get(1).(*connect.StaticResolver)
+	assert.Equal(t, "10.0.0.1:8080", r.Addr)
+	assert.Equal(t, "spiffe://11111111.consul/ns/default/dc/dc1/svc/api", r.CertURI.URI().String())
+	cs.AssertCalled(t, "HTTPDialTLS", "tcp", "web.service.consul:443")
+}
+
+func TestHashKeyUsesClientAddress(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header["X-Forwarded-For"] = []string{"10.1.1.1:1234", "192.168.0.1"}
+
+	assert.Equal(t, "10.1.1.1", hashKey("ip", req))
+}
+
+func TestPickWaitsForContext(t *testing.T) {
+	p := &instancePool{ready: make(chan struct{})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := p.pick(ctx, &Upstream{LoadBalancer: LoadBalancerRoundRobin}, "", nil)
+
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestCertURIIsNilForUnknownAddress(t *testing.T) {
+	b := newLoadBalancer(nil, log.Default())
+
+	assert.Equal(t, connectid.CertURI(nil), b.certURI("10.0.0.1:8080"))
+}
@@ -0,0 +1,188 @@
+package router
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/serf/coordinate"
+)
+
+const (
+	// coordinateRefresh is how often the network coordinates are reloaded
+	coordinateRefresh = 30 * time.Second
+	// defaultLocalitySpread is the default RTT from the nearest instance
+	// within which instances are considered near
+	defaultLocalitySpread = 5 * time.Millisecond
+)
+
+// coordinateCache holds the network coordinates of the router's node and the
+// nodes in the local datacenter, coordinates are loaded from the first
+// request to a nearest route
+type coordinateCache struct {
+	client   *api.Client
+	logger   log.Logger
+	interval time.Duration
+	once     sync.Once
+
+	mu     sync.RWMutex
+	node   string
+	coords map[string]*coordinate.Coordinate
+}
+
+func newCoordinateCache(c *api.Client, l log.Logger) *coordinateCache {
+	return &coordinateCache{
+		client:   c,
+		logger:   l,
+		interval: coordinateRefresh,
+		coords:   map[string]*coordinate.Coordinate{},
+	}
+}
+
+// start reloads the coordinates until the context is cancelled
+func (c *coordinateCache) start(ctx context.Context) {
+	c.once.Do(func() {
+		go func() {
+			t := time.NewTicker(c.interval)
+			defer t.Stop()
+
+			for {
+				err := c.load(ctx)
+				if err != nil {
+					c.logger.Error("Unable to load network coordinates", "error", err)
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-t.C:
+				}
+			}
+		}()
+	})
+}
+
+// load fetches the router's node name and the coordinates of the nodes
+func (c *coordinateCache) load(ctx context.Context) error {
+	c.mu.RLock()
+	node := c.node
+	c.mu.RUnlock()
+
+	if node == "" {
+		n, err := c.client.Agent().NodeName()
+		if err != nil {
+			return err
+		}
+		node = n
+	}
+
+	entries, _, err := c.client.Coordinate().Nodes((&api.QueryOptions{AllowStale: true}).WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	coords := map[string]*coordinate.Coordinate{}
+	for _, e := range entries {
+		// nodes are in the default segment and may be in other segments
+		if _, ok := coords[e.Node]; ok && e.Segment != "" {
+			continue
+		}
+
+		coords[e.Node] = e.Coord
+	}
+
+	c.mu.Lock()
+	c.node = node
+	c.coords = coords
+	c.mu.Unlock()
+
+	c.logger.Debug("Loaded network coordinates", "node", node, "nodes", len(coords))
+
+	return nil
+}
+
+// rtt returns the estimated round trip time from the router's node to the
+// node, false is returned when either coordinate is unknown
+func (c *coordinateCache) rtt(node string) (time.Duration, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	self, ok := c.coords[c.node]
+	if !ok {
+		return 0, false
+	}
+
+	other, ok := c.coords[node]
+	if !ok || !self.IsCompatibleWith(other) {
+		return 0, false
+	}
+
+	return self.DistanceTo(other), true
+}
+
+// nearest returns the instance with the fewest requests from the instances
+// within the spread of the lowest RTT, requests spill over to all instances
+// when the near instances have the maximum requests in progress. Instances
+// without coordinates are only used when spilling over.
+func (p *instancePool) nearest(us *Upstream, instances []*connectInstance, n int) *connectInstance {
+	// coordinates are only comparable within the local datacenter
+	if p.datacenter != "" {
+		return leastRequest(instances, n)
+	}
+
+	coords := p.balancer.coordinates
+
+	rtts := map[*connectInstance]time.Duration{}
+	min := time.Duration(-1)
+	for _, i := range instances {
+		d, ok := coords.rtt(i.node)
+		if !ok {
+			continue
+		}
+
+		rtts[i] = d
+		if min < 0 || d < min {
+			min = d
+		}
+	}
+
+	if len(rtts) == 0 {
+		return leastRequest(instances, n)
+	}
+
+	spread := us.LocalitySpread
+	if spread == 0 {
+		spread = defaultLocalitySpread
+	}
+
+	near := []*connectInstance{}
+	for _, i := range instances {
+		if d, ok := rtts[i]; ok && d <= min+spread {
+			near = append(near, i)
+		}
+	}
+
+	best := leastRequest(near, n)
+	if us.LocalityMaxRequests > 0 && atomic.LoadInt64(&best.active) >= int64(us.LocalityMaxRequests) {
+		return leastRequest(instances, n)
+	}
+
+	return best
+}
+
+// leastRequest returns the instance with the fewest requests in progress
+// starting at the nth instance so ties are shared between instances
+func leastRequest(instances []*connectInstance, n int) *connectInstance {
+	var best *connectInstance
+	for i := range instances {
+		inst := instances[(n+i)%len(instances)]
+		if best == nil || atomic.LoadInt64(&inst.active) < atomic.LoadInt64(&best.active) {
+			best = inst
+		}
+	}
+
+	return best
+}
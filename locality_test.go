@@ -0,0 +1,139 @@
+package router
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/serf/coordinate"
+	"github.com/stretchr/testify/assert"
+)
+
+// setCoordinates places the nodes on a line at their distance from the router
+func (c *testCatalog) setCoordinates(distances map[string]time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.coords = []*api.CoordinateEntry{}
+	for node, d := range distances {
+		coord := coordinate.NewCoordinate(coordinate.DefaultConfig())
+		coord.Vec[0] = d.Seconds()
+
+		c.coords = append(c.coords, &api.CoordinateEntry{Node: node, Coord: coord})
+	}
+}
+
+func setupLocality(t *testing.T, route string, distances map[string]time.Duration) *Router {
+	rec, catalog := setupLoadBalancer(t, route)
+	catalog.set("api", "a=10.0.0.1:8080", "b=10.0.0.2:8080", "c=10.0.0.3:8080")
+	catalog.setCoordinates(distances)
+
+	err := rec.balancer.coordinates.load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rec
+}
+
+func TestNearestUsesInstancesWithLowestRTT(t *testing.T) {
+	rec := setupLocality(t, "service=api#path=/api#lb=nearest", map[string]time.Duration{
+		"router": 0,
+		"a":      time.Millisecond,
+		"b":      3 * time.Millisecond,
+		"c":      40 * time.Millisecond,
+	})
+
+	used := map[string]int{}
+	for _, h := range requestHosts(rec, 6, nil) {
+		used[h]++
+	}
+
+	assert.Equal(t, map[string]int{"10.0.0.1:8080": 3, "10.0.0.2:8080": 3}, used, "Should share requests between instances within the spread")
+}
+
+func TestNearestUsesLocalitySpread(t *testing.T) {
+	rec := setupLocality(t, "service=api#path=/api#lb=nearest#locality_spread=500us", map[string]time.Duration{
+		"router": 0,
+		"a":      time.Millisecond,
+		"b":      3 * time.Millisecond,
+		"c":      40 * time.Millisecond,
+	})
+
+	hosts := requestHosts(rec, 3, nil)
+
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.1:8080", "10.0.0.1:8080"}, hosts)
+}
+
+func TestNearestSpillsOverWhenNearInstancesBusy(t *testing.T) {
+	rec := setupLocality(t, "service=api#path=/api#lb=nearest#locality_max_requests=1", map[string]time.Duration{
+		"router": 0,
+		"a":      time.Millisecond,
+		"b":      20 * time.Millisecond,
+		"c":      40 * time.Millisecond,
+	})
+
+	us := rec.upstreams.FindUpstream("/api")
+	target := us.targets()[0]
+
+	req := httptest.NewRequest("GET", "https://api.service.consul/", nil)
+	br, err := rec.balance(us, target, req)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:8080", req.URL.Host)
+
+	// the nearest instance has the maximum requests in progress
+	req = httptest.NewRequest("GET", "https://api.service.consul/", nil)
+	_, err = rec.balance(us, target, req)
+	assert.NoError(t, err)
+	assert.NotEqual(t, "10.0.0.1:8080", req.URL.Host)
+
+	br.release()
+
+	req = httptest.NewRequest("GET", "https://api.service.consul/", nil)
+	_, err = rec.balance(us, target, req)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:8080", req.URL.Host)
+}
+
+func TestNearestWithoutCoordinatesUsesAllInstances(t *testing.T) {
+	rec := setupLocality(t, "service=api#path=/api#lb=nearest", map[string]time.Duration{
+		"a": time.Millisecond,
+	})
+
+	used := map[string]bool{}
+	for _, h := range requestHosts(rec, 3, nil) {
+		used[h] = true
+	}
+
+	assert.Len(t, used, 3)
+}
+
+func TestNearestIgnoresCoordinatesInOtherDatacenters(t *testing.T) {
+	rec := setupLocality(t, "service=api#path=/api#lb=nearest#datacenter=dc2", map[string]time.Duration{
+		"router": 0,
+		"a":      time.Millisecond,
+		"b":      20 * time.Millisecond,
+		"c":      40 * time.Millisecond,
+	})
+
+	used := map[string]bool{}
+	for _, h := range requestHosts(rec, 3, nil) {
+		used[h] = true
+	}
+
+	assert.Len(t, used, 3)
+}
+
+func TestCoordinateRTT(t *testing.T) {
+	rec := setupLocality(t, "service=api#path=/api", map[string]time.Duration{"router": 0, "a": 10 * time.Millisecond})
+	c := rec.balancer.coordinates
+
+	d, ok := c.rtt("a")
+	assert.True(t, ok)
+	assert.InDelta(t, float64(10*time.Millisecond), float64(d), float64(time.Millisecond))
+
+	_, ok = c.rtt("unknown")
+	assert.False(t, ok)
+}
@@ -0,0 +1,78 @@
+package router
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+// statusWriter records the status code written to the response so that it
+// can be used for metrics
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusWriter) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Flush implements http.Flusher when the underlying writer supports it
+func (s *statusWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// recordRequest emits the request count and latency labelled with the
+// upstream and response status. The principal is not used as a label on
+// these as it would make the number of series unbounded, routes with
+// principal metrics enabled count requests per principal separately.
+func recordRequest(us *Upstream, req *http.Request, status int, start time.Time) {
+	service := ""
+	if us != nil {
+		service = us.Service
+	}
+
+	labels := []metrics.Label{
+		{Name: "upstream", Value: service},
+		{Name: "code", Value: strconv.Itoa(status)},
+	}
+
+	metrics.IncrCounterWithLabels([]string{"router", "request"}, 1, labels)
+	metrics.MeasureSinceWithLabels([]string{"router", "request", "duration"}, start, labels)
+
+	if us == nil || !us.PrincipalMetrics {
+		return
+	}
+
+	if p := requestPrincipal(req); p != "" {
+		metrics.IncrCounterWithLabels([]string{"router", "request", "principal"}, 1, []metrics.Label{
+			{Name: "upstream", Value: service},
+			{Name: "principal", Value: p},
+			{Name: "code", Value: strconv.Itoa(status)},
+		})
+	}
+}
+
+// recordTCPConnection emits the connection count, duration and bytes
+// transferred labelled with the upstream and outcome
+func recordTCPConnection(route *TCPRoute, result string, sent, received int64, start time.Time) {
+	service := ""
+	if route != nil {
+		service = route.Service
+	}
+
+	labels := []metrics.Label{
+		{Name: "upstream", Value: service},
+		{Name: "result", Value: result},
+	}
+
+	metrics.IncrCounterWithLabels([]string{"router", "tcp", "connection"}, 1, labels)
+	metrics.MeasureSinceWithLabels([]string{"router", "tcp", "connection", "duration"}, start, labels)
+	metrics.IncrCounterWithLabels([]string{"router", "tcp", "bytes_sent"}, float32(sent), labels)
+	metrics.IncrCounterWithLabels([]string{"router", "tcp", "bytes_received"}, float32(received), labels)
+}
@@ -0,0 +1,392 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+// outlier detection and health check defaults
+const (
+	defaultOutlier5xx                = 5
+	defaultOutlierErrors             = 5
+	defaultOutlierEjection           = 30 * time.Second
+	defaultOutlierMaxEjection        = 5 * time.Minute
+	defaultOutlierMaxEjectionPercent = 50
+
+	defaultHealthCheckInterval  = 10 * time.Second
+	defaultHealthCheckTimeout   = 2 * time.Second
+	defaultHealthCheckHealthy   = 2
+	defaultHealthCheckUnhealthy = 3
+
+	// outlierLatencySamples is the number of responses needed before the
+	// latency of an instance is compared with the other instances
+	outlierLatencySamples = 10
+	// outlierLatencyWeight is the weight of each response in the moving
+	// average of an instance's latency
+	outlierLatencyWeight = 0.2
+)
+
+// OutlierDetection ejects instances of a load balanced route from the load
+// balancer when requests to them fail or are slow, instances are ejected for
+// a period which doubles each time they are ejected
+type OutlierDetection struct {
+	// Consecutive5xx is the number of consecutive 5xx responses after which
+	// an instance is ejected, 0 disables
+	Consecutive5xx int
+	// ConsecutiveErrors is the number of consecutive connection errors after
+	// which an instance is ejected, 0 disables
+	ConsecutiveErrors int
+	// LatencyFactor ejects instances with an average latency greater than
+	// the factor times the median of the other instances, 0 disables
+	LatencyFactor float64
+	// BaseEjection is the period of the first ejection
+	BaseEjection time.Duration
+	// MaxEjection is the longest ejection period, instances which have not
+	// been ejected for this period start again at the base ejection
+	MaxEjection time.Duration
+	// MaxEjectionPercent is the largest percentage of instances which can be
+	// ejected at the same time
+	MaxEjectionPercent int
+}
+
+// HealthCheck sends HTTP requests over Connect to each instance of a load
+// balanced route, instances which fail the check are not used until they
+// pass again
+type HealthCheck struct {
+	// Path is requested from each instance, 2xx responses pass the check
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+	// HealthyThreshold is the number of consecutive passing checks before
+	// an unhealthy instance is used again
+	HealthyThreshold int
+	// UnhealthyThreshold is the number of consecutive failed checks before
+	// an instance is unhealthy
+	UnhealthyThreshold int
+}
+
+// setDefaults sets the defaults for values which are not set
+func (o *OutlierDetection) setDefaults() {
+	if o.Consecutive5xx == 0 && o.ConsecutiveErrors == 0 && o.LatencyFactor == 0 {
+		o.Consecutive5xx = defaultOutlier5xx
+		o.ConsecutiveErrors = defaultOutlierErrors
+	}
+
+	if o.BaseEjection == 0 {
+		o.BaseEjection = defaultOutlierEjection
+	}
+
+	if o.MaxEjection == 0 {
+		o.MaxEjection = defaultOutlierMaxEjection
+	}
+
+	if o.MaxEjection < o.BaseEjection {
+		o.MaxEjection = o.BaseEjection
+	}
+
+	if o.MaxEjectionPercent == 0 {
+		o.MaxEjectionPercent = defaultOutlierMaxEjectionPercent
+	}
+}
+
+// setDefaults sets the defaults for values which are not set
+func (h *HealthCheck) setDefaults() {
+	if h.Interval == 0 {
+		h.Interval = defaultHealthCheckInterval
+	}
+
+	if h.Timeout == 0 {
+		h.Timeout = defaultHealthCheckTimeout
+	}
+
+	if h.HealthyThreshold == 0 {
+		h.HealthyThreshold = defaultHealthCheckHealthy
+	}
+
+	if h.UnhealthyThreshold == 0 {
+		h.UnhealthyThreshold = defaultHealthCheckUnhealthy
+	}
+}
+
+// instanceHealth is the outlier detection and health check state of an
+// instance
+type instanceHealth struct {
+	mu                sync.Mutex
+	consecutive5xx    int
+	consecutiveErrors int
+	// latency is the moving average of the response time in seconds
+	latency      float64
+	samples      int
+	ejections    int
+	ejectedUntil time.Time
+	reason       string
+
+	unhealthy      bool
+	checkPasses    int
+	checkFailures  int
+	lastCheckError string
+}
+
+// available returns true when the instance is not ejected or unhealthy
+func (h *instanceHealth) available(now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return !h.unhealthy && !now.Before(h.ejectedUntil)
+}
+
+// result records the outcome of the request for outlier detection
+func (b *balancedRequest) result(resp *http.Response, err error) {
+	if b == nil || b.outlier == nil {
+		return
+	}
+
+	o := b.outlier
+	p := b.pool
+	now := p.balancer.now()
+	h := &b.instance.health
+
+	h.mu.Lock()
+
+	switch {
+	case err != nil:
+		h.consecutiveErrors++
+	case resp.StatusCode >= http.StatusInternalServerError:
+		h.consecutiveErrors = 0
+		h.consecutive5xx++
+	default:
+		h.consecutiveErrors = 0
+		h.consecutive5xx = 0
+	}
+
+	if err == nil {
+		d := now.Sub(b.start).Seconds()
+		if h.samples == 0 {
+			h.latency = d
+		} else {
+			h.latency = outlierLatencyWeight*d + (1-outlierLatencyWeight)*h.latency
+		}
+		h.samples++
+	}
+
+	reason := ""
+	switch {
+	case o.ConsecutiveErrors > 0 && h.consecutiveErrors >= o.ConsecutiveErrors:
+		reason = "errors"
+	case o.Consecutive5xx > 0 && h.consecutive5xx >= o.Consecutive5xx:
+		reason = "5xx"
+	}
+
+	latency := h.latency
+	samples := h.samples
+
+	h.mu.Unlock()
+
+	if reason == "" && o.LatencyFactor > 0 && samples >= outlierLatencySamples {
+		median := p.medianLatency(b.instance)
+		if median > 0 && latency > o.LatencyFactor*median {
+			reason = "latency"
+		}
+	}
+
+	if reason != "" {
+		p.eject(b.instance, o, reason, now)
+	}
+}
+
+// medianLatency returns the median latency of the other instances which
+// have enough responses, 0 is returned when there are none
+func (p *instancePool) medianLatency(exclude *connectInstance) float64 {
+	p.mu.RLock()
+	instances := p.instances
+	p.mu.RUnlock()
+
+	latencies := []float64{}
+	for _, i := range instances {
+		if i == exclude {
+			continue
+		}
+
+		i.health.mu.Lock()
+		if i.health.samples >= outlierLatencySamples {
+			latencies = append(latencies, i.health.latency)
+		}
+		i.health.mu.Unlock()
+	}
+
+	if len(latencies) == 0 {
+		return 0
+	}
+
+	sort.Float64s(latencies)
+
+	return latencies[len(latencies)/2]
+}
+
+// eject removes the instance from the load balancer unless the maximum
+// percentage of instances are ejected
+func (p *instancePool) eject(inst *connectInstance, o *OutlierDetection, reason string, now time.Time) {
+	p.mu.RLock()
+	instances := p.instances
+	p.mu.RUnlock()
+
+	ejected := 0
+	for _, i := range instances {
+		i.health.mu.Lock()
+		if i != inst && now.Before(i.health.ejectedUntil) {
+			ejected++
+		}
+		i.health.mu.Unlock()
+	}
+
+	if (ejected+1)*100 > len(instances)*o.MaxEjectionPercent {
+		p.balancer.logger.Debug("Not ejecting upstream instance, maximum instances ejected", "upstream", p.service, "addr", inst.addr, "reason", reason)
+		return
+	}
+
+	h := &inst.health
+	h.mu.Lock()
+
+	if now.Before(h.ejectedUntil) {
+		h.mu.Unlock()
+		return
+	}
+
+	// instances which have not been ejected for the longest period start
+	// again at the base period
+	if h.ejections > 0 && now.After(h.ejectedUntil.Add(o.MaxEjection)) {
+		h.ejections = 0
+	}
+
+	d := o.BaseEjection
+	for i := 0; i < h.ejections && d < o.MaxEjection; i++ {
+		d *= 2
+	}
+
+	if d > o.MaxEjection {
+		d = o.MaxEjection
+	}
+
+	h.ejections++
+	h.ejectedUntil = now.Add(d)
+	h.reason = reason
+	h.consecutive5xx = 0
+	h.consecutiveErrors = 0
+	h.latency = 0
+	h.samples = 0
+
+	h.mu.Unlock()
+
+	p.balancer.logger.Info("Ejecting upstream instance", "upstream", p.service, "addr", inst.addr, "reason", reason, "duration", d)
+
+	metrics.IncrCounterWithLabels([]string{"router", "upstream", "ejection"}, 1, []metrics.Label{
+		{Name: "upstream", Value: p.service},
+		{Name: "reason", Value: reason},
+	})
+}
+
+// startHealthCheck checks the instances of the pool over Connect until the
+// pool is closed, the first route with health checks configures the checks
+func (p *instancePool) startHealthCheck(hc *HealthCheck, client HTTPClient, host string) {
+	p.healthCheck.Do(func() {
+		go func() {
+			select {
+			case <-p.ready:
+			case <-p.ctx.Done():
+				return
+			}
+
+			t := time.NewTicker(hc.Interval)
+			defer t.Stop()
+
+			for {
+				p.checkInstances(hc, client, host)
+
+				select {
+				case <-p.ctx.Done():
+					return
+				case <-t.C:
+				}
+			}
+		}()
+	})
+}
+
+// checkInstances checks every instance concurrently
+func (p *instancePool) checkInstances(hc *HealthCheck, client HTTPClient, host string) {
+	p.mu.RLock()
+	instances := p.instances
+	p.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, i := range instances {
+		wg.Add(1)
+
+		go func(i *connectInstance) {
+			defer wg.Done()
+			p.checkInstance(hc, client, host, i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// checkInstance requests the health check path from the instance
+func (p *instancePool) checkInstance(hc *HealthCheck, client HTTPClient, host string, inst *connectInstance) {
+	ctx, cancel := context.WithTimeout(p.ctx, hc.Timeout)
+	defer cancel()
+
+	checkErr := ""
+
+	req, err := http.NewRequest(http.MethodGet, "https://"+inst.addr+hc.Path, nil)
+	if err != nil {
+		checkErr = err.Error()
+	} else {
+		req.Host = host
+
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			checkErr = err.Error()
+		} else {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				checkErr = fmt.Sprintf("Unexpected status code %d", resp.StatusCode)
+			}
+		}
+	}
+
+	h := &inst.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastCheckError = checkErr
+
+	if checkErr == "" {
+		h.checkPasses++
+		h.checkFailures = 0
+
+		if h.unhealthy && h.checkPasses >= hc.HealthyThreshold {
+			h.unhealthy = false
+			p.balancer.logger.Info("Upstream instance is healthy", "upstream", p.service, "addr", inst.addr)
+		}
+
+		return
+	}
+
+	h.checkFailures++
+	h.checkPasses = 0
+
+	if !h.unhealthy && h.checkFailures >= hc.UnhealthyThreshold {
+		h.unhealthy = true
+		p.balancer.logger.Info("Upstream instance is unhealthy", "upstream", p.service, "addr", inst.addr, "error", checkErr)
+	}
+}
@@ -0,0 +1,248 @@
+package router
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+// testInstances returns the response of each instance by address, requests
+// to the instances are recorded
+type testInstances struct {
+	mu        sync.Mutex
+	responses map[string]int
+	requests  []string
+}
+
+func (ti *testInstances) set(addr string, status int) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	ti.responses[addr] = status
+}
+
+func (ti *testInstances) Do(req *http.Request) (*http.Response, error) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	ti.requests = append(ti.requests, req.URL.Host+req.URL.Path)
+
+	status := ti.responses[req.URL.Host]
+	if status == 0 {
+		return nil, errors.New("connection refused")
+	}
+
+	return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+}
+
+// proxied returns the instances which received proxied requests
+func (ti *testInstances) proxied() []string {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	hosts := []string{}
+	for _, r := range ti.requests {
+		if strings.HasSuffix(r, "/") {
+			hosts = append(hosts, strings.TrimSuffix(r, "/"))
+		}
+	}
+
+	return hosts
+}
+
+func setupOutliers(t *testing.T, route string, responses map[string]int) (*Router, *testInstances) {
+	rec, catalog := setupLoadBalancer(t, route)
+	catalog.set("api", "a=10.0.0.1:8080", "b=10.0.0.2:8080")
+
+	ti := &testInstances{responses: responses}
+	rec.httpClient = ti
+
+	return rec, ti
+}
+
+func sendRequests(rec *Router, n int) {
+	for i := 0; i < n; i++ {
+		rec.Handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/api", nil))
+	}
+}
+
+func TestOutlierDetectionEjectsInstanceAfterConsecutive5xx(t *testing.T) {
+	rec, ti := setupOutliers(t, "service=api#path=/api#lb=round_robin#outlier_5xx=2", map[string]int{
+		"10.0.0.1:8080": http.StatusServiceUnavailable,
+		"10.0.0.2:8080": http.StatusOK,
+	})
+
+	sendRequests(rec, 6)
+
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.2:8080", "10.0.0.2:8080"}, ti.proxied())
+
+	status := rec.balancer.status()
+	assert.True(t, status[0].Instances[0].Ejected)
+	assert.Equal(t, "5xx", status[0].Instances[0].EjectionReason)
+	assert.False(t, status[0].Instances[1].Ejected)
+}
+
+func TestOutlierDetectionEjectsInstanceAfterConnectionErrors(t *testing.T) {
+	rec, ti := setupOutliers(t, "service=api#path=/api#lb=round_robin#outlier_errors=2", map[string]int{
+		"10.0.0.2:8080": http.StatusOK,
+	})
+
+	sendRequests(rec, 3)
+
+	// failed requests are retried on the next instance
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.2:8080"}, ti.proxied())
+	assert.Equal(t, "errors", rec.balancer.status()[0].Instances[0].EjectionReason)
+}
+
+func TestOutlierDetectionReturnsInstanceAfterEjection(t *testing.T) {
+	rec, ti := setupOutliers(t, "service=api#path=/api#lb=round_robin#outlier_5xx=1#outlier_ejection=10s", map[string]int{
+		"10.0.0.1:8080": http.StatusServiceUnavailable,
+		"10.0.0.2:8080": http.StatusOK,
+	})
+
+	now := time.Now()
+	rec.balancer.now = func() time.Time { return now }
+
+	sendRequests(rec, 3)
+	ti.set("10.0.0.1:8080", http.StatusOK)
+
+	now = now.Add(11 * time.Second)
+	sendRequests(rec, 2)
+
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.2:8080"}, ti.proxied()[:3], "Should eject the instance")
+	assert.Contains(t, ti.proxied()[3:], "10.0.0.1:8080", "Should use the instance after the ejection")
+}
+
+func TestOutlierDetectionLimitsEjectedInstances(t *testing.T) {
+	rec, _ := setupOutliers(t, "service=api#path=/api#lb=round_robin#outlier_5xx=1", map[string]int{
+		"10.0.0.1:8080": http.StatusServiceUnavailable,
+		"10.0.0.2:8080": http.StatusServiceUnavailable,
+	})
+
+	sendRequests(rec, 4)
+
+	ejected := 0
+	for _, i := range rec.balancer.status()[0].Instances {
+		if i.Ejected {
+			ejected++
+		}
+	}
+
+	assert.Equal(t, 1, ejected, "Should not eject more than half of the instances")
+}
+
+func TestOutlierEjectionPeriodGrows(t *testing.T) {
+	o := &OutlierDetection{BaseEjection: 10 * time.Second, MaxEjection: 30 * time.Second, MaxEjectionPercent: 100}
+	p := &instancePool{balancer: newLoadBalancer(nil, log.Default())}
+	inst := &connectInstance{id: "a", addr: "10.0.0.1:8080"}
+	p.instances = []*connectInstance{inst}
+
+	now := time.Now()
+	periods := []time.Duration{}
+	for i := 0; i < 4; i++ {
+		p.eject(inst, o, "5xx", now)
+		periods = append(periods, inst.health.ejectedUntil.Sub(now))
+		now = inst.health.ejectedUntil
+	}
+
+	assert.Equal(t, []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second}, periods)
+
+	// instances which are not ejected for the maximum period start again
+	now = now.Add(31 * time.Second)
+	p.eject(inst, o, "5xx", now)
+	assert.Equal(t, 10*time.Second, inst.health.ejectedUntil.Sub(now))
+}
+
+func TestOutlierDetectionEjectsSlowInstances(t *testing.T) {
+	o := &OutlierDetection{LatencyFactor: 3}
+	o.setDefaults()
+
+	p := &instancePool{balancer: newLoadBalancer(nil, log.Default())}
+	latencies := map[string]time.Duration{"a": 10 * time.Millisecond, "b": 12 * time.Millisecond, "c": 100 * time.Millisecond}
+	for _, id := range []string{"a", "b", "c"} {
+		p.instances = append(p.instances, &connectInstance{id: id, addr: id + ":8080"})
+	}
+
+	now := time.Now()
+	p.balancer.now = func() time.Time { return now }
+
+	for i := 0; i < outlierLatencySamples; i++ {
+		for _, inst := range p.instances {
+			br := &balancedRequest{pool: p, instance: inst, outlier: o, start: now.Add(-latencies[inst.id])}
+			br.result(&http.Response{StatusCode: http.StatusOK}, nil)
+		}
+	}
+
+	assert.True(t, p.instances[0].health.available(now))
+	assert.True(t, p.instances[1].health.available(now))
+	assert.False(t, p.instances[2].health.available(now))
+	assert.Equal(t, "latency", p.instances[2].health.reason)
+}
+
+func TestHashSkipsEjectedInstances(t *testing.T) {
+	rec, ti := setupOutliers(t, "service=api#path=/api#lb=hash#hash_on=header:X-User#outlier_5xx=1", map[string]int{
+		"10.0.0.1:8080": http.StatusServiceUnavailable,
+		"10.0.0.2:8080": http.StatusServiceUnavailable,
+	})
+
+	send := func() string {
+		req := httptest.NewRequest("GET", "/api", nil)
+		req.Header.Set("X-User", "nic")
+		rec.Handler(httptest.NewRecorder(), req)
+
+		hosts := ti.proxied()
+		return hosts[len(hosts)-1]
+	}
+
+	first := send()
+	second := send()
+
+	assert.NotEqual(t, first, second, "Should move keys of ejected instances to the next instance")
+}
+
+func TestHealthCheckRemovesUnhealthyInstances(t *testing.T) {
+	rec, ti := setupOutliers(t, "service=api#path=/api#lb=round_robin#health_check_path=/health#health_check_interval=10ms#health_check_unhealthy=1#health_check_healthy=1", map[string]int{
+		"10.0.0.1:8080": http.StatusOK,
+		"10.0.0.2:8080": http.StatusOK,
+	})
+
+	// the first request starts the health checks
+	sendRequests(rec, 1)
+
+	ti.set("10.0.0.1:8080", http.StatusServiceUnavailable)
+
+	waitFor(t, func() bool {
+		return !rec.balancer.status()[0].Instances[0].Healthy
+	}, "Expected instance to be unhealthy")
+
+	assert.Equal(t, "Unexpected status code 503", rec.balancer.status()[0].Instances[0].HealthCheckError)
+
+	before := len(ti.proxied())
+	sendRequests(rec, 2)
+	assert.Equal(t, []string{"10.0.0.2:8080", "10.0.0.2:8080"}, ti.proxied()[before:])
+
+	ti.set("10.0.0.1:8080", http.StatusOK)
+
+	waitFor(t, func() bool {
+		return rec.balancer.status()[0].Instances[0].Healthy
+	}, "Expected instance to be healthy")
+
+	ti.mu.Lock()
+	checks := 0
+	for _, r := range ti.requests {
+		if strings.HasSuffix(r, "/health") {
+			checks++
+		}
+	}
+	ti.mu.Unlock()
+
+	assert.True(t, checks > 2, "Should check the instances")
+}
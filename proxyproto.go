@@ -0,0 +1,382 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol versions which can be sent to TCP upstreams
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// proxyHeaderTimeout limits the time a trusted source has to send the PROXY
+// protocol header
+const proxyHeaderTimeout = 5 * time.Second
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// EnableProxyProtocol parses PROXY protocol v1 and v2 headers on the HTTP,
+// HTTPS and TCP listeners. Connections from the trusted CIDRs must send a
+// header, the client address in the header replaces the remote address of
+// the connection. Connections from other sources are not parsed.
+func (r *Router) EnableProxyProtocol(trustedCIDRs []string) error {
+	if len(trustedCIDRs) == 0 {
+		return fmt.Errorf("PROXY protocol requires at least one trusted CIDR")
+	}
+
+	trusted := []*net.IPNet{}
+	for _, c := range trustedCIDRs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return fmt.Errorf("Invalid trusted CIDR %s: %s", c, err)
+		}
+
+		trusted = append(trusted, n)
+	}
+
+	r.proxyTrusted = trusted
+
+	return nil
+}
+
+// proxyListener wraps the listener to parse PROXY protocol headers when
+// enabled
+func (r *Router) proxyListener(l net.Listener) net.Listener {
+	if len(r.proxyTrusted) == 0 {
+		return l
+	}
+
+	return &proxyProtocolListener{Listener: l, trusted: r.proxyTrusted}
+}
+
+// proxyProtocolListener returns connections which read the PROXY protocol
+// header from trusted sources
+type proxyProtocolListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	addr, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return c, nil
+	}
+
+	for _, n := range l.trusted {
+		if n.Contains(addr.IP) {
+			return &proxyProtocolConn{Conn: c, br: bufio.NewReader(c)}, nil
+		}
+	}
+
+	return c, nil
+}
+
+// proxyProtocolConn reads the header on first use so a slow client does not
+// block the listener
+type proxyProtocolConn struct {
+	net.Conn
+	br *bufio.Reader
+
+	once   sync.Once
+	err    error
+	remote net.Addr
+	local  net.Addr
+
+	// deadline is the read deadline set by the server, it is restored after
+	// the header has been read
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.mu.Lock()
+		deadline := c.deadline
+		c.mu.Unlock()
+
+		d := time.Now().Add(proxyHeaderTimeout)
+		if !deadline.IsZero() && deadline.Before(d) {
+			d = deadline
+		}
+
+		c.Conn.SetReadDeadline(d)
+		c.remote, c.local, c.err = readProxyHeader(c.br)
+
+		c.mu.Lock()
+		c.Conn.SetReadDeadline(c.deadline)
+		c.mu.Unlock()
+	})
+}
+
+// SetDeadline records the read deadline so it is kept after the header has
+// been read
+func (c *proxyProtocolConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline records the read deadline so it is kept after the header
+// has been read
+func (c *proxyProtocolConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.br.Read(p)
+}
+
+// readProxyProtocolHeader reads the header for connections from trusted
+// sources, other connections are not read
+func readProxyProtocolHeader(c net.Conn) error {
+	pc, ok := c.(*proxyProtocolConn)
+	if !ok {
+		return nil
+	}
+
+	pc.readHeader()
+	return pc.err
+}
+
+// RemoteAddr returns the client address from the header
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address from the header
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.local != nil {
+		return c.local
+	}
+
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite half closes the underlying connection when supported
+func (c *proxyProtocolConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return c.Conn.Close()
+}
+
+// readProxyHeader reads a v1 or v2 header returning the source and
+// destination addresses, the addresses are nil for LOCAL and UNKNOWN
+// connections
+func readProxyHeader(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	sig, err := br.Peek(5)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to read PROXY protocol header: %s", err)
+	}
+
+	if string(sig) == "PROXY" {
+		return readProxyV1(br)
+	}
+
+	// do not wait for the rest of the v2 signature when it can not match
+	if !bytes.Equal(sig, proxyV2Signature[:5]) {
+		return nil, nil, fmt.Errorf("Missing PROXY protocol header")
+	}
+
+	sig, err = br.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(br)
+	}
+
+	return nil, nil, fmt.Errorf("Missing PROXY protocol header")
+}
+
+// readProxyV1 reads the text header i.e.
+// PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\r\n
+func readProxyV1(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	line := []byte{}
+
+	// the header is at most 107 bytes
+	for len(line) < 107 {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to read PROXY protocol header: %s", err)
+		}
+
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("Invalid PROXY protocol header")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("Invalid PROXY protocol header")
+	}
+
+	src, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dst, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return src, dst, nil
+}
+
+func parseProxyAddr(ip, port string) (*net.TCPAddr, error) {
+	a := net.ParseIP(ip)
+	if a == nil {
+		return nil, fmt.Errorf("Invalid PROXY protocol address %s", ip)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid PROXY protocol port %s", port)
+	}
+
+	return &net.TCPAddr{IP: a, Port: int(p)}, nil
+}
+
+// readProxyV2 reads the binary header, TLVs are ignored
+func readProxyV2(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, nil, fmt.Errorf("Unable to read PROXY protocol header: %s", err)
+	}
+
+	if hdr[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("Unsupported PROXY protocol version %d", hdr[12]>>4)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, nil, fmt.Errorf("Unable to read PROXY protocol header: %s", err)
+	}
+
+	switch hdr[12] & 0xf {
+	case 0x0:
+		// LOCAL connections i.e. health checks from the proxy
+		return nil, nil, nil
+	case 0x1:
+	default:
+		return nil, nil, fmt.Errorf("Invalid PROXY protocol command %d", hdr[12]&0xf)
+	}
+
+	var size int
+	switch hdr[13] {
+	case 0x11:
+		size = net.IPv4len
+	case 0x21:
+		size = net.IPv6len
+	default:
+		// UDP and unix socket addresses are not used by the router
+		return nil, nil, nil
+	}
+
+	if len(body) < 2*size+4 {
+		return nil, nil, fmt.Errorf("Invalid PROXY protocol address length %d", len(body))
+	}
+
+	src := &net.TCPAddr{
+		IP:   net.IP(body[:size]),
+		Port: int(binary.BigEndian.Uint16(body[2*size:])),
+	}
+
+	dst := &net.TCPAddr{
+		IP:   net.IP(body[size : 2*size]),
+		Port: int(binary.BigEndian.Uint16(body[2*size+2:])),
+	}
+
+	return src, dst, nil
+}
+
+// writeProxyHeader writes the header for the client connection, UNKNOWN and
+// LOCAL headers are sent when the addresses are not TCP addresses
+func writeProxyHeader(w io.Writer, version string, src, dst net.Addr) error {
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+
+	v4 := sok && dok && s.IP.To4() != nil && d.IP.To4() != nil
+	v6 := sok && dok && !v4 && s.IP.To16() != nil && d.IP.To16() != nil
+
+	if version == ProxyProtocolV1 {
+		var hdr string
+		switch {
+		case v4:
+			hdr = fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", s.IP.To4(), d.IP.To4(), s.Port, d.Port)
+		case v6:
+			hdr = fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", s.IP.To16(), d.IP.To16(), s.Port, d.Port)
+		default:
+			hdr = "PROXY UNKNOWN\r\n"
+		}
+
+		_, err := io.WriteString(w, hdr)
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	buf.Write(proxyV2Signature)
+
+	var sip, dip net.IP
+	switch {
+	case v4:
+		buf.Write([]byte{0x21, 0x11})
+		sip, dip = s.IP.To4(), d.IP.To4()
+	case v6:
+		buf.Write([]byte{0x21, 0x21})
+		sip, dip = s.IP.To16(), d.IP.To16()
+	default:
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+
+	binary.Write(buf, binary.BigEndian, uint16(2*len(sip)+4))
+	buf.Write(sip)
+	buf.Write(dip)
+	binary.Write(buf, binary.BigEndian, uint16(s.Port))
+	binary.Write(buf, binary.BigEndian, uint16(d.Port))
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,191 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestReadProxyHeaderParsesV1AndV2(t *testing.T) {
+	addrs := map[string][2]*net.TCPAddr{
+		"ipv4": {
+			{IP: net.ParseIP("203.0.113.7").To4(), Port: 40000},
+			{IP: net.ParseIP("10.0.0.1").To4(), Port: 443},
+		},
+		"ipv6": {
+			{IP: net.ParseIP("2001:db8::7"), Port: 40000},
+			{IP: net.ParseIP("2001:db8::1"), Port: 443},
+		},
+	}
+
+	for name, a := range addrs {
+		for _, v := range []string{ProxyProtocolV1, ProxyProtocolV2} {
+			buf := &bytes.Buffer{}
+			assert.NoError(t, writeProxyHeader(buf, v, a[0], a[1]))
+			buf.WriteString("GET / HTTP/1.1\r\n")
+
+			br := bufio.NewReader(buf)
+			src, dst, err := readProxyHeader(br)
+
+			assert.NoError(t, err, name+" "+v)
+			assert.Equal(t, a[0].String(), src.String(), name+" "+v)
+			assert.Equal(t, a[1].String(), dst.String(), name+" "+v)
+
+			rest, _ := ioutil.ReadAll(br)
+			assert.Equal(t, "GET / HTTP/1.1\r\n", string(rest), "Should leave the request in the buffer")
+		}
+	}
+}
+
+func TestReadProxyHeaderReturnsNoAddressForLocalConnections(t *testing.T) {
+	for _, v := range []string{ProxyProtocolV1, ProxyProtocolV2} {
+		buf := &bytes.Buffer{}
+		assert.NoError(t, writeProxyHeader(buf, v, &net.UnixAddr{}, &net.UnixAddr{}))
+
+		src, dst, err := readProxyHeader(bufio.NewReader(buf))
+
+		assert.NoError(t, err)
+		assert.Nil(t, src)
+		assert.Nil(t, dst)
+	}
+}
+
+func TestReadProxyHeaderRejectsInvalidHeaders(t *testing.T) {
+	headers := []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 203.0.113.7 10.0.0.1 40000\r\n",
+		"PROXY TCP4 203.0.113.7 10.0.0.1 40000 70000\r\n",
+		"PROXY TCP4 nothost 10.0.0.1 40000 443\r\n",
+		"PROXY TCP4 203.0.113.7 10.0.0.1 40000 443\n",
+		"PROXY " + strings.Repeat("A", 120) + "\r\n",
+		string(proxyV2Signature) + "\x11\x11\x00\x00",
+		string(proxyV2Signature) + "\x21\x11\x00\x04\x01\x02\x03\x04",
+	}
+
+	for _, h := range headers {
+		_, _, err := readProxyHeader(bufio.NewReader(strings.NewReader(h)))
+		assert.Error(t, err, h)
+	}
+}
+
+func TestProxyListenerReplacesRemoteAddrForTrustedSources(t *testing.T) {
+	rec := setupRouterTests(t)
+	rec.upstreams = append(rec.upstreams, Upstream{Service: "test", Path: "/test"})
+	assert.NoError(t, rec.EnableProxyProtocol([]string{"127.0.0.0/8"}))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	s := &http.Server{Handler: http.HandlerFunc(rec.Handler)}
+	go s.Serve(rec.proxyListener(l))
+	defer s.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	defer c.Close()
+
+	c.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 40000 80\r\nGET /test HTTP/1.1\r\nHost: test\r\n\r\n"))
+
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	mockHTTPClient.AssertCalled(t, "Do", mock.Anything)
+	req := mockHTTPClient.Calls[0].Arguments.Get(0).(*http.Request)
+	assert.Equal(t, "203.0.113.7:40000", req.Header.Get("X-Forwarded-For"))
+}
+
+func TestProxyListenerRequiresHeaderFromTrustedSources(t *testing.T) {
+	rec := setupRouterTests(t)
+	rec.EnableProxyProtocol([]string{"127.0.0.0/8"})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	pl := rec.proxyListener(l)
+	defer pl.Close()
+
+	go func() {
+		c, _ := net.Dial("tcp", l.Addr().String())
+		c.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	}()
+
+	c, err := pl.Accept()
+	assert.NoError(t, err)
+
+	_, err = c.Read(make([]byte, 10))
+	assert.Error(t, err)
+}
+
+func TestProxyListenerKeepsReadDeadlineAfterHeader(t *testing.T) {
+	rec := setupRouterTests(t)
+	rec.EnableProxyProtocol([]string{"127.0.0.0/8"})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	pl := rec.proxyListener(l)
+	defer pl.Close()
+
+	go func() {
+		c, _ := net.Dial("tcp", l.Addr().String())
+		c.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 40000 80\r\n"))
+	}()
+
+	c, err := pl.Accept()
+	assert.NoError(t, err)
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 10))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		assert.Error(t, err, "Should have timed out reading after the header")
+	case <-time.After(time.Second):
+		t.Fatal("Read deadline was cleared after reading the header")
+	}
+}
+
+func TestProxyListenerDoesNotParseUntrustedSources(t *testing.T) {
+	rec := setupRouterTests(t)
+	rec.EnableProxyProtocol([]string{"10.0.0.0/8"})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	pl := rec.proxyListener(l)
+	defer pl.Close()
+
+	go func() {
+		c, _ := net.Dial("tcp", l.Addr().String())
+		c.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 40000 80\r\n"))
+	}()
+
+	c, err := pl.Accept()
+	assert.NoError(t, err)
+
+	assert.Equal(t, "127.0.0.1", c.RemoteAddr().(*net.TCPAddr).IP.String())
+
+	buf := make([]byte, 5)
+	io.ReadFull(c, buf)
+	assert.Equal(t, "PROXY", string(buf), "Should pass the header through")
+}
+
+func TestEnableProxyProtocolValidatesCIDRs(t *testing.T) {
+	rec := setupRouterTests(t)
+
+	assert.Error(t, rec.EnableProxyProtocol(nil))
+	assert.Error(t, rec.EnableProxyProtocol([]string{"10.0.0.1"}))
+}
@@ -0,0 +1,245 @@
+package router
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit defines a token bucket rate limit, a separate bucket is allocated
+// for every client key
+type RateLimit struct {
+	// Rate is the number of tokens added to the bucket every second
+	Rate float64
+	// Burst is the maximum number of tokens the bucket can hold
+	Burst int
+	// Key defines how requests are grouped into buckets, valid values are
+	// "" (all clients share a bucket), "ip", "header:[name]" or "claim:[name]",
+	// claims are only available on routes with JWT authentication
+	Key string
+
+	scope string
+	store rateLimitStore
+}
+
+// rateLimitResult is the outcome of taking a token from a bucket
+type rateLimitResult struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration
+	Reset      time.Duration
+}
+
+// rateLimitStore holds the state of the token buckets
+type rateLimitStore interface {
+	Take(scope, key string, rate float64, burst int) (rateLimitResult, error)
+}
+
+// NewRateLimit creates a rate limit from a rate definition such as 10/s, 600/m
+// or 1000/h, when burst is 0 the burst is set to the per second rate
+func NewRateLimit(rate string, burst int, key string) (*RateLimit, error) {
+	r, err := parseRate(rate)
+	if err != nil {
+		return nil, err
+	}
+
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(r)))
+	}
+
+	if key != "" && key != "ip" && !strings.HasPrefix(key, "header:") && !strings.HasPrefix(key, "claim:") {
+		return nil, fmt.Errorf("Invalid rate limit key %s", key)
+	}
+
+	return &RateLimit{
+		Rate:  r,
+		Burst: burst,
+		Key:   key,
+		scope: "global",
+		store: newMemoryRateLimitStore(),
+	}, nil
+}
+
+// Take removes a token from the bucket for the client making the request
+func (rl *RateLimit) Take(req *http.Request) (rateLimitResult, error) {
+	return rl.store.Take(rl.scope, rl.clientKey(req), rl.Rate, rl.Burst)
+}
+
+// clientKey returns the bucket key for the request
+func (rl *RateLimit) clientKey(req *http.Request) string {
+	switch {
+	case rl.Key == "ip":
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			return req.RemoteAddr
+		}
+		return host
+	case strings.HasPrefix(rl.Key, "header:"):
+		return req.Header.Get(strings.TrimPrefix(rl.Key, "header:"))
+	case strings.HasPrefix(rl.Key, "claim:"):
+		return validatedClaim(req, strings.TrimPrefix(rl.Key, "claim:"))
+	}
+
+	return ""
+}
+
+// setHeaders writes the X-RateLimit headers to the response
+func (rl *RateLimit) setHeaders(rw http.ResponseWriter, res rateLimitResult) {
+	rw.Header().Set("X-RateLimit-Limit", strconv.Itoa(rl.Burst))
+	rw.Header().Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	rw.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(res.Reset.Seconds()))))
+
+	if !res.Allowed {
+		rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(res.RetryAfter.Seconds()))))
+	}
+}
+
+// allowRequest checks the rate limit for the request, when the request is
+// denied a 429 is written to the response and false is returned
+func (r *Router) allowRequest(rl *RateLimit, rw http.ResponseWriter, req *http.Request) bool {
+	if rl == nil {
+		return true
+	}
+
+	res, err := rl.Take(req)
+	if err != nil {
+		// fail open, an unavailable store should not take down the router
+		r.logger.Error("Unable to check rate limit", "error", err)
+		return true
+	}
+
+	rl.setHeaders(rw, res)
+
+	if !res.Allowed {
+		r.logger.Info("Rate limit exceeded", "scope", rl.scope, "path", req.URL.Path, "remote_addr", req.RemoteAddr)
+		http.Error(rw, "Rate limit exceeded", http.StatusTooManyRequests)
+		return false
+	}
+
+	return true
+}
+
+// parseRate converts a rate definition into tokens per second
+func parseRate(rate string) (float64, error) {
+	parts := strings.Split(rate, "/")
+
+	n, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Invalid rate %s", rate)
+	}
+
+	if len(parts) == 1 {
+		return n, nil
+	}
+
+	switch parts[1] {
+	case "s":
+		return n, nil
+	case "m":
+		return n / 60, nil
+	case "h":
+		return n / 3600, nil
+	}
+
+	return 0, fmt.Errorf("Invalid rate unit %s", rate)
+}
+
+// validatedClaim returns the string value of a claim validated by JWT
+// authentication, requests without validated claims return an empty string
+func validatedClaim(req *http.Request, claim string) string {
+	claims, ok := requestClaims(req)
+	if !ok {
+		return ""
+	}
+
+	return claimString(claims[claim])
+}
+
+// tokenBucket is the state of a single bucket
+type tokenBucket struct {
+	Tokens float64   `json:"tokens"`
+	Last   time.Time `json:"last"`
+}
+
+// refill adds the tokens for the time elapsed since the bucket was last used
+func (b *tokenBucket) refill(now time.Time, rate float64, burst int) {
+	if b.Last.IsZero() {
+		b.Tokens = float64(burst)
+	} else if elapsed := now.Sub(b.Last).Seconds(); elapsed > 0 {
+		b.Tokens = math.Min(float64(burst), b.Tokens+elapsed*rate)
+	}
+	b.Last = now
+}
+
+// take refills the bucket based on the elapsed time and attempts to remove
+// a single token
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) rateLimitResult {
+	b.refill(now, rate, burst)
+
+	res := rateLimitResult{}
+	if b.Tokens >= 1 {
+		b.Tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = time.Duration((1 - b.Tokens) / rate * float64(time.Second))
+	}
+
+	res.Remaining = int(b.Tokens)
+	res.Reset = time.Duration((float64(burst) - b.Tokens) / rate * float64(time.Second))
+
+	return res
+}
+
+// memoryRateLimitStore keeps buckets in memory local to the router instance
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+	takes   int
+	now     func() time.Time
+}
+
+type memoryBucket struct {
+	tokenBucket
+	// refill is the time taken for an empty bucket to refill
+	refill time.Duration
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{
+		buckets: map[string]*memoryBucket{},
+		now:     time.Now,
+	}
+}
+
+// Take implements rateLimitStore
+func (m *memoryRateLimitStore) Take(scope, key string, rate float64, burst int) (rateLimitResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+
+	// periodically remove buckets which have refilled, they are identical
+	// to a new bucket
+	m.takes++
+	if m.takes%1000 == 0 {
+		for k, b := range m.buckets {
+			if now.Sub(b.Last) > b.refill {
+				delete(m.buckets, k)
+			}
+		}
+	}
+
+	k := scope + "/" + key
+	b, ok := m.buckets[k]
+	if !ok {
+		b = &memoryBucket{refill: time.Duration(float64(burst) / rate * float64(time.Second))}
+		m.buckets[k] = b
+	}
+
+	return b.take(now, rate, burst), nil
+}
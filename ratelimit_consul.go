@@ -0,0 +1,301 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// rateLimitSyncInterval is how often local buckets are synced with the
+	// shared buckets in Consul
+	rateLimitSyncInterval = time.Second
+	// rateLimitSyncTimeout bounds each Consul request made when syncing
+	rateLimitSyncTimeout = 2 * time.Second
+	// rateLimitSeedTimeout bounds the Consul request made by the first
+	// request for a bucket
+	rateLimitSeedTimeout = 200 * time.Millisecond
+)
+
+// consulRateLimitStore shares token buckets between router instances using
+// the Consul KV store. Requests take tokens from local buckets which are
+// seeded from Consul when they are created and synced with Consul in the
+// background, so an unavailable Consul does not slow down requests for
+// long. Between syncs each router takes from its own copy of the bucket, so
+// with N routers up to N times the tokens in the shared bucket at the last
+// sync, plus one sync interval of refill, can be allowed. Buckets are
+// created in Consul holding a lock from a session owned by the router, when
+// the router stops and the session is invalidated the buckets it created are
+// removed.
+type consulRateLimitStore struct {
+	client    *api.Client
+	prefix    string
+	doneCh    chan struct{}
+	now       func() time.Time
+	mu        sync.Mutex
+	sessionID string
+
+	bucketsMu sync.Mutex
+	buckets   map[string]*syncedBucket
+}
+
+// syncedBucket is a local bucket and the tokens taken since it was synced,
+// seeded is closed once the bucket has been read from Consul
+type syncedBucket struct {
+	tokenBucket
+	rate   float64
+	burst  int
+	taken  int
+	seeded chan struct{}
+}
+
+// newConsulRateLimitStore creates a session for the router and starts
+// renewing it in the background
+func newConsulRateLimitStore(c *api.Client, prefix string) (*consulRateLimitStore, error) {
+	s := &consulRateLimitStore{
+		client:  c,
+		prefix:  prefix,
+		doneCh:  make(chan struct{}),
+		now:     time.Now,
+		buckets: map[string]*syncedBucket{},
+	}
+
+	err := s.createSession()
+	if err != nil {
+		return nil, err
+	}
+
+	go s.renewSession()
+	go s.syncPeriodic()
+
+	return s, nil
+}
+
+func (c *consulRateLimitStore) createSession() error {
+	id, _, err := c.client.Session().Create(&api.SessionEntry{
+		Name:      "connect-router-ratelimit",
+		Behavior:  api.SessionBehaviorDelete,
+		TTL:       "30s",
+		LockDelay: 1 * time.Millisecond,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("Unable to create rate limit session: %s", err)
+	}
+
+	c.mu.Lock()
+	c.sessionID = id
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *consulRateLimitStore) session() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.sessionID
+}
+
+// renewSession keeps the session alive until the store is closed, if the
+// session expires a new session is created
+func (c *consulRateLimitStore) renewSession() {
+	for {
+		c.client.Session().RenewPeriodic("30s", c.session(), nil, c.doneCh)
+
+		select {
+		case <-c.doneCh:
+			return
+		default:
+		}
+
+		if err := c.createSession(); err != nil {
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// Take implements rateLimitStore, tokens are taken from the local bucket
+// which is seeded from the shared bucket by the first request
+func (c *consulRateLimitStore) Take(scope, key string, rate float64, burst int) (rateLimitResult, error) {
+	k := path.Join(c.prefix, scope, url.PathEscape(key))
+	if key == "" {
+		k = path.Join(c.prefix, scope, "_")
+	}
+
+	c.bucketsMu.Lock()
+	b, ok := c.buckets[k]
+	if !ok {
+		b = &syncedBucket{rate: rate, burst: burst, seeded: make(chan struct{})}
+		c.buckets[k] = b
+	}
+	c.bucketsMu.Unlock()
+
+	if !ok {
+		c.seed(k, b)
+	}
+
+	<-b.seeded
+
+	c.bucketsMu.Lock()
+	defer c.bucketsMu.Unlock()
+
+	res := b.take(c.now(), rate, burst)
+	if res.Allowed {
+		b.taken++
+	}
+
+	return res, nil
+}
+
+// seed sets a new local bucket from the shared bucket so the tokens taken by
+// other routers are counted, when Consul can not be read the bucket starts
+// full
+func (c *consulRateLimitStore) seed(k string, b *syncedBucket) {
+	defer close(b.seeded)
+
+	ctx, cancel := context.WithTimeout(context.Background(), rateLimitSeedTimeout)
+	defer cancel()
+
+	pair, _, err := c.client.KV().Get(k, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil || pair == nil {
+		return
+	}
+
+	shared := tokenBucket{}
+	if err := json.Unmarshal(pair.Value, &shared); err != nil {
+		return
+	}
+
+	c.bucketsMu.Lock()
+	b.tokenBucket = shared
+	c.bucketsMu.Unlock()
+}
+
+// syncPeriodic syncs the local buckets until the store is closed
+func (c *consulRateLimitStore) syncPeriodic() {
+	t := time.NewTicker(rateLimitSyncInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.doneCh:
+			return
+		case <-t.C:
+			c.sync()
+		}
+	}
+}
+
+// sync writes the tokens taken from local buckets to Consul and updates the
+// local buckets with the tokens taken by other routers. Buckets which have
+// refilled and have not been used since the last sync are removed.
+func (c *consulRateLimitStore) sync() {
+	now := c.now()
+
+	c.bucketsMu.Lock()
+	keys := []string{}
+	for k, b := range c.buckets {
+		// buckets being seeded have not been used yet
+		select {
+		case <-b.seeded:
+		default:
+			continue
+		}
+
+		refill := time.Duration(float64(b.burst) / b.rate * float64(time.Second))
+		if b.taken == 0 && now.Sub(b.Last) > refill {
+			delete(c.buckets, k)
+			continue
+		}
+
+		if b.taken > 0 {
+			keys = append(keys, k)
+		}
+	}
+	c.bucketsMu.Unlock()
+
+	// buckets which can not be synced are retried with the next interval
+	for _, k := range keys {
+		c.syncBucket(k)
+	}
+}
+
+// syncBucket removes the tokens taken locally from the shared bucket using
+// check and set, retrying when another router has modified it
+func (c *consulRateLimitStore) syncBucket(k string) error {
+	c.bucketsMu.Lock()
+	b := c.buckets[k]
+	taken, rate, burst := b.taken, b.rate, b.burst
+	c.bucketsMu.Unlock()
+
+	kv := c.client.KV()
+
+	for i := 0; i < 5; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), rateLimitSyncTimeout)
+		pair, _, err := kv.Get(k, (&api.QueryOptions{}).WithContext(ctx))
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		shared := &tokenBucket{}
+		if pair != nil {
+			if err := json.Unmarshal(pair.Value, shared); err != nil {
+				return err
+			}
+		}
+
+		shared.refill(c.now(), rate, burst)
+		shared.Tokens -= float64(taken)
+		if shared.Tokens < 0 {
+			shared.Tokens = 0
+		}
+
+		data, err := json.Marshal(shared)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel = context.WithTimeout(context.Background(), rateLimitSyncTimeout)
+		wo := (&api.WriteOptions{}).WithContext(ctx)
+
+		var ok bool
+		if pair == nil {
+			// new buckets are locked by our session so they are cleaned up
+			ok, _, err = kv.Acquire(&api.KVPair{Key: k, Value: data, Session: c.session()}, wo)
+		} else {
+			ok, _, err = kv.CAS(&api.KVPair{Key: k, Value: data, ModifyIndex: pair.ModifyIndex}, wo)
+		}
+		cancel()
+
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			// tokens taken while syncing are kept for the next sync
+			c.bucketsMu.Lock()
+			b.taken -= taken
+			b.Tokens = math.Max(0, shared.Tokens-float64(b.taken))
+			b.Last = shared.Last
+			c.bucketsMu.Unlock()
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Unable to update rate limit bucket %s, too many conflicts", k)
+}
+
+// Close stops renewing and destroys the session, removing any buckets created
+// by this router
+func (c *consulRateLimitStore) Close() {
+	close(c.doneCh)
+}
@@ -0,0 +1,258 @@
+package router
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspTimeout limits the time an OCSP responder can hold up a request
+const ocspTimeout = 2 * time.Second
+
+// ocspMaxResponseSize is the largest OCSP response read from a responder
+const ocspMaxResponseSize = 32 * 1024
+
+// ocspCacheSize is the number of OCSP responses cached, the least recently
+// used responses are evicted
+const ocspCacheSize = 10000
+
+var errCertificateRevoked = errors.New("Certificate has been revoked")
+
+// revocationChecker checks client certificates against CRLs loaded from disk
+// or the OCSP responder in the certificate, checks fail closed when the
+// status can not be determined
+type revocationChecker struct {
+	crlFiles   []string
+	httpClient *http.Client
+	now        func() time.Time
+
+	mu       sync.Mutex
+	crls     []*x509.RevocationList
+	modTimes map[string]time.Time
+
+	// cache holds ocspStatus values keyed by issuer and serial
+	cache *lru.Cache
+}
+
+type ocspStatus struct {
+	err     error
+	expires time.Time
+}
+
+func newRevocationChecker(crlFiles []string) (*revocationChecker, error) {
+	// the size is always positive so New can not fail
+	cache, _ := lru.New(ocspCacheSize)
+
+	c := &revocationChecker{
+		crlFiles:   crlFiles,
+		httpClient: &http.Client{Timeout: ocspTimeout},
+		now:        time.Now,
+		cache:      cache,
+	}
+
+	err := c.loadCRLs()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// loadCRLs reads the CRL files, the current CRLs are kept when any file can
+// not be loaded
+func (c *revocationChecker) loadCRLs() error {
+	crls := []*x509.RevocationList{}
+	modTimes := map[string]time.Time{}
+
+	for _, f := range c.crlFiles {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modTimes[f] = fi.ModTime()
+
+		d, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+
+		if b, _ := pem.Decode(d); b != nil {
+			d = b.Bytes
+		}
+
+		crl, err := x509.ParseRevocationList(d)
+		if err != nil {
+			return fmt.Errorf("Unable to parse CRL %s: %s", f, err)
+		}
+
+		crls = append(crls, crl)
+	}
+
+	c.mu.Lock()
+	c.crls = crls
+	c.modTimes = modTimes
+	c.mu.Unlock()
+
+	return nil
+}
+
+// crlsChanged returns true when any of the CRL files have been modified
+// since they were loaded
+func (c *revocationChecker) crlsChanged() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for file, mt := range c.modTimes {
+		fi, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+
+		if !fi.ModTime().Equal(mt) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// watchCRLFiles reloads the CRLs when the files change, CRLs are published
+// with a next update time so they must be replaced without a restart
+func (r *Router) watchCRLFiles(rc *revocationChecker, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-r.tlsStop:
+			return
+		case <-t.C:
+		}
+
+		if !rc.crlsChanged() {
+			continue
+		}
+
+		err := rc.loadCRLs()
+		if err != nil {
+			r.logger.Error("Unable to reload CRLs", "error", err)
+			continue
+		}
+
+		r.logger.Info("Reloaded CRLs", "count", len(rc.crlFiles))
+	}
+}
+
+// checkRevocation checks the certificate using the listener's revocation
+// checker
+func (r *Router) checkRevocation(method string, cert, issuer *x509.Certificate) error {
+	if r.revocation == nil || issuer == nil {
+		return fmt.Errorf("Revocation checking is not available")
+	}
+
+	if method == RevocationOCSP {
+		return r.revocation.CheckOCSP(cert, issuer)
+	}
+
+	return r.revocation.CheckCRL(cert, issuer)
+}
+
+// CheckCRL returns an error when the certificate is listed in the CRL for
+// its issuer or no current CRL is available
+func (c *revocationChecker) CheckCRL(cert, issuer *x509.Certificate) error {
+	c.mu.Lock()
+	crls := c.crls
+	c.mu.Unlock()
+
+	for _, crl := range crls {
+		if !bytes.Equal(crl.RawIssuer, cert.RawIssuer) || crl.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+
+		if !crl.NextUpdate.IsZero() && c.now().After(crl.NextUpdate) {
+			return fmt.Errorf("CRL for %s has expired", issuer.Subject.String())
+		}
+
+		for _, rc := range crl.RevokedCertificateEntries {
+			if rc.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return errCertificateRevoked
+			}
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("No CRL for %s", issuer.Subject.String())
+}
+
+// CheckOCSP queries the OCSP responder in the certificate, responses are
+// cached until their next update and removed once it has passed
+func (c *revocationChecker) CheckOCSP(cert, issuer *x509.Certificate) error {
+	key := string(issuer.RawSubject) + cert.SerialNumber.String()
+
+	if v, ok := c.cache.Get(key); ok {
+		s := v.(ocspStatus)
+		if c.now().Before(s.expires) {
+			return s.err
+		}
+
+		c.cache.Remove(key)
+	}
+
+	if len(cert.OCSPServer) == 0 {
+		return fmt.Errorf("Certificate has no OCSP responder")
+	}
+
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Post(cert.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, ocspMaxResponseSize+1))
+	if err != nil {
+		return err
+	}
+
+	if len(body) > ocspMaxResponseSize {
+		return fmt.Errorf("OCSP response is larger than %d bytes", ocspMaxResponseSize)
+	}
+
+	r, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		return err
+	}
+
+	if r.Status != ocsp.Good && r.Status != ocsp.Revoked {
+		return fmt.Errorf("Certificate status is unknown")
+	}
+
+	s := ocspStatus{expires: r.NextUpdate}
+	if s.expires.IsZero() {
+		s.expires = c.now().Add(time.Hour)
+	}
+
+	if r.Status == ocsp.Revoked {
+		s.err = errCertificateRevoked
+	}
+
+	c.cache.Add(key, s)
+
+	return s.err
+}
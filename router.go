@@ -2,13 +2,16 @@ package router
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/eapache/go-resiliency/retrier"
+	"github.com/eapache/go-resiliency/breaker"
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/connect"
 	log "github.com/hashicorp/go-hclog"
@@ -26,6 +29,37 @@ type Router struct {
 	httpClientFactory     func(ConnectService) HTTPClient
 	connectServiceFactory func(name string) (ConnectService, error)
 	registerService       func(*api.AgentServiceRegistration)
+	rateLimit             *RateLimit
+	rateLimitStore        *consulRateLimitStore
+	jwtValidator          *JWTValidator
+	credentials           *CredentialStore
+	intentions            *IntentionChecker
+	tls                   *TLSConfig
+	tlsServer             *http.Server
+	tlsServerConfig       *tls.Config
+	tlsStop               chan struct{}
+	certificates          *certificateStore
+	acme                  *acmeManager
+	revocation            *revocationChecker
+	connectBindAddress    string
+	connectServer         *http.Server
+	tcpRoutes             []TCPRoute
+	tcpMu                 sync.Mutex
+	tcpListeners          []net.Listener
+	tcpConns              map[net.Conn]struct{}
+	proxyTrusted          []*net.IPNet
+	http2                 *HTTP2Config
+	http2Pool             *http2ConnPool
+	http2Client           HTTPClient
+	autoClient            HTTPClient
+	started               bool
+	lambda                *lambdaClient
+	health                *healthResolver
+	circuitsMu            sync.Mutex
+	circuits              map[string]*breaker.Breaker
+	balancer              *loadBalancer
+	adminBindAddress      string
+	adminServer           *http.Server
 }
 
 // NewRouter creates a new instance of the Router
@@ -41,6 +75,8 @@ func NewRouter(c *api.Client, l log.Logger, bind string, upstreams []string) (*R
 		connectServiceFactory: func(name string) (ConnectService, error) {
 			return connect.NewService(name, c)
 		},
+		health:   newHealthResolver(c),
+		balancer: newLoadBalancer(c, l),
 	}
 
 	var err error
@@ -54,60 +90,317 @@ func NewRouter(c *api.Client, l log.Logger, bind string, upstreams []string) (*R
 
 // Run starts the router and listens on the defined address
 func (r *Router) Run() error {
-	var err error
+	return r.RunContext(context.Background())
+}
 
-	r.logger.Info("Starting Connect Router", "version", "0.4", "listen_addr", r.bindAddress)
+// RunContext starts the router, it returns an error when the context is done
+// before the Connect certificates are ready. The Connect service is kept so
+// calling RunContext again continues to wait for the same certificates.
+func (r *Router) RunContext(ctx context.Context) error {
+	if r.started {
+		return nil
+	}
 
-	// Register the router as a Consul service
-	r.registerService(&api.AgentServiceRegistration{Name: "connect-router"})
+	// lambda routes use the AWS environment unless configured
+	if r.lambda == nil && r.upstreams.hasType(Lambda) {
+		err := r.SetLambda(LambdaConfig{})
+		if err != nil {
+			return err
+		}
+	}
 
-	// Create an instance representing this service. "my-service" is the
-	// name of _this_ service. The service should be cleaned up via Close.
-	r.service, err = r.connectServiceFactory("connect-router")
-	if err != nil {
-		return err
+	if r.service == nil {
+		r.logger.Info("Starting Connect Router", "version", "0.4", "listen_addr", r.bindAddress)
+
+		// Register the router as a Consul service
+		r.registerService(r.registration())
+
+		// Create an instance representing this service. "my-service" is the
+		// name of _this_ service. The service should be cleaned up via Close.
+		s, err := r.connectServiceFactory("connect-router")
+		if err != nil {
+			return err
+		}
+
+		r.service = s
+	}
+
+	select {
+	case <-r.service.ReadyWait():
+	case <-ctx.Done():
+		return fmt.Errorf("Timed out waiting for Connect certificates: %s", ctx.Err())
+	}
+
+	if r.balancer == nil {
+		r.balancer = newLoadBalancer(r.consulClient, r.logger)
 	}
 
-	<-r.service.ReadyWait()
+	// instances selected by the load balancer are dialed directly
+	s := &balancedConnectService{ConnectService: r.service, balancer: r.balancer}
 
 	// Get an HTTP client
-	r.httpClient = buildHTTPClient(r.service)
+	r.httpClient = buildHTTPClient(s)
+
+	// HTTP/2 routes multiplex requests over pooled connections
+	r.http2Pool = newHTTP2ConnPool(s.dialTLS, r.logger)
+	r.http2Client, r.autoClient = buildHTTP2Clients(s, r.http2Pool)
+
+	r.balancer.mu.Lock()
+	r.balancer.drain = r.drainInstance
+	r.balancer.mu.Unlock()
+
+	r.started = true
 
 	return nil
 }
 
-// ListenAndServe starts the router HTTP server
+// ListenAndServe starts the router HTTP server, the HTTPS server when TLS has
+// been configured, the Connect listener and admin API when enabled and the
+// TCP listeners, it returns when any server stops
 func (r *Router) ListenAndServe() error {
-	// Set the handlers
-	http.HandleFunc("/", r.Handler)
+	errs := make(chan error, 5)
 
 	// Setup the HTTP server
 	r.server = &http.Server{}
 	r.server.Addr = r.bindAddress
+	r.server.Handler = r.httpHandler()
+
+	if r.tls != nil {
+		r.logger.Info("Starting HTTPS listener", "listen_addr", r.tls.BindAddress)
+
+		s, err := r.newTLSServer()
+		if err != nil {
+			return err
+		}
+		r.tlsServer = s
+
+		go func() {
+			errs <- r.listenAndServeTLS(s)
+		}()
+	}
+
+	if len(r.tcpRoutes) > 0 {
+		go func() {
+			errs <- r.listenAndServeTCP()
+		}()
+	}
+
+	if r.connectBindAddress != "" {
+		r.logger.Info("Starting Connect listener", "listen_addr", r.connectBindAddress)
+
+		// the listener uses the certificates for the router's Connect service
+		s := r.newConnectServer(r.service.ServerTLSConfig())
+		r.connectServer = s
+
+		go func() {
+			errs <- r.listenAndServeConnect(s)
+		}()
+	}
+
+	if r.adminBindAddress != "" {
+		r.logger.Info("Starting admin API", "listen_addr", r.adminBindAddress)
+
+		// the server is created before it is started so Stop can always
+		// shut it down
+		s := &http.Server{
+			Addr:    r.adminBindAddress,
+			Handler: r.adminHandler(),
+		}
+		r.adminServer = s
+
+		go func() {
+			errs <- s.ListenAndServe()
+		}()
+	}
+
+	go func() {
+		l, err := net.Listen("tcp", r.bindAddress)
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		errs <- r.server.Serve(r.proxyListener(l))
+	}()
+
+	return <-errs
+}
+
+// httpHandler returns the handler for the plain HTTP listener
+func (r *Router) httpHandler() http.Handler {
+	var h http.Handler = http.HandlerFunc(r.Handler)
+
+	if r.tls != nil && r.tls.RedirectHTTP {
+		h = http.HandlerFunc(r.redirectHandler)
+	}
+
+	// ACME challenges must be answered before any redirect
+	if r.acme != nil {
+		h = r.acme.httpHandler(h)
+	}
+
+	return r.h2cHandler(h)
+}
+
+// SetRateLimit applies a rate limit to every request received by the router
+// in addition to any limits defined on the upstreams. The global limit is
+// checked before authentication so it can not be keyed by claims.
+func (r *Router) SetRateLimit(rl *RateLimit) error {
+	if strings.HasPrefix(rl.Key, "claim:") {
+		return fmt.Errorf("Invalid global rate limit key %s, claims are only validated on routes with JWT authentication", rl.Key)
+	}
+
+	r.rateLimit = rl
+
+	return nil
+}
 
-	err := r.server.ListenAndServe()
+// EnableDistributedRateLimit shares the rate limit buckets between all router
+// instances using the Consul KV store at the given prefix
+func (r *Router) EnableDistributedRateLimit(prefix string) error {
+	s, err := newConsulRateLimitStore(r.consulClient, prefix)
 	if err != nil {
 		return err
 	}
 
+	r.rateLimitStore = s
+
+	if r.rateLimit != nil {
+		r.rateLimit.store = s
+	}
+
+	for _, us := range r.upstreams {
+		if us.RateLimit != nil {
+			us.RateLimit.store = s
+		}
+	}
+
 	return nil
 }
 
+// SetJWTValidator sets the validator used by routes which require JWT
+// authentication
+func (r *Router) SetJWTValidator(v *JWTValidator) {
+	r.jwtValidator = v
+}
+
+// SetCredentialStore sets the store used by routes which require API key or
+// Basic authentication
+func (r *Router) SetCredentialStore(s *CredentialStore) {
+	r.credentials = s
+}
+
+// SetIntentionChecker sets the checker used by routes which authorize
+// external principals with Consul intentions
+func (r *Router) SetIntentionChecker(i *IntentionChecker) {
+	r.intentions = i
+}
+
 // Stop the router and cancel the http server
 func (r *Router) Stop(ctx context.Context) {
+	if r.rateLimitStore != nil {
+		r.rateLimitStore.Close()
+	}
+
+	if r.credentials != nil {
+		r.credentials.Close()
+	}
+
+	if r.tlsStop != nil {
+		close(r.tlsStop)
+	}
+
+	if r.tlsServer != nil {
+		r.tlsServer.Shutdown(ctx)
+	}
+
+	if r.connectServer != nil {
+		r.connectServer.Shutdown(ctx)
+	}
+
+	if r.adminServer != nil {
+		r.adminServer.Shutdown(ctx)
+	}
+
+	r.stopTCP()
+
+	if r.http2Pool != nil {
+		r.http2Pool.Close()
+	}
+
+	if r.balancer != nil {
+		r.balancer.Close()
+	}
+
 	r.server.Shutdown(ctx)
 }
 
 // Handler defines the HTTP request handler for the router
 func (r *Router) Handler(rw http.ResponseWriter, req *http.Request) {
+	var us *Upstream
+
+	// record metrics for every request including those rejected by the router
+	received := time.Now()
+	sw := &statusWriter{ResponseWriter: rw, status: http.StatusOK}
+	rw = sw
+	defer func() {
+		recordRequest(us, req, sw.status, received)
+	}()
+
+	// check the global rate limit before doing any work
+	if !r.allowRequest(r.rateLimit, rw, req) {
+		return
+	}
+
 	//find the upstream
-	us := r.upstreams.FindUpstream(req.URL.Path)
+	us = r.upstreams.FindUpstream(req.URL.Path)
 	if us == nil {
 		r.logger.Error("No upstream defined", "path", req.URL.Path)
 		http.Error(rw, "No upstream defined for path", http.StatusNotFound)
 		return
 	}
 
+	// callers on the Connect listener are identified by their certificate
+	connectReq, ok := r.authorizeConnect(rw, req, us)
+	if !ok {
+		return
+	}
+	req = connectReq
+
+	if !r.authorizeClientCert(rw, req, us) {
+		return
+	}
+
+	// authenticate the request, the principal and any validated claims are
+	// added to the request context
+	authReq, ok := r.authenticate(rw, req, us)
+	if !ok {
+		return
+	}
+	req = authReq
+
+	if !r.authorizeIntentions(rw, req, us) {
+		return
+	}
+
+	if !r.allowRequest(us.RateLimit, rw, req) {
+		return
+	}
+
+	// limit the number of requests in flight to the upstream, the outcome
+	// of the request is used to adjust adaptive limits
+	if !r.acquireConcurrency(us, rw, req) {
+		return
+	}
+
+	start := time.Now()
+	failed := true
+	if us.ConcurrencyLimit != nil {
+		defer func() {
+			us.ConcurrencyLimit.Release(time.Since(start), failed)
+		}()
+	}
+
 	// strip the prefix from the router
 	// TODO: make this optional
 	path := strings.TrimPrefix(req.URL.Path, us.Path)
@@ -119,17 +412,35 @@ func (r *Router) Handler(rw http.ResponseWriter, req *http.Request) {
 
 	query := req.URL.RawQuery
 
-	uri := "https://" + us.Service + ".service.consul" + path
+	uri := "https://" + us.targets()[0].host() + path
+
+	// routes outside the mesh are sent to the URL or a healthy instance
+	if us.Type == URL || us.Type == Consul {
+		var err error
+		uri, err = r.directURI(us, path)
+		if err != nil {
+			r.logger.Error("Unable to resolve upstream", "upstream", us.Service, "error", err)
+			http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
 
 	r.logger.Debug("Processing request", "uri", uri, "method", req.Method, "protocol", req.Proto)
 
-	proxyReq, err := http.NewRequest(req.Method, uri, req.Body)
+	body := req.Body
+	if req.ContentLength == 0 {
+		body = http.NoBody
+	}
+
+	proxyReq, err := http.NewRequest(req.Method, uri, body)
 	if err != nil {
 		r.logger.Error("Unable to create proxy request", "error", err)
 		http.Error(rw, "Upable to create proxy request", http.StatusInternalServerError)
 		return
 	}
 
+	proxyReq.ContentLength = req.ContentLength
+
 	proxyReq.Header.Set("Host", req.Host)
 	proxyReq.Header.Set("X-Forwarded-For", req.RemoteAddr)
 	proxyReq.URL.RawQuery = query
@@ -141,22 +452,13 @@ func (r *Router) Handler(rw http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	r.logger.Info("Attempting to request from upstream", "upstream", us.Service, "uri", path, "query", query, "method", proxyReq.Method, "protocol", proxyReq.Proto)
-
-	var resp *http.Response
+	r.logger.Info("Attempting to request from upstream", "upstream", us.Service, "uri", path, "query", query, "method", proxyReq.Method, "protocol", proxyReq.Proto, "principal", requestPrincipal(req))
 
-	// retry the request 3 times with a backoff
-	retry := retrier.New(retrier.ConstantBackoff(3, 200*time.Millisecond), nil)
-	err = retry.Run(func() error {
-		var localError error
-		resp, localError = r.httpClient.Do(proxyReq)
-		if localError != nil {
-			r.logger.Error("Unable to contact upstream", "error", localError)
-			return localError
-		}
-
-		return nil
-	})
+	resp, err := r.doUpstream(us, proxyReq)
+	if err == errNoHealthyTargets || err == errNoHealthyInstances {
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
@@ -165,6 +467,8 @@ func (r *Router) Handler(rw http.ResponseWriter, req *http.Request) {
 
 	defer resp.Body.Close()
 
+	failed = resp.StatusCode >= http.StatusInternalServerError
+
 	// set the response headers
 	for header, values := range resp.Header {
 		for _, value := range values {
@@ -179,7 +483,16 @@ func (r *Router) Handler(rw http.ResponseWriter, req *http.Request) {
 }
 
 func buildHTTPClient(s ConnectService) HTTPClient {
-	t := &http.Transport{
+	return &http.Client{
+		Transport: buildHTTPTransport(s),
+		Timeout:   10 * time.Second,
+	}
+}
+
+// buildHTTPTransport returns an HTTP/1.1 transport which dials upstreams
+// over Connect
+func buildHTTPTransport(s ConnectService) *http.Transport {
+	return &http.Transport{
 		TLSHandshakeTimeout: 20 * time.Second,
 		MaxIdleConns:        20,
 		MaxIdleConnsPerHost: 10,
@@ -187,9 +500,4 @@ func buildHTTPClient(s ConnectService) HTTPClient {
 
 		DialTLS: s.HTTPDialTLS,
 	}
-
-	return &http.Client{
-		Transport: t,
-		Timeout:   10 * time.Second,
-	}
 }
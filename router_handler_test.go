@@ -18,7 +18,8 @@ var mockConnectService *MockConnectService
 
 func setupRouterTests(t *testing.T) *Router {
 	httpResponse = &http.Response{
-		Body: ioutil.NopCloser(bytes.NewReader([]byte("testbody"))),
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte("testbody"))),
 	}
 
 	mockHTTPClient = &MockHTTPClient{}
@@ -0,0 +1,166 @@
+package serverless
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// content types of the CloudEvents HTTP binding
+const (
+	cloudEventsJSON      = "application/cloudevents+json"
+	cloudEventsBatchJSON = "application/cloudevents-batch+json"
+)
+
+// cloudEventsRequired are the attributes every event must contain
+var cloudEventsRequired = []string{"specversion", "id", "source", "type"}
+
+// CloudEventsHandler handles events delivered with the CloudEvents HTTP
+// binding. Structured mode events are converted to binary mode so the
+// handler receives the event data as the body and the attributes as ce-
+// headers, binary mode events are passed through. Responses are returned
+// unchanged, binary mode reply events are supported.
+type CloudEventsHandler struct {
+	handler http.Handler
+}
+
+// NewCloudEventsHandler creates a CloudEvents adapter for the handler
+func NewCloudEventsHandler(h http.Handler) *CloudEventsHandler {
+	return &CloudEventsHandler{handler: h}
+}
+
+// ServeHTTP implements http.Handler
+func (c *CloudEventsHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+
+	switch {
+	case mt == cloudEventsBatchJSON:
+		http.Error(rw, "Batched CloudEvents are not supported", http.StatusUnsupportedMediaType)
+		return
+	case mt == cloudEventsJSON:
+		err := structuredToBinary(req)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case req.Header.Get("ce-specversion") == "":
+		http.Error(rw, "Request is not a CloudEvent", http.StatusBadRequest)
+		return
+	}
+
+	for _, a := range cloudEventsRequired {
+		if req.Header.Get("ce-"+a) == "" {
+			http.Error(rw, fmt.Sprintf("CloudEvent is missing the %s attribute", a), http.StatusBadRequest)
+			return
+		}
+	}
+
+	c.handler.ServeHTTP(rw, req)
+}
+
+// structuredToBinary moves the attributes of a structured mode event to ce-
+// headers and replaces the body with the event data
+func structuredToBinary(req *http.Request) error {
+	payload, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return fmt.Errorf("Unable to read CloudEvent: %s", err)
+	}
+
+	event := map[string]json.RawMessage{}
+	err = json.Unmarshal(payload, &event)
+	if err != nil {
+		return fmt.Errorf("Unable to parse CloudEvent: %s", err)
+	}
+
+	var contentType string
+	if v, ok := event["datacontenttype"]; ok {
+		json.Unmarshal(v, &contentType)
+	}
+
+	data, err := eventData(event, contentType)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range event {
+		if k == "data" || k == "data_base64" || k == "datacontenttype" {
+			continue
+		}
+
+		// attributes are strings, numbers or booleans
+		var s interface{}
+		err := json.Unmarshal(v, &s)
+		if err != nil {
+			return fmt.Errorf("Invalid CloudEvent attribute %s: %s", k, err)
+		}
+
+		req.Header.Set("ce-"+k, fmt.Sprint(s))
+	}
+
+	req.Header.Del("Content-Type")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(data))
+	req.ContentLength = int64(len(data))
+
+	return nil
+}
+
+// eventData returns the event data, JSON data is returned as is while string
+// data of other content types is unquoted
+func eventData(event map[string]json.RawMessage, contentType string) ([]byte, error) {
+	if v, ok := event["data_base64"]; ok {
+		var s string
+		err := json.Unmarshal(v, &s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CloudEvent data_base64: %s", err)
+		}
+
+		d, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CloudEvent data_base64: %s", err)
+		}
+
+		return d, nil
+	}
+
+	v, ok := event["data"]
+	if !ok {
+		return nil, nil
+	}
+
+	if isJSON(contentType) {
+		return v, nil
+	}
+
+	var s string
+	err := json.Unmarshal(v, &s)
+	if err != nil {
+		// data which is not a string is JSON regardless of the content type
+		return v, nil
+	}
+
+	return []byte(s), nil
+}
+
+// isJSON returns true for JSON content types, events without a content type
+// contain JSON data
+func isJSON(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mt == "application/json" || mt == "text/json" || strings.HasSuffix(mt, "+json")
+}
@@ -0,0 +1,164 @@
+package serverless
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nicholasjackson/consul-connect-router/serverless/serverlesstest"
+	"github.com/stretchr/testify/assert"
+)
+
+func cloudEventsResponse(rw *httptest.ResponseRecorder) serverlesstest.Response {
+	return serverlesstest.Response{StatusCode: rw.Code, Header: rw.Header(), Body: rw.Body.Bytes()}
+}
+
+func invokeCloudEventsBinary(t *testing.T, h http.Handler, req serverlesstest.Request) serverlesstest.Response {
+	r := httptest.NewRequest(req.Method, req.Path+"?"+req.Query.Encode(), bytes.NewReader(req.Body))
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("ce-specversion", "1.0")
+	r.Header.Set("ce-id", "1")
+	r.Header.Set("ce-source", "/tests")
+	r.Header.Set("ce-type", "test.request")
+
+	rw := httptest.NewRecorder()
+	NewCloudEventsHandler(h).ServeHTTP(rw, r)
+
+	return cloudEventsResponse(rw)
+}
+
+func invokeCloudEventsStructured(t *testing.T, h http.Handler, req serverlesstest.Request) serverlesstest.Response {
+	event := map[string]interface{}{
+		"specversion": "1.0",
+		"id":          "1",
+		"source":      "/tests",
+		"type":        "test.request",
+		"data_base64": base64.StdEncoding.EncodeToString(req.Body),
+	}
+
+	header := http.Header{}
+	for k, v := range req.Header {
+		if k == "Content-Type" {
+			event["datacontenttype"] = v[0]
+			continue
+		}
+		header[k] = v
+	}
+
+	payload, _ := json.Marshal(event)
+	r := httptest.NewRequest(req.Method, req.Path+"?"+req.Query.Encode(), bytes.NewReader(payload))
+	r.Header = header
+	r.Header.Set("Content-Type", cloudEventsJSON)
+
+	rw := httptest.NewRecorder()
+	NewCloudEventsHandler(h).ServeHTTP(rw, r)
+
+	return cloudEventsResponse(rw)
+}
+
+func TestCloudEventsBinaryConformance(t *testing.T) {
+	serverlesstest.Run(t, invokeCloudEventsBinary)
+}
+
+func TestCloudEventsStructuredConformance(t *testing.T) {
+	serverlesstest.Run(t, invokeCloudEventsStructured)
+}
+
+func TestCloudEventsConvertsStructuredEvents(t *testing.T) {
+	tests := []struct {
+		name        string
+		event       string
+		body        string
+		contentType string
+	}{
+		{
+			name:        "json data",
+			event:       `{"specversion":"1.0","id":"1","source":"/orders","type":"order.created","datacontenttype":"application/json","data":{"id":42}}`,
+			body:        `{"id":42}`,
+			contentType: "application/json",
+		},
+		{
+			name:  "json data without content type",
+			event: `{"specversion":"1.0","id":"1","source":"/orders","type":"order.created","data":{"id":42}}`,
+			body:  `{"id":42}`,
+		},
+		{
+			name:        "text data",
+			event:       `{"specversion":"1.0","id":"1","source":"/orders","type":"order.created","datacontenttype":"text/plain","data":"hello"}`,
+			body:        "hello",
+			contentType: "text/plain",
+		},
+		{
+			name:  "no data",
+			event: `{"specversion":"1.0","id":"1","source":"/orders","type":"order.created"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req *http.Request
+			var body []byte
+			h := NewCloudEventsHandler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				req = r
+				body, _ = ioutil.ReadAll(r.Body)
+			}))
+
+			r := httptest.NewRequest("POST", "/events", strings.NewReader(tt.event))
+			r.Header.Set("Content-Type", "application/cloudevents+json; charset=utf-8")
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			if assert.NotNil(t, req) {
+				assert.Equal(t, tt.body, string(body))
+				assert.Equal(t, tt.contentType, req.Header.Get("Content-Type"))
+				assert.Equal(t, "1.0", req.Header.Get("ce-specversion"))
+				assert.Equal(t, "order.created", req.Header.Get("ce-type"))
+				assert.Equal(t, "/orders", req.Header.Get("ce-source"))
+				assert.Equal(t, "", req.Header.Get("ce-data"))
+			}
+		})
+	}
+}
+
+func TestCloudEventsRejectsInvalidEvents(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		header      http.Header
+		body        string
+		status      int
+	}{
+		{"not an event", "application/json", nil, `{}`, http.StatusBadRequest},
+		{"missing attribute", "application/json", http.Header{"Ce-Specversion": {"1.0"}, "Ce-Id": {"1"}, "Ce-Source": {"/orders"}}, `{}`, http.StatusBadRequest},
+		{"invalid structured event", cloudEventsJSON, nil, `{`, http.StatusBadRequest},
+		{"invalid base64 data", cloudEventsJSON, nil, `{"specversion":"1.0","id":"1","source":"/orders","type":"order","data_base64":"!"}`, http.StatusBadRequest},
+		{"batch", cloudEventsBatchJSON, nil, `[]`, http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			h := NewCloudEventsHandler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				called = true
+			}))
+
+			r := httptest.NewRequest("POST", "/events", strings.NewReader(tt.body))
+			for k, v := range tt.header {
+				r.Header[k] = v
+			}
+			r.Header.Set("Content-Type", tt.contentType)
+
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, r)
+
+			assert.Equal(t, tt.status, rw.Code)
+			assert.False(t, called)
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package serverless
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// maxLineSize is the largest request read by ServeLines
+const maxLineSize = 10 * 1024 * 1024
+
+// JSONRequest is an HTTP request encoded as JSON, the ID is returned in the
+// response so callers can match responses to requests
+type JSONRequest struct {
+	ID              string              `json:"id,omitempty"`
+	Method          string              `json:"method"`
+	Path            string              `json:"path"`
+	Query           map[string][]string `json:"query,omitempty"`
+	Headers         map[string][]string `json:"headers,omitempty"`
+	Body            string              `json:"body,omitempty"`
+	IsBase64Encoded bool                `json:"isBase64Encoded,omitempty"`
+	RemoteAddr      string              `json:"remoteAddr,omitempty"`
+}
+
+// JSONResponse is an HTTP response encoded as JSON, bodies which are not
+// text are base64 encoded
+type JSONResponse struct {
+	ID              string              `json:"id,omitempty"`
+	StatusCode      int                 `json:"statusCode"`
+	Headers         map[string][]string `json:"headers,omitempty"`
+	Body            string              `json:"body"`
+	IsBase64Encoded bool                `json:"isBase64Encoded"`
+}
+
+// JSONAdapter handles runtimes which invoke a function with a JSON request
+// and expect a JSON response
+type JSONAdapter struct {
+	handler http.Handler
+}
+
+// NewJSONAdapter creates an adapter for the handler
+func NewJSONAdapter(h http.Handler) *JSONAdapter {
+	return &JSONAdapter{handler: h}
+}
+
+// Invoke decodes the request, serves it with the handler and returns the
+// encoded response
+func (a *JSONAdapter) Invoke(ctx context.Context, payload []byte) ([]byte, error) {
+	jr := JSONRequest{}
+	err := json.Unmarshal(payload, &jr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse request: %s", err)
+	}
+
+	return json.Marshal(a.Serve(ctx, jr))
+}
+
+// Serve serves the request with the handler, invalid requests return a bad
+// request response
+func (a *JSONAdapter) Serve(ctx context.Context, jr JSONRequest) JSONResponse {
+	req, err := newJSONRequest(jr)
+	if err != nil {
+		return JSONResponse{ID: jr.ID, StatusCode: http.StatusBadRequest, Body: err.Error()}
+	}
+
+	rw := NewResponseWriter()
+	a.handler.ServeHTTP(rw, req.WithContext(ctx))
+
+	resp := JSONResponse{
+		ID:         jr.ID,
+		StatusCode: rw.StatusCode(),
+		Headers:    map[string][]string{},
+		Body:       string(rw.Bytes()),
+	}
+
+	if IsBinary(rw.Header(), rw.Bytes()) {
+		resp.Body = base64.StdEncoding.EncodeToString(rw.Bytes())
+		resp.IsBase64Encoded = true
+	}
+
+	for k, v := range rw.Header() {
+		if len(v) > 0 {
+			resp.Headers[k] = v
+		}
+	}
+
+	return resp
+}
+
+// ServeLines serves a request for each line of the reader and writes a
+// response line for each request, i.e. a JSON lines fixture. Lines which can
+// not be parsed return a bad request response.
+func (a *JSONAdapter) ServeLines(ctx context.Context, r io.Reader, w io.Writer) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), maxLineSize)
+	enc := json.NewEncoder(w)
+
+	for s.Scan() {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var resp JSONResponse
+
+		jr := JSONRequest{}
+		err := json.Unmarshal(line, &jr)
+		if err != nil {
+			resp = JSONResponse{StatusCode: http.StatusBadRequest, Body: fmt.Sprintf("Unable to parse request: %s", err)}
+		} else {
+			resp = a.Serve(ctx, jr)
+		}
+
+		err = enc.Encode(resp)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.Err()
+}
+
+// newJSONRequest converts the JSON request to an HTTP request, the path may
+// contain a query string which is merged with the query
+func newJSONRequest(jr JSONRequest) (*http.Request, error) {
+	body := []byte(jr.Body)
+	if jr.IsBase64Encoded {
+		b, err := base64.StdEncoding.DecodeString(jr.Body)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decode request body: %s", err)
+		}
+		body = b
+	}
+
+	method := jr.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	p := jr.Path
+	if p == "" {
+		p = "/"
+	}
+
+	u, err := url.ParseRequestURI(p)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid request path: %s", err)
+	}
+
+	req, err := http.NewRequest(method, "http://localhost", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	query := u.Query()
+	for k, vs := range jr.Query {
+		for _, v := range vs {
+			query.Add(k, v)
+		}
+	}
+
+	req.URL.Path = u.Path
+	req.URL.RawQuery = query.Encode()
+	req.RequestURI = req.URL.RequestURI()
+
+	for k, vs := range jr.Headers {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+
+	if h := req.Header.Get("Host"); h != "" {
+		req.Host = h
+	}
+
+	if jr.RemoteAddr != "" {
+		req.RemoteAddr = jr.RemoteAddr
+	}
+
+	return req, nil
+}
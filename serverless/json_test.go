@@ -0,0 +1,103 @@
+package serverless
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nicholasjackson/consul-connect-router/serverless/serverlesstest"
+	"github.com/stretchr/testify/assert"
+)
+
+func invokeJSON(t *testing.T, h http.Handler, req serverlesstest.Request) serverlesstest.Response {
+	jr := JSONRequest{
+		Method:          req.Method,
+		Path:            req.Path,
+		Query:           req.Query,
+		Headers:         req.Header,
+		Body:            base64.StdEncoding.EncodeToString(req.Body),
+		IsBase64Encoded: true,
+	}
+	payload, _ := json.Marshal(jr)
+
+	out, err := NewJSONAdapter(h).Invoke(context.Background(), payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := JSONResponse{}
+	json.Unmarshal(out, &resp)
+
+	body := []byte(resp.Body)
+	if resp.IsBase64Encoded {
+		body, _ = base64.StdEncoding.DecodeString(resp.Body)
+	}
+
+	return serverlesstest.Response{StatusCode: resp.StatusCode, Header: resp.Headers, Body: body}
+}
+
+func TestJSONAdapterConformance(t *testing.T) {
+	serverlesstest.Run(t, invokeJSON)
+}
+
+func TestJSONAdapterMergesQueryInPath(t *testing.T) {
+	var query string
+	a := NewJSONAdapter(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		query = req.URL.RawQuery
+	}))
+
+	resp := a.Serve(context.Background(), JSONRequest{Path: "/api?a=1", Query: map[string][]string{"b": {"2"}}})
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "a=1&b=2", query)
+}
+
+func TestJSONAdapterReturnsBadRequestForInvalidRequests(t *testing.T) {
+	a := NewJSONAdapter(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+
+	resp := a.Serve(context.Background(), JSONRequest{ID: "1", Path: "/api", Body: "not base64!", IsBase64Encoded: true})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "1", resp.ID)
+
+	resp = a.Serve(context.Background(), JSONRequest{Path: "api"})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	_, err := a.Invoke(context.Background(), []byte("{"))
+	assert.Error(t, err)
+}
+
+func TestJSONAdapterServesLines(t *testing.T) {
+	a := NewJSONAdapter(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Write([]byte(req.Method + " " + req.URL.Path))
+	}))
+
+	in := strings.Join([]string{
+		`{"id":"user-001","method":"GET","path":"/api"}`,
+		``,
+		`not json`,
+		`{"id":"user-002","method":"POST","path":"/api/users"}`,
+	}, "\n")
+	out := &bytes.Buffer{}
+
+	err := a.ServeLines(context.Background(), strings.NewReader(in), out)
+	assert.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if assert.Len(t, lines, 3) {
+		responses := make([]JSONResponse, len(lines))
+		for i, l := range lines {
+			json.Unmarshal([]byte(l), &responses[i])
+		}
+
+		assert.Equal(t, "user-001", responses[0].ID)
+		assert.Equal(t, "GET /api", responses[0].Body)
+		assert.Equal(t, http.StatusBadRequest, responses[1].StatusCode)
+		assert.Equal(t, "user-002", responses[2].ID)
+		assert.Equal(t, "POST /api/users", responses[2].Body)
+	}
+}
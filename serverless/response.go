@@ -0,0 +1,92 @@
+// Package serverless adapts the router to event driven runtimes, adapters
+// convert the runtime's requests to HTTP requests for the router and return
+// the router's responses in the runtime's format
+package serverless
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// ResponseWriter buffers the router response so it can be returned to the
+// runtime
+type ResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+// NewResponseWriter creates a response writer
+func NewResponseWriter() *ResponseWriter {
+	return &ResponseWriter{header: http.Header{}}
+}
+
+// Header returns the response headers
+func (r *ResponseWriter) Header() http.Header {
+	return r.header
+}
+
+// Write appends the data to the response body
+func (r *ResponseWriter) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+
+	return r.body.Write(data)
+}
+
+// WriteHeader sets the status code, only the first call has any effect
+func (r *ResponseWriter) WriteHeader(statusCode int) {
+	if r.status == 0 {
+		r.status = statusCode
+	}
+}
+
+// StatusCode returns the response status, 200 when no status was written
+func (r *ResponseWriter) StatusCode() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+
+	return r.status
+}
+
+// Bytes returns the response body
+func (r *ResponseWriter) Bytes() []byte {
+	return r.body.Bytes()
+}
+
+// IsBinary returns true when the response body can not be returned as text,
+// responses with a content encoding such as gzip are always binary
+func IsBinary(h http.Header, body []byte) bool {
+	if h.Get("Content-Encoding") != "" && h.Get("Content-Encoding") != "identity" {
+		return true
+	}
+
+	ct := h.Get("Content-Type")
+	if ct == "" {
+		return !utf8.Valid(body)
+	}
+
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return !utf8.Valid(body)
+	}
+
+	switch {
+	case strings.HasPrefix(mt, "text/"),
+		strings.HasSuffix(mt, "+json"),
+		strings.HasSuffix(mt, "+xml"),
+		mt == "application/json",
+		mt == "application/javascript",
+		mt == "application/xml",
+		mt == "application/x-www-form-urlencoded",
+		mt == "application/graphql":
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,182 @@
+// Package serverlesstest contains the conformance suite for serverless
+// adapters, every adapter must pass the same header, body and status checks
+package serverlesstest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Request is the request sent by the runtime
+type Request struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   []byte
+}
+
+// Response is the response received by the runtime
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// Invoke converts the request to the runtime's format, passes it through the
+// adapter to the handler and converts the adapter's response back
+type Invoke func(t *testing.T, h http.Handler, req Request) Response
+
+// received is the request seen by the handler
+type received struct {
+	method string
+	path   string
+	query  url.Values
+	header http.Header
+	body   []byte
+}
+
+// Run runs the conformance suite against the adapter
+func Run(t *testing.T, invoke Invoke) {
+	requestTests := []struct {
+		name  string
+		req   Request
+		check func(t *testing.T, r received)
+	}{
+		{
+			name: "method and path",
+			req:  Request{Method: "DELETE", Path: "/api/users/1"},
+			check: func(t *testing.T, r received) {
+				assert.Equal(t, "DELETE", r.method)
+				assert.Equal(t, "/api/users/1", r.path)
+			},
+		},
+		{
+			name: "multi value query",
+			req:  Request{Method: "GET", Path: "/api", Query: url.Values{"id": {"1", "2"}, "q": {"a b"}}},
+			check: func(t *testing.T, r received) {
+				assert.Equal(t, []string{"1", "2"}, r.query["id"])
+				assert.Equal(t, "a b", r.query.Get("q"))
+			},
+		},
+		{
+			name: "multi value headers",
+			req:  Request{Method: "GET", Path: "/api", Header: http.Header{"X-Tag": {"a", "b"}, "Accept": {"text/plain"}}},
+			check: func(t *testing.T, r received) {
+				assert.Equal(t, []string{"a", "b"}, r.header["X-Tag"])
+				assert.Equal(t, "text/plain", r.header.Get("Accept"))
+			},
+		},
+		{
+			name: "text body",
+			req:  Request{Method: "POST", Path: "/api", Header: http.Header{"Content-Type": {"application/json"}}, Body: []byte(`{"name":"nic"}`)},
+			check: func(t *testing.T, r received) {
+				assert.Equal(t, `{"name":"nic"}`, string(r.body))
+				assert.Equal(t, "application/json", r.header.Get("Content-Type"))
+			},
+		},
+		{
+			name: "binary body",
+			req:  Request{Method: "POST", Path: "/api", Header: http.Header{"Content-Type": {"application/octet-stream"}}, Body: []byte{0xff, 0x00, 0x01}},
+			check: func(t *testing.T, r received) {
+				assert.Equal(t, []byte{0xff, 0x00, 0x01}, r.body)
+			},
+		},
+	}
+
+	for _, tt := range requestTests {
+		t.Run("request "+tt.name, func(t *testing.T) {
+			var r *received
+			h := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				body, _ := ioutil.ReadAll(req.Body)
+				r = &received{req.Method, req.URL.Path, req.URL.Query(), req.Header, body}
+			})
+
+			invoke(t, h, tt.req)
+
+			if assert.NotNil(t, r, "Handler should have been called") {
+				tt.check(t, *r)
+			}
+		})
+	}
+
+	responseTests := []struct {
+		name    string
+		handler http.HandlerFunc
+		check   func(t *testing.T, r Response)
+	}{
+		{
+			name:    "default status",
+			handler: func(rw http.ResponseWriter, req *http.Request) {},
+			check: func(t *testing.T, r Response) {
+				assert.Equal(t, http.StatusOK, r.StatusCode)
+				assert.Empty(t, r.Body)
+			},
+		},
+		{
+			name: "first status written",
+			handler: func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(http.StatusCreated)
+				rw.WriteHeader(http.StatusInternalServerError)
+			},
+			check: func(t *testing.T, r Response) {
+				assert.Equal(t, http.StatusCreated, r.StatusCode)
+			},
+		},
+		{
+			name: "error status",
+			handler: func(rw http.ResponseWriter, req *http.Request) {
+				http.Error(rw, "not found", http.StatusNotFound)
+			},
+			check: func(t *testing.T, r Response) {
+				assert.Equal(t, http.StatusNotFound, r.StatusCode)
+				assert.Equal(t, "not found\n", string(r.Body))
+			},
+		},
+		{
+			name: "multi value headers",
+			handler: func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", "application/json")
+				rw.Header().Add("Set-Cookie", "a=1")
+				rw.Header().Add("Set-Cookie", "b=2")
+			},
+			check: func(t *testing.T, r Response) {
+				assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+				assert.Equal(t, []string{"a=1", "b=2"}, r.Header["Set-Cookie"])
+			},
+		},
+		{
+			name: "multiple writes",
+			handler: func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", "text/plain")
+				rw.Write([]byte("hello "))
+				rw.Write([]byte("world"))
+			},
+			check: func(t *testing.T, r Response) {
+				assert.Equal(t, "hello world", string(r.Body))
+			},
+		},
+		{
+			name: "binary body",
+			handler: func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", "image/png")
+				rw.Write([]byte{0x89, 0x50, 0xff})
+			},
+			check: func(t *testing.T, r Response) {
+				assert.Equal(t, []byte{0x89, 0x50, 0xff}, r.Body)
+			},
+		},
+	}
+
+	for _, tt := range responseTests {
+		t.Run("response "+tt.name, func(t *testing.T) {
+			r := invoke(t, tt.handler, Request{Method: "GET", Path: "/api"})
+
+			tt.check(t, r)
+		})
+	}
+}
@@ -0,0 +1,454 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/connect"
+)
+
+// DefaultTCPIdleTimeout closes TCP connections with no traffic in either
+// direction
+const DefaultTCPIdleTimeout = 5 * time.Minute
+
+// DefaultTCPSNITimeout is the time a client has to send the TLS ClientHello
+// on listeners which route by server name
+const DefaultTCPSNITimeout = 2 * time.Second
+
+var errClientHelloPeeked = errors.New("ClientHello peeked")
+
+// TCPRoute maps a listener, and optionally the SNI name from the TLS
+// ClientHello, to a Connect service. Bytes are passed through unmodified so
+// TLS is terminated by the service.
+type TCPRoute struct {
+	Service     string
+	BindAddress string
+	// SNI is the server name which selects the route, routes without a name
+	// receive connections which do not match any other route on the listener
+	SNI         string
+	IdleTimeout time.Duration
+	// SNITimeout is the time a client has to send the ClientHello, the
+	// largest timeout of the routes on a listener is used
+	SNITimeout time.Duration
+	// ProxyProtocol sends a PROXY protocol v1 or v2 header with the client
+	// address to the upstream
+	ProxyProtocol string
+}
+
+// NewTCPRoutes parses the command line flags i.e.
+// service=postgres#listen=:5432 or service=db#listen=:443#sni=db.example.com#proxy_protocol=v2
+func NewTCPRoutes(routes []string) ([]TCPRoute, error) {
+	tr := []TCPRoute{}
+
+	for _, v := range routes {
+		r := TCPRoute{IdleTimeout: DefaultTCPIdleTimeout, SNITimeout: DefaultTCPSNITimeout}
+
+		for _, p := range strings.Split(v, "#") {
+			kv := strings.SplitN(p, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("Invalid TCP route %s", v)
+			}
+
+			switch kv[0] {
+			case "service":
+				r.Service = kv[1]
+			case "listen":
+				r.BindAddress = kv[1]
+			case "sni":
+				r.SNI = strings.ToLower(kv[1])
+			case "idle_timeout":
+				d, err := time.ParseDuration(kv[1])
+				if err != nil {
+					return nil, err
+				}
+				r.IdleTimeout = d
+			case "sni_timeout":
+				d, err := time.ParseDuration(kv[1])
+				if err != nil {
+					return nil, err
+				}
+				r.SNITimeout = d
+			case "proxy_protocol":
+				if kv[1] != ProxyProtocolV1 && kv[1] != ProxyProtocolV2 {
+					return nil, fmt.Errorf("Invalid PROXY protocol version %s", kv[1])
+				}
+				r.ProxyProtocol = kv[1]
+			}
+		}
+
+		if r.Service == "" || r.BindAddress == "" {
+			return nil, fmt.Errorf("TCP route %s requires a service and listen address", v)
+		}
+
+		for _, o := range tr {
+			if o.BindAddress == r.BindAddress && o.SNI == r.SNI {
+				return nil, fmt.Errorf("Duplicate TCP route for %s %s", r.BindAddress, r.SNI)
+			}
+		}
+
+		tr = append(tr, r)
+	}
+
+	return tr, nil
+}
+
+// SetTCPRoutes configures the TCP routes, a listener is started for each
+// listen address
+func (r *Router) SetTCPRoutes(routes []string) error {
+	tr, err := NewTCPRoutes(routes)
+	if err != nil {
+		return fmt.Errorf("Unable to parse TCP routes: %s", err)
+	}
+
+	r.tcpRoutes = tr
+	r.tcpConns = map[net.Conn]struct{}{}
+
+	return nil
+}
+
+// listenAndServeTCP starts a listener for each TCP listen address
+func (r *Router) listenAndServeTCP() error {
+	listeners := map[string]net.Listener{}
+
+	for _, tr := range r.tcpRoutes {
+		if _, ok := listeners[tr.BindAddress]; ok {
+			continue
+		}
+
+		l, err := net.Listen("tcp", tr.BindAddress)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+
+		listeners[tr.BindAddress] = r.proxyListener(l)
+	}
+
+	errs := make(chan error, len(listeners))
+	for addr, l := range listeners {
+		r.logger.Info("Starting TCP listener", "listen_addr", addr)
+
+		go func(addr string, l net.Listener) {
+			errs <- r.serveTCP(addr, l)
+		}(addr, l)
+	}
+
+	return <-errs
+}
+
+// serveTCP accepts connections for the routes with the listen address
+func (r *Router) serveTCP(addr string, l net.Listener) error {
+	r.tcpMu.Lock()
+	r.tcpListeners = append(r.tcpListeners, l)
+	r.tcpMu.Unlock()
+
+	routes := []TCPRoute{}
+	for _, tr := range r.tcpRoutes {
+		if tr.BindAddress == addr {
+			routes = append(routes, tr)
+		}
+	}
+
+	for {
+		c, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			// the listener is closed when the router is stopped
+			return http.ErrServerClosed
+		}
+
+		if err != nil {
+			return err
+		}
+
+		go r.handleTCP(c, routes)
+	}
+}
+
+// handleTCP selects the route for the connection and proxies it to the
+// Connect service
+func (r *Router) handleTCP(c net.Conn, routes []TCPRoute) {
+	start := time.Now()
+
+	r.trackTCPConn(c, true)
+	defer r.trackTCPConn(c, false)
+	defer c.Close()
+
+	// read any PROXY protocol header before the route deadline is set
+	err := readProxyProtocolHeader(c)
+	if err != nil {
+		r.logger.Info("Unable to read PROXY protocol header", "remote_addr", c.RemoteAddr().String(), "error", err)
+		recordTCPConnection(nil, "proxy_protocol_error", 0, 0, start)
+		return
+	}
+
+	route, c, err := selectTCPRoute(c, routes)
+	if err != nil {
+		r.logger.Info("Unable to route TCP connection", "remote_addr", c.RemoteAddr().String(), "error", err)
+		recordTCPConnection(nil, "no_route", 0, 0, start)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	upstream, err := r.service.Dial(ctx, &connect.ConsulResolver{
+		Client: r.consulClient,
+		Name:   route.Service,
+		Type:   connect.ConsulResolverTypeService,
+	})
+	cancel()
+
+	if err != nil {
+		r.logger.Error("Unable to connect to upstream", "upstream", route.Service, "error", err)
+		recordTCPConnection(route, "dial_error", 0, 0, start)
+		return
+	}
+
+	r.trackTCPConn(upstream, true)
+	defer r.trackTCPConn(upstream, false)
+	defer upstream.Close()
+
+	if route.ProxyProtocol != "" {
+		err := writeProxyHeader(upstream, route.ProxyProtocol, c.RemoteAddr(), c.LocalAddr())
+		if err != nil {
+			r.logger.Error("Unable to send PROXY protocol header", "upstream", route.Service, "error", err)
+			recordTCPConnection(route, "dial_error", 0, 0, start)
+			return
+		}
+	}
+
+	r.logger.Debug("Proxying TCP connection", "upstream", route.Service, "sni", route.SNI, "remote_addr", c.RemoteAddr().String())
+
+	sent, received := copyBidirectional(c, upstream, route.IdleTimeout)
+	recordTCPConnection(route, "closed", sent, received, start)
+}
+
+// trackTCPConn records open connections so they can be closed when the
+// router stops
+func (r *Router) trackTCPConn(c net.Conn, open bool) {
+	r.tcpMu.Lock()
+	defer r.tcpMu.Unlock()
+
+	if open {
+		r.tcpConns[c] = struct{}{}
+		return
+	}
+
+	delete(r.tcpConns, c)
+}
+
+// stopTCP closes the TCP listeners and open connections
+func (r *Router) stopTCP() {
+	r.tcpMu.Lock()
+	defer r.tcpMu.Unlock()
+
+	for _, l := range r.tcpListeners {
+		l.Close()
+	}
+
+	for c := range r.tcpConns {
+		c.Close()
+	}
+}
+
+// selectTCPRoute returns the route for the connection, when any route on the
+// listener uses SNI the ClientHello is peeked and the returned connection
+// replays it
+func selectTCPRoute(c net.Conn, routes []TCPRoute) (*TCPRoute, net.Conn, error) {
+	var def *TCPRoute
+	sni := false
+	timeout := time.Duration(0)
+
+	for i := range routes {
+		if routes[i].SNI == "" {
+			def = &routes[i]
+		} else {
+			sni = true
+		}
+
+		if routes[i].SNITimeout > timeout {
+			timeout = routes[i].SNITimeout
+		}
+	}
+
+	if !sni {
+		return def, c, nil
+	}
+
+	if timeout == 0 {
+		timeout = DefaultTCPSNITimeout
+	}
+
+	c.SetReadDeadline(time.Now().Add(timeout))
+	name, pc, err := peekServerName(c)
+	c.SetReadDeadline(time.Time{})
+
+	if err != nil && def == nil {
+		return nil, pc, err
+	}
+
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for i := range routes {
+		if routes[i].SNI == name {
+			return &routes[i], pc, nil
+		}
+	}
+
+	// wildcard routes match a single label i.e. *.example.com
+	if i := strings.Index(name, "."); i > 0 {
+		for j := range routes {
+			if routes[j].SNI == "*"+name[i:] {
+				return &routes[j], pc, nil
+			}
+		}
+	}
+
+	if def == nil {
+		return nil, pc, fmt.Errorf("No route for server name %s", name)
+	}
+
+	return def, pc, nil
+}
+
+// peekServerName reads the TLS ClientHello returning the server name and a
+// connection which replays the bytes read
+func peekServerName(c net.Conn) (string, net.Conn, error) {
+	buf := &bytes.Buffer{}
+	var name string
+	peeked := false
+
+	err := tls.Server(&readOnlyConn{Conn: c, r: io.TeeReader(c, buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			peeked = true
+			return nil, errClientHelloPeeked
+		},
+	}).Handshake()
+
+	pc := &peekedConn{Conn: c, r: io.MultiReader(buf, c)}
+
+	if !peeked {
+		return "", pc, fmt.Errorf("Unable to read ClientHello: %s", err)
+	}
+
+	return name, pc, nil
+}
+
+// readOnlyConn allows the TLS server to read the ClientHello without writing
+// a response to the client
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readOnlyConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *readOnlyConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// peekedConn replays bytes read while peeking before reading from the
+// connection
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// CloseWrite half closes the underlying connection when supported
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return c.Conn.Close()
+}
+
+// copyBidirectional copies between the connections until both directions are
+// closed or no data has been transferred for the idle timeout, it returns
+// the bytes sent to and received from the upstream
+func copyBidirectional(client, upstream net.Conn, idle time.Duration) (int64, int64) {
+	var sent, received int64
+	var mu sync.Mutex
+	last := time.Now()
+
+	touch := func() {
+		mu.Lock()
+		last = time.Now()
+		mu.Unlock()
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	pipe := func(dst, src net.Conn, n *int64) {
+		defer wg.Done()
+
+		*n, _ = io.Copy(dst, &activityReader{r: src, touch: touch})
+
+		// signal the end of the stream while allowing the other direction
+		// to finish
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+
+	go pipe(upstream, client, &sent)
+	go pipe(client, upstream, &received)
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	if idle <= 0 {
+		<-done
+		return sent, received
+	}
+
+	t := time.NewTicker(idle / 10)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-done:
+			return sent, received
+		case <-t.C:
+			mu.Lock()
+			expired := time.Since(last) > idle
+			mu.Unlock()
+
+			if expired {
+				client.Close()
+				upstream.Close()
+				<-done
+				return sent, received
+			}
+		}
+	}
+}
+
+// activityReader records the time of each successful read
+type activityReader struct {
+	r     io.Reader
+	touch func()
+}
+
+func (a *activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		a.touch()
+	}
+
+	return n, err
+}
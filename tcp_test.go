@@ -0,0 +1,208 @@
+package router
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/connect"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestNewTCPRoutesParsesRoutes(t *testing.T) {
+	tr, err := NewTCPRoutes([]string{
+		"service=postgres#listen=:5432",
+		"service=db#listen=:443#sni=DB.example.com#idle_timeout=30s#sni_timeout=500ms",
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, TCPRoute{Service: "postgres", BindAddress: ":5432", IdleTimeout: DefaultTCPIdleTimeout, SNITimeout: DefaultTCPSNITimeout}, tr[0])
+	assert.Equal(t, TCPRoute{Service: "db", BindAddress: ":443", SNI: "db.example.com", IdleTimeout: 30 * time.Second, SNITimeout: 500 * time.Millisecond}, tr[1])
+
+	_, err = NewTCPRoutes([]string{"listen=:5432"})
+	assert.Error(t, err)
+
+	_, err = NewTCPRoutes([]string{"service=postgres#listen=:5432#proxy_protocol=v3"})
+	assert.Error(t, err)
+
+	_, err = NewTCPRoutes([]string{"service=a#listen=:5432", "service=b#listen=:5432"})
+	assert.Error(t, err, "Should not allow two default routes on a listener")
+}
+
+func TestSelectTCPRouteUsesServerNameAndReplaysClientHello(t *testing.T) {
+	routes := []TCPRoute{
+		{Service: "default", BindAddress: ":443"},
+		{Service: "db", BindAddress: ":443", SNI: "db.example.com"},
+		{Service: "wildcard", BindAddress: ":443", SNI: "*.example.com"},
+	}
+
+	tests := map[string]string{
+		"db.example.com":    "db",
+		"cache.example.com": "wildcard",
+		"other.com":         "default",
+	}
+
+	for name, service := range tests {
+		client, server := net.Pipe()
+
+		handshake := make(chan error, 1)
+		go func() {
+			handshake <- tls.Client(client, &tls.Config{ServerName: name, InsecureSkipVerify: true}).Handshake()
+		}()
+
+		route, pc, err := selectTCPRoute(server, routes)
+		assert.NoError(t, err)
+		assert.Equal(t, service, route.Service, name)
+
+		// the upstream must be able to complete the handshake
+		err = tls.Server(pc, &tls.Config{Certificates: []tls.Certificate{testKeyPair(t, name)}}).Handshake()
+		assert.NoError(t, err, name)
+		assert.NoError(t, <-handshake, name)
+
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestSelectTCPRouteRejectsUnknownServerNameWithoutDefault(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go tls.Client(client, &tls.Config{ServerName: "other.com", InsecureSkipVerify: true}).Handshake()
+
+	_, _, err := selectTCPRoute(server, []TCPRoute{{Service: "db", SNI: "db.example.com"}})
+	assert.Error(t, err)
+}
+
+func TestSelectTCPRouteTimesOutWaitingForClientHello(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	start := time.Now()
+	_, _, err := selectTCPRoute(server, []TCPRoute{{Service: "db", SNI: "db.example.com", SNITimeout: 50 * time.Millisecond}})
+
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second, "Should have used the route timeout")
+}
+
+func TestTCPListenerProxiesToConnectService(t *testing.T) {
+	rec := setupRouterTests(t)
+	rec.service = mockConnectService
+	rec.SetTCPRoutes([]string{"service=echo#listen=test"})
+
+	upstream, echo := net.Pipe()
+	go io.Copy(echo, echo)
+	mockConnectService.On("Dial", mock.Anything, mock.Anything).Return(upstream, nil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go rec.serveTCP("test", l)
+	defer rec.stopTCP()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	defer c.Close()
+
+	c.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(c, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	resolver := mockConnectService.Calls[len(mockConnectService.Calls)-1].Arguments.Get(1).(*connect.ConsulResolver)
+	assert.Equal(t, "echo", resolver.Name)
+}
+
+func TestTCPListenerReturnsServerClosedWhenStopped(t *testing.T) {
+	rec := setupRouterTests(t)
+	rec.SetTCPRoutes([]string{"service=echo#listen=test"})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	errs := make(chan error, 1)
+	go func() { errs <- rec.serveTCP("test", l) }()
+
+	waitFor(t, func() bool {
+		rec.tcpMu.Lock()
+		defer rec.tcpMu.Unlock()
+		return len(rec.tcpListeners) == 1
+	}, "Expected listener to be started")
+
+	rec.stopTCP()
+
+	assert.Equal(t, http.ErrServerClosed, <-errs)
+}
+
+func TestTCPListenerSendsProxyHeaderToUpstream(t *testing.T) {
+	rec := setupRouterTests(t)
+	rec.service = mockConnectService
+	rec.SetTCPRoutes([]string{"service=echo#listen=test#proxy_protocol=v1"})
+	rec.EnableProxyProtocol([]string{"127.0.0.0/8"})
+
+	upstream, server := net.Pipe()
+	mockConnectService.On("Dial", mock.Anything, mock.Anything).Return(upstream, nil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go rec.serveTCP("test", rec.proxyListener(l))
+	defer rec.stopTCP()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	defer c.Close()
+
+	c.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 40000 5432\r\nhello"))
+
+	expected := "PROXY TCP4 203.0.113.7 10.0.0.1 40000 5432\r\nhello"
+	buf := make([]byte, len(expected))
+	_, err = io.ReadFull(server, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, string(buf), "Should send the client address from the inbound header")
+}
+
+func TestTCPListenerClosesConnectionsWithInvalidProxyHeader(t *testing.T) {
+	rec := setupRouterTests(t)
+	rec.service = mockConnectService
+	rec.SetTCPRoutes([]string{"service=echo#listen=test"})
+	rec.EnableProxyProtocol([]string{"127.0.0.0/8"})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go rec.serveTCP("test", rec.proxyListener(l))
+	defer rec.stopTCP()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	defer c.Close()
+
+	c.Write([]byte("hello\r\n"))
+
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = c.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "Should have closed the connection")
+	mockConnectService.AssertNotCalled(t, "Dial", mock.Anything, mock.Anything)
+}
+
+func TestCopyBidirectionalClosesIdleConnections(t *testing.T) {
+	client, _ := net.Pipe()
+	upstream, _ := net.Pipe()
+
+	done := make(chan struct{})
+	go func() {
+		copyBidirectional(client, upstream, 50*time.Millisecond)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Should have closed the idle connections")
+	}
+}
@@ -0,0 +1,389 @@
+package router
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSConfig defines the HTTPS listener for the router
+type TLSConfig struct {
+	// BindAddress is the address the HTTPS listener binds to i.e :8443
+	BindAddress string
+	// CertFiles and KeyFiles are the PEM encoded certificate and key pairs,
+	// the certificate for a connection is selected using SNI
+	CertFiles []string
+	KeyFiles  []string
+	// ReloadInterval is how often the files are checked for changes
+	ReloadInterval time.Duration
+	// MinVersion is the minimum TLS version, 1.0, 1.1, 1.2 or 1.3
+	MinVersion string
+	// CipherSuites restricts the cipher suites used for TLS 1.2 and below,
+	// i.e. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	CipherSuites []string
+	// RedirectHTTP redirects requests to the plain HTTP listener to HTTPS
+	RedirectHTTP bool
+	// ConsulPrefix loads certificates from Consul KV, each certificate is
+	// stored as [prefix]/[name]/cert and [prefix]/[name]/key
+	ConsulPrefix string
+	// VaultAddr, VaultToken, VaultMount and VaultPath load certificates from
+	// a Vault KV v2 secrets engine, each secret under the path must contain a
+	// certificate and private_key field
+	VaultAddr  string
+	VaultToken string
+	VaultMount string
+	VaultPath  string
+	// ClientCAFiles are PEM encoded CA bundles used to verify client
+	// certificates, certificates are requested but only required by routes
+	// with a client certificate policy
+	ClientCAFiles []string
+	// ClientCRLFiles are CRLs used by routes which check revocation with
+	// crl, the files are reloaded when they change
+	ClientCRLFiles []string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// SetTLS configures the HTTPS listener, the certificates are loaded and then
+// watched for changes
+func (r *Router) SetTLS(c TLSConfig) error {
+	if len(c.CertFiles) != len(c.KeyFiles) {
+		return fmt.Errorf("Each certificate must have a key")
+	}
+
+	if c.ReloadInterval == 0 {
+		c.ReloadInterval = 10 * time.Second
+	}
+
+	tc, err := c.serverConfig()
+	if err != nil {
+		return err
+	}
+
+	if len(c.ClientCAFiles) > 0 {
+		pool := x509.NewCertPool()
+		for _, f := range c.ClientCAFiles {
+			d, err := ioutil.ReadFile(f)
+			if err != nil {
+				return err
+			}
+
+			if !pool.AppendCertsFromPEM(d) {
+				return fmt.Errorf("No certificates found in %s", f)
+			}
+		}
+
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	rc, err := newRevocationChecker(c.ClientCRLFiles)
+	if err != nil {
+		return err
+	}
+
+	r.tls = &c
+	r.revocation = rc
+	r.certificates = newCertificateStore()
+	r.tlsStop = make(chan struct{})
+	tc.GetCertificate = r.certificates.GetCertificate
+	r.tlsServerConfig = tc
+
+	if len(c.CertFiles) > 0 {
+		fs := &fileCertificateSource{certFiles: c.CertFiles, keyFiles: c.KeyFiles}
+		certs, err := fs.load()
+		if err != nil {
+			return err
+		}
+
+		r.certificates.Set("files", certs)
+		go r.watchCertificateFiles(fs, c.ReloadInterval)
+	}
+
+	if len(c.ClientCRLFiles) > 0 {
+		go r.watchCRLFiles(rc, c.ReloadInterval)
+	}
+
+	if c.ConsulPrefix != "" {
+		cs := &consulCertificateSource{client: r.consulClient, prefix: strings.TrimSuffix(c.ConsulPrefix, "/")}
+		go r.watchCertificateSource("consul", cs.load, 0)
+	}
+
+	if c.VaultAddr != "" {
+		if c.VaultMount == "" {
+			c.VaultMount = "secret"
+		}
+
+		vs := &vaultCertificateSource{
+			addr:       c.VaultAddr,
+			token:      c.VaultToken,
+			mount:      c.VaultMount,
+			path:       c.VaultPath,
+			httpClient: &http.Client{Timeout: 30 * time.Second},
+		}
+		go r.watchCertificateSource("vault", vs.load, c.ReloadInterval)
+	}
+
+	return nil
+}
+
+// serverConfig builds the TLS configuration for the listener, HTTP/2 and
+// HTTP/1.1 are negotiated with ALPN
+func (c *TLSConfig) serverConfig() (*tls.Config, error) {
+	tc := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+
+	if c.MinVersion != "" {
+		v, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("Invalid TLS version %s", c.MinVersion)
+		}
+		tc.MinVersion = v
+	}
+
+	for _, name := range c.CipherSuites {
+		id, ok := cipherSuite(name)
+		if !ok {
+			return nil, fmt.Errorf("Invalid cipher suite %s", name)
+		}
+		tc.CipherSuites = append(tc.CipherSuites, id)
+	}
+
+	return tc, nil
+}
+
+func cipherSuite(name string) (uint16, bool) {
+	for _, cs := range tls.CipherSuites() {
+		if cs.Name == name {
+			return cs.ID, true
+		}
+	}
+
+	return 0, false
+}
+
+// newTLSServer creates the HTTPS server, it is created before the listener
+// is started so Stop can always shut it down
+func (r *Router) newTLSServer() (*http.Server, error) {
+	s := &http.Server{
+		Handler:   http.HandlerFunc(r.Handler),
+		TLSConfig: r.tlsServerConfig,
+	}
+
+	err := r.configureHTTP2(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// listenAndServeTLS starts the HTTPS listener
+func (r *Router) listenAndServeTLS(s *http.Server) error {
+	l, err := net.Listen("tcp", r.tls.BindAddress)
+	if err != nil {
+		return err
+	}
+
+	return r.serveTLS(s, r.proxyListener(l))
+}
+
+// serveTLS serves HTTPS requests on the listener
+func (r *Router) serveTLS(s *http.Server, l net.Listener) error {
+	return s.Serve(tls.NewListener(l, r.tlsServerConfig))
+}
+
+// redirectHandler redirects plain HTTP requests to the HTTPS listener
+func (r *Router) redirectHandler(rw http.ResponseWriter, req *http.Request) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if _, port, err := net.SplitHostPort(r.tls.BindAddress); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	u := *req.URL
+	u.Scheme = "https"
+	u.Host = host
+
+	http.Redirect(rw, req, u.String(), http.StatusPermanentRedirect)
+}
+
+// watchCertificateFiles reloads the certificates when the files change
+func (r *Router) watchCertificateFiles(fs *fileCertificateSource, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-r.tlsStop:
+			return
+		case <-t.C:
+		}
+
+		if !fs.changed() {
+			continue
+		}
+
+		certs, err := fs.load()
+		if err != nil {
+			r.logger.Error("Unable to reload certificates", "error", err)
+			continue
+		}
+
+		r.logger.Info("Reloaded certificates", "count", len(certs))
+		r.certificates.Set("files", certs)
+	}
+}
+
+// fileCertificateSource loads certificates from disk
+type fileCertificateSource struct {
+	certFiles []string
+	keyFiles  []string
+	modTimes  map[string]time.Time
+}
+
+func (f *fileCertificateSource) load() ([]tls.Certificate, error) {
+	certs := []tls.Certificate{}
+	modTimes := map[string]time.Time{}
+
+	for i := range f.certFiles {
+		for _, file := range []string{f.certFiles[i], f.keyFiles[i]} {
+			fi, err := os.Stat(file)
+			if err != nil {
+				return nil, err
+			}
+			modTimes[file] = fi.ModTime()
+		}
+
+		c, err := tls.LoadX509KeyPair(f.certFiles[i], f.keyFiles[i])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load certificate %s: %s", f.certFiles[i], err)
+		}
+
+		certs = append(certs, c)
+	}
+
+	f.modTimes = modTimes
+
+	return certs, nil
+}
+
+// changed returns true when any of the files have been modified since they
+// were loaded
+func (f *fileCertificateSource) changed() bool {
+	for file, mt := range f.modTimes {
+		fi, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+
+		if !fi.ModTime().Equal(mt) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// certificateStore selects certificates for TLS handshakes using SNI,
+// certificates are grouped by the source which provided them so each source
+// can replace its certificates independently. Changes only affect new
+// handshakes, existing connections continue to use their certificate.
+type certificateStore struct {
+	mu      sync.RWMutex
+	sources map[string][]tls.Certificate
+	byName  map[string]*tls.Certificate
+	def     *tls.Certificate
+}
+
+func newCertificateStore() *certificateStore {
+	return &certificateStore{
+		sources: map[string][]tls.Certificate{},
+		byName:  map[string]*tls.Certificate{},
+	}
+}
+
+// Set replaces the certificates for a source and rebuilds the name index
+func (c *certificateStore) Set(source string, certs []tls.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sources[source] = certs
+	c.byName = map[string]*tls.Certificate{}
+	c.def = nil
+
+	// sort the sources so the default certificate is stable
+	names := []string{}
+	for n := range c.sources {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		s := c.sources[n]
+		for i := range s {
+			cert := &s[i]
+			if cert.Leaf == nil && len(cert.Certificate) > 0 {
+				cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+			}
+
+			if c.def == nil {
+				c.def = cert
+			}
+
+			if cert.Leaf == nil {
+				continue
+			}
+
+			for _, name := range append([]string{cert.Leaf.Subject.CommonName}, cert.Leaf.DNSNames...) {
+				if name != "" {
+					c.byName[strings.ToLower(name)] = cert
+				}
+			}
+		}
+	}
+}
+
+// GetCertificate implements tls.Config.GetCertificate, exact matches are
+// preferred over wildcards, when no certificate matches the first
+// certificate is returned
+func (c *certificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	if cert, ok := c.byName[name]; ok {
+		return cert, nil
+	}
+
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := c.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+
+	if c.def == nil {
+		return nil, fmt.Errorf("No certificate available for %s", hello.ServerName)
+	}
+
+	return c.def, nil
+}
@@ -0,0 +1,247 @@
+package router
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// consulCertificateSource loads certificates from the Consul KV store, each
+// certificate is stored as [prefix]/[name]/cert and [prefix]/[name]/key
+type consulCertificateSource struct {
+	client *api.Client
+	prefix string
+	index  uint64
+	certs  map[string]tls.Certificate
+}
+
+// load returns the certificates under the prefix, when the certificates
+// have previously been loaded load blocks until the prefix changes. The
+// index is only advanced when every pair is valid so invalid pairs are
+// retried.
+func (c *consulCertificateSource) load(ctx context.Context) ([]tls.Certificate, bool, error) {
+	q := &api.QueryOptions{WaitIndex: c.index, WaitTime: 5 * time.Minute}
+
+	pairs, meta, err := c.client.KV().List(c.prefix+"/", q.WithContext(ctx))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if meta.LastIndex == c.index {
+		return nil, false, nil
+	}
+
+	pems := map[string]map[string][]byte{}
+	for _, p := range pairs {
+		name, file := path.Split(strings.TrimPrefix(p.Key, c.prefix+"/"))
+		// ignore folder entries
+		if file == "" {
+			continue
+		}
+
+		if pems[name] == nil {
+			pems[name] = map[string][]byte{}
+		}
+		pems[name][file] = p.Value
+	}
+
+	loaded, certs, err := keyPairs(pems, "cert", "key", c.certs)
+	c.certs = loaded
+	if err == nil {
+		c.index = meta.LastIndex
+	}
+
+	return certs, true, err
+}
+
+// vaultCertificateSource loads certificates from a Vault compatible KV v2
+// secrets engine, each secret under the path contains a certificate and
+// private_key field
+type vaultCertificateSource struct {
+	addr       string
+	token      string
+	mount      string
+	path       string
+	httpClient *http.Client
+	versions   map[string]int
+	certs      map[string]tls.Certificate
+}
+
+// load returns the certificates under the path, the boolean return is false
+// when no secrets have changed since the last load
+func (v *vaultCertificateSource) load(ctx context.Context) ([]tls.Certificate, bool, error) {
+	list := struct {
+		Data struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}{}
+
+	err := v.get(ctx, path.Join("/v1", v.mount, "metadata", v.path)+"?list=true", &list)
+	if err != nil {
+		return nil, false, err
+	}
+
+	pems := map[string]map[string][]byte{}
+	versions := map[string]int{}
+
+	for _, name := range list.Data.Keys {
+		if strings.HasSuffix(name, "/") {
+			continue
+		}
+
+		secret := struct {
+			Data struct {
+				Data     map[string]string `json:"data"`
+				Metadata struct {
+					Version int `json:"version"`
+				} `json:"metadata"`
+			} `json:"data"`
+		}{}
+
+		err := v.get(ctx, path.Join("/v1", v.mount, "data", v.path, name), &secret)
+		if err != nil {
+			return nil, false, err
+		}
+
+		versions[name] = secret.Data.Metadata.Version
+		pems[name] = map[string][]byte{
+			"certificate": []byte(secret.Data.Data["certificate"]),
+			"private_key": []byte(secret.Data.Data["private_key"]),
+		}
+	}
+
+	if sameVersions(v.versions, versions) {
+		return nil, false, nil
+	}
+
+	loaded, certs, err := keyPairs(pems, "certificate", "private_key", v.certs)
+	v.certs = loaded
+	if err == nil {
+		v.versions = versions
+	}
+
+	return certs, true, err
+}
+
+func (v *vaultCertificateSource) get(ctx context.Context, uri string, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(v.addr, "/")+uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+
+	resp, err := v.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status %d from %s", resp.StatusCode, uri)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func sameVersions(a, b map[string]int) bool {
+	if a == nil || len(a) != len(b) {
+		return false
+	}
+
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// keyPairs builds certificates from PEM data grouped by name, names are
+// processed in order so the default certificate is stable. Invalid pairs are
+// skipped keeping the previously loaded certificate for the name, an error
+// listing the invalid pairs is returned with the certificates.
+func keyPairs(pems map[string]map[string][]byte, certField, keyField string, previous map[string]tls.Certificate) (map[string]tls.Certificate, []tls.Certificate, error) {
+	names := []string{}
+	for n := range pems {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	loaded := map[string]tls.Certificate{}
+	certs := []tls.Certificate{}
+	invalid := []string{}
+
+	for _, n := range names {
+		c, err := tls.X509KeyPair(pems[n][certField], pems[n][keyField])
+		if err != nil {
+			invalid = append(invalid, fmt.Sprintf("%s: %s", strings.TrimSuffix(n, "/"), err))
+
+			p, ok := previous[n]
+			if !ok {
+				continue
+			}
+			c = p
+		}
+
+		loaded[n] = c
+		certs = append(certs, c)
+	}
+
+	if len(invalid) > 0 {
+		return loaded, certs, fmt.Errorf("Unable to load certificates %s", strings.Join(invalid, ", "))
+	}
+
+	return loaded, certs, nil
+}
+
+// watchCertificateSource loads certificates from the source into the store
+// until the TLS listener is stopped, interval is the delay between loads
+// for sources which do not block
+func (r *Router) watchCertificateSource(name string, load func(context.Context) ([]tls.Certificate, bool, error), interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-r.tlsStop
+		cancel()
+	}()
+
+	for {
+		certs, changed, err := load(ctx)
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		// invalid pairs are skipped, the valid certificates are still used
+		if changed {
+			r.logger.Info("Loaded certificates", "source", name, "count", len(certs))
+			r.certificates.Set(name, certs)
+		}
+
+		wait := interval
+		if err != nil {
+			r.logger.Error("Unable to load certificates", "source", name, "error", err)
+			if wait == 0 {
+				wait = time.Second
+			}
+		}
+
+		if wait == 0 {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package router
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// currentName returns the common name of the certificate served for the SNI
+// name or an empty string when no certificate is available
+func currentName(cs *certificateStore, sni string) string {
+	c, err := cs.GetCertificate(&tls.ClientHelloInfo{ServerName: sni})
+	if err != nil {
+		return ""
+	}
+
+	return c.Leaf.Subject.CommonName
+}
+
+func TestSetTLSLoadsAndRotatesCertificatesFromConsul(t *testing.T) {
+	s, c := newConsulStub(t)
+	defer s.Close()
+
+	cert, key := generateTestCert(t, "old.example.com")
+	s.Put("router/certs/site/cert", cert)
+	s.Put("router/certs/site/key", key)
+
+	rec := setupRouterTests(t)
+	rec.consulClient = c
+	err := rec.SetTLS(TLSConfig{ConsulPrefix: "router/certs/"})
+	assert.NoError(t, err)
+	defer close(rec.tlsStop)
+
+	waitFor(t, func() bool {
+		return currentName(rec.certificates, "old.example.com") == "old.example.com"
+	}, "Should have loaded the certificate")
+
+	cert, key = generateTestCert(t, "new.example.com")
+	s.Put("router/certs/site/cert", cert)
+	s.Put("router/certs/site/key", key)
+
+	waitFor(t, func() bool {
+		return currentName(rec.certificates, "new.example.com") == "new.example.com"
+	}, "Should have rotated the certificate")
+}
+
+func TestSetTLSKeepsCertificatesWhenConsulKeyPairInvalid(t *testing.T) {
+	s, c := newConsulStub(t)
+	defer s.Close()
+
+	cert, key := generateTestCert(t, "old.example.com")
+	s.Put("router/certs/site/cert", cert)
+	s.Put("router/certs/site/key", key)
+
+	rec := setupRouterTests(t)
+	rec.consulClient = c
+	rec.SetTLS(TLSConfig{ConsulPrefix: "router/certs"})
+	defer close(rec.tlsStop)
+
+	waitFor(t, func() bool {
+		return currentName(rec.certificates, "old.example.com") == "old.example.com"
+	}, "Should have loaded the certificate")
+
+	// only half of the pair has been written
+	cert, _ = generateTestCert(t, "new.example.com")
+	s.Put("router/certs/site/cert", cert)
+	time.Sleep(50 * time.Millisecond)
+
+	assert.Equal(t, "old.example.com", currentName(rec.certificates, "new.example.com"))
+}
+
+func TestSetTLSSkipsInvalidConsulKeyPairs(t *testing.T) {
+	s, c := newConsulStub(t)
+	defer s.Close()
+
+	cert, key := generateTestCert(t, "api.example.com")
+	s.Put("router/certs/api/cert", cert)
+	s.Put("router/certs/api/key", key)
+
+	// the web key has not been written yet
+	cert, key = generateTestCert(t, "web.example.com")
+	s.Put("router/certs/web/cert", cert)
+
+	rec := setupRouterTests(t)
+	rec.consulClient = c
+	rec.SetTLS(TLSConfig{ConsulPrefix: "router/certs"})
+	defer close(rec.tlsStop)
+
+	waitFor(t, func() bool {
+		return currentName(rec.certificates, "api.example.com") == "api.example.com"
+	}, "Should have loaded the valid certificate")
+
+	s.Put("router/certs/web/key", key)
+
+	waitFor(t, func() bool {
+		return currentName(rec.certificates, "web.example.com") == "web.example.com"
+	}, "Should have loaded the completed certificate")
+}
+
+// vaultStub is a minimal implementation of the Vault KV v2 HTTP API
+type vaultStub struct {
+	mu      sync.Mutex
+	secrets map[string]map[string]string
+	version map[string]int
+}
+
+func (v *vaultStub) put(name string, cert, key []byte) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.secrets[name] = map[string]string{"certificate": string(cert), "private_key": string(key)}
+	v.version[name]++
+}
+
+func (v *vaultStub) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if r.Header.Get("X-Vault-Token") != "root" {
+		rw.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if r.URL.Path == "/v1/kv/metadata/router/certs" && r.URL.Query().Get("list") == "true" {
+		keys := []string{}
+		for k := range v.secrets {
+			keys = append(keys, k)
+		}
+
+		json.NewEncoder(rw).Encode(map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/v1/kv/data/router/certs/")
+	s, ok := v.secrets[name]
+	if !ok {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(rw).Encode(map[string]interface{}{
+		"data": map[string]interface{}{
+			"data":     s,
+			"metadata": map[string]interface{}{"version": v.version[name]},
+		},
+	})
+}
+
+func TestSetTLSLoadsAndRotatesCertificatesFromVault(t *testing.T) {
+	v := &vaultStub{secrets: map[string]map[string]string{}, version: map[string]int{}}
+	ts := httptest.NewServer(v)
+	defer ts.Close()
+
+	cert, key := generateTestCert(t, "old.example.com")
+	v.put("site", cert, key)
+
+	rec := setupRouterTests(t)
+	err := rec.SetTLS(TLSConfig{
+		VaultAddr:      ts.URL,
+		VaultToken:     "root",
+		VaultMount:     "kv",
+		VaultPath:      "router/certs",
+		ReloadInterval: 10 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	defer close(rec.tlsStop)
+
+	waitFor(t, func() bool {
+		return currentName(rec.certificates, "old.example.com") == "old.example.com"
+	}, "Should have loaded the certificate")
+
+	cert, key = generateTestCert(t, "new.example.com")
+	v.put("site", cert, key)
+
+	waitFor(t, func() bool {
+		return currentName(rec.certificates, "new.example.com") == "new.example.com"
+	}, "Should have rotated the certificate")
+}
@@ -0,0 +1,183 @@
+package router
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// generateTestCert creates a self signed certificate for the given names
+// returning the PEM encoded certificate and key
+func generateTestCert(t *testing.T, names ...string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func testKeyPair(t *testing.T, names ...string) tls.Certificate {
+	c, k := generateTestCert(t, names...)
+
+	kp, err := tls.X509KeyPair(c, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return kp
+}
+
+func writeTestCert(t *testing.T, dir, name string, names ...string) (string, string) {
+	c, k := generateTestCert(t, names...)
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certFile, c, 0600)
+	ioutil.WriteFile(keyFile, k, 0600)
+
+	return certFile, keyFile
+}
+
+func servedName(t *testing.T, cs *certificateStore, sni string) string {
+	c, err := cs.GetCertificate(&tls.ClientHelloInfo{ServerName: sni})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c.Leaf.Subject.CommonName
+}
+
+func TestCertificateStoreSelectsCertificateBySNI(t *testing.T) {
+	cs := newCertificateStore()
+	cs.Set("test", []tls.Certificate{
+		testKeyPair(t, "a.example.com"),
+		testKeyPair(t, "*.b.example.com"),
+		testKeyPair(t, "c.b.example.com"),
+	})
+
+	assert.Equal(t, "a.example.com", servedName(t, cs, "A.example.com"))
+	assert.Equal(t, "*.b.example.com", servedName(t, cs, "x.b.example.com"))
+	assert.Equal(t, "c.b.example.com", servedName(t, cs, "c.b.example.com"))
+	assert.Equal(t, "a.example.com", servedName(t, cs, "unknown.com"), "Should have returned the default")
+}
+
+func TestCertificateStoreReturnsErrorWhenEmpty(t *testing.T) {
+	cs := newCertificateStore()
+
+	_, err := cs.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"})
+
+	assert.Error(t, err)
+}
+
+func TestTLSConfigSetsVersionAndCipherSuites(t *testing.T) {
+	c := &TLSConfig{MinVersion: "1.3", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}}
+
+	tc, err := c.serverConfig()
+
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), tc.MinVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, tc.CipherSuites)
+	assert.Equal(t, []string{"h2", "http/1.1"}, tc.NextProtos)
+
+	_, err = (&TLSConfig{MinVersion: "2.0"}).serverConfig()
+	assert.Error(t, err)
+
+	_, err = (&TLSConfig{CipherSuites: []string{"ROT13"}}).serverConfig()
+	assert.Error(t, err)
+}
+
+func TestSetTLSReloadsChangedCertificates(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir, "site", "old.example.com")
+
+	rec := setupRouterTests(t)
+	err := rec.SetTLS(TLSConfig{CertFiles: []string{certFile}, KeyFiles: []string{keyFile}, ReloadInterval: 10 * time.Millisecond})
+	assert.NoError(t, err)
+	defer close(rec.tlsStop)
+
+	assert.Equal(t, "old.example.com", servedName(t, rec.certificates, "old.example.com"))
+
+	writeTestCert(t, dir, "site", "new.example.com")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+
+	waitFor(t, func() bool {
+		return servedName(t, rec.certificates, "new.example.com") == "new.example.com"
+	}, "Should have reloaded the certificate")
+}
+
+func TestRedirectHandlerRedirectsToHTTPS(t *testing.T) {
+	rec := setupRouterTests(t)
+	rec.tls = &TLSConfig{BindAddress: ":8443"}
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://example.com:8181/api?a=b", nil)
+
+	rec.redirectHandler(rw, r)
+
+	assert.Equal(t, http.StatusPermanentRedirect, rw.Code)
+	assert.Equal(t, "https://example.com:8443/api?a=b", rw.Header().Get("Location"))
+}
+
+func TestHTTPSListenerNegotiatesHTTP2(t *testing.T) {
+	rec := setupRouterTests(t)
+	rec.SetTLS(TLSConfig{})
+	defer close(rec.tlsStop)
+	rec.certificates.Set("test", []tls.Certificate{testKeyPair(t, "example.com")})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	srv, err := rec.newTLSServer()
+	assert.NoError(t, err)
+	go rec.serveTLS(srv, l)
+	defer l.Close()
+
+	for _, proto := range []string{"h2", "http/1.1"} {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			ServerName:         "example.com",
+			NextProtos:         []string{proto},
+			InsecureSkipVerify: true,
+		})
+		assert.NoError(t, err)
+
+		assert.Equal(t, proto, conn.ConnectionState().NegotiatedProtocol)
+		assert.Equal(t, "example.com", conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+		conn.Close()
+	}
+}
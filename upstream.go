@@ -1,9 +1,11 @@
 package router
 
 import (
+	"fmt"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // ConnectionType enforces the connect type for the route
@@ -15,6 +17,16 @@ const HTTP ConnectionType = "http"
 // GRPC ConnectionType
 const GRPC ConnectionType = "grpc"
 
+// Lambda ConnectionType invokes an AWS Lambda function
+const Lambda ConnectionType = "lambda"
+
+// URL ConnectionType sends requests to a static URL outside the mesh
+const URL ConnectionType = "url"
+
+// Consul ConnectionType sends requests to healthy instances of a Consul
+// service which is not Connect enabled
+const Consul ConnectionType = "consul"
+
 // Upstream defines a struct to encapsulate upstream info
 type Upstream struct {
 	Service     string
@@ -22,6 +34,74 @@ type Upstream struct {
 	Type        ConnectionType
 	StripPrefix string
 	Port        int
+	RateLimit   *RateLimit
+
+	ConcurrencyLimit *ConcurrencyLimit
+
+	// Auth is the authentication required for the route
+	Auth AuthType
+	// JWTClaims are the claims and optional values required in the token
+	JWTClaims map[string]string
+	// JWTHeaders maps token claims to headers sent to the upstream
+	JWTHeaders map[string]string
+	// APIKeyHeader is the request header containing the API key
+	APIKeyHeader string
+	// PrincipalHeader is the header used to send the authenticated principal
+	// to the upstream
+	PrincipalHeader string
+	// PrincipalMetrics counts requests per authenticated principal, the
+	// number of series grows with the number of principals
+	PrincipalMetrics bool
+	// Intentions authorizes the principal using Consul intentions
+	Intentions bool
+	// ClientCert is the client certificate policy for the route
+	ClientCert *ClientCertPolicy
+	// Protocol is the protocol used for requests to the service, grpc
+	// routes default to HTTP/2
+	Protocol UpstreamProtocol
+	// Function is the name or ARN of the Lambda function for lambda routes
+	Function string
+	// Qualifier is the version or alias of the Lambda function
+	Qualifier string
+	// URL is the target of url routes
+	URL string
+	// Scheme is the scheme used for requests to consul routes
+	Scheme string
+	// Tag filters the instances of consul routes
+	Tag string
+	// TLS configures TLS for url and consul routes
+	TLS *UpstreamTLS
+	// Query is the prepared query used to find instances instead of the
+	// service
+	Query string
+	// Datacenter is the datacenter of the service or query, defaults to the
+	// local datacenter
+	Datacenter string
+	// Failover is the ordered list of datacenters tried when the datacenter
+	// has no healthy instances or its circuit is open
+	Failover []string
+	// LoadBalancer selects the instance of the service for each request,
+	// instances are selected when connections are dialed when not set
+	LoadBalancer LoadBalancerPolicy
+	// HashOn is the key used by hash load balancers, the client IP,
+	// header:[name] or cookie:[name]
+	HashOn string
+	// LocalitySpread is the RTT from the nearest instance within which
+	// instances are near for nearest load balancers, defaults to 5ms
+	LocalitySpread time.Duration
+	// LocalityMaxRequests is the number of requests in progress to the near
+	// instances after which requests spill over to other instances
+	LocalityMaxRequests int
+	// OutlierDetection ejects failing instances of load balanced routes
+	OutlierDetection *OutlierDetection
+	// HealthCheck actively checks the instances of load balanced routes
+	HealthCheck *HealthCheck
+	// Hedge sends a duplicate of slow idempotent requests to another
+	// instance of load balanced routes
+	Hedge *HedgePolicy
+
+	// client is the client for url and consul routes
+	client HTTPClient
 }
 
 // Upstreams is a collection of Upstream
@@ -38,6 +118,17 @@ func (u Upstreams) FindUpstream(path string) *Upstream {
 	return nil
 }
 
+// hasType returns true when any upstream has the connection type
+func (u Upstreams) hasType(t ConnectionType) bool {
+	for _, us := range u {
+		if us.Type == t {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Len is part of sort.Interface.
 func (u Upstreams) Len() int {
 	return len(u)
@@ -57,6 +148,9 @@ func (u Upstreams) Less(i, j int) bool {
 func NewUpstreams(u []string) (Upstreams, error) {
 	us := Upstreams{}
 
+	// concurrency limits are shared by all routes to the same service
+	limits := map[string]*ConcurrencyLimit{}
+
 	for _, v := range u {
 		// split into kv pairs
 		parts := strings.Split(v, "#")
@@ -65,8 +159,46 @@ func NewUpstreams(u []string) (Upstreams, error) {
 			Type: HTTP,
 		}
 
+		var rateLimit, rateLimitKey string
+		var rateLimitBurst int
+
+		var maxInFlight, maxQueue int
+		var queueTimeout, latencyTarget time.Duration
+		var adaptive bool
+
+		var clientCert, clientCertRevocation, clientCertHeader string
+		var clientCertSubjects, clientCertSANs, clientCertForward []string
+
+		upstreamTLS := func() *UpstreamTLS {
+			if u.TLS == nil {
+				u.TLS = &UpstreamTLS{}
+			}
+			return u.TLS
+		}
+
+		outlier := func() *OutlierDetection {
+			if u.OutlierDetection == nil {
+				u.OutlierDetection = &OutlierDetection{}
+			}
+			return u.OutlierDetection
+		}
+
+		healthCheck := func() *HealthCheck {
+			if u.HealthCheck == nil {
+				u.HealthCheck = &HealthCheck{}
+			}
+			return u.HealthCheck
+		}
+
+		hedge := func() *HedgePolicy {
+			if u.Hedge == nil {
+				u.Hedge = &HedgePolicy{}
+			}
+			return u.Hedge
+		}
+
 		for _, p := range parts {
-			kv := strings.Split(p, "=")
+			kv := strings.SplitN(p, "=", 2)
 
 			switch kv[0] {
 			case "service":
@@ -79,6 +211,12 @@ func NewUpstreams(u []string) (Upstreams, error) {
 					u.Type = HTTP
 				case "grpc":
 					u.Type = GRPC
+				case "lambda":
+					u.Type = Lambda
+				case "url":
+					u.Type = URL
+				case "consul":
+					u.Type = Consul
 				}
 			case "port":
 				p, err := strconv.Atoi(kv[1])
@@ -88,13 +226,380 @@ func NewUpstreams(u []string) (Upstreams, error) {
 				u.Port = p
 			case "strip_prefix":
 				u.StripPrefix = kv[1]
+			case "rate_limit":
+				rateLimit = kv[1]
+			case "rate_limit_burst":
+				b, err := strconv.Atoi(kv[1])
+				if err != nil {
+					return nil, err
+				}
+				rateLimitBurst = b
+			case "rate_limit_key":
+				rateLimitKey = kv[1]
+			case "concurrency_limit":
+				l, err := strconv.Atoi(kv[1])
+				if err != nil {
+					return nil, err
+				}
+				maxInFlight = l
+			case "concurrency_queue":
+				q, err := strconv.Atoi(kv[1])
+				if err != nil {
+					return nil, err
+				}
+				maxQueue = q
+			case "concurrency_queue_timeout":
+				d, err := time.ParseDuration(kv[1])
+				if err != nil {
+					return nil, err
+				}
+				queueTimeout = d
+			case "concurrency_adaptive":
+				adaptive = kv[1] == "true"
+			case "auth":
+				u.Auth = AuthType(kv[1])
+			case "jwt_claims":
+				u.JWTClaims = parseMap(kv[1])
+			case "jwt_headers":
+				u.JWTHeaders = parseMap(kv[1])
+			case "api_key_header":
+				u.APIKeyHeader = kv[1]
+			case "principal_header":
+				u.PrincipalHeader = kv[1]
+			case "principal_metrics":
+				u.PrincipalMetrics = kv[1] == "true"
+			case "intentions":
+				u.Intentions = kv[1] == "true"
+			case "concurrency_latency_target":
+				d, err := time.ParseDuration(kv[1])
+				if err != nil {
+					return nil, err
+				}
+				latencyTarget = d
+			case "client_cert":
+				clientCert = kv[1]
+			case "client_cert_subjects":
+				clientCertSubjects = parseList(kv[1])
+			case "client_cert_sans":
+				clientCertSANs = parseList(kv[1])
+			case "client_cert_revocation":
+				clientCertRevocation = kv[1]
+			case "client_cert_header":
+				clientCertHeader = kv[1]
+			case "client_cert_forward":
+				clientCertForward = parseList(kv[1])
+			case "function":
+				u.Function = kv[1]
+			case "qualifier":
+				u.Qualifier = kv[1]
+			case "query":
+				u.Query = kv[1]
+			case "datacenter":
+				u.Datacenter = kv[1]
+			case "failover":
+				u.Failover = parseList(kv[1])
+			case "lb":
+				u.LoadBalancer = LoadBalancerPolicy(kv[1])
+			case "hash_on":
+				u.HashOn = kv[1]
+			case "locality_spread":
+				d, err := time.ParseDuration(kv[1])
+				if err != nil {
+					return nil, err
+				}
+				u.LocalitySpread = d
+			case "locality_max_requests":
+				n, err := strconv.Atoi(kv[1])
+				if err != nil {
+					return nil, err
+				}
+				u.LocalityMaxRequests = n
+			case "outlier_detection":
+				if kv[1] == "true" {
+					outlier()
+				}
+			case "outlier_5xx":
+				n, err := strconv.Atoi(kv[1])
+				if err != nil {
+					return nil, err
+				}
+				outlier().Consecutive5xx = n
+			case "outlier_errors":
+				n, err := strconv.Atoi(kv[1])
+				if err != nil {
+					return nil, err
+				}
+				outlier().ConsecutiveErrors = n
+			case "outlier_latency_factor":
+				f, err := strconv.ParseFloat(kv[1], 64)
+				if err != nil {
+					return nil, err
+				}
+				outlier().LatencyFactor = f
+			case "outlier_ejection":
+				d, err := time.ParseDuration(kv[1])
+				if err != nil {
+					return nil, err
+				}
+				outlier().BaseEjection = d
+			case "outlier_max_ejection":
+				d, err := time.ParseDuration(kv[1])
+				if err != nil {
+					return nil, err
+				}
+				outlier().MaxEjection = d
+			case "outlier_max_ejection_percent":
+				n, err := strconv.Atoi(kv[1])
+				if err != nil {
+					return nil, err
+				}
+				outlier().MaxEjectionPercent = n
+			case "health_check_path":
+				healthCheck().Path = kv[1]
+			case "health_check_interval":
+				d, err := time.ParseDuration(kv[1])
+				if err != nil {
+					return nil, err
+				}
+				healthCheck().Interval = d
+			case "health_check_timeout":
+				d, err := time.ParseDuration(kv[1])
+				if err != nil {
+					return nil, err
+				}
+				healthCheck().Timeout = d
+			case "health_check_healthy":
+				n, err := strconv.Atoi(kv[1])
+				if err != nil {
+					return nil, err
+				}
+				healthCheck().HealthyThreshold = n
+			case "health_check_unhealthy":
+				n, err := strconv.Atoi(kv[1])
+				if err != nil {
+					return nil, err
+				}
+				healthCheck().UnhealthyThreshold = n
+			case "hedge_delay":
+				err := parseHedgeDelay(hedge(), kv[1])
+				if err != nil {
+					return nil, err
+				}
+			case "hedge_max_percent":
+				n, err := strconv.Atoi(kv[1])
+				if err != nil {
+					return nil, err
+				}
+
+				// zero is rejected as it can not be told apart from the default
+				if n < 1 || n > 100 {
+					return nil, fmt.Errorf("Invalid hedge max percent, must be between 1 and 100: %s", kv[1])
+				}
+				hedge().MaxPercent = n
+			case "url":
+				u.URL = kv[1]
+			case "scheme":
+				u.Scheme = kv[1]
+			case "tag":
+				u.Tag = kv[1]
+			case "tls_ca_file":
+				upstreamTLS().CAFile = kv[1]
+			case "tls_cert_file":
+				upstreamTLS().CertFile = kv[1]
+			case "tls_key_file":
+				upstreamTLS().KeyFile = kv[1]
+			case "tls_server_name":
+				upstreamTLS().ServerName = kv[1]
+			case "tls_skip_verify":
+				upstreamTLS().InsecureSkipVerify = kv[1] == "true"
+			case "protocol":
+				switch UpstreamProtocol(kv[1]) {
+				case ProtocolHTTP1, ProtocolHTTP2, ProtocolAuto:
+					u.Protocol = UpstreamProtocol(kv[1])
+				default:
+					return nil, fmt.Errorf("Invalid protocol for %s: %s", u.Path, kv[1])
+				}
+			}
+		}
+
+		// the service of prepared query routes defaults to the query
+		if u.Service == "" {
+			u.Service = u.Query
+		}
+
+		// lambda routes invoke the function with the service name unless a
+		// function is given, the service defaults to the function name
+		if u.Type == Lambda {
+			if u.Function == "" {
+				u.Function = u.Service
+			}
+
+			if u.Function == "" {
+				return nil, fmt.Errorf("No function defined for %s", u.Path)
+			}
+
+			if u.Service == "" {
+				u.Service = lambdaFunctionName(u.Function)
+			}
+		}
+
+		if u.Protocol == "" {
+			u.Protocol = ProtocolHTTP1
+			if u.Type == GRPC {
+				u.Protocol = ProtocolHTTP2
+			}
+		}
+
+		switch u.Auth {
+		case "", AuthJWT, AuthAPIKey, AuthBasic:
+		default:
+			return nil, fmt.Errorf("Invalid auth type for %s: %s", u.Path, u.Auth)
+		}
+
+		switch u.LoadBalancer {
+		case "", LoadBalancerRoundRobin, LoadBalancerLeastRequest, LoadBalancerP2C, LoadBalancerNearest:
+		case LoadBalancerHash:
+			if u.HashOn == "" {
+				u.HashOn = "ip"
+			}
+
+			err := parseHashOn(u.HashOn)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid load balancer for %s: %s", u.Path, err)
+			}
+		default:
+			return nil, fmt.Errorf("Invalid load balancer for %s: %s", u.Path, u.LoadBalancer)
+		}
+
+		// outlier detection and health checks track the instances selected by
+		// the load balancer
+		if (u.OutlierDetection != nil || u.HealthCheck != nil) && u.LoadBalancer == "" {
+			return nil, fmt.Errorf("Outlier detection and health checks require a load balancer for %s", u.Path)
+		}
+
+		if u.OutlierDetection != nil {
+			u.OutlierDetection.setDefaults()
+		}
+
+		if u.HealthCheck != nil {
+			if !strings.HasPrefix(u.HealthCheck.Path, "/") {
+				return nil, fmt.Errorf("Invalid health check path for %s: %s", u.Path, u.HealthCheck.Path)
+			}
+
+			u.HealthCheck.setDefaults()
+		}
+
+		// hedged requests are sent to a different instance selected by the
+		// load balancer
+		if u.Hedge != nil {
+			if u.LoadBalancer == "" {
+				return nil, fmt.Errorf("Hedging requires a load balancer for %s", u.Path)
+			}
+
+			if u.Hedge.Delay == 0 && u.Hedge.Percentile == 0 {
+				return nil, fmt.Errorf("No hedge delay defined for %s", u.Path)
+			}
+
+			if u.Hedge.MaxPercent < 0 || u.Hedge.MaxPercent > 100 {
+				return nil, fmt.Errorf("Invalid hedge max percent for %s: %d", u.Path, u.Hedge.MaxPercent)
+			}
+
+			u.Hedge.setDefaults()
+		}
+
+		// routes outside the mesh use their own client and TLS settings
+		if u.Type == URL || u.Type == Consul {
+			err := u.setDirect()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if rateLimit != "" {
+			rl, err := NewRateLimit(rateLimit, rateLimitBurst, rateLimitKey)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid rate limit for %s: %s", u.Path, err)
+			}
+			// claims are only validated on routes with JWT authentication
+			if strings.HasPrefix(rl.Key, "claim:") && u.Auth != AuthJWT {
+				return nil, fmt.Errorf("Invalid rate limit for %s: claim keys require auth=jwt", u.Path)
+			}
+
+			rl.scope = "route" + u.Path
+			u.RateLimit = rl
+		}
+
+		if clientCert != "" || len(clientCertSubjects) > 0 || len(clientCertSANs) > 0 || clientCertRevocation != "" {
+			if clientCert != "" && clientCert != "required" && clientCert != "optional" {
+				return nil, fmt.Errorf("Invalid client certificate mode for %s: %s", u.Path, clientCert)
+			}
+
+			p, err := NewClientCertPolicy(clientCert == "required", clientCertSubjects, clientCertSANs, clientCertRevocation, clientCertHeader, clientCertForward)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid client certificate policy for %s: %s", u.Path, err)
+			}
+			u.ClientCert = p
+		}
+
+		// routes to the same service share a limit so their settings must
+		// match
+		if maxInFlight > 0 {
+			cl := NewConcurrencyLimit(maxInFlight, maxQueue, queueTimeout, adaptive, latencyTarget)
+
+			existing, ok := limits[u.Service]
+			if ok && !existing.sameSettings(cl) {
+				return nil, fmt.Errorf("Conflicting concurrency limits for %s, routes to service %s share a limit", u.Path, u.Service)
+			}
+
+			if !ok {
+				limits[u.Service] = cl
 			}
 		}
+
 		us = append(us, u)
 	}
 
+	for i := range us {
+		us[i].ConcurrencyLimit = limits[us[i].Service]
+	}
+
 	// sort the upstreams to ensure that find always returns the longest path first
 	sort.Sort(us)
 
 	return us, nil
 }
+
+// parseMap parses a list of key:value pairs separated by ; i.e.
+// sub:X-User-ID;email:X-User-Email, the value is optional
+func parseMap(s string) map[string]string {
+	m := map[string]string{}
+
+	for _, p := range strings.Split(s, ";") {
+		if p == "" {
+			continue
+		}
+
+		kv := strings.SplitN(p, ":", 2)
+		if len(kv) == 1 {
+			m[kv[0]] = ""
+			continue
+		}
+
+		m[kv[0]] = kv[1]
+	}
+
+	return m
+}
+
+// parseList parses a list of values separated by ;
+func parseList(s string) []string {
+	l := []string{}
+
+	for _, v := range strings.Split(s, ";") {
+		if v != "" {
+			l = append(l, v)
+		}
+	}
+
+	return l
+}
@@ -0,0 +1,278 @@
+package router
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// healthCacheTTL is the time the healthy instances of a service are cached
+const healthCacheTTL = 5 * time.Second
+
+// healthLookupTimeout bounds a lookup of the healthy instances of a service
+// so a slow Consul agent does not hold up requests
+const healthLookupTimeout = 2 * time.Second
+
+// UpstreamTLS configures TLS for upstreams outside the mesh
+type UpstreamTLS struct {
+	// CAFile is a PEM encoded CA bundle used to verify the upstream, the
+	// system roots are used when not set
+	CAFile string
+	// CertFile and KeyFile are the client certificate sent to the upstream
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name used to verify the upstream certificate
+	ServerName string
+	// InsecureSkipVerify disables verification of the upstream certificate
+	InsecureSkipVerify bool
+}
+
+// config returns the client TLS config
+func (u *UpstreamTLS) config() (*tls.Config, error) {
+	tc := &tls.Config{
+		ServerName:         u.ServerName,
+		InsecureSkipVerify: u.InsecureSkipVerify,
+	}
+
+	if u.CAFile != "" {
+		d, err := ioutil.ReadFile(u.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(d) {
+			return nil, fmt.Errorf("No certificates found in %s", u.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+
+	if u.CertFile != "" || u.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(u.CertFile, u.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	return tc, nil
+}
+
+// setDirect validates a url or consul route and creates its client, the
+// service of url routes defaults to the host
+func (u *Upstream) setDirect() error {
+	switch u.Type {
+	case URL:
+		t, err := url.Parse(u.URL)
+		if err != nil || (t.Scheme != "http" && t.Scheme != "https") || t.Host == "" {
+			return fmt.Errorf("Invalid URL for %s: %s", u.Path, u.URL)
+		}
+
+		if u.Service == "" {
+			u.Service = t.Hostname()
+		}
+	case Consul:
+		if u.Service == "" {
+			return fmt.Errorf("No service defined for %s", u.Path)
+		}
+
+		if u.Scheme == "" {
+			u.Scheme = "http"
+			if u.TLS != nil {
+				u.Scheme = "https"
+			}
+		}
+
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("Invalid scheme for %s: %s", u.Path, u.Scheme)
+		}
+	}
+
+	c, err := buildDirectClient(u)
+	if err != nil {
+		return fmt.Errorf("Invalid TLS config for %s: %s", u.Path, err)
+	}
+	u.client = c
+
+	return nil
+}
+
+// buildDirectClient returns the client for an upstream outside the mesh,
+// HTTP/2 is negotiated unless the route uses HTTP/1.1
+func buildDirectClient(u *Upstream) (HTTPClient, error) {
+	t := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSHandshakeTimeout: 20 * time.Second,
+		MaxIdleConns:        20,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     120 * time.Second,
+		ForceAttemptHTTP2:   u.Protocol != ProtocolHTTP1,
+	}
+
+	if u.TLS != nil {
+		tc, err := u.TLS.config()
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig = tc
+	}
+
+	return &http.Client{Transport: t, Timeout: 10 * time.Second}, nil
+}
+
+// directURI returns the URI for a request to an upstream outside the mesh,
+// the path is appended to the path of the target
+func (r *Router) directURI(us *Upstream, p string) (string, error) {
+	base := us.URL
+
+	if us.Type == Consul {
+		addr, err := r.health.resolve(us.Service, us.Tag)
+		if err != nil {
+			return "", err
+		}
+
+		base = us.Scheme + "://" + addr
+	}
+
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+
+	u.Path = path.Join("/", u.Path, p)
+	if strings.HasSuffix(p, "/") && !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+
+	return u.String(), nil
+}
+
+// healthResolver returns the address of a healthy instance of a service
+// which is not Connect enabled, instances are selected in turn
+type healthResolver struct {
+	client  *api.Client
+	ttl     time.Duration
+	timeout time.Duration
+	now     func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]*healthEntry
+}
+
+type healthEntry struct {
+	addrs   []string
+	expires time.Time
+	next    uint32
+	err     error
+	// loaded is closed when the first lookup completes, refreshing is set
+	// while a lookup is in progress
+	loaded     chan struct{}
+	refreshing bool
+}
+
+func newHealthResolver(c *api.Client) *healthResolver {
+	return &healthResolver{
+		client:  c,
+		ttl:     healthCacheTTL,
+		timeout: healthLookupTimeout,
+		now:     time.Now,
+		cache:   map[string]*healthEntry{},
+	}
+}
+
+// resolve returns the address of an instance with passing health checks
+func (h *healthResolver) resolve(service, tag string) (string, error) {
+	e, addrs, err := h.lookup(service+"/"+tag, func(ctx context.Context) ([]string, error) {
+		entries, _, err := h.client.Health().Service(service, tag, true, (&api.QueryOptions{}).WithContext(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to find instances of %s: %s", service, err)
+		}
+
+		addrs := []string{}
+		for _, se := range entries {
+			addr := se.Service.Address
+			if addr == "" {
+				addr = se.Node.Address
+			}
+
+			addrs = append(addrs, net.JoinHostPort(addr, strconv.Itoa(se.Service.Port)))
+		}
+
+		return addrs, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("No healthy instances of %s", service)
+	}
+
+	n := atomic.AddUint32(&e.next, 1)
+
+	return addrs[int(n-1)%len(addrs)], nil
+}
+
+// lookup returns the cached addresses for the key, callers share a single
+// fetch for the first lookup. Expired addresses are returned while they are
+// refreshed in the background and are kept when the refresh fails.
+func (h *healthResolver) lookup(key string, fetch func(context.Context) ([]string, error)) (*healthEntry, []string, error) {
+	h.mu.Lock()
+	e, ok := h.cache[key]
+	if !ok {
+		e = &healthEntry{loaded: make(chan struct{}), refreshing: true}
+		h.cache[key] = e
+		go h.refresh(key, e, fetch)
+	} else if !e.refreshing && h.now().After(e.expires) {
+		e.refreshing = true
+		go h.refresh(key, e, fetch)
+	}
+	h.mu.Unlock()
+
+	<-e.loaded
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return e, e.addrs, e.err
+}
+
+// refresh fetches the addresses for the entry, when the first lookup fails
+// the entry is removed so the next lookup retries
+func (h *healthResolver) refresh(key string, e *healthEntry, fetch func(context.Context) ([]string, error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	addrs, err := fetch(ctx)
+	cancel()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	e.refreshing = false
+	e.expires = h.now().Add(h.ttl)
+
+	select {
+	case <-e.loaded:
+		if err == nil {
+			e.addrs = addrs
+		}
+	default:
+		e.addrs, e.err = addrs, err
+		if err != nil {
+			delete(h.cache, key)
+		}
+		close(e.loaded)
+	}
+}
@@ -0,0 +1,291 @@
+package router
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// echoServer returns the name of the server and the request URI
+func echoServer(name string) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(name + " " + req.URL.RequestURI()))
+	}
+}
+
+func setupDirectRouter(t *testing.T, routes ...string) *Router {
+	us, err := NewUpstreams(routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := setupRouterTests(t)
+	rec.upstreams = us
+
+	return rec
+}
+
+// setupConsulHealth stubs the Consul health API, the instances of each
+// service are returned when passing checks are requested
+func setupConsulHealth(t *testing.T, instances map[string][]string) (*healthResolver, *int32) {
+	calls := new(int32)
+
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(calls, 1)
+
+		service := filepath.Base(req.URL.Path)
+		if req.URL.Query().Get("tag") != "" {
+			service += "/" + req.URL.Query().Get("tag")
+		}
+
+		entries := []*api.ServiceEntry{}
+		if _, ok := req.URL.Query()["passing"]; ok {
+			for _, addr := range instances[service] {
+				host, port, _ := net.SplitHostPort(addr)
+				p, _ := strconv.Atoi(port)
+				entries = append(entries, &api.ServiceEntry{
+					Node:    &api.Node{Address: host},
+					Service: &api.AgentService{Service: service, Port: p},
+				})
+			}
+		}
+
+		json.NewEncoder(rw).Encode(entries)
+	}))
+	t.Cleanup(s.Close)
+
+	c, _ := api.NewClient(&api.Config{Address: s.Listener.Addr().String()})
+
+	return newHealthResolver(c), calls
+}
+
+func writePEM(t *testing.T, name, typ string, der []byte) string {
+	f := filepath.Join(t.TempDir(), name)
+	err := ioutil.WriteFile(f, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+func TestURLUpstreamAppendsPathToTarget(t *testing.T) {
+	s := httptest.NewServer(echoServer("legacy"))
+	defer s.Close()
+
+	rec := setupDirectRouter(t, "path=/legacy#type=url#url="+s.URL+"/base")
+	rw := httptest.NewRecorder()
+
+	rec.Handler(rw, httptest.NewRequest("GET", "/legacy/users?id=1", nil))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "legacy /base/users?id=1", rw.Body.String())
+	mockHTTPClient.AssertNotCalled(t, "Do", mock.Anything)
+}
+
+func TestURLUpstreamTLSOptions(t *testing.T) {
+	ca := newTestCA(t)
+	cert, key := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "client"}})
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certFile := writePEM(t, "cert.pem", "CERTIFICATE", cert.Raw)
+	keyFile := writePEM(t, "key.pem", "EC PRIVATE KEY", keyDER)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		name := ""
+		if len(req.TLS.PeerCertificates) > 0 {
+			name = req.TLS.PeerCertificates[0].Subject.CommonName
+		}
+		rw.Write([]byte("client=" + name))
+	}))
+	s.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	s.StartTLS()
+	defer s.Close()
+
+	caFile := writePEM(t, "ca.pem", "CERTIFICATE", s.Certificate().Raw)
+
+	tests := []struct {
+		name   string
+		route  string
+		status int
+		body   string
+	}{
+		{"untrusted certificate", "", http.StatusInternalServerError, ""},
+		{"custom ca", "#tls_ca_file=" + caFile, http.StatusOK, "client="},
+		{"skip verify", "#tls_skip_verify=true", http.StatusOK, "client="},
+		{"client certificate", "#tls_ca_file=" + caFile + "#tls_cert_file=" + certFile + "#tls_key_file=" + keyFile, http.StatusOK, "client=client"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := setupDirectRouter(t, "path=/legacy#type=url#url="+s.URL+tt.route)
+			rw := httptest.NewRecorder()
+
+			rec.Handler(rw, httptest.NewRequest("GET", "/legacy", nil))
+
+			assert.Equal(t, tt.status, rw.Code)
+			if tt.body != "" {
+				assert.Equal(t, tt.body, rw.Body.String())
+			}
+		})
+	}
+}
+
+func TestConsulUpstreamUsesHealthyInstancesInTurn(t *testing.T) {
+	a := httptest.NewServer(echoServer("a"))
+	defer a.Close()
+	b := httptest.NewServer(echoServer("b"))
+	defer b.Close()
+
+	health, calls := setupConsulHealth(t, map[string][]string{
+		"legacy": {a.Listener.Addr().String(), b.Listener.Addr().String()},
+	})
+
+	rec := setupDirectRouter(t, "service=legacy#path=/legacy#type=consul")
+	rec.health = health
+
+	bodies := []string{}
+	for i := 0; i < 3; i++ {
+		rw := httptest.NewRecorder()
+		rec.Handler(rw, httptest.NewRequest("GET", "/legacy/users", nil))
+		bodies = append(bodies, rw.Body.String())
+	}
+
+	assert.Equal(t, []string{"a /users", "b /users", "a /users"}, bodies)
+	assert.Equal(t, int32(1), atomic.LoadInt32(calls), "Should cache the healthy instances")
+}
+
+func TestHealthResolverSharesLookupsAndServesStaleInstances(t *testing.T) {
+	health, calls := setupConsulHealth(t, map[string][]string{"legacy": {"10.0.0.1:80"}})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addr, err := health.resolve("legacy", "")
+			assert.NoError(t, err)
+			assert.Equal(t, "10.0.0.1:80", addr)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(calls), "Should share the first lookup")
+
+	health.mu.Lock()
+	health.now = func() time.Time { return time.Now().Add(time.Hour) }
+	health.mu.Unlock()
+
+	addr, err := health.resolve("legacy", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:80", addr, "Should serve the stale instances")
+
+	waitFor(t, func() bool { return atomic.LoadInt32(calls) == 2 }, "Should refresh in the background")
+}
+
+func TestHealthResolverTimesOutSlowLookups(t *testing.T) {
+	done := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		select {
+		case <-done:
+		case <-req.Context().Done():
+		}
+	}))
+	defer s.Close()
+	defer close(done)
+
+	c, _ := api.NewClient(&api.Config{Address: s.Listener.Addr().String()})
+	health := newHealthResolver(c)
+	health.timeout = 50 * time.Millisecond
+
+	start := time.Now()
+	_, err := health.resolve("legacy", "")
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Unable to find instances of legacy")
+	assert.True(t, time.Since(start) < time.Second, "Should give up after the timeout")
+}
+
+func TestConsulUpstreamFiltersByTag(t *testing.T) {
+	v2 := httptest.NewServer(echoServer("v2"))
+	defer v2.Close()
+
+	health, _ := setupConsulHealth(t, map[string][]string{"legacy/v2": {v2.Listener.Addr().String()}})
+
+	rec := setupDirectRouter(t, "service=legacy#path=/legacy#type=consul#tag=v2")
+	rec.health = health
+	rw := httptest.NewRecorder()
+
+	rec.Handler(rw, httptest.NewRequest("GET", "/legacy", nil))
+
+	assert.Equal(t, "v2 /", rw.Body.String())
+}
+
+func TestConsulUpstreamReturnsUnavailableWithoutHealthyInstances(t *testing.T) {
+	health, _ := setupConsulHealth(t, nil)
+
+	rec := setupDirectRouter(t, "service=legacy#path=/legacy#type=consul")
+	rec.health = health
+	rw := httptest.NewRecorder()
+
+	rec.Handler(rw, httptest.NewRequest("GET", "/legacy", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Contains(t, rw.Body.String(), "No healthy instances of legacy")
+}
+
+func TestNewUpstreamsValidatesDirectRoutes(t *testing.T) {
+	tests := []struct {
+		name  string
+		route string
+	}{
+		{"invalid url", "path=/a#type=url#url=ftp://example.com"},
+		{"url without host", "path=/a#type=url#url=/base"},
+		{"consul without service", "path=/a#type=consul"},
+		{"invalid scheme", "service=a#path=/a#type=consul#scheme=ftp"},
+		{"missing ca file", "path=/a#type=url#url=https://example.com#tls_ca_file=" + filepath.Join(t.TempDir(), "missing.pem")},
+		{"missing key", "path=/a#type=url#url=https://example.com#tls_cert_file=cert.pem"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewUpstreams([]string{tt.route})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestNewUpstreamsSetsDirectDefaults(t *testing.T) {
+	us, err := NewUpstreams([]string{
+		"path=/legacy#type=url#url=https://legacy.example.com:8443/api",
+		"service=billing#path=/billing#type=consul#tls_skip_verify=true",
+		"service=orders#path=/orders#type=consul",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "legacy.example.com", us.FindUpstream("/legacy").Service)
+	assert.Equal(t, "https", us.FindUpstream("/billing").Scheme)
+	assert.Equal(t, "http", us.FindUpstream("/orders").Scheme)
+	assert.NotNil(t, us.FindUpstream("/orders").client)
+	assert.True(t, us.FindUpstream("/billing").TLS.InsecureSkipVerify)
+}
@@ -0,0 +1,299 @@
+package router
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/hashicorp/go-hclog"
+	"golang.org/x/net/http2"
+)
+
+// UpstreamProtocol is the protocol used for requests to the upstream service
+type UpstreamProtocol string
+
+// Upstream protocols, auto uses HTTP/2 when the service negotiates it with
+// ALPN and HTTP/1.1 otherwise
+const (
+	ProtocolHTTP1 UpstreamProtocol = "http1"
+	ProtocolHTTP2 UpstreamProtocol = "http2"
+	ProtocolAuto  UpstreamProtocol = "auto"
+)
+
+const (
+	// http2PingInterval is how often pooled connections are checked
+	http2PingInterval = 30 * time.Second
+	// http2PingTimeout is the time a connection has to answer a ping before
+	// it is closed
+	http2PingTimeout = 5 * time.Second
+	// http1Retry is how long auto routes use HTTP/1.1 for a service which did
+	// not negotiate HTTP/2 before trying again
+	http1Retry = 10 * time.Minute
+)
+
+var errHTTP2NotNegotiated = errors.New("Upstream did not negotiate HTTP/2")
+
+// http2ConnPool multiplexes requests over HTTP/2 connections to each
+// upstream service, connections are dialed over Connect and checked with
+// pings
+type http2ConnPool struct {
+	dialTLS      func(network, addr string) (net.Conn, error)
+	transport    *http2.Transport
+	logger       log.Logger
+	pingInterval time.Duration
+	pingTimeout  time.Duration
+
+	mu      sync.Mutex
+	conns   map[string][]*http2.ClientConn
+	dialing map[string]*http2Dial
+	stop    chan struct{}
+}
+
+// http2Dial allows concurrent requests to wait for the same connection
+type http2Dial struct {
+	done chan struct{}
+	cc   *http2.ClientConn
+	err  error
+}
+
+func newHTTP2ConnPool(dialTLS func(network, addr string) (net.Conn, error), l log.Logger) *http2ConnPool {
+	p := &http2ConnPool{
+		dialTLS:      dialTLS,
+		logger:       l,
+		pingInterval: http2PingInterval,
+		pingTimeout:  http2PingTimeout,
+		conns:        map[string][]*http2.ClientConn{},
+		dialing:      map[string]*http2Dial{},
+		stop:         make(chan struct{}),
+	}
+
+	p.transport = &http2.Transport{ConnPool: p}
+
+	go p.healthCheck()
+
+	return p
+}
+
+// GetClientConn returns a connection with capacity for another stream,
+// a new connection is dialed when all connections are busy
+func (p *http2ConnPool) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+	p.mu.Lock()
+
+	for _, cc := range p.conns[addr] {
+		if cc.CanTakeNewRequest() {
+			p.mu.Unlock()
+			return cc, nil
+		}
+	}
+
+	d, ok := p.dialing[addr]
+	if !ok {
+		d = &http2Dial{done: make(chan struct{})}
+		p.dialing[addr] = d
+
+		go p.dial(addr, d)
+	}
+
+	p.mu.Unlock()
+
+	<-d.done
+
+	return d.cc, d.err
+}
+
+func (p *http2ConnPool) dial(addr string, d *http2Dial) {
+	defer close(d.done)
+
+	d.cc, d.err = p.newClientConn(addr)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.dialing, addr)
+	if d.cc != nil {
+		p.conns[addr] = append(p.conns[addr], d.cc)
+	}
+}
+
+// newClientConn dials the service and checks HTTP/2 was negotiated
+func (p *http2ConnPool) newClientConn(addr string) (*http2.ClientConn, error) {
+	c, err := p.dialTLS("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tc, ok := c.(*tls.Conn)
+	if !ok || tc.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		c.Close()
+		return nil, errHTTP2NotNegotiated
+	}
+
+	return p.transport.NewClientConn(c)
+}
+
+// MarkDead removes the connection from the pool
+func (p *http2ConnPool) MarkDead(cc *http2.ClientConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for addr, conns := range p.conns {
+		for i, c := range conns {
+			if c == cc {
+				p.conns[addr] = append(conns[:i:i], conns[i+1:]...)
+				if len(p.conns[addr]) == 0 {
+					delete(p.conns, addr)
+				}
+				return
+			}
+		}
+	}
+}
+
+// drain removes the connections to the address from the pool, the
+// connections are closed when their requests complete
+func (p *http2ConnPool) drain(addr string) {
+	p.mu.Lock()
+	conns := p.conns[addr]
+	delete(p.conns, addr)
+	p.mu.Unlock()
+
+	for _, cc := range conns {
+		go cc.Shutdown(context.Background())
+	}
+}
+
+// healthCheck pings the connections until the pool is closed
+func (p *http2ConnPool) healthCheck() {
+	t := time.NewTicker(p.pingInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-t.C:
+			p.ping()
+		}
+	}
+}
+
+// ping checks every connection in the pool, connections which do not
+// respond are closed
+func (p *http2ConnPool) ping() {
+	p.mu.Lock()
+	conns := map[*http2.ClientConn]string{}
+	for addr, cs := range p.conns {
+		for _, cc := range cs {
+			conns[cc] = addr
+		}
+	}
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for cc, addr := range conns {
+		wg.Add(1)
+
+		go func(cc *http2.ClientConn, addr string) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), p.pingTimeout)
+			defer cancel()
+
+			err := cc.Ping(ctx)
+			if err != nil {
+				p.logger.Info("Closing unhealthy HTTP/2 connection", "upstream", addr, "error", err)
+				p.MarkDead(cc)
+				cc.Close()
+			}
+		}(cc, addr)
+	}
+	wg.Wait()
+}
+
+// Close stops the health checks and closes the connections
+func (p *http2ConnPool) Close() {
+	close(p.stop)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, cs := range p.conns {
+		for _, cc := range cs {
+			cc.Close()
+		}
+	}
+
+	p.conns = map[string][]*http2.ClientConn{}
+}
+
+// autoTransport sends requests over HTTP/2 when the upstream negotiates it
+// and falls back to HTTP/1.1
+type autoTransport struct {
+	http2 http.RoundTripper
+	http1 http.RoundTripper
+
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+func (t *autoTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	h1 := time.Now().Before(t.until[req.URL.Host])
+	t.mu.Unlock()
+
+	if !h1 {
+		resp, err := t.http2.RoundTrip(req)
+		if err != errHTTP2NotNegotiated {
+			return resp, err
+		}
+
+		t.mu.Lock()
+		t.until[req.URL.Host] = time.Now().Add(http1Retry)
+		t.mu.Unlock()
+	}
+
+	return t.http1.RoundTrip(req)
+}
+
+// buildHTTP2Clients returns the clients for HTTP/2 and auto routes, both
+// share the connection pool
+func buildHTTP2Clients(s ConnectService, pool *http2ConnPool) (HTTPClient, HTTPClient) {
+	h2 := &http.Client{
+		Transport: pool.transport,
+		Timeout:   10 * time.Second,
+	}
+
+	auto := &http.Client{
+		Transport: &autoTransport{
+			http2: pool.transport,
+			http1: buildHTTPTransport(s),
+			until: map[string]time.Time{},
+		},
+		Timeout: 10 * time.Second,
+	}
+
+	return h2, auto
+}
+
+// upstreamClient returns the client for the route's type and protocol
+func (r *Router) upstreamClient(us *Upstream) HTTPClient {
+	switch us.Type {
+	case Lambda:
+		return &lambdaFunction{client: r.lambda, function: us.Function, qualifier: us.Qualifier}
+	case URL, Consul:
+		return us.client
+	}
+
+	switch us.Protocol {
+	case ProtocolHTTP2:
+		return r.http2Client
+	case ProtocolAuto:
+		return r.autoClient
+	}
+
+	return r.httpClient
+}
@@ -0,0 +1,158 @@
+package router
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// setupHTTP2Upstream starts a TLS server and returns a dial function which
+// connects to it offering the protocols and counts the connections
+func setupHTTP2Upstream(t *testing.T, h2 bool, protos ...string) (*httptest.Server, func(string, string) (net.Conn, error), *int32) {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		rw.Write([]byte(req.Proto))
+	}))
+	s.EnableHTTP2 = h2
+	s.StartTLS()
+
+	dials := new(int32)
+	dial := func(network, addr string) (net.Conn, error) {
+		atomic.AddInt32(dials, 1)
+		return tls.Dial("tcp", s.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: protos})
+	}
+
+	return s, dial, dials
+}
+
+func TestHTTP2PoolMultiplexesRequestsOverOneConnection(t *testing.T) {
+	s, dial, dials := setupHTTP2Upstream(t, true, "h2")
+	defer s.Close()
+
+	p := newHTTP2ConnPool(dial, log.Default())
+	defer p.Close()
+	client := &http.Client{Transport: p.transport}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			resp, err := client.Get("https://api.service.consul/")
+			if assert.NoError(t, err) {
+				assert.Equal(t, 2, resp.ProtoMajor)
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(dials))
+}
+
+func TestHTTP2PoolReturnsErrorWhenHTTP2NotNegotiated(t *testing.T) {
+	s, dial, _ := setupHTTP2Upstream(t, false, "h2", "http/1.1")
+	defer s.Close()
+
+	p := newHTTP2ConnPool(dial, log.Default())
+	defer p.Close()
+
+	_, err := p.transport.RoundTrip(httptest.NewRequest("GET", "https://api.service.consul/", nil))
+	assert.Equal(t, errHTTP2NotNegotiated, err)
+}
+
+func TestHTTP2PoolRemovesConnectionsFailingPing(t *testing.T) {
+	s, dial, dials := setupHTTP2Upstream(t, true, "h2")
+	defer s.Close()
+
+	p := newHTTP2ConnPool(dial, log.Default())
+	defer p.Close()
+	client := &http.Client{Transport: p.transport}
+
+	resp, err := client.Get("https://api.service.consul/")
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	p.ping()
+	assert.Len(t, p.conns["api.service.consul:443"], 1, "Should keep healthy connections")
+
+	s.CloseClientConnections()
+	p.ping()
+	assert.Len(t, p.conns["api.service.consul:443"], 0, "Should remove connections which do not respond")
+
+	resp, err = client.Get("https://api.service.consul/")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, int32(2), atomic.LoadInt32(dials))
+}
+
+func TestAutoTransportFallsBackToHTTP1(t *testing.T) {
+	s, dial, dials := setupHTTP2Upstream(t, false, "h2", "http/1.1")
+	defer s.Close()
+
+	p := newHTTP2ConnPool(dial, log.Default())
+	defer p.Close()
+
+	client := &http.Client{Transport: &autoTransport{
+		http2: p.transport,
+		http1: &http.Transport{DialTLS: dial},
+		until: map[string]time.Time{},
+	}}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("https://api.service.consul/")
+		if assert.NoError(t, err) {
+			assert.Equal(t, 1, resp.ProtoMajor)
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+	}
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(dials), "Should only try HTTP/2 once")
+}
+
+func TestAutoTransportUsesHTTP2WhenNegotiated(t *testing.T) {
+	s, dial, _ := setupHTTP2Upstream(t, true, "h2", "http/1.1")
+	defer s.Close()
+
+	p := newHTTP2ConnPool(dial, log.Default())
+	defer p.Close()
+
+	client := &http.Client{Transport: &autoTransport{
+		http2: p.transport,
+		http1: &http.Transport{DialTLS: dial},
+		until: map[string]time.Time{},
+	}}
+
+	resp, err := client.Get("https://api.service.consul/")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, 2, resp.ProtoMajor)
+}
+
+func TestHandlerUsesClientForRouteProtocol(t *testing.T) {
+	rec := setupRouterTests(t)
+	rec.upstreams = append(rec.upstreams, Upstream{Service: "api", Path: "/api", Protocol: ProtocolHTTP2})
+
+	h2 := &MockHTTPClient{}
+	h2.On("Do", mock.Anything).Return(httpResponse, nil)
+	rec.http2Client = h2
+
+	rec.Handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/api", nil))
+
+	h2.AssertCalled(t, "Do", mock.Anything)
+	mockHTTPClient.AssertNotCalled(t, "Do", mock.Anything)
+}
@@ -0,0 +1,337 @@
+package router
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// lambdaMaxPayload is the largest request payload accepted by synchronous
+// Lambda invocations, the limit applies to the JSON event including the
+// base64 encoded body
+const lambdaMaxPayload = 6 * 1024 * 1024
+
+// LambdaConfig configures the client used to invoke Lambda functions, empty
+// values are read from the standard AWS environment variables
+type LambdaConfig struct {
+	// Region is the default region for functions which are not specified by
+	// ARN, defaults to AWS_REGION
+	Region string
+	// Endpoint overrides the Lambda API endpoint for the region i.e. a local
+	// Lambda emulator
+	Endpoint string
+	// AccessKeyID, SecretAccessKey and SessionToken are static credentials,
+	// when empty AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+	// AWS_SESSION_TOKEN are read for each invocation, otherwise the ECS
+	// container credentials or the EC2 instance profile are used
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Timeout is the maximum duration of an invocation, defaults to 30s
+	Timeout time.Duration
+}
+
+// SetLambda configures the client for routes with type=lambda
+func (r *Router) SetLambda(c LambdaConfig) error {
+	if c.Region == "" {
+		c.Region = os.Getenv("AWS_REGION")
+	}
+
+	if c.Region == "" {
+		c.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+
+	creds, err := newAWSCredentialProvider(c)
+	if err != nil {
+		return err
+	}
+
+	if c.Endpoint != "" {
+		_, err := url.ParseRequestURI(c.Endpoint)
+		if err != nil {
+			return fmt.Errorf("Invalid Lambda endpoint: %s", err)
+		}
+	}
+
+	if c.Timeout == 0 {
+		c.Timeout = 30 * time.Second
+	}
+
+	r.lambda = &lambdaClient{
+		config:      c,
+		credentials: creds,
+		httpClient:  &http.Client{Timeout: c.Timeout},
+		now:         time.Now,
+	}
+
+	return nil
+}
+
+// lambdaClient invokes functions with the Lambda Invoke API
+type lambdaClient struct {
+	config      LambdaConfig
+	credentials awsCredentialProvider
+	httpClient  HTTPClient
+	now         func() time.Time
+}
+
+// lambdaFunction is the HTTPClient for a route to a function, requests are
+// sent as API Gateway proxy events
+type lambdaFunction struct {
+	client    *lambdaClient
+	function  string
+	qualifier string
+}
+
+// lambdaProxyRequest is the API Gateway proxy event sent to functions
+type lambdaProxyRequest struct {
+	Resource                        string                    `json:"resource"`
+	Path                            string                    `json:"path"`
+	HTTPMethod                      string                    `json:"httpMethod"`
+	Headers                         map[string]string         `json:"headers"`
+	MultiValueHeaders               map[string][]string       `json:"multiValueHeaders"`
+	QueryStringParameters           map[string]string         `json:"queryStringParameters"`
+	MultiValueQueryStringParameters map[string][]string       `json:"multiValueQueryStringParameters"`
+	PathParameters                  map[string]string         `json:"pathParameters"`
+	RequestContext                  lambdaProxyRequestContext `json:"requestContext"`
+	Body                            string                    `json:"body"`
+	IsBase64Encoded                 bool                      `json:"isBase64Encoded"`
+}
+
+type lambdaProxyRequestContext struct {
+	Path       string `json:"path"`
+	HTTPMethod string `json:"httpMethod"`
+	Stage      string `json:"stage"`
+	Identity   struct {
+		SourceIP string `json:"sourceIp"`
+	} `json:"identity"`
+}
+
+// lambdaProxyResponse is the API Gateway proxy response returned by functions
+type lambdaProxyResponse struct {
+	StatusCode        int                 `json:"statusCode"`
+	Headers           map[string]string   `json:"headers"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders"`
+	Body              string              `json:"body"`
+	IsBase64Encoded   bool                `json:"isBase64Encoded"`
+}
+
+// Do invokes the function with the request, function errors and invalid
+// responses return a bad gateway response while errors calling the Lambda
+// API are returned
+func (f *lambdaFunction) Do(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(http.MaxBytesReader(nil, req.Body, lambdaMaxPayload))
+
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return lambdaResponse(req, http.StatusRequestEntityTooLarge, "Request is too large for Lambda"), nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+
+	payload, err := json.Marshal(newLambdaProxyRequest(req, body))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(payload) > lambdaMaxPayload {
+		return lambdaResponse(req, http.StatusRequestEntityTooLarge, "Request is too large for Lambda"), nil
+	}
+
+	out, functionError, err := f.client.invoke(req, f.function, f.qualifier, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if functionError != "" {
+		return lambdaResponse(req, http.StatusBadGateway, fmt.Sprintf("Lambda function error: %s", functionError)), nil
+	}
+
+	pr := lambdaProxyResponse{}
+	err = json.Unmarshal(out, &pr)
+	if err != nil || pr.StatusCode == 0 {
+		return lambdaResponse(req, http.StatusBadGateway, "Invalid response from Lambda function"), nil
+	}
+
+	respBody := []byte(pr.Body)
+	if pr.IsBase64Encoded {
+		respBody, err = base64.StdEncoding.DecodeString(pr.Body)
+		if err != nil {
+			return lambdaResponse(req, http.StatusBadGateway, "Invalid response body from Lambda function"), nil
+		}
+	}
+
+	resp := lambdaResponse(req, pr.StatusCode, "")
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+	resp.ContentLength = int64(len(respBody))
+
+	for k, v := range pr.Headers {
+		resp.Header.Set(k, v)
+	}
+
+	for k, vs := range pr.MultiValueHeaders {
+		resp.Header.Del(k)
+		for _, v := range vs {
+			resp.Header.Add(k, v)
+		}
+	}
+
+	return resp, nil
+}
+
+// invoke calls the function and returns the payload and the function error
+func (c *lambdaClient) invoke(req *http.Request, function, qualifier string, payload []byte) ([]byte, string, error) {
+	region := c.config.Region
+	if arnRegion := lambdaARNRegion(function); arnRegion != "" {
+		region = arnRegion
+	}
+
+	if region == "" {
+		return nil, "", fmt.Errorf("No region configured for Lambda function %s", function)
+	}
+
+	endpoint := c.config.Endpoint
+	if endpoint == "" {
+		endpoint = "https://lambda." + region + ".amazonaws.com"
+	}
+
+	uri := strings.TrimSuffix(endpoint, "/") + "/2015-03-31/functions/" + awsEscape(function) + "/invocations"
+	if qualifier != "" {
+		uri += "?Qualifier=" + url.QueryEscape(qualifier)
+	}
+
+	invokeReq, err := http.NewRequest(http.MethodPost, uri, bytes.NewReader(payload))
+	if err != nil {
+		return nil, "", err
+	}
+
+	invokeReq.Header.Set("Content-Type", "application/json")
+	invokeReq.Header.Set("X-Amz-Invocation-Type", "RequestResponse")
+
+	creds, err := c.credentials.Credentials(req.Context())
+	if err != nil {
+		return nil, "", err
+	}
+
+	signV4(invokeReq, payload, creds, region, "lambda", c.now())
+
+	resp, err := c.httpClient.Do(invokeReq.WithContext(req.Context()))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	out, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("Unable to invoke Lambda function %s: %d %s", function, resp.StatusCode, strings.TrimSpace(string(out)))
+	}
+
+	return out, resp.Header.Get("X-Amz-Function-Error"), nil
+}
+
+// newLambdaProxyRequest converts the request to a proxy event, bodies which
+// are not valid UTF-8 are base64 encoded
+func newLambdaProxyRequest(req *http.Request, body []byte) lambdaProxyRequest {
+	e := lambdaProxyRequest{
+		Resource:                        "/{proxy+}",
+		Path:                            req.URL.Path,
+		HTTPMethod:                      req.Method,
+		Headers:                         map[string]string{},
+		MultiValueHeaders:               map[string][]string{},
+		QueryStringParameters:           map[string]string{},
+		MultiValueQueryStringParameters: map[string][]string{},
+		PathParameters:                  map[string]string{"proxy": strings.TrimPrefix(req.URL.Path, "/")},
+		Body:                            string(body),
+	}
+
+	e.RequestContext.Path = req.URL.Path
+	e.RequestContext.HTTPMethod = req.Method
+	e.RequestContext.Stage = "$default"
+
+	if !utf8.Valid(body) {
+		e.Body = base64.StdEncoding.EncodeToString(body)
+		e.IsBase64Encoded = true
+	}
+
+	for k, vs := range req.Header {
+		if len(vs) == 0 {
+			continue
+		}
+
+		// single value headers contain the last value as with API Gateway
+		e.Headers[k] = vs[len(vs)-1]
+		e.MultiValueHeaders[k] = vs
+	}
+
+	for k, vs := range req.URL.Query() {
+		e.QueryStringParameters[k] = vs[len(vs)-1]
+		e.MultiValueQueryStringParameters[k] = vs
+	}
+
+	// the router sets X-Forwarded-For to the client address
+	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+		ip := strings.TrimSpace(strings.Split(xff, ",")[0])
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+		e.RequestContext.Identity.SourceIP = ip
+	}
+
+	return e
+}
+
+// lambdaResponse returns a response with a text body
+func lambdaResponse(req *http.Request, status int, body string) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// lambdaARNRegion returns the region of a function ARN
+// arn:aws:lambda:[region]:[account]:function:[name]
+func lambdaARNRegion(function string) string {
+	parts := strings.Split(function, ":")
+	if len(parts) < 7 || parts[0] != "arn" || parts[2] != "lambda" {
+		return ""
+	}
+
+	return parts[3]
+}
+
+// lambdaFunctionName returns the name of the function from a name or ARN
+func lambdaFunctionName(function string) string {
+	parts := strings.Split(function, ":")
+	if len(parts) >= 7 && parts[0] == "arn" {
+		return parts[6]
+	}
+
+	return function
+}
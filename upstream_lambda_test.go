@@ -0,0 +1,295 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// lambdaInvocation is a request received by the Lambda stand-in
+type lambdaInvocation struct {
+	path          string
+	qualifier     string
+	authorization string
+	event         lambdaProxyRequest
+}
+
+// setupLambdaUpstream starts a stand-in for the Lambda Invoke API which runs
+// the function for each invocation and returns a router with a route to it
+func setupLambdaUpstream(t *testing.T, route string, function func(e lambdaProxyRequest) (interface{}, string)) (*Router, *[]lambdaInvocation) {
+	invocations := &[]lambdaInvocation{}
+
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Amz-Invocation-Type") != "RequestResponse" {
+			http.Error(rw, "invalid invocation type", http.StatusBadRequest)
+			return
+		}
+
+		i := lambdaInvocation{
+			path:          req.URL.EscapedPath(),
+			qualifier:     req.URL.Query().Get("Qualifier"),
+			authorization: req.Header.Get("Authorization"),
+		}
+		json.NewDecoder(req.Body).Decode(&i.event)
+		*invocations = append(*invocations, i)
+
+		if strings.Contains(i.path, "missing") {
+			rw.WriteHeader(http.StatusNotFound)
+			rw.Write([]byte(`{"Type":"User","message":"Function not found"}`))
+			return
+		}
+
+		out, functionError := function(i.event)
+		if functionError != "" {
+			rw.Header().Set("X-Amz-Function-Error", functionError)
+		}
+		json.NewEncoder(rw).Encode(out)
+	}))
+	t.Cleanup(s.Close)
+
+	us, err := NewUpstreams([]string{route})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := setupRouterTests(t)
+	rec.upstreams = us
+
+	err = rec.SetLambda(LambdaConfig{
+		Region:          "eu-west-1",
+		Endpoint:        s.URL,
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.lambda.now = func() time.Time { return time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC) }
+
+	return rec, invocations
+}
+
+func TestLambdaUpstreamInvokesFunctionWithProxyEvent(t *testing.T) {
+	rec, invocations := setupLambdaUpstream(t, "service=orders#path=/orders#type=lambda", func(e lambdaProxyRequest) (interface{}, string) {
+		return map[string]interface{}{
+			"statusCode":        http.StatusCreated,
+			"headers":           map[string]string{"Content-Type": "application/json"},
+			"multiValueHeaders": map[string][]string{"Set-Cookie": {"a=1", "b=2"}},
+			"body":              `{"id":42}`,
+		}, ""
+	})
+
+	req := httptest.NewRequest("POST", "/orders/42?tag=a&tag=b", strings.NewReader(`{"qty":1}`))
+	req.Header.Add("X-Tag", "a")
+	req.Header.Add("X-Tag", "b")
+	rw := httptest.NewRecorder()
+
+	rec.Handler(rw, req)
+
+	assert.Equal(t, http.StatusCreated, rw.Code)
+	assert.Equal(t, `{"id":42}`, rw.Body.String())
+	assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+	assert.Equal(t, []string{"a=1", "b=2"}, rw.Header()["Set-Cookie"])
+
+	if assert.Len(t, *invocations, 1) {
+		i := (*invocations)[0]
+		assert.Equal(t, "/2015-03-31/functions/orders/invocations", i.path)
+		assert.Contains(t, i.authorization, "Credential=AKIDEXAMPLE/20181001/eu-west-1/lambda/aws4_request")
+
+		assert.Equal(t, "POST", i.event.HTTPMethod)
+		assert.Equal(t, "/42", i.event.Path)
+		assert.Equal(t, "42", i.event.PathParameters["proxy"])
+		assert.Equal(t, []string{"a", "b"}, i.event.MultiValueQueryStringParameters["tag"])
+		assert.Equal(t, "b", i.event.QueryStringParameters["tag"])
+		assert.Equal(t, []string{"a", "b"}, i.event.MultiValueHeaders["X-Tag"])
+		assert.Equal(t, "192.0.2.1", i.event.RequestContext.Identity.SourceIP)
+		assert.Equal(t, `{"qty":1}`, i.event.Body)
+		assert.False(t, i.event.IsBase64Encoded)
+	}
+}
+
+func TestLambdaUpstreamEncodesBinaryBodies(t *testing.T) {
+	rec, invocations := setupLambdaUpstream(t, "service=images#path=/images#type=lambda", func(e lambdaProxyRequest) (interface{}, string) {
+		return map[string]interface{}{
+			"statusCode":      http.StatusOK,
+			"body":            e.Body,
+			"isBase64Encoded": e.IsBase64Encoded,
+		}, ""
+	})
+
+	rw := httptest.NewRecorder()
+	rec.Handler(rw, httptest.NewRequest("PUT", "/images/1", bytes.NewReader([]byte{0xff, 0x00, 0x01})))
+
+	assert.Equal(t, []byte{0xff, 0x00, 0x01}, rw.Body.Bytes())
+	if assert.Len(t, *invocations, 1) {
+		assert.True(t, (*invocations)[0].event.IsBase64Encoded)
+		assert.Equal(t, base64.StdEncoding.EncodeToString([]byte{0xff, 0x00, 0x01}), (*invocations)[0].event.Body)
+	}
+}
+
+func TestLambdaUpstreamUsesFunctionARNRegionAndQualifier(t *testing.T) {
+	arn := "arn:aws:lambda:us-east-2:123456789012:function:billing"
+	rec, invocations := setupLambdaUpstream(t, "path=/billing#type=lambda#qualifier=live#function="+arn, func(e lambdaProxyRequest) (interface{}, string) {
+		return map[string]interface{}{"statusCode": http.StatusOK}, ""
+	})
+
+	rec.Handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/billing", nil))
+
+	if assert.Len(t, *invocations, 1) {
+		i := (*invocations)[0]
+		assert.Equal(t, "/2015-03-31/functions/arn%3Aaws%3Alambda%3Aus-east-2%3A123456789012%3Afunction%3Abilling/invocations", i.path)
+		assert.Equal(t, "live", i.qualifier)
+		assert.Contains(t, i.authorization, "/us-east-2/lambda/aws4_request")
+	}
+}
+
+func TestLambdaUpstreamReturnsBadGatewayForFunctionErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		function func(e lambdaProxyRequest) (interface{}, string)
+		body     string
+	}{
+		{
+			name: "function error",
+			function: func(e lambdaProxyRequest) (interface{}, string) {
+				return map[string]string{"errorMessage": "boom"}, "Unhandled"
+			},
+			body: "Lambda function error: Unhandled",
+		},
+		{
+			name: "not a proxy response",
+			function: func(e lambdaProxyRequest) (interface{}, string) {
+				return "hello", ""
+			},
+			body: "Invalid response from Lambda function",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, invocations := setupLambdaUpstream(t, "service=orders#path=/orders#type=lambda", tt.function)
+			rw := httptest.NewRecorder()
+
+			rec.Handler(rw, httptest.NewRequest("GET", "/orders", nil))
+
+			assert.Equal(t, http.StatusBadGateway, rw.Code)
+			assert.Equal(t, tt.body, rw.Body.String())
+			assert.Len(t, *invocations, 1, "Function errors should not be retried")
+		})
+	}
+}
+
+func TestLambdaUpstreamReturnsErrorWhenInvokeFails(t *testing.T) {
+	rec, _ := setupLambdaUpstream(t, "service=missing#path=/missing#type=lambda", nil)
+	rw := httptest.NewRecorder()
+
+	rec.Handler(rw, httptest.NewRequest("GET", "/missing", nil))
+
+	assert.Equal(t, http.StatusInternalServerError, rw.Code)
+	assert.Contains(t, rw.Body.String(), "Function not found")
+}
+
+func TestLambdaUpstreamRejectsLargeRequests(t *testing.T) {
+	rec, invocations := setupLambdaUpstream(t, "service=orders#path=/orders#type=lambda", nil)
+	rw := httptest.NewRecorder()
+
+	rec.Handler(rw, httptest.NewRequest("POST", "/orders", bytes.NewReader(make([]byte, lambdaMaxPayload+1))))
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rw.Code)
+	assert.Len(t, *invocations, 0)
+}
+
+func TestLambdaUpstreamLimitsEncodedPayload(t *testing.T) {
+	rec, invocations := setupLambdaUpstream(t, "service=orders#path=/orders#type=lambda", nil)
+	rw := httptest.NewRecorder()
+
+	// binary bodies grow by a third when they are base64 encoded
+	body := bytes.Repeat([]byte{0xff}, lambdaMaxPayload*4/5)
+	rec.Handler(rw, httptest.NewRequest("POST", "/orders", bytes.NewReader(body)))
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rw.Code)
+	assert.Len(t, *invocations, 0)
+}
+
+func TestLambdaUpstreamReturnsErrorWhenBodyCanNotBeRead(t *testing.T) {
+	rec, invocations := setupLambdaUpstream(t, "service=orders#path=/orders#type=lambda", nil)
+	rw := httptest.NewRecorder()
+
+	rec.Handler(rw, httptest.NewRequest("POST", "/orders", iotest.ErrReader(io.ErrUnexpectedEOF)))
+
+	assert.NotEqual(t, http.StatusRequestEntityTooLarge, rw.Code)
+	assert.Len(t, *invocations, 0)
+}
+
+func TestSetLambdaReadsAWSEnvironment(t *testing.T) {
+	t.Setenv("AWS_REGION", "eu-west-2")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDENV")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "token")
+
+	rec := setupRouterTests(t)
+	err := rec.SetLambda(LambdaConfig{})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "eu-west-2", rec.lambda.config.Region)
+	assert.Equal(t, 30*time.Second, rec.lambda.config.Timeout)
+
+	creds, err := rec.lambda.credentials.Credentials(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "AKIDENV", creds.AccessKeyID)
+	assert.Equal(t, "token", creds.SessionToken)
+
+	// rotated session credentials are used without reconfiguring
+	t.Setenv("AWS_SESSION_TOKEN", "rotated")
+
+	creds, err = rec.lambda.credentials.Credentials(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "rotated", creds.SessionToken)
+}
+
+func TestSetLambdaReturnsErrorWithoutCredentials(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", "")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	rec := setupRouterTests(t)
+	err := rec.SetLambda(LambdaConfig{Region: "eu-west-1"})
+
+	assert.Error(t, err)
+}
+
+func TestLambdaInvokeSignsSessionToken(t *testing.T) {
+	var header http.Header
+	c := &lambdaClient{
+		config:      LambdaConfig{Region: "eu-west-1"},
+		credentials: staticAWSCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "token"},
+		now:         time.Now,
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		header = req.Header
+		ioutil.ReadAll(req.Body)
+		rw.Write([]byte(`{"statusCode":200}`))
+	}))
+	defer s.Close()
+	c.config.Endpoint = s.URL
+	c.httpClient = http.DefaultClient
+
+	_, _, err := c.invoke(httptest.NewRequest("GET", "/", nil), "orders", "", []byte("{}"))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "token", header.Get("X-Amz-Security-Token"))
+	assert.Contains(t, header.Get("Authorization"), "SignedHeaders=content-type;host;x-amz-date;x-amz-invocation-type;x-amz-security-token")
+}
@@ -2,6 +2,7 @@ package router
 
 import (
 	"testing"
+	"time"
 )
 
 func createUpstreams() (Upstreams, error) {
@@ -121,3 +122,299 @@ func TestFindReturnsPath(t *testing.T) {
 		t.Fatal("Should have returned correct upstream")
 	}
 }
+
+func TestSetsRateLimit(t *testing.T) {
+	us, err := NewUpstreams([]string{"service=api#path=/api#rate_limit=60/m#rate_limit_burst=5#rate_limit_key=ip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rl := us.FindUpstream("/api").RateLimit
+	if rl == nil {
+		t.Fatal("Expected rate limit to be set")
+	}
+
+	if rl.Rate != 1 || rl.Burst != 5 || rl.Key != "ip" {
+		t.Fatalf("Expected: rate 1 burst 5 key ip, got: %v %v %v", rl.Rate, rl.Burst, rl.Key)
+	}
+}
+
+func TestRateLimitClaimKeyRequiresJWT(t *testing.T) {
+	_, err := NewUpstreams([]string{"service=api#path=/api#rate_limit=60/m#rate_limit_key=claim:sub"})
+	if err == nil {
+		t.Fatal("Expected: error for claim key without JWT authentication")
+	}
+
+	_, err = NewUpstreams([]string{"service=api#path=/api#auth=jwt#rate_limit=60/m#rate_limit_key=claim:sub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSharesConcurrencyLimitBetweenRoutesToService(t *testing.T) {
+	us, err := NewUpstreams([]string{
+		"service=api#path=/api#concurrency_limit=10#concurrency_queue=5#concurrency_adaptive=true",
+		"service=api#path=/v2/api",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cl := us.FindUpstream("/api").ConcurrencyLimit
+	if cl == nil || cl.MaxInFlight != 10 || cl.MaxQueue != 5 || !cl.Adaptive {
+		t.Fatalf("Expected concurrency limit to be set, got: %v", cl)
+	}
+
+	if us.FindUpstream("/v2/api").ConcurrencyLimit != cl {
+		t.Fatal("Expected routes to the same service to share the limit")
+	}
+}
+
+func TestRejectsConflictingConcurrencyLimitsForService(t *testing.T) {
+	_, err := NewUpstreams([]string{
+		"service=api#path=/api#concurrency_limit=10",
+		"service=api#path=/v2/api#concurrency_limit=10",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewUpstreams([]string{
+		"service=api#path=/api#concurrency_limit=10",
+		"service=api#path=/v2/api#concurrency_limit=20",
+	})
+	if err == nil {
+		t.Fatal("Expected: error for conflicting limits")
+	}
+}
+
+func TestSetsJWTAuth(t *testing.T) {
+	us, err := NewUpstreams([]string{"service=api#path=/api#auth=jwt#jwt_claims=scope:read;admin#jwt_headers=sub:X-User-ID"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := us.FindUpstream("/api")
+	if u.Auth != AuthJWT {
+		t.Fatalf("Expected: auth jwt, got: %v", u.Auth)
+	}
+
+	if u.JWTClaims["scope"] != "read" || len(u.JWTClaims) != 2 {
+		t.Fatalf("Expected: claims scope:read and admin, got: %v", u.JWTClaims)
+	}
+
+	if u.JWTHeaders["sub"] != "X-User-ID" {
+		t.Fatalf("Expected: header mapping sub:X-User-ID, got: %v", u.JWTHeaders)
+	}
+}
+
+func TestRejectsUnknownAuthTypes(t *testing.T) {
+	_, err := NewUpstreams([]string{"service=api#path=/api#auth=oauth"})
+	if err == nil {
+		t.Fatal("Expected: error for unknown auth type")
+	}
+
+	for _, a := range []string{"jwt", "api_key", "basic"} {
+		_, err := NewUpstreams([]string{"service=api#path=/api#auth=" + a})
+		if err != nil {
+			t.Fatalf("Expected: auth %s to be accepted, got: %s", a, err)
+		}
+	}
+}
+
+func TestSetsClientCertPolicy(t *testing.T) {
+	us, err := NewUpstreams([]string{"service=api#path=/api#client_cert=required#client_cert_sans=spiffe://partner/*#client_cert_revocation=ocsp#client_cert_forward=subject;hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := us.FindUpstream("/api").ClientCert
+	if p == nil || !p.Required || p.Revocation != RevocationOCSP {
+		t.Fatalf("Expected: required client cert with ocsp, got: %v", p)
+	}
+
+	if len(p.SANs) != 1 || len(p.Forward) != 2 || p.Header != DefaultClientCertHeader {
+		t.Fatalf("Expected: sans, forward fields and default header, got: %v", p)
+	}
+
+	_, err = NewUpstreams([]string{"service=api#path=/api#client_cert=sometimes"})
+	if err == nil {
+		t.Fatal("Expected: error for invalid client cert mode")
+	}
+}
+
+func TestSetsProtocol(t *testing.T) {
+	us, err := NewUpstreams([]string{
+		"service=api#path=/api#protocol=http2",
+		"service=web#path=/web#protocol=auto",
+		"service=blah#path=/blah#type=grpc",
+		"service=something#path=/something",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]UpstreamProtocol{
+		"/api":       ProtocolHTTP2,
+		"/web":       ProtocolAuto,
+		"/blah":      ProtocolHTTP2,
+		"/something": ProtocolHTTP1,
+	}
+
+	for path, p := range expected {
+		if u := us.FindUpstream(path); u.Protocol != p {
+			t.Fatalf("Expected: protocol %s for %s, got: %v", p, path, u.Protocol)
+		}
+	}
+
+	_, err = NewUpstreams([]string{"service=api#path=/api#protocol=spdy"})
+	if err == nil {
+		t.Fatal("Expected: error for invalid protocol")
+	}
+}
+
+func TestSetsLambdaFunction(t *testing.T) {
+	us, err := NewUpstreams([]string{
+		"service=orders#path=/orders#type=lambda",
+		"path=/billing#type=lambda#function=arn:aws:lambda:eu-west-1:123456789012:function:billing#qualifier=live",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orders := us.FindUpstream("/orders")
+	if orders.Type != Lambda || orders.Function != "orders" {
+		t.Fatalf("Expected: function orders, got: %v %v", orders.Type, orders.Function)
+	}
+
+	billing := us.FindUpstream("/billing")
+	if billing.Service != "billing" || billing.Function != "arn:aws:lambda:eu-west-1:123456789012:function:billing" || billing.Qualifier != "live" {
+		t.Fatalf("Expected: billing function ARN and qualifier, got: %v %v %v", billing.Service, billing.Function, billing.Qualifier)
+	}
+
+	_, err = NewUpstreams([]string{"path=/api#type=lambda"})
+	if err == nil {
+		t.Fatal("Expected: error for lambda route without a function")
+	}
+}
+
+func TestSetsQueryDatacenterAndFailover(t *testing.T) {
+	us, err := NewUpstreams([]string{
+		"query=api-nearest#path=/api#datacenter=dc2#failover=dc3;dc4",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := us.FindUpstream("/api")
+	if api.Service != "api-nearest" || api.Query != "api-nearest" || api.Datacenter != "dc2" {
+		t.Fatalf("Expected: query api-nearest in dc2, got: %v %v %v", api.Service, api.Query, api.Datacenter)
+	}
+
+	if len(api.Failover) != 2 || api.Failover[0] != "dc3" || api.Failover[1] != "dc4" {
+		t.Fatalf("Expected: failover dc3 and dc4, got: %v", api.Failover)
+	}
+}
+
+func TestSetsLoadBalancer(t *testing.T) {
+	us, err := NewUpstreams([]string{
+		"service=api#path=/api#lb=least_request",
+		"service=cart#path=/cart#lb=hash",
+		"service=users#path=/users#lb=hash#hash_on=cookie:session",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lb := us.FindUpstream("/api").LoadBalancer; lb != LoadBalancerLeastRequest {
+		t.Fatalf("Expected: least_request, got: %v", lb)
+	}
+
+	if h := us.FindUpstream("/cart").HashOn; h != "ip" {
+		t.Fatalf("Expected: hash on ip, got: %v", h)
+	}
+
+	if h := us.FindUpstream("/users").HashOn; h != "cookie:session" {
+		t.Fatalf("Expected: hash on cookie:session, got: %v", h)
+	}
+
+	_, err = NewUpstreams([]string{"service=api#path=/api#lb=random"})
+	if err == nil {
+		t.Fatal("Expected: error for invalid load balancer")
+	}
+
+	_, err = NewUpstreams([]string{"service=api#path=/api#lb=hash#hash_on=query:id"})
+	if err == nil {
+		t.Fatal("Expected: error for invalid hash key")
+	}
+}
+
+func TestSetsLocality(t *testing.T) {
+	us, err := NewUpstreams([]string{"service=api#path=/api#lb=nearest#locality_spread=2ms#locality_max_requests=50"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := us.FindUpstream("/api")
+	if api.LoadBalancer != LoadBalancerNearest || api.LocalitySpread != 2*time.Millisecond || api.LocalityMaxRequests != 50 {
+		t.Fatalf("Expected: nearest with 2ms spread and 50 requests, got: %v %v %v", api.LoadBalancer, api.LocalitySpread, api.LocalityMaxRequests)
+	}
+}
+
+func TestSetsOutlierDetectionAndHealthCheck(t *testing.T) {
+	us, err := NewUpstreams([]string{"service=api#path=/api#lb=round_robin#outlier_detection=true#health_check_path=/health#health_check_interval=5s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := us.FindUpstream("/api")
+	o := api.OutlierDetection
+	if o == nil || o.Consecutive5xx != 5 || o.ConsecutiveErrors != 5 || o.BaseEjection != 30*time.Second || o.MaxEjectionPercent != 50 {
+		t.Fatalf("Expected: default outlier detection, got: %+v", o)
+	}
+
+	hc := api.HealthCheck
+	if hc == nil || hc.Path != "/health" || hc.Interval != 5*time.Second || hc.Timeout != 2*time.Second || hc.UnhealthyThreshold != 3 {
+		t.Fatalf("Expected: health check of /health every 5s, got: %+v", hc)
+	}
+
+	_, err = NewUpstreams([]string{"service=api#path=/api#outlier_5xx=3"})
+	if err == nil {
+		t.Fatal("Expected: error for outlier detection without a load balancer")
+	}
+
+	_, err = NewUpstreams([]string{"service=api#path=/api#lb=round_robin#health_check_path=health"})
+	if err == nil {
+		t.Fatal("Expected: error for health check path without a leading /")
+	}
+}
+
+func TestSetsHedgePolicy(t *testing.T) {
+	us, err := NewUpstreams([]string{
+		"service=api#path=/api#lb=least_request#hedge_delay=50ms",
+		"service=cart#path=/cart#lb=round_robin#hedge_delay=p95#hedge_max_percent=5",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h := us.FindUpstream("/api").Hedge; h == nil || h.Delay != 50*time.Millisecond || h.MaxPercent != 10 {
+		t.Fatalf("Expected: hedge after 50ms for 10%% of requests, got: %+v", h)
+	}
+
+	if h := us.FindUpstream("/cart").Hedge; h == nil || h.Percentile != 95 || h.MaxPercent != 5 {
+		t.Fatalf("Expected: hedge after p95 for 5%% of requests, got: %+v", h)
+	}
+
+	for _, u := range []string{
+		"service=api#path=/api#hedge_delay=50ms",
+		"service=api#path=/api#lb=round_robin#hedge_max_percent=5",
+		"service=api#path=/api#lb=round_robin#hedge_delay=p100",
+		"service=api#path=/api#lb=round_robin#hedge_delay=p95#hedge_max_percent=0",
+	} {
+		_, err = NewUpstreams([]string{u})
+		if err == nil {
+			t.Fatalf("Expected: error for %s", u)
+		}
+	}
+}